@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"multiexit-proxy/internal/config"
+	"multiexit-proxy/internal/proxy"
+
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	configPath := flag.String("config", "configs/client.json", "Path to client config file")
+	flag.Parse()
+
+	// 加载配置
+	cfg, err := config.LoadClientConfig(*configPath)
+	if err != nil {
+		logrus.Fatalf("Failed to load config: %v", err)
+	}
+
+	// 设置日志级别
+	level, err := logrus.ParseLevel(cfg.Logging.Level)
+	if err != nil {
+		level = logrus.InfoLevel
+	}
+	logrus.SetLevel(level)
+
+	// 验证配置
+	if err := config.ValidateClientConfig(cfg); err != nil {
+		logrus.Fatalf("Invalid config: %v", err)
+	}
+
+	// 创建代理客户端
+	client, err := proxy.NewClient(proxy.BuildClientConfig(cfg))
+	if err != nil {
+		logrus.Fatalf("Failed to create client: %v", err)
+	}
+
+	// 启动代理客户端
+	errCh := make(chan error, 1)
+	go func() {
+		logrus.Infof("MultiExit client starting, server %s, SOCKS5 %q, HTTP %q", cfg.Server.Address, cfg.Local.SOCKS5, cfg.Local.HTTP)
+		errCh <- client.Start()
+	}()
+
+	// 处理信号
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case sig := <-sigCh:
+		logrus.Infof("Received signal %v, shutting down client...", sig)
+	case err := <-errCh:
+		if err != nil {
+			logrus.Fatalf("Client error: %v", err)
+		}
+	}
+
+	if err := client.Stop(); err != nil {
+		logrus.Errorf("Error stopping client: %v", err)
+	}
+}
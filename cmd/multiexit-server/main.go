@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"multiexit-proxy/internal/config"
+	"multiexit-proxy/internal/logging"
+	"multiexit-proxy/internal/proxy"
+	"multiexit-proxy/internal/web"
+
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	configPath := flag.String("config", "configs/server.yaml", "Path to server config file")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "Graceful shutdown timeout")
+	flag.Parse()
+
+	// 加载配置
+	cfg, err := config.LoadServerConfig(*configPath)
+	if err != nil {
+		logrus.Fatalf("Failed to load config: %v", err)
+	}
+
+	// 设置日志级别
+	level, err := logrus.ParseLevel(cfg.Logging.Level)
+	if err != nil {
+		level = logrus.InfoLevel
+	}
+	logrus.SetLevel(level)
+
+	// 验证配置
+	if err := config.ValidateServerConfig(cfg); err != nil {
+		logrus.Fatalf("Invalid config: %v", err)
+	}
+
+	// 设置日志文件（带轮转）
+	if err := logging.SetupRotationWithDefaults(cfg.Logging.File); err != nil {
+		logrus.Fatalf("Failed to setup log file: %v", err)
+	}
+
+	// 转换为代理服务端配置
+	serverConfig, err := proxy.BuildServerConfig(cfg)
+	if err != nil {
+		logrus.Fatalf("Failed to build server config: %v", err)
+	}
+
+	// 创建代理服务端
+	server, err := proxy.NewServer(serverConfig)
+	if err != nil {
+		logrus.Fatalf("Failed to create server: %v", err)
+	}
+
+	// 监听配置文件变化并热重载
+	watcher, err := config.NewConfigWatcher(*configPath, func(newCfg *config.ServerConfig) error {
+		if err := config.ValidateServerConfig(newCfg); err != nil {
+			return err
+		}
+		newServerConfig, err := proxy.BuildServerConfig(newCfg)
+		if err != nil {
+			return err
+		}
+		_, err = server.ApplyConfig(newServerConfig)
+		return err
+	})
+	if err != nil {
+		logrus.Warnf("Failed to watch config file, hot reload disabled: %v", err)
+	} else {
+		defer watcher.Close()
+		go watcher.Watch()
+	}
+
+	// 启动Web管理服务器
+	var webServer *web.Server
+	if cfg.Web.Enabled {
+		webServer = web.NewServer(*configPath, cfg)
+		webServer.SetProxyServer(server)
+		go func() {
+			if err := webServer.Start(cfg.Web.Listen); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logrus.Errorf("Web server error: %v", err)
+			}
+		}()
+	}
+
+	// 启动代理服务端
+	errCh := make(chan error, 1)
+	go func() {
+		logrus.Infof("MultiExit server starting on %s with %d exit IP(s)", serverConfig.ListenAddr, len(serverConfig.ExitIPs))
+		errCh <- server.Start()
+	}()
+
+	// 处理信号
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case sig := <-sigCh:
+		logrus.Infof("Received signal %v", sig)
+	case err := <-errCh:
+		if err != nil {
+			logrus.Errorf("Server error: %v", err)
+		}
+	}
+
+	// Web管理服务器与代理服务端同时关闭，使用相同的超时，等待处理中的API请求（如配置写入）完成
+	webDone := make(chan struct{})
+	go func() {
+		defer close(webDone)
+		if webServer != nil {
+			if err := webServer.Shutdown(*shutdownTimeout); err != nil {
+				logrus.Errorf("Error shutting down web server: %v", err)
+			}
+		}
+	}()
+	err = server.Shutdown(*shutdownTimeout)
+	<-webDone
+	if err != nil {
+		logrus.Errorf("Error shutting down server: %v", err)
+		os.Exit(1)
+	}
+}
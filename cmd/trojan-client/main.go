@@ -2,15 +2,20 @@ package main
 
 import (
 	"crypto/tls"
+	"errors"
 	"flag"
+	"fmt"
 	"net"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"multiexit-proxy/internal/config"
+	"multiexit-proxy/internal/proxy"
 	"multiexit-proxy/internal/trojan"
+	"multiexit-proxy/pkg/httpproxy"
 	"multiexit-proxy/pkg/socks5"
+	"multiexit-proxy/pkg/tproxy"
 
 	"github.com/sirupsen/logrus"
 )
@@ -46,38 +51,123 @@ func main() {
 		TLSConfig:  tlsConfig,
 	})
 
-	// 创建SOCKS5服务器
-	socks5Server := socks5.NewServer(func(network, addr string) (net.Conn, error) {
+	dial := func(network, addr string) (net.Conn, error) {
 		return trojanClient.Dial(addr)
-	})
+	}
+	users := proxy.BuildLocalUsers(cfg)
 
-	// 创建本地监听器
-	listener, err := net.Listen("tcp", cfg.Local.SOCKS5)
-	if err != nil {
-		logrus.Fatalf("Failed to listen: %v", err)
+	// 创建SOCKS5服务器（配置了local.users时要求用户名/密码认证）
+	socks5Server := socks5.NewServer(dial)
+	if users != nil {
+		socks5Server.Authenticators = []socks5.Authenticator{socks5.NewUserManagerAuthenticator(users)}
+	}
+	// Trojan请求中没有用户名字段（服务端按密码识别用户），本地认证的用户只记录日志，不参与服务端的出口IP选择
+	// 需要按本地用户选择出口IP时使用原生协议客户端
+	socks5Server.IdentityDialFunc = func(identity *socks5.Identity, network, addr string) (net.Conn, error) {
+		if identity.Username != "" {
+			logrus.Debugf("SOCKS5 user %s connecting to %s", identity.Username, addr)
+		}
+		return trojanClient.Dial(addr)
+	}
+	// Trojan协议没有反向连接，无法在服务端出口IP上监听：BIND返回失败响应（不在本地监听，避免对端连到客户端所在主机）
+	// 需要BIND时使用原生协议客户端
+	socks5Server.BindFunc = func(identity *socks5.Identity, addr string) (net.Listener, error) {
+		return nil, fmt.Errorf("BIND is not supported over Trojan")
+	}
+	// UDP ASSOCIATE经Trojan UDP关联转发
+	socks5Server.PacketDialFunc = func() (net.PacketConn, error) {
+		return trojanClient.DialUDP()
+	}
+
+	// 创建HTTP代理服务器（与SOCKS5共用Trojan连接）
+	httpServer := httpproxy.NewServer(dial)
+	if users != nil {
+		httpServer.Authenticate = httpproxy.NewUserManagerAuth(users)
+	}
+
+	if cfg.Local.HTTP != "" {
+		httpListener, err := net.Listen("tcp", cfg.Local.HTTP)
+		if err != nil {
+			logrus.Fatalf("Failed to listen: %v", err)
+		}
+		defer httpListener.Close()
+		logrus.Infof("Local HTTP proxy listening on %s", cfg.Local.HTTP)
+		go serve(httpListener, httpServer.HandleConn)
+	}
+
+	// 创建透明代理（与SOCKS5共用Trojan连接，UDP经Trojan UDP关联转发）
+	if transparent := cfg.Local.Transparent; transparent.Listen != "" {
+		tproxyServer, err := tproxy.NewServer(transparent.Mode, dial)
+		if err != nil {
+			logrus.Fatalf("Failed to create transparent proxy: %v", err)
+		}
+		tproxyServer.PacketDialFunc = socks5Server.PacketDialFunc
+
+		tproxyListener, err := tproxyServer.Listen(transparent.Listen)
+		if err != nil {
+			logrus.Fatalf("Failed to listen: %v", err)
+		}
+		defer tproxyListener.Close()
+		go serve(tproxyListener, tproxyServer.HandleConn)
+
+		if transparent.UDP {
+			udpConn, err := tproxyServer.ListenUDP(transparent.Listen)
+			if err != nil {
+				logrus.Fatalf("Failed to listen UDP: %v", err)
+			}
+			defer udpConn.Close()
+			go tproxyServer.ServeUDP(udpConn)
+		}
+
+		// 配置了fwmark时添加TPROXY策略路由
+		if transparent.Mark != 0 {
+			table := transparent.Table
+			if table == 0 {
+				table = 100
+			}
+			routing, err := tproxy.NewRouting(transparent.Mark, table)
+			if err != nil {
+				logrus.Fatalf("Invalid transparent proxy routing: %v", err)
+			}
+			if err := routing.Setup(); err != nil {
+				logrus.Fatalf("Failed to setup transparent proxy routing: %v", err)
+			}
+			defer routing.Cleanup()
+		}
+		logrus.Infof("Transparent proxy (%s) listening on %s, UDP %v", transparent.Mode, transparent.Listen, transparent.UDP)
+	}
+
+	if cfg.Local.SOCKS5 != "" {
+		// 创建本地监听器
+		listener, err := net.Listen("tcp", cfg.Local.SOCKS5)
+		if err != nil {
+			logrus.Fatalf("Failed to listen: %v", err)
+		}
+		defer listener.Close()
+
+		logrus.Infof("Trojan client starting, listening on %s", cfg.Local.SOCKS5)
+		go serve(listener, socks5Server.HandleConn)
 	}
-	defer listener.Close()
 
 	// 处理信号
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	<-sigCh
+	logrus.Info("Shutting down client...")
+}
 
-	go func() {
-		<-sigCh
-		logrus.Info("Shutting down client...")
-		os.Exit(0)
-	}()
-
-	logrus.Infof("Trojan client starting, listening on %s", cfg.Local.SOCKS5)
+// serve 接受本地连接并交给handle处理（监听器关闭后返回）
+func serve(listener net.Listener, handle func(net.Conn) error) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			logrus.Errorf("Accept error: %v", err)
 			continue
 		}
 
-		go socks5Server.HandleConn(conn)
+		go handle(conn)
 	}
 }
-
-
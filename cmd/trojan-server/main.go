@@ -1,22 +1,24 @@
 package main
 
 import (
-	"crypto/tls"
 	"flag"
-	"net"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"multiexit-proxy/internal/config"
-	"multiexit-proxy/internal/snat"
-	"multiexit-proxy/internal/trojan"
+	"multiexit-proxy/internal/logging"
+	"multiexit-proxy/internal/proxy"
+	"multiexit-proxy/internal/web"
 
 	"github.com/sirupsen/logrus"
 )
 
 func main() {
 	configPath := flag.String("config", "configs/server.yaml", "Path to server config file")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "Graceful shutdown timeout")
 	flag.Parse()
 
 	// 加载配置
@@ -32,90 +34,99 @@ func main() {
 	}
 	logrus.SetLevel(level)
 
-	// 检查Trojan是否启用
-	if !cfg.Trojan.Enabled {
-		logrus.Fatalf("Trojan protocol is not enabled in config")
+	// 验证配置（热重载时同样验证）
+	if err := validateConfig(cfg); err != nil {
+		logrus.Fatalf("Invalid config: %v", err)
 	}
 
-	if cfg.Trojan.Password == "" {
-		logrus.Fatalf("Trojan password is required")
+	// 设置日志文件（带轮转）
+	if err := logging.SetupRotationWithDefaults(cfg.Logging.File); err != nil {
+		logrus.Fatalf("Failed to setup log file: %v", err)
 	}
 
-	// 加载TLS证书
-	var tlsConfig *tls.Config
-	if cfg.Server.TLS.Cert != "" && cfg.Server.TLS.Key != "" {
-		cert, err := tls.LoadX509KeyPair(cfg.Server.TLS.Cert, cfg.Server.TLS.Key)
+	// 转换为代理服务端配置（与原生协议共用出口选择、连接管理、统计等全部流程）
+	buildConfig := func(cfg *config.ServerConfig) (*proxy.ServerConfig, error) {
+		serverConfig, err := proxy.BuildServerConfig(cfg)
 		if err != nil {
-			logrus.Fatalf("Failed to load TLS certificate: %v", err)
-		}
-		tlsConfig = &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			NextProtos:   []string{"h2", "http/1.1"},
+			return nil, err
 		}
-	} else {
-		logrus.Fatalf("TLS certificate is required for Trojan protocol")
+		serverConfig.Protocol = proxy.ProtocolTrojan
+		return serverConfig, nil
 	}
-
-	// 创建IP选择器
-	var ipSelector snat.IPSelector
-	switch cfg.Strategy.Type {
-	case "round_robin":
-		ipSelector, err = snat.NewRoundRobinSelector(cfg.ExitIPs)
-	case "destination_based":
-		ipSelector, err = snat.NewDestinationBasedSelector(cfg.ExitIPs)
-	default:
-		ipSelector, err = snat.NewRoundRobinSelector(cfg.ExitIPs)
+	serverConfig, err := buildConfig(cfg)
+	if err != nil {
+		logrus.Fatalf("Failed to build server config: %v", err)
 	}
+
+	// 创建Trojan服务端
+	server, err := proxy.NewServer(serverConfig)
 	if err != nil {
-		logrus.Fatalf("Failed to create IP selector: %v", err)
+		logrus.Fatalf("Failed to create Trojan server: %v", err)
 	}
 
-	// 创建路由管理器
-	var routingMgr *snat.RoutingManager
-	if cfg.SNAT.Enabled {
-		ips := make([]net.IP, 0, len(cfg.ExitIPs))
-		for _, ipStr := range cfg.ExitIPs {
-			ips = append(ips, net.ParseIP(ipStr))
+	// 监听配置文件变化并热重载
+	watcher, err := config.NewConfigWatcher(*configPath, func(newCfg *config.ServerConfig) error {
+		if err := validateConfig(newCfg); err != nil {
+			return err
 		}
-		routingMgr, err = snat.NewRoutingManager(ips, cfg.SNAT.Gateway, cfg.SNAT.Interface)
+		newServerConfig, err := buildConfig(newCfg)
 		if err != nil {
-			logrus.Fatalf("Failed to create routing manager: %v", err)
-		}
-
-		if err := routingMgr.Setup(); err != nil {
-			logrus.Fatalf("Failed to setup routing: %v", err)
+			return err
 		}
+		_, err = server.ApplyConfig(newServerConfig)
+		return err
+	})
+	if err != nil {
+		logrus.Warnf("Failed to watch config file, hot reload disabled: %v", err)
+	} else {
+		defer watcher.Close()
+		go watcher.Watch()
 	}
 
-	// 创建Trojan服务器
-	serverConfig := &trojan.ServerConfig{
-		ListenAddr: cfg.Server.Listen,
-		Password:   cfg.Trojan.Password,
-		TLSConfig:  tlsConfig,
-		IPSelector: ipSelector,
-		RoutingMgr: routingMgr,
+	// 启动Web管理服务器
+	if cfg.Web.Enabled {
+		webServer := web.NewServer(*configPath, cfg)
+		webServer.SetProxyServer(server)
+		go func() {
+			if err := webServer.Start(cfg.Web.Listen); err != nil {
+				logrus.Errorf("Web server error: %v", err)
+			}
+		}()
 	}
 
-	server, err := trojan.NewServer(serverConfig)
-	if err != nil {
-		logrus.Fatalf("Failed to create Trojan server: %v", err)
-	}
+	// 启动服务端
+	errCh := make(chan error, 1)
+	go func() {
+		logrus.Infof("Trojan server starting on %s with %d exit IP(s)", serverConfig.ListenAddr, len(serverConfig.ExitIPs))
+		errCh <- server.Start()
+	}()
 
 	// 处理信号
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
 
-	go func() {
-		<-sigCh
-		logrus.Info("Shutting down server...")
-		if err := server.Stop(); err != nil {
-			logrus.Errorf("Error stopping server: %v", err)
+	select {
+	case sig := <-sigCh:
+		logrus.Infof("Received signal %v", sig)
+	case err := <-errCh:
+		if err != nil {
+			logrus.Errorf("Server error: %v", err)
 		}
-		os.Exit(0)
-	}()
+	}
+
+	if err := server.Shutdown(*shutdownTimeout); err != nil {
+		logrus.Errorf("Error shutting down server: %v", err)
+		os.Exit(1)
+	}
+}
 
-	logrus.Infof("Trojan server starting on %s", cfg.Server.Listen)
-	if err := server.Start(); err != nil {
-		logrus.Fatalf("Server error: %v", err)
+// validateConfig 验证Trojan服务端配置：通用的服务端配置验证，以及Trojan必须启用并配置密码或用户
+func validateConfig(cfg *config.ServerConfig) error {
+	if !cfg.Trojan.Enabled {
+		return fmt.Errorf("Trojan protocol is not enabled in config")
+	}
+	if cfg.Trojan.Password == "" && len(cfg.Trojan.Users) == 0 {
+		return fmt.Errorf("Trojan password or users is required")
 	}
+	return config.ValidateServerConfig(cfg)
 }
@@ -7,6 +7,7 @@ var (
 	ErrUserNotFound      = errors.New("user not found")
 	ErrInvalidCredentials = errors.New("invalid credentials")
 	ErrIPNotAllowed      = errors.New("IP address not allowed")
+	ErrQuotaExceeded     = errors.New("traffic quota exceeded")
 )
 
 
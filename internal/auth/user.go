@@ -15,6 +15,8 @@ type User struct {
 	Username     string
 	PasswordHash []byte
 	RateLimit    int64 // bytes per second
+	Quota        int64 // 流量配额（字节，0表示不限）
+	BytesUsed    int64 // 已用流量（字节）
 	AllowedIPs   []net.IPNet
 	CreatedAt    time.Time
 	LastLogin    time.Time
@@ -89,17 +91,8 @@ func (m *UserManager) Authenticate(username, password string, clientIP net.IP) (
 	}
 	
 	// 检查IP白名单
-	if len(user.AllowedIPs) > 0 {
-		allowed := false
-		for _, ipNet := range user.AllowedIPs {
-			if ipNet.Contains(clientIP) {
-				allowed = true
-				break
-			}
-		}
-		if !allowed {
-			return nil, ErrIPNotAllowed
-		}
+	if !user.AllowsIP(clientIP) {
+		return nil, ErrIPNotAllowed
 	}
 	
 	// 更新最后登录时间
@@ -138,6 +131,8 @@ func (m *UserManager) GetUser(username string) (*User, error) {
 		Username:     user.Username,
 		PasswordHash: append([]byte{}, user.PasswordHash...),
 		RateLimit:    user.RateLimit,
+		Quota:        user.Quota,
+		BytesUsed:    user.BytesUsed,
 		AllowedIPs:   append([]net.IPNet{}, user.AllowedIPs...),
 		CreatedAt:    user.CreatedAt,
 		LastLogin:    user.LastLogin,
@@ -197,3 +192,76 @@ func (m *UserManager) UpdateUserRateLimit(username string, rateLimit int64) erro
 	return nil
 }
 
+// SetUserQuota 设置用户流量配额（0表示不限）
+func (m *UserManager) SetUserQuota(username string, quota int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	user, exists := m.users[username]
+	if !exists {
+		return ErrUserNotFound
+	}
+	
+	user.Quota = quota
+	return nil
+}
+
+// AddUserTraffic 累计用户流量，超出配额时返回ErrQuotaExceeded
+func (m *UserManager) AddUserTraffic(username string, n int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	user, exists := m.users[username]
+	if !exists {
+		return ErrUserNotFound
+	}
+	
+	user.BytesUsed += n
+	if user.Quota > 0 && user.BytesUsed > user.Quota {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// CheckQuota 检查用户配额是否已用完
+func (m *UserManager) CheckQuota(username string) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	
+	user, exists := m.users[username]
+	if !exists {
+		return ErrUserNotFound
+	}
+	
+	if user.Quota > 0 && user.BytesUsed >= user.Quota {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// ResetUserTraffic 重置用户已用流量
+func (m *UserManager) ResetUserTraffic(username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	
+	user, exists := m.users[username]
+	if !exists {
+		return ErrUserNotFound
+	}
+	
+	user.BytesUsed = 0
+	return nil
+}
+
+// AllowsIP 检查IP是否在用户白名单内（白名单为空表示不限制）
+func (u *User) AllowsIP(ip net.IP) bool {
+	if len(u.AllowedIPs) == 0 {
+		return true
+	}
+	for _, ipNet := range u.AllowedIPs {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
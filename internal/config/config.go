@@ -22,17 +22,34 @@ type ServerConfig struct {
 	} `yaml:"server" json:"server"`
 
 	Auth struct {
-		Method string `yaml:"method" json:"method"`
-		Key    string `yaml:"key" json:"key"`
+		Method      string   `yaml:"method" json:"method"` // psk（默认，同时接受X25519握手）或 x25519（只接受前向安全的X25519握手）
+		Key         string   `yaml:"key" json:"key"`
+		Ciphers     []string `yaml:"ciphers" json:"ciphers"` // v2数据加密算法偏好：aes-256-gcm、chacha20-poly1305（空=全部，AES优先）
+		KeyRotation struct {
+			MaxBytes int64  `yaml:"max_bytes" json:"max_bytes"` // X25519会话密钥最多加密的字节数（0=不限制）
+			Interval string `yaml:"interval" json:"interval"`   // X25519会话密钥最长使用时间（如"1h"，空=不限制）
+		} `yaml:"key_rotation" json:"key_rotation"`
 	} `yaml:"auth" json:"auth"`
 
 	ExitIPs []string `yaml:"exit_ips" json:"exit_ips"`
 
 	Strategy struct {
-		Type       string `yaml:"type" json:"type"`
+		Type string `yaml:"type" json:"type"`
+		// load_balanced策略参数：connections 或 traffic；least_load策略参数：connections 或 bandwidth
+		Param string `yaml:"param" json:"param"`
+		// destination_based策略的哈希键：host_port（默认）、host、etld1或client_host
+		HashKey string `yaml:"hash_key" json:"hash_key"`
+		// 出口IP的权重（IP -> 权重，未配置的IP为1），destination_based、weighted_round_robin和least_load策略按权重分配
+		Weights map[string]float64 `yaml:"weights" json:"weights"`
+		// 出口IP的容量上限（IP -> 上限），weighted_round_robin和least_load策略不再向达到上限的IP分配新连接
+		Limits map[string]struct {
+			MaxConnections int64 `yaml:"max_connections" json:"max_connections"` // 最大并发连接数（0=不限制）
+			MaxBandwidth   int64 `yaml:"max_bandwidth" json:"max_bandwidth"`     // 最大带宽（字节/秒，0=不限制）
+		} `yaml:"limits" json:"limits"`
 		PortRanges []struct {
-			Range string `yaml:"range" json:"range"`
-			IP    string `yaml:"ip" json:"ip"`
+			Range  string `yaml:"range" json:"range"`
+			IP     string `yaml:"ip" json:"ip"`
+			Backup string `yaml:"backup" json:"backup"` // IP故障时使用的备用IP（可选）
 		} `yaml:"port_ranges" json:"port_ranges"`
 	} `yaml:"strategy" json:"strategy"`
 
@@ -40,8 +57,18 @@ type ServerConfig struct {
 		Enabled   bool   `yaml:"enabled" json:"enabled"`
 		Gateway   string `yaml:"gateway" json:"gateway"`
 		Interface string `yaml:"interface" json:"interface"`
+		Backend   string `yaml:"backend" json:"backend"`       // netlink（默认）或exec
+		GatewayV6 string `yaml:"gateway_v6" json:"gateway_v6"` // IPv6出口IP的网关（为空时经接口直接出站）
 	} `yaml:"snat" json:"snat"`
 
+	// Egress 出站连接使用出口IP的方式
+	Egress struct {
+		Mode       string `yaml:"mode" json:"mode"`                 // bind、mark或both（默认：启用SNAT时为both，否则为bind）
+		BindNoPort bool   `yaml:"bind_no_port" json:"bind_no_port"` // 绑定源地址时设置IP_BIND_ADDRESS_NO_PORT
+		// 目标为域名时出口IP的地址族：prefer_v4（默认）、prefer_v6、v4_only、v6_only或happy_eyeballs
+		FamilyPolicy string `yaml:"family_policy" json:"family_policy"`
+	} `yaml:"egress" json:"egress"`
+
 	Logging struct {
 		Level string `yaml:"level" json:"level"`
 		File  string `yaml:"file" json:"file"`
@@ -58,6 +85,16 @@ type ServerConfig struct {
 	Trojan struct {
 		Enabled  bool   `yaml:"enabled" json:"enabled"`
 		Password string `yaml:"password" json:"password"`
+		// 认证失败时转发到的回落后端，按ALPN选择的地址优先
+		Fallback     string            `yaml:"fallback" json:"fallback"`
+		FallbackALPN map[string]string `yaml:"fallback_alpn" json:"fallback_alpn"`
+		// 多用户（可与password同时使用），按用户限制连接数、流量配额并统计
+		Users []struct {
+			Username   string   `yaml:"username" json:"username"`
+			Password   string   `yaml:"password" json:"password"`
+			Quota      int64    `yaml:"quota" json:"quota"`             // 流量配额（字节，0表示不限）
+			AllowedIPs []string `yaml:"allowed_ips" json:"allowed_ips"` // 客户端IP白名单
+		} `yaml:"users" json:"users"`
 	} `yaml:"trojan" json:"trojan"`
 
 	// 健康检查配置
@@ -89,8 +126,17 @@ type ServerConfig struct {
 		Enabled         bool   `yaml:"enabled" json:"enabled"`                   // 启用地理位置选择
 		APIURL          string `yaml:"api_url" json:"api_url"`                   // 地理位置API URL（可选，默认使用ip-api.com）
 		LatencyOptimize bool   `yaml:"latency_optimize" json:"latency_optimize"` // 启用延迟优化
+		DBPath          string `yaml:"db_path" json:"db_path"`                   // GeoIP数据库路径（可选）
 	} `yaml:"geo_location" json:"geo_location"`
 
+	// 粘性会话配置：同一会话键在有效期内使用同一出口IP
+	Sticky struct {
+		Enabled     bool     `yaml:"enabled" json:"enabled"`
+		Key         []string `yaml:"key" json:"key"`                   // 会话键的组成部分：client、user、etld1（默认client+etld1）
+		IdleTTL     string   `yaml:"idle_ttl" json:"idle_ttl"`         // 空闲超时（默认10m）
+		MaxLifetime string   `yaml:"max_lifetime" json:"max_lifetime"` // 最长存活时间（默认1h）
+	} `yaml:"sticky" json:"sticky"`
+
 	// 规则引擎配置
 	Rules []struct {
 		Name        string   `yaml:"name" json:"name"`
@@ -101,6 +147,8 @@ type ServerConfig struct {
 		TargetIP    string   `yaml:"target_ip" json:"target_ip"`
 		Action      string   `yaml:"action" json:"action"`
 		Enabled     bool     `yaml:"enabled" json:"enabled"`
+		// 匹配该规则的目标使用的地址族策略（为空时使用egress.family_policy）
+		FamilyPolicy string `yaml:"family_policy" json:"family_policy"`
 	} `yaml:"rules" json:"rules"`
 
 	// 集群配置
@@ -119,6 +167,31 @@ type ServerConfig struct {
 		AnomalyThreshold float64 `yaml:"anomaly_threshold" json:"anomaly_threshold"`
 	} `yaml:"traffic_analysis" json:"traffic_analysis"`
 
+	// 速率限制配置
+	RateLimit struct {
+		Enabled              bool  `yaml:"enabled" json:"enabled"`
+		IPMaxConnections     int   `yaml:"ip_max_connections" json:"ip_max_connections"`         // 每个IP最大连接数
+		IPRateLimit          int   `yaml:"ip_rate_limit" json:"ip_rate_limit"`                   // 每个IP每秒连接数
+		UserMaxConnections   int   `yaml:"user_max_connections" json:"user_max_connections"`     // 每个用户最大连接数
+		UserRateLimit        int   `yaml:"user_rate_limit" json:"user_rate_limit"`               // 每个用户每秒连接数
+		UserBandwidthLimit   int64 `yaml:"user_bandwidth_limit" json:"user_bandwidth_limit"`     // 每个用户带宽限制（字节/秒）
+		GlobalMaxConnections int   `yaml:"global_max_connections" json:"global_max_connections"` // 全局最大连接数
+		GlobalRateLimit      int   `yaml:"global_rate_limit" json:"global_rate_limit"`           // 全局每秒连接数
+	} `yaml:"rate_limit" json:"rate_limit"`
+
+	// 握手重放过滤配置（仅原生协议，Trojan由TLS防重放）
+	ReplayProtection struct {
+		Mode              string  `yaml:"mode" json:"mode"`                               // exact（默认，精确去重）、bloom（布隆过滤器，省内存）或 off
+		MaxEntries        int     `yaml:"max_entries" json:"max_entries"`                 // 时间窗口内最多记录的握手数（默认1048576）
+		FalsePositiveRate float64 `yaml:"false_positive_rate" json:"false_positive_rate"` // bloom模式的误判率（默认0.0001）
+	} `yaml:"replay_protection" json:"replay_protection"`
+
+	// UDP中继配置（客户端SOCKS5 UDP ASSOCIATE）
+	UDP struct {
+		Enabled bool   `yaml:"enabled" json:"enabled"` // 允许客户端建立UDP关联
+		Timeout string `yaml:"timeout" json:"timeout"` // 出口UDP映射的空闲超时（默认60s）
+	} `yaml:"udp" json:"udp"`
+
 	// 监控统计配置
 	Monitor struct {
 		Enabled bool `yaml:"enabled" json:"enabled"` // 启用统计
@@ -141,17 +214,38 @@ type ServerConfig struct {
 // ClientConfig 客户端配置
 type ClientConfig struct {
 	Server struct {
-		Address string `json:"address"`
-		SNI     string `json:"sni"`
+		Address         string `json:"address"`
+		SNI             string `json:"sni"`
+		ProtocolVersion int    `json:"protocol_version"` // 协议版本：2（默认，AEAD记录分帧）或1（兼容旧服务端）
 	} `json:"server"`
 
 	Auth struct {
-		Key string `json:"key"`
+		Key         string   `json:"key"`
+		Method      string   `json:"method"`  // psk（默认）或 x25519（每个会话临时密钥交换，前向安全，需要协议v2）
+		Ciphers     []string `json:"ciphers"` // v2支持的数据加密算法，按偏好排序（空=按本机是否有AES硬件加速自动选择）
+		KeyRotation struct {
+			MaxBytes int64  `json:"max_bytes"` // X25519会话密钥最多加密的字节数（0=不限制）
+			Interval string `json:"interval"`  // X25519会话密钥最长使用时间（如"1h"，空=不限制）
+		} `json:"key_rotation"`
 	} `json:"auth"`
 
 	Local struct {
 		SOCKS5 string `json:"socks5"`
 		HTTP   string `json:"http"`
+		// 本地代理用户（为空时不认证），SOCKS5使用用户名/密码认证（RFC 1929）
+		Users []struct {
+			Username   string   `json:"username"`
+			Password   string   `json:"password"`
+			AllowedIPs []string `json:"allowed_ips"` // 客户端IP白名单
+		} `json:"users"`
+		// 透明代理（仅Linux），接受iptables REDIRECT或TPROXY重定向的流量
+		Transparent struct {
+			Listen string `json:"listen"` // 监听地址（为空时不启用）
+			Mode   string `json:"mode"`   // redirect（仅TCP）或 tproxy（TCP和UDP）
+			UDP    bool   `json:"udp"`    // 转发UDP（需要tproxy模式）
+			Mark   int    `json:"mark"`   // TPROXY的fwmark，非0时自动添加策略路由
+			Table  int    `json:"table"`  // 策略路由表（默认100）
+		} `json:"transparent"`
 	} `json:"local"`
 
 	Logging struct {
@@ -166,6 +260,19 @@ type ClientConfig struct {
 		BackoffFactor float64 `json:"backoff_factor"` // 退避因子（默认2.0）
 		Jitter        bool    `json:"jitter"`         // 是否添加随机抖动
 	} `json:"reconnect"`
+
+	// 连接池配置
+	Pool struct {
+		Enabled     bool   `json:"enabled"`      // 启用连接池
+		MaxSize     int    `json:"max_size"`     // 最大连接数
+		MaxIdle     int    `json:"max_idle"`     // 最大空闲连接数
+		IdleTimeout string `json:"idle_timeout"` // 空闲超时（如"5m"）
+	} `json:"pool"`
+
+	// 多路复用配置
+	Mux struct {
+		Enabled bool `json:"enabled"` // 所有请求复用同一条加密会话，避免每个请求重新握手
+	} `json:"mux"`
 }
 
 // LoadServerConfig 加载服务端配置
@@ -195,6 +302,24 @@ func (c *ServerConfig) GetHealthCheckInterval() time.Duration {
 	return d
 }
 
+// GetStickyIdleTTL 获取粘性会话空闲超时（0表示使用默认值）
+func (c *ServerConfig) GetStickyIdleTTL() time.Duration {
+	d, err := time.ParseDuration(c.Sticky.IdleTTL)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// GetStickyMaxLifetime 获取粘性会话最长存活时间（0表示使用默认值）
+func (c *ServerConfig) GetStickyMaxLifetime() time.Duration {
+	d, err := time.ParseDuration(c.Sticky.MaxLifetime)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
 // GetHealthCheckTimeout 获取健康检查超时
 func (c *ServerConfig) GetHealthCheckTimeout() time.Duration {
 	if c.HealthCheck.Timeout == "" {
@@ -255,6 +380,52 @@ func (c *ServerConfig) GetDialTimeout() time.Duration {
 	return d
 }
 
+// GetKeepAliveTime 获取KeepAlive间隔
+func (c *ServerConfig) GetKeepAliveTime() time.Duration {
+	if c.Connection.KeepAliveTime == "" {
+		return 30 * time.Second
+	}
+	d, err := time.ParseDuration(c.Connection.KeepAliveTime)
+	if err != nil {
+		return 30 * time.Second
+	}
+	return d
+}
+
+// GetTrendWindow 获取流量趋势窗口
+func (c *ServerConfig) GetTrendWindow() time.Duration {
+	if c.TrafficAnalysis.TrendWindow == "" {
+		return 1 * time.Hour
+	}
+	d, err := time.ParseDuration(c.TrafficAnalysis.TrendWindow)
+	if err != nil {
+		return 1 * time.Hour
+	}
+	return d
+}
+
+// GetClusterHealthInterval 获取集群健康检查间隔
+func (c *ServerConfig) GetClusterHealthInterval() time.Duration {
+	if c.Cluster.HealthInterval == "" {
+		return 30 * time.Second
+	}
+	d, err := time.ParseDuration(c.Cluster.HealthInterval)
+	if err != nil {
+		return 30 * time.Second
+	}
+	return d
+}
+
+// GetKeyRotationInterval 获取X25519会话密钥轮换间隔（0表示不按时间轮换）
+func (c *ServerConfig) GetKeyRotationInterval() time.Duration {
+	return parseDurationOrDefault(c.Auth.KeyRotation.Interval, 0)
+}
+
+// GetUDPTimeout 获取出口UDP映射的空闲超时
+func (c *ServerConfig) GetUDPTimeout() time.Duration {
+	return parseDurationOrDefault(c.UDP.Timeout, 60*time.Second)
+}
+
 // LoadClientConfig 加载客户端配置
 func LoadClientConfig(path string) (*ClientConfig, error) {
 	data, err := os.ReadFile(path)
@@ -269,3 +440,35 @@ func LoadClientConfig(path string) (*ClientConfig, error) {
 
 	return &config, nil
 }
+
+// parseDurationOrDefault 解析时间间隔，为空或无效时返回默认值
+func parseDurationOrDefault(value string, def time.Duration) time.Duration {
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return def
+	}
+	return d
+}
+
+// GetReconnectInitialDelay 获取重连初始延迟
+func (c *ClientConfig) GetReconnectInitialDelay() time.Duration {
+	return parseDurationOrDefault(c.Reconnect.InitialDelay, 1*time.Second)
+}
+
+// GetReconnectMaxDelay 获取重连最大延迟
+func (c *ClientConfig) GetReconnectMaxDelay() time.Duration {
+	return parseDurationOrDefault(c.Reconnect.MaxDelay, 5*time.Minute)
+}
+
+// GetKeyRotationInterval 获取X25519会话密钥轮换间隔（0表示不按时间轮换）
+func (c *ClientConfig) GetKeyRotationInterval() time.Duration {
+	return parseDurationOrDefault(c.Auth.KeyRotation.Interval, 0)
+}
+
+// GetPoolIdleTimeout 获取连接池空闲超时
+func (c *ClientConfig) GetPoolIdleTimeout() time.Duration {
+	return parseDurationOrDefault(c.Pool.IdleTimeout, 5*time.Minute)
+}
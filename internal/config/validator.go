@@ -5,8 +5,12 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
+	"multiexit-proxy/internal/protocol"
+
 	"github.com/sirupsen/logrus"
 )
 
@@ -46,6 +50,8 @@ func ValidateServerConfig(cfg *ServerConfig) error {
 	} else if len(cfg.Auth.Key) < 16 {
 		errors = append(errors, fmt.Errorf("auth.key must be at least 16 characters"))
 	}
+	errors = append(errors, validateKeyExchange(cfg.Auth.Method, cfg.Auth.KeyRotation.MaxBytes, cfg.Auth.KeyRotation.Interval)...)
+	errors = append(errors, validateCiphers(cfg.Auth.Ciphers)...)
 
 	// 验证出口IP
 	if len(cfg.ExitIPs) == 0 && !cfg.IPDetection.Enabled {
@@ -64,10 +70,45 @@ func ValidateServerConfig(cfg *ServerConfig) error {
 		"port_based":        true,
 		"destination_based": true,
 		"load_balanced":     true,
+		"weighted_round_robin": true,
+		"least_load":           true,
 	}
 	if cfg.Strategy.Type != "" && !validStrategies[cfg.Strategy.Type] {
 		errors = append(errors, fmt.Errorf("invalid strategy type: %s", cfg.Strategy.Type))
 	}
+	if cfg.Strategy.Type == "port_based" && len(cfg.Strategy.PortRanges) == 0 {
+		errors = append(errors, fmt.Errorf("strategy.port_ranges is required for port_based strategy"))
+	}
+	errors = append(errors, validatePortRanges(cfg)...)
+	validHashKeys := map[string]bool{
+		"":            true,
+		"host_port":   true,
+		"host":        true,
+		"etld1":       true,
+		"client_host": true,
+	}
+	if !validHashKeys[cfg.Strategy.HashKey] {
+		errors = append(errors, fmt.Errorf("invalid strategy.hash_key: %s (must be host_port, host, etld1 or client_host)", cfg.Strategy.HashKey))
+	}
+	for ipStr, weight := range cfg.Strategy.Weights {
+		if net.ParseIP(ipStr) == nil {
+			errors = append(errors, fmt.Errorf("invalid IP in strategy.weights: %s", ipStr))
+		} else if weight <= 0 {
+			errors = append(errors, fmt.Errorf("strategy.weights for %s must be > 0", ipStr))
+		}
+	}
+	for ipStr, limit := range cfg.Strategy.Limits {
+		if net.ParseIP(ipStr) == nil {
+			errors = append(errors, fmt.Errorf("invalid IP in strategy.limits: %s", ipStr))
+		}
+		if limit.MaxConnections < 0 || limit.MaxBandwidth < 0 {
+			errors = append(errors, fmt.Errorf("strategy.limits for %s must be >= 0", ipStr))
+		}
+	}
+	if cfg.Strategy.Type == "least_load" && cfg.Strategy.Param != "" &&
+		cfg.Strategy.Param != "connections" && cfg.Strategy.Param != "bandwidth" {
+		errors = append(errors, fmt.Errorf("invalid strategy.param for least_load: %s (must be connections or bandwidth)", cfg.Strategy.Param))
+	}
 
 	// 验证SNAT配置
 	if cfg.SNAT.Enabled {
@@ -81,6 +122,43 @@ func ValidateServerConfig(cfg *ServerConfig) error {
 		if cfg.SNAT.Interface == "" {
 			errors = append(errors, fmt.Errorf("snat.interface is required when snat.enabled is true"))
 		}
+		if cfg.SNAT.Backend != "" && cfg.SNAT.Backend != "netlink" && cfg.SNAT.Backend != "exec" {
+			errors = append(errors, fmt.Errorf("invalid snat.backend: %s (must be netlink or exec)", cfg.SNAT.Backend))
+		}
+		if cfg.SNAT.GatewayV6 != "" {
+			if ip := net.ParseIP(cfg.SNAT.GatewayV6); ip == nil || ip.To4() != nil {
+				errors = append(errors, fmt.Errorf("invalid snat.gateway_v6: %s", cfg.SNAT.GatewayV6))
+			}
+		}
+	}
+
+	// 验证出口模式
+	switch cfg.Egress.Mode {
+	case "", "bind":
+	case "mark", "both":
+		if !cfg.SNAT.Enabled {
+			errors = append(errors, fmt.Errorf("egress.mode %s requires snat.enabled", cfg.Egress.Mode))
+		}
+	default:
+		errors = append(errors, fmt.Errorf("invalid egress.mode: %s (must be bind, mark or both)", cfg.Egress.Mode))
+	}
+
+	// 验证地址族策略
+	validFamilyPolicies := map[string]bool{
+		"":               true,
+		"prefer_v4":      true,
+		"prefer_v6":      true,
+		"v4_only":        true,
+		"v6_only":        true,
+		"happy_eyeballs": true,
+	}
+	if !validFamilyPolicies[cfg.Egress.FamilyPolicy] {
+		errors = append(errors, fmt.Errorf("invalid egress.family_policy: %s", cfg.Egress.FamilyPolicy))
+	}
+	for _, rule := range cfg.Rules {
+		if !validFamilyPolicies[rule.FamilyPolicy] {
+			errors = append(errors, fmt.Errorf("invalid family_policy in rule %s: %s", rule.Name, rule.FamilyPolicy))
+		}
 	}
 
 	// 验证健康检查配置
@@ -97,6 +175,25 @@ func ValidateServerConfig(cfg *ServerConfig) error {
 		}
 	}
 
+	// 验证粘性会话配置
+	if cfg.Sticky.Enabled {
+		for _, part := range cfg.Sticky.Key {
+			if part != "client" && part != "user" && part != "etld1" {
+				errors = append(errors, fmt.Errorf("invalid sticky.key: %s (must be client, user or etld1)", part))
+			}
+		}
+		for _, d := range []struct{ name, value string }{{"idle_ttl", cfg.Sticky.IdleTTL}, {"max_lifetime", cfg.Sticky.MaxLifetime}} {
+			if d.value == "" {
+				continue
+			}
+			if v, err := time.ParseDuration(d.value); err != nil {
+				errors = append(errors, fmt.Errorf("invalid sticky.%s: %w", d.name, err))
+			} else if v <= 0 {
+				errors = append(errors, fmt.Errorf("sticky.%s must be positive", d.name))
+			}
+		}
+	}
+
 	// 验证连接配置
 	if cfg.Connection.ReadTimeout != "" {
 		if _, err := time.ParseDuration(cfg.Connection.ReadTimeout); err != nil {
@@ -137,6 +234,62 @@ func ValidateServerConfig(cfg *ServerConfig) error {
 		}
 	}
 
+	// 验证重放过滤配置
+	switch cfg.ReplayProtection.Mode {
+	case "", "exact", "bloom", "off":
+	default:
+		errors = append(errors, fmt.Errorf("invalid replay_protection.mode: %s (must be exact, bloom or off)", cfg.ReplayProtection.Mode))
+	}
+	if cfg.ReplayProtection.MaxEntries < 0 {
+		errors = append(errors, fmt.Errorf("replay_protection.max_entries must be >= 0"))
+	}
+	if cfg.ReplayProtection.FalsePositiveRate < 0 || cfg.ReplayProtection.FalsePositiveRate >= 1 {
+		errors = append(errors, fmt.Errorf("replay_protection.false_positive_rate must be in [0, 1)"))
+	}
+
+	// 验证Trojan配置
+	if cfg.Trojan.Fallback != "" {
+		if _, _, err := net.SplitHostPort(cfg.Trojan.Fallback); err != nil {
+			errors = append(errors, fmt.Errorf("invalid trojan.fallback address: %w", err))
+		}
+	}
+	trojanUsers := make(map[string]bool)
+	trojanPasswords := make(map[string]bool)
+	if cfg.Trojan.Password != "" {
+		trojanPasswords[cfg.Trojan.Password] = true
+	}
+	for i, user := range cfg.Trojan.Users {
+		if user.Username == "" || user.Password == "" {
+			errors = append(errors, fmt.Errorf("trojan.users[%d]: username and password are required", i))
+			continue
+		}
+		if trojanUsers[user.Username] {
+			errors = append(errors, fmt.Errorf("duplicate trojan user: %s", user.Username))
+		}
+		if trojanPasswords[user.Password] {
+			errors = append(errors, fmt.Errorf("trojan.users[%d]: password is already in use", i))
+		}
+		if user.Quota < 0 {
+			errors = append(errors, fmt.Errorf("trojan.users[%d].quota must be >= 0", i))
+		}
+		trojanUsers[user.Username] = true
+		trojanPasswords[user.Password] = true
+	}
+	for alpn, addr := range cfg.Trojan.FallbackALPN {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			errors = append(errors, fmt.Errorf("invalid trojan.fallback_alpn[%s] address: %w", alpn, err))
+		}
+	}
+
+	// 验证UDP中继配置
+	if cfg.UDP.Timeout != "" {
+		if d, err := time.ParseDuration(cfg.UDP.Timeout); err != nil {
+			errors = append(errors, fmt.Errorf("invalid udp.timeout: %w", err))
+		} else if d <= 0 {
+			errors = append(errors, fmt.Errorf("udp.timeout must be positive"))
+		}
+	}
+
 	// 验证Web配置
 	if cfg.Web.Enabled {
 		if cfg.Web.Listen == "" {
@@ -179,14 +332,24 @@ func ValidateClientConfig(cfg *ClientConfig) error {
 		}
 	}
 
+	// 验证协议版本
+	if cfg.Server.ProtocolVersion != 0 && cfg.Server.ProtocolVersion != 1 && cfg.Server.ProtocolVersion != 2 {
+		errors = append(errors, fmt.Errorf("invalid server.protocol_version: %d (must be 1 or 2)", cfg.Server.ProtocolVersion))
+	}
+
 	// 验证认证密钥
 	if cfg.Auth.Key == "" {
 		errors = append(errors, fmt.Errorf("auth.key is required"))
 	}
+	errors = append(errors, validateKeyExchange(cfg.Auth.Method, cfg.Auth.KeyRotation.MaxBytes, cfg.Auth.KeyRotation.Interval)...)
+	errors = append(errors, validateCiphers(cfg.Auth.Ciphers)...)
+	if cfg.Auth.Method == "x25519" && cfg.Server.ProtocolVersion == 1 {
+		errors = append(errors, fmt.Errorf("auth.method x25519 requires server.protocol_version 2"))
+	}
 
 	// 验证本地监听地址
-	if cfg.Local.SOCKS5 == "" && cfg.Local.HTTP == "" {
-		errors = append(errors, fmt.Errorf("at least one of local.socks5 or local.http is required"))
+	if cfg.Local.SOCKS5 == "" && cfg.Local.HTTP == "" && cfg.Local.Transparent.Listen == "" {
+		errors = append(errors, fmt.Errorf("at least one of local.socks5, local.http or local.transparent.listen is required"))
 	}
 	if cfg.Local.SOCKS5 != "" {
 		if _, _, err := net.SplitHostPort(cfg.Local.SOCKS5); err != nil {
@@ -198,6 +361,40 @@ func ValidateClientConfig(cfg *ClientConfig) error {
 			errors = append(errors, fmt.Errorf("invalid local.http address: %w", err))
 		}
 	}
+	if transparent := cfg.Local.Transparent; transparent.Listen != "" {
+		if _, _, err := net.SplitHostPort(transparent.Listen); err != nil {
+			errors = append(errors, fmt.Errorf("invalid local.transparent.listen address: %w", err))
+		}
+		if transparent.Mode != "redirect" && transparent.Mode != "tproxy" {
+			errors = append(errors, fmt.Errorf("invalid local.transparent.mode: %s (must be redirect or tproxy)", transparent.Mode))
+		}
+		if transparent.UDP && transparent.Mode != "tproxy" {
+			errors = append(errors, fmt.Errorf("local.transparent.udp requires tproxy mode"))
+		}
+		if transparent.Mark < 0 || transparent.Table < 0 {
+			errors = append(errors, fmt.Errorf("local.transparent.mark and table must be >= 0"))
+		}
+	}
+	localUsers := make(map[string]bool)
+	for i, user := range cfg.Local.Users {
+		if user.Username == "" || user.Password == "" {
+			errors = append(errors, fmt.Errorf("local.users[%d]: username and password are required", i))
+			continue
+		}
+		// RFC 1929中用户名和密码长度各占一个字节
+		if len(user.Username) > 255 || len(user.Password) > 255 {
+			errors = append(errors, fmt.Errorf("local.users[%d]: username and password must be at most 255 bytes", i))
+		}
+		if localUsers[user.Username] {
+			errors = append(errors, fmt.Errorf("duplicate local user: %s", user.Username))
+		}
+		for _, allowed := range user.AllowedIPs {
+			if _, _, err := net.ParseCIDR(allowed); err != nil && net.ParseIP(allowed) == nil {
+				errors = append(errors, fmt.Errorf("local.users[%d]: invalid allowed_ips entry: %s", i, allowed))
+			}
+		}
+		localUsers[user.Username] = true
+	}
 
 	// 验证日志级别
 	if cfg.Logging.Level != "" {
@@ -217,5 +414,100 @@ func ValidateClientConfig(cfg *ClientConfig) error {
 	return nil
 }
 
+// validateKeyExchange 验证握手方法和会话密钥轮换配置
+func validateKeyExchange(method string, maxBytes int64, interval string) []error {
+	var errors []error
+	if method != "" && method != "psk" && method != "x25519" {
+		errors = append(errors, fmt.Errorf("invalid auth.method: %s (must be psk or x25519)", method))
+	}
+	if maxBytes < 0 {
+		errors = append(errors, fmt.Errorf("auth.key_rotation.max_bytes must be >= 0"))
+	}
+	if interval != "" {
+		if _, err := time.ParseDuration(interval); err != nil {
+			errors = append(errors, fmt.Errorf("invalid auth.key_rotation.interval: %w", err))
+		}
+	}
+	return errors
+}
+
+// validateCiphers 验证数据加密算法列表
+func validateCiphers(ciphers []string) []error {
+	var errors []error
+	seen := make(map[protocol.CipherSuite]bool)
+	for _, name := range ciphers {
+		suite, err := protocol.ParseCipherSuite(name)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("invalid auth.ciphers: %w", err))
+			continue
+		}
+		if seen[suite] {
+			errors = append(errors, fmt.Errorf("duplicate auth.ciphers entry: %s", name))
+		}
+		seen[suite] = true
+	}
+	return errors
+}
+
+// validatePortRanges 验证端口范围：格式为起止端口、不超出0-65535、互不重叠，IP和备用IP属于出口IP
+func validatePortRanges(cfg *ServerConfig) []error {
+	var errors []error
+	type portRange struct {
+		name       string
+		start, end int
+	}
+	var ranges []portRange
+	for i, pr := range cfg.Strategy.PortRanges {
+		name := fmt.Sprintf("strategy.port_ranges[%d]", i)
+
+		bounds := strings.SplitN(pr.Range, "-", 2)
+		if len(bounds) != 2 {
+			errors = append(errors, fmt.Errorf("invalid %s.range: %s (must be start-end)", name, pr.Range))
+		} else {
+			start, startErr := strconv.Atoi(strings.TrimSpace(bounds[0]))
+			end, endErr := strconv.Atoi(strings.TrimSpace(bounds[1]))
+			switch {
+			case startErr != nil || endErr != nil:
+				errors = append(errors, fmt.Errorf("invalid %s.range: %s (must be start-end)", name, pr.Range))
+			case start < 0 || end > 65535 || start > end:
+				errors = append(errors, fmt.Errorf("invalid %s.range: %s (must be within 0-65535 and start <= end)", name, pr.Range))
+			default:
+				for _, other := range ranges {
+					if start <= other.end && other.start <= end {
+						errors = append(errors, fmt.Errorf("%s.range %s overlaps %s", name, pr.Range, other.name))
+					}
+				}
+				ranges = append(ranges, portRange{name: name, start: start, end: end})
+			}
+		}
 
+		for _, ip := range []struct{ field, value string }{{"ip", pr.IP}, {"backup", pr.Backup}} {
+			if ip.value == "" {
+				if ip.field == "ip" {
+					errors = append(errors, fmt.Errorf("%s.ip is required", name))
+				}
+				continue
+			}
+			if net.ParseIP(ip.value) == nil {
+				errors = append(errors, fmt.Errorf("invalid %s.%s: %s", name, ip.field, ip.value))
+			} else if len(cfg.ExitIPs) > 0 && !containsIP(cfg.ExitIPs, ip.value) {
+				errors = append(errors, fmt.Errorf("%s.%s %s is not in exit_ips", name, ip.field, ip.value))
+			}
+		}
+		if pr.Backup != "" && pr.Backup == pr.IP {
+			errors = append(errors, fmt.Errorf("%s.backup must differ from ip", name))
+		}
+	}
+	return errors
+}
 
+// containsIP ips中是否有与ipStr相同的IP地址
+func containsIP(ips []string, ipStr string) bool {
+	ip := net.ParseIP(ipStr)
+	for _, s := range ips {
+		if other := net.ParseIP(s); other != nil && other.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -69,7 +70,7 @@ func checkIPReachability(ip net.IP) error {
 	testPorts := []int{80, 443, 22}
 	
 	for _, port := range testPorts {
-		addr := fmt.Sprintf("%s:%d", ip.String(), port)
+		addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
 		conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
 		if err == nil {
 			conn.Close()
@@ -57,6 +57,14 @@ func (e *PrometheusExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "# TYPE multiexit_proxy_bytes_transferred counter\n")
 	fmt.Fprintf(w, "multiexit_proxy_bytes_transferred %d\n\n", stats.BytesTransferred)
 
+	// 导出按加密算法的连接数
+	fmt.Fprintf(w, "# HELP multiexit_proxy_cipher_connections Connections per negotiated cipher\n")
+	fmt.Fprintf(w, "# TYPE multiexit_proxy_cipher_connections counter\n")
+	for cipher, count := range stats.CipherStats {
+		fmt.Fprintf(w, "multiexit_proxy_cipher_connections{cipher=%s} %d\n", strconv.Quote(cipher), count)
+	}
+	fmt.Fprintf(w, "\n")
+
 	// 导出按IP的统计
 	stats.mu.RLock()
 	for ipStr, ipStat := range stats.IPStats {
@@ -15,6 +15,8 @@ type ConnectionStats struct {
 	BytesUp             int64
 	BytesDown           int64
 	IPStats             map[string]*IPConnectionStats
+	CipherStats         map[string]int64 // 各数据加密算法的连接数
+	UserStats           map[string]*UserConnectionStats
 	mu                  sync.RWMutex
 }
 
@@ -31,6 +33,17 @@ type IPConnectionStats struct {
 	mu              sync.RWMutex
 }
 
+// UserConnectionStats 用户连接统计
+type UserConnectionStats struct {
+	Connections int64
+	ActiveConn  int64
+	BytesUp     int64
+	BytesDown   int64
+	TotalBytes  int64
+	LastUsed    time.Time
+	mu          sync.RWMutex
+}
+
 // StatsManager 统计管理器
 type StatsManager struct {
 	stats *ConnectionStats
@@ -40,7 +53,9 @@ type StatsManager struct {
 func NewStatsManager() *StatsManager {
 	return &StatsManager{
 		stats: &ConnectionStats{
-			IPStats: make(map[string]*IPConnectionStats),
+			IPStats:     make(map[string]*IPConnectionStats),
+			CipherStats: make(map[string]int64),
+			UserStats:   make(map[string]*UserConnectionStats),
 		},
 	}
 }
@@ -118,6 +133,83 @@ func (s *StatsManager) OnBytesTransferred(ip net.IP, up, down int64) {
 	atomic.AddInt64(&stat.TotalBytes, up+down)
 }
 
+// OnCipherNegotiated 记录连接协商的数据加密算法
+func (s *StatsManager) OnCipherNegotiated(cipher string) {
+	s.stats.mu.Lock()
+	s.stats.CipherStats[cipher]++
+	s.stats.mu.Unlock()
+}
+
+// OnUserConnectionStart 用户连接开始
+func (s *StatsManager) OnUserConnectionStart(username string) {
+	s.stats.mu.Lock()
+	stat, ok := s.stats.UserStats[username]
+	if !ok {
+		stat = &UserConnectionStats{}
+		s.stats.UserStats[username] = stat
+	}
+	s.stats.mu.Unlock()
+	
+	atomic.AddInt64(&stat.Connections, 1)
+	atomic.AddInt64(&stat.ActiveConn, 1)
+	stat.mu.Lock()
+	stat.LastUsed = time.Now()
+	stat.mu.Unlock()
+}
+
+// OnUserConnectionEnd 用户连接结束
+func (s *StatsManager) OnUserConnectionEnd(username string) {
+	s.stats.mu.RLock()
+	stat, ok := s.stats.UserStats[username]
+	s.stats.mu.RUnlock()
+	
+	if ok {
+		atomic.AddInt64(&stat.ActiveConn, -1)
+	}
+}
+
+// OnUserBytesTransferred 用户数据传输
+func (s *StatsManager) OnUserBytesTransferred(username string, up, down int64) {
+	s.stats.mu.RLock()
+	stat, ok := s.stats.UserStats[username]
+	s.stats.mu.RUnlock()
+	
+	if !ok {
+		return
+	}
+	
+	atomic.AddInt64(&stat.BytesUp, up)
+	atomic.AddInt64(&stat.BytesDown, down)
+	atomic.AddInt64(&stat.TotalBytes, up+down)
+}
+
+// GetUserStats 获取特定用户的统计
+func (s *StatsManager) GetUserStats(username string) *UserConnectionStats {
+	s.stats.mu.RLock()
+	defer s.stats.mu.RUnlock()
+	
+	stat, ok := s.stats.UserStats[username]
+	if !ok {
+		return nil
+	}
+	return stat.snapshot()
+}
+
+// snapshot 复制用户统计
+func (u *UserConnectionStats) snapshot() *UserConnectionStats {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	
+	return &UserConnectionStats{
+		Connections: atomic.LoadInt64(&u.Connections),
+		ActiveConn:  atomic.LoadInt64(&u.ActiveConn),
+		BytesUp:     atomic.LoadInt64(&u.BytesUp),
+		BytesDown:   atomic.LoadInt64(&u.BytesDown),
+		TotalBytes:  atomic.LoadInt64(&u.TotalBytes),
+		LastUsed:    u.LastUsed,
+	}
+}
+
 // GetStats 获取统计信息
 func (s *StatsManager) GetStats() *ConnectionStats {
 	s.stats.mu.RLock()
@@ -139,6 +231,14 @@ func (s *StatsManager) GetStats() *ConnectionStats {
 		}
 		v.mu.RUnlock()
 	}
+	cipherStats := make(map[string]int64, len(s.stats.CipherStats))
+	for k, v := range s.stats.CipherStats {
+		cipherStats[k] = v
+	}
+	userStats := make(map[string]*UserConnectionStats, len(s.stats.UserStats))
+	for k, v := range s.stats.UserStats {
+		userStats[k] = v.snapshot()
+	}
 	
 	return &ConnectionStats{
 		TotalConnections:  atomic.LoadInt64(&s.stats.TotalConnections),
@@ -147,6 +247,8 @@ func (s *StatsManager) GetStats() *ConnectionStats {
 		BytesUp:           atomic.LoadInt64(&s.stats.BytesUp),
 		BytesDown:         atomic.LoadInt64(&s.stats.BytesDown),
 		IPStats:           ipStats,
+		CipherStats:       cipherStats,
+		UserStats:         userStats,
 	}
 }
 
@@ -190,6 +292,12 @@ func (s *StatsManager) Reset() {
 	for k := range s.stats.IPStats {
 		delete(s.stats.IPStats, k)
 	}
+	for k := range s.stats.CipherStats {
+		delete(s.stats.CipherStats, k)
+	}
+	for k := range s.stats.UserStats {
+		delete(s.stats.UserStats, k)
+	}
 }
 
 
@@ -85,3 +85,25 @@ func TestStatsManager_Reset(t *testing.T) {
 
 
 
+
+func TestStatsManager_UserStats(t *testing.T) {
+	sm := NewStatsManager()
+	
+	sm.OnUserConnectionStart("alice")
+	sm.OnUserBytesTransferred("alice", 100, 200)
+	sm.OnUserConnectionEnd("alice")
+	
+	userStats := sm.GetUserStats("alice")
+	if userStats == nil {
+		t.Fatal("Expected user stats, got nil")
+	}
+	if userStats.Connections != 1 || userStats.ActiveConn != 0 {
+		t.Errorf("Expected 1 connection and 0 active, got %d/%d", userStats.Connections, userStats.ActiveConn)
+	}
+	if userStats.TotalBytes != 300 {
+		t.Errorf("Expected 300 bytes for user, got %d", userStats.TotalBytes)
+	}
+	if sm.GetUserStats("bob") != nil {
+		t.Error("Expected nil stats for unknown user")
+	}
+}
@@ -0,0 +1,161 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+const (
+	// Version2 协议v2：握手后的所有数据使用长度前缀的AEAD记录分帧
+	Version2 = 0x02
+
+	// MaxRecordSize 单条记录的最大明文长度
+	MaxRecordSize = 16 * 1024
+
+	// RecordHeaderSize 记录头长度（2字节密文长度，大端序）
+	RecordHeaderSize = 2
+
+	// recordKeyUpdateFlag 记录头最高位：本条记录使用发送方的下一代密钥加密（仅会话密钥支持）
+	recordKeyUpdateFlag = 0x8000
+
+	// recordOverhead 每条记录的加密开销（nonce + AEAD tag）
+	recordOverhead = NonceSize + 16
+)
+
+// AEADWriter v2记录写入器：将数据切分为不超过MaxRecordSize的记录，逐条加密并写入
+// 记录格式：2字节密文长度 + nonce + 密文（含tag）
+// AEADWriter非并发安全
+type AEADWriter struct {
+	w      io.Writer
+	cipher RecordCipher
+	buf    []byte
+}
+
+// NewAEADWriter 创建v2记录写入器
+func NewAEADWriter(w io.Writer, cipher RecordCipher) *AEADWriter {
+	return &AEADWriter{
+		w:      w,
+		cipher: cipher,
+		buf:    make([]byte, RecordHeaderSize+MaxRecordSize+recordOverhead),
+	}
+}
+
+// Write 写入数据，超过MaxRecordSize时自动分为多条记录
+func (aw *AEADWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > MaxRecordSize {
+			n = MaxRecordSize
+		}
+		if err := aw.WriteRecord(p[:n]); err != nil {
+			return total, err
+		}
+		total += n
+		p = p[n:]
+	}
+	return total, nil
+}
+
+// WriteRecord 将数据作为一条完整记录写入（长度不能超过MaxRecordSize）
+func (aw *AEADWriter) WriteRecord(p []byte) error {
+	if len(p) > MaxRecordSize {
+		return ErrRecordTooLarge
+	}
+
+	// 密钥用量达到轮换策略时切换到下一代密钥，并在记录头中通知对端
+	var flags uint16
+	if updater, ok := aw.cipher.(keyUpdater); ok && updater.needsKeyUpdate() {
+		if err := updater.updateKey(); err != nil {
+			return err
+		}
+		flags |= recordKeyUpdateFlag
+	}
+
+	ciphertext, err := aw.cipher.Encrypt(p)
+	if err != nil {
+		return err
+	}
+
+	// 记录头和密文合并为一次写入
+	record := aw.buf[:RecordHeaderSize+len(ciphertext)]
+	binary.BigEndian.PutUint16(record[:RecordHeaderSize], uint16(len(ciphertext))|flags)
+	copy(record[RecordHeaderSize:], ciphertext)
+
+	_, err = aw.w.Write(record)
+	return err
+}
+
+// AEADReader v2记录读取器：按长度头读取完整记录并解密
+// AEADReader非并发安全
+type AEADReader struct {
+	r       io.Reader
+	cipher  RecordCipher
+	buf     []byte
+	pending []byte // 已解密但未被读取的数据
+}
+
+// NewAEADReader 创建v2记录读取器
+func NewAEADReader(r io.Reader, cipher RecordCipher) *AEADReader {
+	return &AEADReader{
+		r:      r,
+		cipher: cipher,
+		buf:    make([]byte, MaxRecordSize+recordOverhead),
+	}
+}
+
+// Read 读取解密后的数据（跨记录的流式读取）
+func (ar *AEADReader) Read(p []byte) (int, error) {
+	if len(ar.pending) == 0 {
+		record, err := ar.ReadRecord()
+		if err != nil {
+			return 0, err
+		}
+		ar.pending = record
+	}
+
+	n := copy(p, ar.pending)
+	ar.pending = ar.pending[n:]
+	return n, nil
+}
+
+// ReadRecord 读取并解密一条完整记录
+func (ar *AEADReader) ReadRecord() ([]byte, error) {
+	var header [RecordHeaderSize]byte
+	if _, err := io.ReadFull(ar.r, header[:]); err != nil {
+		return nil, err
+	}
+
+	header16 := binary.BigEndian.Uint16(header[:])
+	length := int(header16 &^ recordKeyUpdateFlag)
+	if length > len(ar.buf) {
+		return nil, ErrRecordTooLarge
+	}
+	if length < recordOverhead {
+		return nil, ErrInvalidMessage
+	}
+
+	if _, err := io.ReadFull(ar.r, ar.buf[:length]); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	// 对端已轮换密钥，接收方向同步切换
+	if header16&recordKeyUpdateFlag != 0 {
+		updater, ok := ar.cipher.(keyUpdater)
+		if !ok {
+			return nil, ErrInvalidMessage
+		}
+		if err := updater.updateKey(); err != nil {
+			return nil, err
+		}
+	}
+
+	plaintext, err := ar.cipher.Decrypt(ar.buf[:length])
+	if err != nil {
+		return nil, ErrDecryption
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,131 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func newTestConnectionCipher(t *testing.T) *ConnectionCipher {
+	cipher, err := NewCipher(DeriveKeyFromPSK("test-key"), true)
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+	return NewConnectionCipher(cipher)
+}
+
+func TestAEADReaderWriter_LargeWrite(t *testing.T) {
+	var wire bytes.Buffer
+	writer := NewAEADWriter(&wire, newTestConnectionCipher(t))
+	reader := NewAEADReader(&wire, newTestConnectionCipher(t))
+
+	// 超过单条记录大小的写入会被切分为多条记录
+	data := make([]byte, MaxRecordSize*3+100)
+	rand.Read(data)
+	n, err := writer.Write(data)
+	if err != nil || n != len(data) {
+		t.Fatalf("Write failed: n=%d err=%v", n, err)
+	}
+
+	received, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(data, received) {
+		t.Error("Received data mismatch")
+	}
+}
+
+func TestAEADReaderWriter_CoalescedRecords(t *testing.T) {
+	var wire bytes.Buffer
+	writer := NewAEADWriter(&wire, newTestConnectionCipher(t))
+
+	// 多条记录合并在一起到达（模拟TCP合包），仍能按记录边界解密
+	records := [][]byte{[]byte("first"), []byte("second"), []byte("third")}
+	for _, record := range records {
+		if err := writer.WriteRecord(record); err != nil {
+			t.Fatalf("WriteRecord failed: %v", err)
+		}
+	}
+
+	reader := NewAEADReader(bytes.NewReader(wire.Bytes()), newTestConnectionCipher(t))
+	for _, want := range records {
+		got, err := reader.ReadRecord()
+		if err != nil {
+			t.Fatalf("ReadRecord failed: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Record mismatch: got %q, want %q", got, want)
+		}
+	}
+	if _, err := reader.ReadRecord(); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+}
+
+func TestAEADReader_SmallReads(t *testing.T) {
+	var wire bytes.Buffer
+	writer := NewAEADWriter(&wire, newTestConnectionCipher(t))
+	writer.Write([]byte("hello world"))
+
+	// 逐字节读取（模拟TCP拆包后的小块读取）
+	reader := NewAEADReader(&oneByteReader{r: &wire}, newTestConnectionCipher(t))
+	buf := make([]byte, 3)
+	var received []byte
+	for {
+		n, err := reader.Read(buf)
+		received = append(received, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+	}
+	if string(received) != "hello world" {
+		t.Errorf("Expected 'hello world', got %q", received)
+	}
+}
+
+func TestAEADReader_Tampered(t *testing.T) {
+	var wire bytes.Buffer
+	writer := NewAEADWriter(&wire, newTestConnectionCipher(t))
+	writer.WriteRecord([]byte("secret"))
+
+	data := wire.Bytes()
+	data[len(data)-1] ^= 0xFF
+
+	reader := NewAEADReader(bytes.NewReader(data), newTestConnectionCipher(t))
+	if _, err := reader.ReadRecord(); err != ErrDecryption {
+		t.Errorf("Expected ErrDecryption, got %v", err)
+	}
+}
+
+func TestAEADReader_RecordTooLarge(t *testing.T) {
+	header := make([]byte, RecordHeaderSize)
+	binary.BigEndian.PutUint16(header, 0xFFFF)
+
+	reader := NewAEADReader(bytes.NewReader(header), newTestConnectionCipher(t))
+	if _, err := reader.ReadRecord(); err != ErrRecordTooLarge {
+		t.Errorf("Expected ErrRecordTooLarge, got %v", err)
+	}
+
+	writer := NewAEADWriter(io.Discard, newTestConnectionCipher(t))
+	if err := writer.WriteRecord(make([]byte, MaxRecordSize+1)); err != ErrRecordTooLarge {
+		t.Errorf("Expected ErrRecordTooLarge, got %v", err)
+	}
+}
+
+// oneByteReader 每次只返回一个字节
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (o *oneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return o.r.Read(p[:1])
+}
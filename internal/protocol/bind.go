@@ -0,0 +1,47 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+)
+
+// WriteBindReply 编码并一次写入BIND响应中的地址（服务端的监听地址或连入的对端地址）
+// 编码格式：[地址类型][IP（4或16字节）][2字节端口]，IPv4映射的IPv6地址按IPv4编码
+func WriteBindReply(w io.Writer, addr *net.TCPAddr) error {
+	var buf []byte
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		buf = append([]byte{AddrTypeIPv4}, ip4...)
+	} else if ip16 := addr.IP.To16(); ip16 != nil {
+		buf = append([]byte{AddrTypeIPv6}, ip16...)
+	} else {
+		return ErrInvalidMessage
+	}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(addr.Port))
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadBindReply 读取BIND响应中的地址
+func ReadBindReply(r io.Reader) (*net.TCPAddr, error) {
+	var addrType [1]byte
+	if _, err := io.ReadFull(r, addrType[:]); err != nil {
+		return nil, err
+	}
+
+	var ipLen int
+	switch addrType[0] {
+	case AddrTypeIPv4:
+		ipLen = net.IPv4len
+	case AddrTypeIPv6:
+		ipLen = net.IPv6len
+	default:
+		return nil, ErrInvalidMessage
+	}
+
+	buf := make([]byte, ipLen+2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return &net.TCPAddr{IP: net.IP(buf[:ipLen]), Port: int(binary.BigEndian.Uint16(buf[ipLen:]))}, nil
+}
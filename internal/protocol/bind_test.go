@@ -0,0 +1,33 @@
+package protocol
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestBindReplyRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	addrs := []*net.TCPAddr{
+		{IP: net.ParseIP("::ffff:198.51.100.7"), Port: 40001},
+		{IP: net.ParseIP("2001:db8::7"), Port: 21},
+	}
+	for _, addr := range addrs {
+		if err := WriteBindReply(&buf, addr); err != nil {
+			t.Fatalf("WriteBindReply(%s) failed: %v", addr, err)
+		}
+	}
+	for _, want := range addrs {
+		got, err := ReadBindReply(&buf)
+		if err != nil {
+			t.Fatalf("ReadBindReply failed: %v", err)
+		}
+		if !got.IP.Equal(want.IP) || got.Port != want.Port {
+			t.Errorf("Got %s, want %s", got, want)
+		}
+	}
+
+	if _, err := ReadBindReply(bytes.NewReader([]byte{AddrTypeDomain, 0, 0})); err != ErrInvalidMessage {
+		t.Errorf("Expected ErrInvalidMessage for a domain address, got %v", err)
+	}
+}
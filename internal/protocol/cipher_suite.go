@@ -0,0 +1,130 @@
+package protocol
+
+import (
+	"fmt"
+	"runtime"
+
+	"golang.org/x/sys/cpu"
+)
+
+// CipherSuite 握手后数据加密使用的AEAD算法
+type CipherSuite uint8
+
+const (
+	CipherAES256GCM        CipherSuite = 0x01
+	CipherChaCha20Poly1305 CipherSuite = 0x02
+)
+
+// handshakeCipherShift HandshakeMessage.Reserved高8位为客户端支持的算法位图（第i位对应算法i+1）
+const handshakeCipherShift = 8
+
+// String 算法名称（与配置文件中的写法一致）
+func (cs CipherSuite) String() string {
+	switch cs {
+	case CipherAES256GCM:
+		return "aes-256-gcm"
+	case CipherChaCha20Poly1305:
+		return "chacha20-poly1305"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(cs))
+	}
+}
+
+// UseAES 是否为AES-GCM（对应NewCipher的useAES参数）
+func (cs CipherSuite) UseAES() bool {
+	return cs == CipherAES256GCM
+}
+
+// ParseCipherSuite 解析算法名称
+func ParseCipherSuite(name string) (CipherSuite, error) {
+	switch name {
+	case "aes-256-gcm", "aes":
+		return CipherAES256GCM, nil
+	case "chacha20-poly1305", "chacha20":
+		return CipherChaCha20Poly1305, nil
+	default:
+		return 0, fmt.Errorf("unknown cipher: %s", name)
+	}
+}
+
+// ParseCipherSuites 解析算法名称列表
+func ParseCipherSuites(names []string) ([]CipherSuite, error) {
+	suites := make([]CipherSuite, 0, len(names))
+	for _, name := range names {
+		suite, err := ParseCipherSuite(name)
+		if err != nil {
+			return nil, err
+		}
+		suites = append(suites, suite)
+	}
+	return suites, nil
+}
+
+// SupportedCipherSuites 支持的全部算法
+func SupportedCipherSuites() []CipherSuite {
+	return []CipherSuite{CipherAES256GCM, CipherChaCha20Poly1305}
+}
+
+// DefaultCipherSuites 按本机硬件排序的默认算法列表（没有AES硬件加速时ChaCha20优先）
+func DefaultCipherSuites() []CipherSuite {
+	if HasAESHardware() {
+		return []CipherSuite{CipherAES256GCM, CipherChaCha20Poly1305}
+	}
+	return []CipherSuite{CipherChaCha20Poly1305, CipherAES256GCM}
+}
+
+// HasAESHardware 本机是否支持AES-GCM硬件加速
+func HasAESHardware() bool {
+	switch runtime.GOARCH {
+	case "amd64":
+		return cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ
+	case "arm64":
+		return cpu.ARM64.HasAES && cpu.ARM64.HasPMULL
+	case "s390x":
+		return cpu.S390X.HasAES && cpu.S390X.HasAESGCM
+	default:
+		return false
+	}
+}
+
+// EncodeCipherSuites 将客户端支持的算法编码到握手标志位中
+// 第一个算法为ChaCha20时同时设置HandshakeFlagPreferChaCha20
+func EncodeCipherSuites(suites []CipherSuite) uint16 {
+	var flags uint16
+	for _, suite := range suites {
+		if suite >= 1 && suite <= 8 {
+			flags |= 1 << (handshakeCipherShift + uint(suite) - 1)
+		}
+	}
+	if len(suites) > 0 && suites[0] == CipherChaCha20Poly1305 {
+		flags |= HandshakeFlagPreferChaCha20
+	}
+	return flags
+}
+
+// OfferedCipherSuites 握手标志位中是否包含客户端支持的算法（旧客户端不广播）
+func OfferedCipherSuites(flags uint16) bool {
+	return flags>>handshakeCipherShift != 0
+}
+
+// NegotiateCipherSuite 按服务端偏好选择客户端支持的算法
+// 客户端声明没有AES硬件加速时，只要服务端允许就选择ChaCha20
+func NegotiateCipherSuite(preference []CipherSuite, flags uint16) (CipherSuite, bool) {
+	offered := func(suite CipherSuite) bool {
+		return suite >= 1 && suite <= 8 && flags&(1<<(handshakeCipherShift+uint(suite)-1)) != 0
+	}
+
+	if flags&HandshakeFlagPreferChaCha20 != 0 && offered(CipherChaCha20Poly1305) {
+		for _, suite := range preference {
+			if suite == CipherChaCha20Poly1305 {
+				return suite, true
+			}
+		}
+	}
+	for _, suite := range preference {
+		if offered(suite) {
+			return suite, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,47 @@
+package protocol
+
+import "testing"
+
+func TestNegotiateCipherSuite(t *testing.T) {
+	both := []CipherSuite{CipherAES256GCM, CipherChaCha20Poly1305}
+	tests := []struct {
+		name       string
+		preference []CipherSuite
+		client     []CipherSuite
+		want       CipherSuite
+		ok         bool
+	}{
+		{"server preference", both, []CipherSuite{CipherAES256GCM, CipherChaCha20Poly1305}, CipherAES256GCM, true},
+		{"client prefers chacha", both, []CipherSuite{CipherChaCha20Poly1305, CipherAES256GCM}, CipherChaCha20Poly1305, true},
+		{"server disallows chacha", []CipherSuite{CipherAES256GCM}, []CipherSuite{CipherChaCha20Poly1305, CipherAES256GCM}, CipherAES256GCM, true},
+		{"only common suite", both, []CipherSuite{CipherChaCha20Poly1305}, CipherChaCha20Poly1305, true},
+		{"no common suite", []CipherSuite{CipherAES256GCM}, []CipherSuite{CipherChaCha20Poly1305}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := NegotiateCipherSuite(tt.preference, EncodeCipherSuites(tt.client))
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("NegotiateCipherSuite() = %v, %v, want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestOfferedCipherSuites(t *testing.T) {
+	if OfferedCipherSuites(HandshakeFlagMux) {
+		t.Error("Legacy flags should not advertise cipher suites")
+	}
+	if !OfferedCipherSuites(EncodeCipherSuites(SupportedCipherSuites()) | HandshakeFlagMux) {
+		t.Error("Encoded flags should advertise cipher suites")
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	suites, err := ParseCipherSuites([]string{"chacha20", "aes-256-gcm"})
+	if err != nil || len(suites) != 2 || suites[0] != CipherChaCha20Poly1305 || suites[1] != CipherAES256GCM {
+		t.Errorf("ParseCipherSuites() = %v, %v", suites, err)
+	}
+	if _, err := ParseCipherSuites([]string{"rc4"}); err == nil {
+		t.Error("Expected unknown cipher to fail")
+	}
+}
@@ -4,12 +4,11 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"sync/atomic"
 
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/hkdf"
@@ -27,7 +26,6 @@ type Cipher struct {
 	decKey        []byte
 	aead          cipher.AEAD
 	useAES        bool
-	nonceCounter  uint64 // 原子计数器，用于生成nonce
 	ciphertextBuf []byte // 预分配的加密输出buffer
 }
 
@@ -85,14 +83,13 @@ func NewCipher(masterKey []byte, useAES bool) (*Cipher, error) {
 	}, nil
 }
 
-// Encrypt 加密数据（使用计数器nonce，避免随机数生成开销）
+// Encrypt 加密数据（使用随机nonce）
+// 密钥由PSK派生且在进程重启和连接之间不变，计数器nonce会重复，因此每条记录使用随机nonce
 func (c *Cipher) Encrypt(plaintext []byte) ([]byte, error) {
-	// 使用原子计数器生成nonce（更高效）
-	counter := atomic.AddUint64(&c.nonceCounter, 1)
 	nonce := make([]byte, NonceSize)
-	binary.BigEndian.PutUint64(nonce[0:8], counter)
-	// 使用counter的低4字节填充剩余空间
-	binary.BigEndian.PutUint32(nonce[8:12], uint32(counter>>32))
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
 
 	// 计算输出大小
 	outputSize := NonceSize + len(plaintext) + c.aead.Overhead()
@@ -150,10 +147,10 @@ func DeriveKeyFromPSK(psk string) []byte {
 	return hash[:]
 }
 
-// ConnectionCipher 连接级加密上下文（复用主cipher，但维护独立的nonce计数器）
+// ConnectionCipher 连接级加密上下文（复用主cipher，维护独立的输出buffer）
+// 所有连接和两个方向共用PSK派生的密钥，每条记录使用随机nonce；v2 PSK会话改用NewPSKSessionCiphers派生的独立密钥
 type ConnectionCipher struct {
 	cipher        *Cipher
-	nonceCounter  uint64
 	ciphertextBuf []byte
 }
 
@@ -165,12 +162,12 @@ func NewConnectionCipher(c *Cipher) *ConnectionCipher {
 	}
 }
 
-// Encrypt 使用连接级nonce计数器加密
+// Encrypt 使用随机nonce加密
 func (cc *ConnectionCipher) Encrypt(plaintext []byte) ([]byte, error) {
-	cc.nonceCounter++
 	nonce := make([]byte, NonceSize)
-	binary.BigEndian.PutUint64(nonce[0:8], cc.nonceCounter)
-	binary.BigEndian.PutUint32(nonce[8:12], uint32(cc.nonceCounter>>32))
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
 
 	outputSize := NonceSize + len(plaintext) + cc.cipher.aead.Overhead()
 	var output []byte
@@ -8,6 +8,8 @@ var (
 	ErrAuthFailed     = errors.New("authentication failed")
 	ErrEncryption     = errors.New("encryption error")
 	ErrDecryption     = errors.New("decryption error")
+	ErrRecordTooLarge = errors.New("record too large")
+	ErrReplayDetected = errors.New("replayed handshake")
 )
 
 
@@ -16,12 +16,38 @@ const (
 	MsgTypeData      = 0x03
 	MsgTypeClose     = 0x04
 
+	// 多路复用会话消息类型（通过DataMessage承载，StreamID标识逻辑流）
+	MsgTypeOpen         = 0x05 // 打开流，Data为编码后的ConnectRequest
+	MsgTypeOpenAck      = 0x06 // 打开流响应，Data[0]为状态（0x00成功）
+	MsgTypeWindowUpdate = 0x07 // 流控窗口更新，Data为4字节增量
+	MsgTypePing         = 0x08 // 会话心跳（StreamID为0）
+	MsgTypePong         = 0x09 // 心跳响应
+
+	// MsgTypeUDPAssociate 连接请求类型：UDP关联（地址字段忽略），建立后隧道中传输UDP数据报帧（见UDPDatagram）
+	MsgTypeUDPAssociate = 0x0A
+
+	// MsgTypeBind 连接请求类型：反向连接（如SOCKS BIND），地址为预期连入的对端地址
+	// 服务端接受后在选定的出口IP上监听，隧道中依次返回监听地址和连入的对端地址（见WriteBindReply），之后转发对端连接的数据
+	MsgTypeBind = 0x0B
+
+	// 握手标志（HandshakeMessage.Reserved）
+	HandshakeFlagMux            = 0x0001 // 握手后进入多路复用会话
+	HandshakeFlagPreferChaCha20 = 0x0002 // 客户端没有AES硬件加速，服务端允许时优先选择ChaCha20-Poly1305
+
 	// 地址类型
 	AddrTypeIPv4   = 0x01
 	AddrTypeIPv6   = 0x02
 	AddrTypeDomain = 0x03
 )
 
+const (
+	// HandshakeSize 握手消息明文长度
+	HandshakeSize = 32
+
+	// EncryptedHandshakeSize 加密后的握手消息长度（nonce + 明文 + AEAD tag）
+	EncryptedHandshakeSize = NonceSize + HandshakeSize + 16
+)
+
 // HandshakeMessage 握手消息 (32字节)
 type HandshakeMessage struct {
 	Version   uint8
@@ -33,14 +59,20 @@ type HandshakeMessage struct {
 }
 
 // ConnectRequest 连接请求
+// User为客户端本地代理认证的用户名（可选），编码在端口之后：[1字节长度][用户名]，为空时不编码，
+// 旧版本服务端忽略端口之后的数据
 type ConnectRequest struct {
 	Type     uint8
 	AddrType uint8
 	AddrLen  uint8
 	Address  []byte
 	Port     uint16
+	User     string
 }
 
+// MaxUserLen 连接请求中用户名的最大长度
+const MaxUserLen = 0xFF
+
 // DataMessage 数据消息
 type DataMessage struct {
 	Type     uint8
@@ -84,6 +116,9 @@ func DecodeHandshake(data []byte) (*HandshakeMessage, error) {
 func EncodeConnectRequest(req *ConnectRequest) []byte {
 	addrLen := len(req.Address)
 	totalLen := 1 + 1 + 1 + addrLen + 2 // type + addrType + addrLen + address + port
+	if req.User != "" {
+		totalLen += 1 + len(req.User) // userLen + user
+	}
 
 	buf := make([]byte, totalLen)
 	buf[0] = req.Type
@@ -91,6 +126,10 @@ func EncodeConnectRequest(req *ConnectRequest) []byte {
 	buf[2] = uint8(addrLen)
 	copy(buf[3:3+addrLen], req.Address)
 	binary.BigEndian.PutUint16(buf[3+addrLen:3+addrLen+2], req.Port)
+	if req.User != "" {
+		buf[3+addrLen+2] = uint8(len(req.User))
+		copy(buf[3+addrLen+3:], req.User)
+	}
 
 	return buf
 }
@@ -117,6 +156,15 @@ func DecodeConnectRequest(data []byte) (*ConnectRequest, error) {
 	copy(req.Address, data[addrStart:addrEnd])
 	req.Port = binary.BigEndian.Uint16(data[addrEnd : addrEnd+2])
 
+	// 可选的用户名
+	if userStart := addrEnd + 2; len(data) > userStart {
+		userEnd := userStart + 1 + int(data[userStart])
+		if len(data) < userEnd {
+			return nil, ErrInvalidMessage
+		}
+		req.User = string(data[userStart+1 : userEnd])
+	}
+
 	return req, nil
 }
 
@@ -0,0 +1,41 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestConnectRequestUserRoundTrip(t *testing.T) {
+	req := &ConnectRequest{
+		Type:     MsgTypeConnect,
+		AddrType: AddrTypeDomain,
+		AddrLen:  11,
+		Address:  []byte("example.com"),
+		Port:     443,
+		User:     "alice",
+	}
+	decoded, err := DecodeConnectRequest(EncodeConnectRequest(req))
+	if err != nil {
+		t.Fatalf("DecodeConnectRequest failed: %v", err)
+	}
+	if !bytes.Equal(decoded.Address, req.Address) || decoded.Port != req.Port || decoded.User != "alice" {
+		t.Errorf("Unexpected request %+v", decoded)
+	}
+
+	// 不带用户名的请求（旧客户端）
+	req.User = ""
+	data := EncodeConnectRequest(req)
+	if len(data) != 3+11+2 {
+		t.Errorf("Request without user has %d bytes, want %d", len(data), 3+11+2)
+	}
+	if decoded, err := DecodeConnectRequest(data); err != nil || decoded.User != "" {
+		t.Errorf("Unexpected request %+v (%v)", decoded, err)
+	}
+
+	// 截断的用户名
+	req.User = "alice"
+	data = EncodeConnectRequest(req)
+	if _, err := DecodeConnectRequest(data[:len(data)-1]); err != ErrInvalidMessage {
+		t.Errorf("Expected ErrInvalidMessage for truncated user, got %v", err)
+	}
+}
@@ -0,0 +1,260 @@
+package protocol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// 握手方法（HandshakeMessage.Method）
+	MethodPSK    = 0x01 // 会话密钥由PSK派生的密钥和双方随机数导出（v2每个连接、每个方向使用独立密钥）
+	MethodX25519 = 0x02 // PSK认证的X25519临时密钥交换，每个会话使用独立密钥（前向安全），仅支持v2
+
+	// X25519PublicKeySize X25519公钥长度
+	X25519PublicKeySize = 32
+
+	// PSKSaltSize v2 PSK握手中服务端随机盐的长度
+	PSKSaltSize = 16
+)
+
+// RecordCipher v2记录的加解密接口
+type RecordCipher interface {
+	Encrypt(plaintext []byte) ([]byte, error)
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// keyUpdater 支持密钥轮换的记录加密器（由AEADWriter/AEADReader驱动）
+type keyUpdater interface {
+	// needsKeyUpdate 发送方是否应切换到下一代密钥
+	needsKeyUpdate() bool
+	// updateKey 切换到下一代密钥
+	updateKey() error
+}
+
+// KeyRotationPolicy 会话密钥轮换策略（任一条件满足即轮换，0表示不限制）
+type KeyRotationPolicy struct {
+	MaxBytes int64         // 同一密钥最多加密的字节数
+	Interval time.Duration // 同一密钥最长使用时间
+}
+
+// SessionCipher 单方向的会话密钥加密器（发送和接收方向各一个）
+// nonce为记录序号，接收方按序校验，拒绝重放和乱序的记录
+// SessionCipher非并发安全
+type SessionCipher struct {
+	key        []byte
+	aead       cipher.AEAD
+	useAES     bool
+	seq        uint64
+	bytes      int64
+	since      time.Time
+	policy     KeyRotationPolicy
+	generation uint32
+	buf        []byte
+}
+
+// newSessionCipher 创建单方向会话加密器
+func newSessionCipher(key []byte, useAES bool, policy KeyRotationPolicy) (*SessionCipher, error) {
+	sc := &SessionCipher{
+		useAES: useAES,
+		policy: policy,
+		buf:    make([]byte, NonceSize+MaxRecordSize+16),
+	}
+	if err := sc.setKey(key); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// setKey 切换密钥并重置序号和用量
+func (sc *SessionCipher) setKey(key []byte) error {
+	var aead cipher.AEAD
+	var err error
+	if sc.useAES {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return fmt.Errorf("failed to create AES cipher: %w", err)
+		}
+		aead, err = cipher.NewGCM(block)
+		if err != nil {
+			return fmt.Errorf("failed to create GCM: %w", err)
+		}
+	} else {
+		aead, err = chacha20poly1305.New(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	// 清除上一代密钥
+	for i := range sc.key {
+		sc.key[i] = 0
+	}
+	sc.key = key
+	sc.aead = aead
+	sc.seq = 0
+	sc.bytes = 0
+	sc.since = time.Now()
+	return nil
+}
+
+// Encrypt 加密数据，输出格式与ConnectionCipher一致（nonce + 密文）
+func (sc *SessionCipher) Encrypt(plaintext []byte) ([]byte, error) {
+	sc.seq++
+	outputSize := NonceSize + len(plaintext) + sc.aead.Overhead()
+	var output []byte
+	if cap(sc.buf) >= outputSize {
+		output = sc.buf[:outputSize]
+	} else {
+		output = make([]byte, outputSize)
+	}
+
+	nonce := output[:NonceSize]
+	sc.putNonce(nonce, sc.seq)
+	sc.bytes += int64(len(plaintext))
+	return sc.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Decrypt 解密数据，nonce必须是下一个期望的序号
+func (sc *SessionCipher) Decrypt(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < NonceSize {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	var expected [NonceSize]byte
+	sc.putNonce(expected[:], sc.seq+1)
+	nonce := ciphertext[:NonceSize]
+	if string(nonce) != string(expected[:]) {
+		return nil, ErrDecryption
+	}
+
+	plaintext, err := sc.aead.Open(nil, nonce, ciphertext[NonceSize:], nil)
+	if err != nil {
+		return nil, err
+	}
+	sc.seq++
+	sc.bytes += int64(len(plaintext))
+	return plaintext, nil
+}
+
+// putNonce 按序号生成nonce（前4字节为密钥代数，后8字节为序号）
+func (sc *SessionCipher) putNonce(nonce []byte, seq uint64) {
+	binary.BigEndian.PutUint32(nonce[0:4], sc.generation)
+	binary.BigEndian.PutUint64(nonce[4:12], seq)
+}
+
+// Generation 当前密钥代数（每次轮换加1）
+func (sc *SessionCipher) Generation() uint32 {
+	return sc.generation
+}
+
+// needsKeyUpdate 用量或时间超出轮换策略时需要轮换
+func (sc *SessionCipher) needsKeyUpdate() bool {
+	if sc.policy.MaxBytes > 0 && sc.bytes >= sc.policy.MaxBytes {
+		return true
+	}
+	if sc.policy.Interval > 0 && time.Since(sc.since) >= sc.policy.Interval {
+		return true
+	}
+	return false
+}
+
+// updateKey 由当前密钥单向派生下一代密钥（旧密钥被清除，泄露新密钥无法推出旧密钥）
+func (sc *SessionCipher) updateKey() error {
+	next := make([]byte, KeySize)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, sc.key, []byte("multiexit-proxy-key-update")), next); err != nil {
+		return err
+	}
+	if err := sc.setKey(next); err != nil {
+		return err
+	}
+	sc.generation++
+	return nil
+}
+
+// KeyExchange 一次X25519临时密钥交换
+type KeyExchange struct {
+	private *ecdh.PrivateKey
+}
+
+// NewKeyExchange 生成临时X25519密钥对
+func NewKeyExchange() (*KeyExchange, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate X25519 key: %w", err)
+	}
+	return &KeyExchange{private: private}, nil
+}
+
+// PublicKey 本端临时公钥
+func (kx *KeyExchange) PublicKey() []byte {
+	return kx.private.PublicKey().Bytes()
+}
+
+// SharedSecret 根据对端公钥计算共享密钥（拒绝低阶点）
+func (kx *KeyExchange) SharedSecret(peerPublic []byte) ([]byte, error) {
+	peer, err := ecdh.X25519().NewPublicKey(peerPublic)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer public key: %w", err)
+	}
+	secret, err := kx.private.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("key exchange failed: %w", err)
+	}
+	return secret, nil
+}
+
+// NewSessionCiphers 从X25519共享密钥派生会话密钥，返回本端的发送和接收加密器
+// PSK派生的密钥作为HKDF盐：没有PSK的中间人即使替换公钥也无法得到会话密钥
+// transcript为握手明文和双方公钥，将会话密钥绑定到本次握手
+func (c *Cipher) NewSessionCiphers(sharedSecret, transcript []byte, isClient bool, policy KeyRotationPolicy) (send, recv *SessionCipher, err error) {
+	info := append([]byte("multiexit-proxy-session"), transcript...)
+	return c.deriveSessionCiphers(hkdf.New(sha256.New, sharedSecret, c.encKey, info), isClient, policy)
+}
+
+// NewPSKSessionCiphers 为v2 PSK握手派生会话密钥，返回本端的发送和接收加密器
+// transcript（握手明文，含客户端随机nonce）和服务端随机盐使每个连接的密钥都不同，
+// 两个方向使用不同的密钥，记录序号nonce不会在连接或方向之间重复
+func (c *Cipher) NewPSKSessionCiphers(transcript, serverSalt []byte, isClient bool, policy KeyRotationPolicy) (send, recv *SessionCipher, err error) {
+	if len(serverSalt) != PSKSaltSize {
+		return nil, nil, fmt.Errorf("invalid server salt size: %d", len(serverSalt))
+	}
+	info := append([]byte("multiexit-proxy-psk-session"), transcript...)
+	return c.deriveSessionCiphers(hkdf.New(sha256.New, c.encKey, serverSalt, info), isClient, policy)
+}
+
+// deriveSessionCiphers 从HKDF输出依次读取客户端和服务端方向的密钥
+func (c *Cipher) deriveSessionCiphers(reader io.Reader, isClient bool, policy KeyRotationPolicy) (send, recv *SessionCipher, err error) {
+	clientKey := make([]byte, KeySize)
+	serverKey := make([]byte, KeySize)
+	if _, err := io.ReadFull(reader, clientKey); err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.ReadFull(reader, serverKey); err != nil {
+		return nil, nil, err
+	}
+
+	sendKey, recvKey := serverKey, clientKey
+	if isClient {
+		sendKey, recvKey = clientKey, serverKey
+	}
+
+	if send, err = newSessionCipher(sendKey, c.useAES, policy); err != nil {
+		return nil, nil, err
+	}
+	// 接收方向跟随对端的轮换信号，不使用本端策略
+	if recv, err = newSessionCipher(recvKey, c.useAES, KeyRotationPolicy{}); err != nil {
+		return nil, nil, err
+	}
+	return send, recv, nil
+}
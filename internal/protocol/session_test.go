@@ -0,0 +1,162 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+// newTestSessionPair 模拟一次X25519握手，返回客户端和服务端的（发送、接收）加密器
+func newTestSessionPair(t *testing.T, policy KeyRotationPolicy) (clientSend, clientRecv, serverSend, serverRecv *SessionCipher) {
+	cipher, err := NewCipher(DeriveKeyFromPSK("test-key"), true)
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+
+	clientKX, _ := NewKeyExchange()
+	serverKX, _ := NewKeyExchange()
+	transcript := append(clientKX.PublicKey(), serverKX.PublicKey()...)
+
+	clientSecret, err := clientKX.SharedSecret(serverKX.PublicKey())
+	if err != nil {
+		t.Fatalf("SharedSecret failed: %v", err)
+	}
+	serverSecret, err := serverKX.SharedSecret(clientKX.PublicKey())
+	if err != nil {
+		t.Fatalf("SharedSecret failed: %v", err)
+	}
+
+	clientSend, clientRecv, err = cipher.NewSessionCiphers(clientSecret, transcript, true, policy)
+	if err != nil {
+		t.Fatalf("NewSessionCiphers failed: %v", err)
+	}
+	serverSend, serverRecv, err = cipher.NewSessionCiphers(serverSecret, transcript, false, policy)
+	if err != nil {
+		t.Fatalf("NewSessionCiphers failed: %v", err)
+	}
+	return
+}
+
+func TestSessionCiphers_Exchange(t *testing.T) {
+	clientSend, clientRecv, serverSend, serverRecv := newTestSessionPair(t, KeyRotationPolicy{})
+
+	var wire bytes.Buffer
+	NewAEADWriter(&wire, clientSend).WriteRecord([]byte("hello server"))
+	got, err := NewAEADReader(&wire, serverRecv).ReadRecord()
+	if err != nil || string(got) != "hello server" {
+		t.Fatalf("Unexpected record %q (%v)", got, err)
+	}
+
+	NewAEADWriter(&wire, serverSend).WriteRecord([]byte("hello client"))
+	got, err = NewAEADReader(&wire, clientRecv).ReadRecord()
+	if err != nil || string(got) != "hello client" {
+		t.Fatalf("Unexpected record %q (%v)", got, err)
+	}
+
+	// 两个方向使用不同的密钥
+	if bytes.Equal(clientSend.key, clientRecv.key) {
+		t.Error("Send and receive keys should differ")
+	}
+}
+
+func TestSessionCiphers_WrongPSK(t *testing.T) {
+	// 相同的X25519共享密钥，但PSK不同
+	sharedSecret := bytes.Repeat([]byte{0x42}, 32)
+	cipher, _ := NewCipher(DeriveKeyFromPSK("test-key"), true)
+	other, _ := NewCipher(DeriveKeyFromPSK("other-key"), true)
+	clientSend, _, _ := cipher.NewSessionCiphers(sharedSecret, nil, true, KeyRotationPolicy{})
+	_, otherRecv, _ := other.NewSessionCiphers(sharedSecret, nil, false, KeyRotationPolicy{})
+
+	ciphertext, _ := clientSend.Encrypt([]byte("secret"))
+	if _, err := otherRecv.Decrypt(ciphertext); err == nil {
+		t.Error("Decrypt with keys derived from a different PSK should fail")
+	}
+}
+
+func TestPSKSessionCiphers_PerConnection(t *testing.T) {
+	cipher, _ := NewCipher(DeriveKeyFromPSK("test-key"), true)
+	salt := bytes.Repeat([]byte{0x01}, PSKSaltSize)
+
+	clientSend, clientRecv, err := cipher.NewPSKSessionCiphers([]byte("handshake-1"), salt, true, KeyRotationPolicy{})
+	if err != nil {
+		t.Fatalf("NewPSKSessionCiphers failed: %v", err)
+	}
+	_, serverRecv, _ := cipher.NewPSKSessionCiphers([]byte("handshake-1"), salt, false, KeyRotationPolicy{})
+	first, _ := clientSend.Encrypt([]byte("same plaintext"))
+	first = append([]byte(nil), first...)
+	if got, err := serverRecv.Decrypt(first); err != nil || string(got) != "same plaintext" {
+		t.Fatalf("Unexpected plaintext %q (%v)", got, err)
+	}
+	if bytes.Equal(clientSend.key, clientRecv.key) {
+		t.Error("Send and receive keys should differ")
+	}
+
+	// 不同的握手或服务端随机盐派生不同的密钥：相同明文的第一条记录密文不同
+	otherHandshake, _, _ := cipher.NewPSKSessionCiphers([]byte("handshake-2"), salt, true, KeyRotationPolicy{})
+	otherSalt, _, _ := cipher.NewPSKSessionCiphers([]byte("handshake-1"), bytes.Repeat([]byte{0x02}, PSKSaltSize), true, KeyRotationPolicy{})
+	for _, other := range []*SessionCipher{otherHandshake, otherSalt} {
+		ciphertext, _ := other.Encrypt([]byte("same plaintext"))
+		if bytes.Equal(ciphertext, first) {
+			t.Error("Different connections should produce different ciphertext")
+		}
+	}
+
+	if _, _, err := cipher.NewPSKSessionCiphers(nil, salt[:4], true, KeyRotationPolicy{}); err == nil {
+		t.Error("Expected error for short server salt")
+	}
+}
+
+func TestSessionCipher_RejectsReplay(t *testing.T) {
+	clientSend, _, _, serverRecv := newTestSessionPair(t, KeyRotationPolicy{})
+
+	first, _ := clientSend.Encrypt([]byte("first"))
+	first = append([]byte(nil), first...)
+	if _, err := serverRecv.Decrypt(first); err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	if _, err := serverRecv.Decrypt(first); err == nil {
+		t.Error("Replayed record should be rejected")
+	}
+}
+
+func TestSessionCipher_KeyRotation(t *testing.T) {
+	clientSend, _, _, serverRecv := newTestSessionPair(t, KeyRotationPolicy{MaxBytes: MaxRecordSize})
+
+	var wire bytes.Buffer
+	writer := NewAEADWriter(&wire, clientSend)
+	reader := NewAEADReader(&wire, serverRecv)
+
+	oldKey := append([]byte(nil), clientSend.key...)
+	data := bytes.Repeat([]byte("x"), MaxRecordSize)
+	for i := 0; i < 3; i++ {
+		if err := writer.WriteRecord(data); err != nil {
+			t.Fatalf("WriteRecord failed: %v", err)
+		}
+		got, err := reader.ReadRecord()
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("ReadRecord %d failed: %v", i, err)
+		}
+	}
+
+	// 每条记录达到字节预算，第2、3条记录前各轮换一次
+	if clientSend.Generation() != 2 || serverRecv.Generation() != 2 {
+		t.Errorf("Expected generation 2, got send=%d recv=%d", clientSend.Generation(), serverRecv.Generation())
+	}
+	if bytes.Equal(oldKey, clientSend.key) {
+		t.Error("Key should change after rotation")
+	}
+}
+
+func TestAEADReader_KeyUpdateRequiresSessionCipher(t *testing.T) {
+	clientSend, _, _, _ := newTestSessionPair(t, KeyRotationPolicy{MaxBytes: 1})
+
+	var wire bytes.Buffer
+	writer := NewAEADWriter(&wire, clientSend)
+	writer.WriteRecord([]byte("a"))
+	wire.Reset()
+	writer.WriteRecord([]byte("b")) // 带轮换标志
+
+	reader := NewAEADReader(&wire, newTestConnectionCipher(t))
+	if _, err := reader.ReadRecord(); err != ErrInvalidMessage {
+		t.Errorf("Expected ErrInvalidMessage, got %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	// udpFrameHeaderSize 数据报帧长度前缀
+	udpFrameHeaderSize = 2
+
+	// MaxUDPFrameSize 单个数据报帧的最大长度（不含长度前缀）
+	MaxUDPFrameSize = 0xFFFF
+)
+
+// UDPDatagram UDP关联中的数据报帧
+// 客户端发出时地址为目标地址，服务端返回时地址为数据报的来源地址
+// 编码格式：[2字节长度][地址类型][地址长度][地址][2字节端口][载荷]，长度前缀保证流式隧道（v2记录、多路复用流）中的数据报边界
+type UDPDatagram struct {
+	AddrType uint8
+	Address  []byte
+	Port     uint16
+	Payload  []byte
+}
+
+// NewUDPDatagram 根据地址字符串（host:port）创建数据报帧
+func NewUDPDatagram(addr string, payload []byte) (*UDPDatagram, error) {
+	addrType, address, err := ParseAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	_, portStr, _ := net.SplitHostPort(addr)
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, ErrInvalidMessage
+	}
+	return &UDPDatagram{AddrType: addrType, Address: address, Port: uint16(port), Payload: payload}, nil
+}
+
+// NewUDPDatagramFromAddr 根据UDP地址创建数据报帧（IPv4映射的IPv6地址按IPv4编码）
+func NewUDPDatagramFromAddr(addr *net.UDPAddr, payload []byte) *UDPDatagram {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		return &UDPDatagram{AddrType: AddrTypeIPv4, Address: ip4, Port: uint16(addr.Port), Payload: payload}
+	}
+	return &UDPDatagram{AddrType: AddrTypeIPv6, Address: addr.IP.To16(), Port: uint16(addr.Port), Payload: payload}
+}
+
+// Addr 数据报地址字符串（host:port）
+func (d *UDPDatagram) Addr() string {
+	return BuildAddress(d.AddrType, d.Address, d.Port)
+}
+
+// EncodeUDPDatagram 编码数据报帧（含长度前缀）
+func EncodeUDPDatagram(d *UDPDatagram) ([]byte, error) {
+	frameLen := 1 + 1 + len(d.Address) + 2 + len(d.Payload)
+	if len(d.Address) > 0xFF || frameLen > MaxUDPFrameSize {
+		return nil, ErrInvalidMessage
+	}
+
+	buf := make([]byte, udpFrameHeaderSize+frameLen)
+	binary.BigEndian.PutUint16(buf[0:2], uint16(frameLen))
+	buf[2] = d.AddrType
+	buf[3] = uint8(len(d.Address))
+	offset := 4 + copy(buf[4:], d.Address)
+	binary.BigEndian.PutUint16(buf[offset:offset+2], d.Port)
+	copy(buf[offset+2:], d.Payload)
+	return buf, nil
+}
+
+// DecodeUDPDatagram 解码数据报帧（不含长度前缀）
+func DecodeUDPDatagram(frame []byte) (*UDPDatagram, error) {
+	if len(frame) < 4 {
+		return nil, ErrInvalidMessage
+	}
+	addrLen := int(frame[1])
+	if len(frame) < 2+addrLen+2 {
+		return nil, ErrInvalidMessage
+	}
+	d := &UDPDatagram{
+		AddrType: frame[0],
+		Address:  frame[2 : 2+addrLen],
+		Port:     binary.BigEndian.Uint16(frame[2+addrLen : 4+addrLen]),
+		Payload:  frame[4+addrLen:],
+	}
+	switch d.AddrType {
+	case AddrTypeIPv4:
+		if addrLen != net.IPv4len {
+			return nil, ErrInvalidMessage
+		}
+	case AddrTypeIPv6:
+		if addrLen != net.IPv6len {
+			return nil, ErrInvalidMessage
+		}
+	case AddrTypeDomain:
+		if addrLen == 0 {
+			return nil, ErrInvalidMessage
+		}
+	default:
+		return nil, ErrInvalidMessage
+	}
+	return d, nil
+}
+
+// WriteUDPDatagram 编码并一次写入数据报帧（并发写入时调用方需加锁）
+func WriteUDPDatagram(w io.Writer, d *UDPDatagram) error {
+	buf, err := EncodeUDPDatagram(d)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// ReadUDPDatagram 读取一个数据报帧
+func ReadUDPDatagram(r io.Reader) (*UDPDatagram, error) {
+	var header [udpFrameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	frame := make([]byte, binary.BigEndian.Uint16(header[:]))
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return DecodeUDPDatagram(frame)
+}
+
+// EncodeUDPAssociateRequest 编码UDP关联请求（地址为0.0.0.0:0）
+func EncodeUDPAssociateRequest() []byte {
+	return EncodeConnectRequest(&ConnectRequest{
+		Type:     MsgTypeUDPAssociate,
+		AddrType: AddrTypeIPv4,
+		AddrLen:  net.IPv4len,
+		Address:  net.IPv4zero.To4(),
+	})
+}
@@ -0,0 +1,58 @@
+package protocol
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestUDPDatagramRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	addrs := []string{"1.2.3.4:53", "[2001:db8::1]:443", "example.com:27015"}
+	for _, addr := range addrs {
+		d, err := NewUDPDatagram(addr, []byte("payload-"+addr))
+		if err != nil {
+			t.Fatalf("NewUDPDatagram(%s) failed: %v", addr, err)
+		}
+		if err := WriteUDPDatagram(&buf, d); err != nil {
+			t.Fatalf("WriteUDPDatagram failed: %v", err)
+		}
+	}
+	// 空载荷的数据报同样保持边界
+	WriteUDPDatagram(&buf, NewUDPDatagramFromAddr(&net.UDPAddr{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 9}, nil))
+
+	for _, addr := range addrs {
+		d, err := ReadUDPDatagram(&buf)
+		if err != nil {
+			t.Fatalf("ReadUDPDatagram failed: %v", err)
+		}
+		if d.Addr() != addr || string(d.Payload) != "payload-"+addr {
+			t.Errorf("Got %s %q, want %s", d.Addr(), d.Payload, addr)
+		}
+	}
+	d, err := ReadUDPDatagram(&buf)
+	if err != nil || d.AddrType != AddrTypeIPv4 || d.Addr() != "10.0.0.1:9" || len(d.Payload) != 0 {
+		t.Errorf("Unexpected empty datagram %+v (%v)", d, err)
+	}
+}
+
+func TestDecodeUDPDatagramInvalid(t *testing.T) {
+	frames := [][]byte{
+		{AddrTypeIPv4, 4, 1, 2},                     // 地址截断
+		{AddrTypeIPv4, 3, 1, 2, 3, 0, 53},           // IPv4地址长度错误
+		{AddrTypeDomain, 0, 0, 53},                  // 空域名
+		{0x7F, 4, 1, 2, 3, 4, 0, 53, 'x', 'y', 'z'}, // 未知地址类型
+	}
+	for i, frame := range frames {
+		if _, err := DecodeUDPDatagram(frame); err == nil {
+			t.Errorf("Frame %d: expected error", i)
+		}
+	}
+}
+
+func TestEncodeUDPDatagramTooLarge(t *testing.T) {
+	d := &UDPDatagram{AddrType: AddrTypeIPv4, Address: net.IPv4(1, 2, 3, 4).To4(), Port: 53, Payload: make([]byte, MaxUDPFrameSize)}
+	if _, err := EncodeUDPDatagram(d); err == nil {
+		t.Error("Expected oversized datagram to fail")
+	}
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+
+	"multiexit-proxy/internal/protocol"
+)
+
+// aeadConn 使用v2记录分帧读写的连接（超时等方法由底层连接提供）
+type aeadConn struct {
+	net.Conn
+	reader *protocol.AEADReader
+	writer *protocol.AEADWriter
+}
+
+// newAEADConn 创建v2记录分帧连接（PSK握手时读写使用同一个加密上下文，会话密钥握手时分别使用两个方向的密钥）
+func newAEADConn(conn net.Conn, readCipher, writeCipher protocol.RecordCipher) *aeadConn {
+	return &aeadConn{
+		Conn:   conn,
+		reader: protocol.NewAEADReader(conn, readCipher),
+		writer: protocol.NewAEADWriter(conn, writeCipher),
+	}
+}
+
+// Read 读取解密后的数据
+func (c *aeadConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// Write 加密并写入数据
+func (c *aeadConn) Write(p []byte) (int, error) {
+	return c.writer.Write(p)
+}
+
+// legacyConn v1协议连接：每次读取的数据块单独解密，每次写入的数据单独加密
+type legacyConn struct {
+	net.Conn
+	cipher  *protocol.ConnectionCipher
+	readBuf []byte
+	pending []byte
+}
+
+// newLegacyConn 创建v1协议连接
+func newLegacyConn(conn net.Conn, cipher *protocol.ConnectionCipher) *legacyConn {
+	return &legacyConn{
+		Conn:    conn,
+		cipher:  cipher,
+		readBuf: make([]byte, 32*1024),
+	}
+}
+
+// Read 读取解密后的数据
+func (c *legacyConn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		n, err := c.Conn.Read(c.readBuf)
+		if n == 0 {
+			return 0, err
+		}
+		plaintext, decErr := c.cipher.Decrypt(c.readBuf[:n])
+		if decErr != nil {
+			return 0, decErr
+		}
+		c.pending = plaintext
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write 加密并写入数据
+func (c *legacyConn) Write(p []byte) (int, error) {
+	ciphertext, err := c.cipher.Encrypt(p)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.Conn.Write(ciphertext); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// newDataCiphers 为每种数据加密算法创建加密器（握手本身固定使用AES-256-GCM）
+func newDataCiphers(masterKey []byte) (map[protocol.CipherSuite]*protocol.Cipher, error) {
+	ciphers := make(map[protocol.CipherSuite]*protocol.Cipher)
+	for _, suite := range protocol.SupportedCipherSuites() {
+		cipher, err := protocol.NewCipher(masterKey, suite.UseAES())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s cipher: %w", suite, err)
+		}
+		ciphers[suite] = cipher
+	}
+	return ciphers, nil
+}
@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"multiexit-proxy/internal/protocol"
+	"multiexit-proxy/internal/snat"
+	"multiexit-proxy/pkg/socks5"
+)
+
+// bindAcceptTimeout BIND请求等待对端连入的超时时间
+const bindAcceptTimeout = 2 * time.Minute
+
+// errBindListenerClosed BIND监听器已关闭或已接受过连接
+var errBindListenerClosed = errors.New("bind listener closed")
+
+// handleBind 处理SOCKS5 BIND：服务端在选定的出口IP上监听，依次返回监听地址和连入的对端地址，之后双向转发
+func (c *Client) handleBind(localConn net.Conn, user, peerAddr string) error {
+	listener, err := c.BindUser(user, peerAddr)
+	if err != nil {
+		c.sendSOCKS5Response(localConn, 0x01)
+		return err
+	}
+	defer listener.Close()
+
+	bindAddr := listener.Addr().(*net.TCPAddr)
+	if err := c.sendSOCKS5ResponseAddr(localConn, 0x00, bindAddr.IP, bindAddr.Port); err != nil {
+		return err
+	}
+
+	peerConn, err := listener.Accept()
+	if err != nil {
+		c.sendSOCKS5Response(localConn, 0x01)
+		return fmt.Errorf("BIND failed: %w", err)
+	}
+	defer peerConn.Close()
+
+	peer := peerConn.RemoteAddr().(*net.TCPAddr)
+	if err := c.sendSOCKS5ResponseAddr(localConn, 0x00, peer.IP, peer.Port); err != nil {
+		return err
+	}
+	return relayConn(localConn, peerConn)
+}
+
+// Bind 请求服务端在为peerAddr选定的出口IP上监听随机端口（反向连接，如SOCKS BIND，需要协议v2）
+// 返回的监听器地址为服务端的监听地址；Accept等待对端连入，返回经隧道转发的连接（只接受一个连接）
+func (c *Client) Bind(peerAddr string) (net.Listener, error) {
+	return c.BindUser("", peerAddr)
+}
+
+// BindUser 同Bind，user为本地代理认证的用户名（为空表示未认证），服务端按用户选择出口IP
+func (c *Client) BindUser(user, peerAddr string) (net.Listener, error) {
+	if c.protocolVersion() != protocol.Version2 {
+		return nil, fmt.Errorf("BIND requires protocol v2")
+	}
+	reqData, err := buildRequest(protocol.MsgTypeBind, peerAddr, user)
+	if err != nil {
+		return nil, err
+	}
+	tunnel, err := c.openRequestTunnel(reqData, "BIND for "+peerAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err := protocol.ReadBindReply(tunnel)
+	if err != nil {
+		tunnel.Close()
+		return nil, fmt.Errorf("failed to read BIND address: %w", err)
+	}
+	return &bindListener{tunnel: tunnel, addr: addr}, nil
+}
+
+// socks4Server 处理本地SOCKS4/4a连接（CONNECT和BIND均经服务端转发，SOCKS4没有认证，配置了用户时拒绝）
+func (c *Client) socks4Server() *socks5.Server {
+	return &socks5.Server{
+		Authenticators: c.socks5Authenticators(),
+		IdentityDialFunc: func(identity *socks5.Identity, network, addr string) (net.Conn, error) {
+			return c.DialUser(identity.Username, addr)
+		},
+		BindFunc: func(identity *socks5.Identity, addr string) (net.Listener, error) {
+			return c.BindUser(identity.Username, addr)
+		},
+	}
+}
+
+// bindListener 服务端BIND监听在客户端的表示：隧道中的第二个响应为连入的对端地址，之后隧道转发对端连接的数据
+type bindListener struct {
+	tunnel   net.Conn
+	addr     *net.TCPAddr
+	mu       sync.Mutex
+	accepted bool
+	closed   bool
+}
+
+// Accept 等待对端连入服务端的监听地址
+func (l *bindListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if l.accepted || l.closed {
+		l.mu.Unlock()
+		return nil, errBindListenerClosed
+	}
+	l.mu.Unlock()
+
+	peer, err := protocol.ReadBindReply(l.tunnel)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, errBindListenerClosed
+	}
+	if err != nil {
+		return nil, err
+	}
+	l.accepted = true
+	return &bindConn{Conn: l.tunnel, remote: peer}, nil
+}
+
+// Close 关闭监听器（已接受的连接由调用方关闭）
+func (l *bindListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	if l.accepted {
+		return nil
+	}
+	return l.tunnel.Close()
+}
+
+// Addr 服务端的监听地址（出口IP和端口）
+func (l *bindListener) Addr() net.Addr {
+	return l.addr
+}
+
+// bindConn 经隧道转发的对端连接
+type bindConn struct {
+	net.Conn
+	remote *net.TCPAddr
+}
+
+// RemoteAddr 连入服务端的对端地址
+func (c *bindConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// prefixedConn 先返回已读取的数据，再从底层连接读取
+type prefixedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+// Read 读取数据
+func (c *prefixedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// listenBind 为client的反向连接选择出口IP（与连接peerAddr时的选择相同）并在出口IP上监听随机端口
+// 返回的出口IP非nil时已记录连接开始统计（正在排空的出口IP会等待该连接结束），调用方需在结束时调用recordConnEnd
+func (s *Server) listenBind(st serverState, client snat.ClientInfo, peerAddr string) (net.Listener, net.IP, error) {
+	host, portStr, err := net.SplitHostPort(peerAddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid peer address: %w", err)
+	}
+	peerPort, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid port: %w", err)
+	}
+
+	families, _, _ := targetFamilies(st, host, peerPort)
+	selectedIP, _, err := s.selectExitIPForTarget(st, client, peerAddr, host, peerPort, families)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.exitConnStart(st, selectedIP)
+	listener, err := s.listenEgressTCP(st, selectedIP)
+	if err != nil {
+		return nil, selectedIP, fmt.Errorf("failed to listen for BIND: %w", err)
+	}
+	return listener, selectedIP, nil
+}
+
+// serveBind 向客户端返回监听地址，等待对端连入后返回对端地址，然后在客户端侧连接和对端连接之间双向转发
+func (s *Server) serveBind(st serverState, clientConn net.Conn, listener net.Listener, peerAddr string, exitIP net.IP, bytesUp, bytesDown *int64) error {
+	s.connManager.ResetWriteDeadline(clientConn)
+	if err := protocol.WriteBindReply(clientConn, listener.Addr().(*net.TCPAddr)); err != nil {
+		return err
+	}
+
+	// 服务端关闭时停止等待
+	stop := context.AfterFunc(s.shutdownCtx, func() { listener.Close() })
+	defer stop()
+	if tcpListener, ok := listener.(*net.TCPListener); ok {
+		tcpListener.SetDeadline(time.Now().Add(bindAcceptTimeout))
+	}
+	peerConn, err := listener.Accept()
+	listener.Close()
+	if err != nil {
+		return fmt.Errorf("BIND accept failed: %w", err)
+	}
+	defer peerConn.Close()
+
+	peer := peerConn.RemoteAddr().(*net.TCPAddr)
+	if !bindPeerAllowed(peerAddr, peer) {
+		return fmt.Errorf("BIND connection from unexpected peer %s (expected %s)", peer, peerAddr)
+	}
+	s.connManager.ResetWriteDeadline(clientConn)
+	if err := protocol.WriteBindReply(clientConn, peer); err != nil {
+		return err
+	}
+
+	s.connManager.SetTimeouts(peerConn, st.config.Connection.ReadTimeout, st.config.Connection.WriteTimeout)
+	return s.relayWithStats(st, clientConn, peerConn, exitIP, bytesUp, bytesDown)
+}
+
+// bindPeerAllowed 检查连入的对端是否为BIND请求中指定的地址（请求中为域名或未指定地址时不检查）
+func bindPeerAllowed(peerAddr string, peer *net.TCPAddr) bool {
+	host, _, err := net.SplitHostPort(peerAddr)
+	if err != nil {
+		return false
+	}
+	expected := net.ParseIP(host)
+	if expected == nil || expected.IsUnspecified() {
+		return true
+	}
+	return peer != nil && peer.IP.Equal(expected)
+}
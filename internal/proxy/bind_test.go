@@ -0,0 +1,266 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"multiexit-proxy/internal/auth"
+	"multiexit-proxy/internal/protocol"
+	"multiexit-proxy/internal/snat"
+)
+
+// startLocalSOCKSClient 启动使用多路复用会话连接服务端的客户端，返回本地SOCKS监听地址（users非nil时要求认证）
+func startLocalSOCKSClient(t *testing.T, s *Server, cipher *protocol.Cipher, users *auth.UserManager) string {
+	muxConn, muxServerConn := net.Pipe()
+	go s.handleConn(muxServerConn)
+	client := &Client{config: &ClientConfig{Users: users}, cipher: cipher, ciphers: s.ciphers}
+	client.config.Mux.Enabled = true
+	readCipher, writeCipher, err := client.handshake(muxConn, protocol.HandshakeFlagMux)
+	if err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	client.muxSession = newMuxSession(muxConn, readCipher, writeCipher, true)
+	t.Cleanup(func() { client.muxSession.Close() })
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go client.handleLocalConn(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// connectBack 作为BIND的对端连入服务端的监听地址，发送data后读取回复
+func connectBack(t *testing.T, addr *net.TCPAddr, data, want string) {
+	conn, err := net.DialTCP("tcp", nil, addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to BIND address %s: %v", addr, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(data)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	reply := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != want {
+		t.Errorf("Peer got %q (%v), want %q", reply, err, want)
+	}
+}
+
+func TestServer_HandleConnBind(t *testing.T) {
+	s, cipher := newTunnelTestServer(t)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go s.handleConn(serverConn)
+
+	client := &Client{config: &ClientConfig{}, cipher: cipher, ciphers: s.ciphers}
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	readCipher, writeCipher, err := client.handshake(clientConn, 0)
+	if err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	tunnel := newAEADConn(clientConn, readCipher, writeCipher)
+	reqData, err := buildRequest(protocol.MsgTypeBind, "127.0.0.1:0", "")
+	if err != nil {
+		t.Fatalf("buildRequest failed: %v", err)
+	}
+	tunnel.writer.WriteRecord(reqData)
+	if response, err := tunnel.reader.ReadRecord(); err != nil || len(response) != 1 || response[0] != 0x00 {
+		t.Fatalf("Unexpected response %v (%v)", response, err)
+	}
+
+	// 监听在选定的出口IP上，出口IP计入连接数（排空时等待）
+	bindAddr, err := protocol.ReadBindReply(tunnel)
+	if err != nil {
+		t.Fatalf("ReadBindReply failed: %v", err)
+	}
+	if !bindAddr.IP.Equal(net.IPv4(127, 0, 0, 1)) || bindAddr.Port == 0 {
+		t.Errorf("Expected listener on exit IP 127.0.0.1, got %s", bindAddr)
+	}
+	if active := s.exitPool.activeConnections("127.0.0.1"); active != 1 {
+		t.Errorf("Exit IP has %d active connections while waiting for the peer, want 1", active)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		connectBack(t, bindAddr, "ping", "pong")
+	}()
+
+	peerAddr, err := protocol.ReadBindReply(tunnel)
+	if err != nil {
+		t.Fatalf("ReadBindReply failed: %v", err)
+	}
+	if !peerAddr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Unexpected peer address %s", peerAddr)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(tunnel, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("Tunnel got %q (%v), want ping", buf, err)
+	}
+	tunnel.Write([]byte("pong"))
+	<-done
+}
+
+func TestClient_SOCKS5Bind(t *testing.T) {
+	s, cipher := newTunnelTestServer(t)
+	socksAddr := startLocalSOCKSClient(t, s, cipher, nil)
+
+	control, err := net.Dial("tcp", socksAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer control.Close()
+	control.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// 无认证协商 + BIND 127.0.0.1:0（预期的对端）
+	control.Write([]byte{0x05, 0x01, 0x00})
+	control.Write([]byte{0x05, socks5CmdBind, 0x00, socks5AddrIPv4, 127, 0, 0, 1, 0, 0})
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(control, reply); err != nil {
+		t.Fatalf("Failed to read SOCKS5 reply: %v", err)
+	}
+	if reply[3] != 0x00 || reply[5] != socks5AddrIPv4 {
+		t.Fatalf("Unexpected SOCKS5 reply: %v", reply)
+	}
+	bindAddr := &net.TCPAddr{IP: net.IP(reply[6:10]), Port: int(reply[10])<<8 | int(reply[11])}
+	if !bindAddr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Expected BIND address on exit IP 127.0.0.1, got %s", bindAddr)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		connectBack(t, bindAddr, "ping", "pong")
+	}()
+
+	// 第二个响应为连入的对端地址
+	second := make([]byte, 10)
+	if _, err := io.ReadFull(control, second); err != nil || second[1] != 0x00 {
+		t.Fatalf("Unexpected second SOCKS5 reply %v (%v)", second, err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(control, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("Control got %q (%v), want ping", buf, err)
+	}
+	control.Write([]byte("pong"))
+	<-done
+}
+
+func TestClient_SOCKS4Connect(t *testing.T) {
+	s, cipher := newTunnelTestServer(t)
+	echoAddr := startEchoServer(t)
+	socksAddr := startLocalSOCKSClient(t, s, cipher, nil)
+
+	conn, err := net.Dial("tcp", socksAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	target := mustResolveTCP(t, echoAddr)
+	request := []byte{0x04, 0x01, byte(target.Port >> 8), byte(target.Port)}
+	request = append(request, target.IP.To4()...)
+	request = append(request, 0x00) // 空USERID
+	conn.Write(request)
+
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0x5A {
+		t.Fatalf("Unexpected SOCKS4 reply %v (%v)", reply, err)
+	}
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("Echo got %q (%v)", buf, err)
+	}
+}
+
+// clientRecordingSelector 记录选择出口IP时的客户端，总是选择127.0.0.1
+type clientRecordingSelector struct {
+	users chan string
+}
+
+func (r *clientRecordingSelector) SelectIP(targetAddr string, targetPort int) (net.IP, error) {
+	return r.SelectIPForClient(snat.ClientInfo{}, targetAddr, targetPort, snat.FamilyAny)
+}
+
+func (r *clientRecordingSelector) SelectIPForClient(client snat.ClientInfo, targetAddr string, targetPort int, family snat.IPFamily) (net.IP, error) {
+	r.users <- client.User
+	return net.IPv4(127, 0, 0, 1), nil
+}
+
+func TestClient_SOCKS5UserReachesServer(t *testing.T) {
+	s, cipher := newTunnelTestServer(t)
+	selector := &clientRecordingSelector{users: make(chan string, 1)}
+	s.ipSelector = selector
+	echoAddr := startEchoServer(t)
+
+	users := auth.NewUserManager()
+	if err := users.AddUser("alice", "secret", 0, nil); err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+	socksAddr := startLocalSOCKSClient(t, s, cipher, users)
+
+	conn, err := net.Dial("tcp", socksAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// 用户名/密码认证（RFC 1929）
+	conn.Write([]byte{0x05, 0x01, 0x02})
+	conn.Write([]byte{0x01, 5, 'a', 'l', 'i', 'c', 'e', 6, 's', 'e', 'c', 'r', 'e', 't'})
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0x02 || reply[3] != 0x00 {
+		t.Fatalf("Authentication failed: %v (%v)", reply, err)
+	}
+
+	target := mustResolveTCP(t, echoAddr)
+	request := []byte{0x05, 0x01, 0x00, socks5AddrIPv4}
+	request = append(request, target.IP.To4()...)
+	request = append(request, byte(target.Port>>8), byte(target.Port))
+	conn.Write(request)
+	response := make([]byte, 10)
+	if _, err := io.ReadFull(conn, response); err != nil || response[1] != 0x00 {
+		t.Fatalf("Unexpected SOCKS5 reply %v (%v)", response, err)
+	}
+
+	// 服务端按认证的用户选择出口IP
+	select {
+	case user := <-selector.users:
+		if user != "alice" {
+			t.Errorf("Selector saw user %q, want alice", user)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Selector was not called")
+	}
+
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("Echo got %q (%v)", buf, err)
+	}
+}
+
+// mustResolveTCP 解析TCP地址
+func mustResolveTCP(t *testing.T, addr string) *net.TCPAddr {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		t.Fatalf("ResolveTCPAddr(%s) failed: %v", addr, err)
+	}
+	return tcpAddr
+}
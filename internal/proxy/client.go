@@ -1,51 +1,86 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"multiexit-proxy/internal/auth"
 	"multiexit-proxy/internal/protocol"
 	"multiexit-proxy/internal/transport"
+	"multiexit-proxy/pkg/httpproxy"
+	"multiexit-proxy/pkg/socks5"
+	"multiexit-proxy/pkg/tproxy"
 
 	"github.com/sirupsen/logrus"
 )
 
 // Client 代理客户端
 type Client struct {
-	config       *ClientConfig
-	cipher       *protocol.Cipher
-	serverConn   net.Conn
-	reconnectMgr *ReconnectManager
-	connPool     *ConnectionPool // 连接池（可选）
+	config        *ClientConfig
+	cipher        *protocol.Cipher                          // 握手加密器（固定为AES-256-GCM）
+	ciphers       map[protocol.CipherSuite]*protocol.Cipher // 可协商的数据加密器
+	serverConn    net.Conn
+	reconnectMgr  *ReconnectManager
+	connPool      *ConnectionPool // 连接池（可选）
+	listeners     []io.Closer     // 本地监听器（SOCKS5、HTTP、透明代理）
+	listenerMu    sync.Mutex
+	tproxyRouting *tproxy.Routing // 透明代理策略路由（配置了fwmark时）
+	closed        int32           // 原子操作，是否已停止
+	muxSession    *MuxSession     // 多路复用会话（启用mux时）
+	muxMu         sync.Mutex
 }
 
 // ClientConfig 客户端配置
 type ClientConfig struct {
-	ServerAddr string
-	SNI        string
-	AuthKey    string
-	LocalAddr  string
-	Reconnect  *ReconnectConfig // 重连配置
-	Pool       struct {
+	ServerAddr      string
+	SNI             string
+	AuthKey         string
+	LocalAddr       string
+	ProtocolVersion uint8                      // 协议版本（0表示默认v2，设为protocol.Version兼容旧服务端）
+	HandshakeMethod uint8                      // 握手方法（0表示protocol.MethodPSK，protocol.MethodX25519启用前向安全）
+	CipherSuites    []protocol.CipherSuite     // v2支持的数据加密算法，按偏好排序（空表示按本机是否有AES硬件加速自动排序）
+	KeyRotation     protocol.KeyRotationPolicy // X25519会话中客户端发送方向的密钥轮换策略
+	Reconnect       *ReconnectConfig           // 重连配置
+	Pool            struct {
 		Enabled     bool
 		MaxSize     int
 		MaxIdle     int
 		IdleTimeout time.Duration
 	}
+	Mux struct {
+		Enabled bool // 所有请求复用同一条加密会话
+	}
+	HTTPAddr    string // 本地HTTP代理监听地址（为空表示不启用）
+	Transparent struct {
+		Addr  string // 透明代理监听地址（为空表示不启用，仅Linux）
+		Mode  string // tproxy.ModeRedirect 或 tproxy.ModeTProxy
+		UDP   bool   // 转发UDP（仅TPROXY模式，需要协议v2）
+		Mark  int    // TPROXY的fwmark，非0时启动时添加策略路由、停止时删除
+		Table int    // 策略路由表
+	}
+	Users *auth.UserManager // 本地代理用户（为nil表示不认证）
 }
 
 // NewClient 创建代理客户端
 func NewClient(config *ClientConfig) (*Client, error) {
-	// 创建加密器（优先使用AES-GCM硬件加速）
+	// 创建加密器（握手和v1固定使用AES-GCM，v2握手后的数据按协商结果选择）
 	masterKey := protocol.DeriveKeyFromPSK(config.AuthKey)
-	cipher, err := protocol.NewCipher(masterKey, true) // true = 使用AES-GCM
+	ciphers, err := newDataCiphers(masterKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %w", err)
+		return nil, err
+	}
+	cipher := ciphers[protocol.CipherAES256GCM]
+
+	if config.HandshakeMethod == protocol.MethodX25519 && config.ProtocolVersion == protocol.Version {
+		return nil, fmt.Errorf("X25519 handshake requires protocol v2")
 	}
 
 	// 创建重连管理器
@@ -93,80 +128,205 @@ func NewClient(config *ClientConfig) (*Client, error) {
 	return &Client{
 		config:       config,
 		cipher:       cipher,
+		ciphers:      ciphers,
 		reconnectMgr: reconnectMgr,
 		connPool:     connPool,
 	}, nil
 }
 
-// Start 启动客户端
+// Start 启动客户端（本地SOCKS5、HTTP和透明代理入站共用到服务端的连接）
 func (c *Client) Start() error {
+	var serves []func() error
+
 	// 创建本地SOCKS5监听器
-	listener, err := net.Listen("tcp", c.config.LocalAddr)
-	if err != nil {
-		return fmt.Errorf("failed to listen on %s: %w", c.config.LocalAddr, err)
+	if c.config.LocalAddr != "" {
+		listener, err := net.Listen("tcp", c.config.LocalAddr)
+		if err != nil {
+			c.closeListeners()
+			return fmt.Errorf("failed to listen on %s: %w", c.config.LocalAddr, err)
+		}
+		c.addListener(listener)
+		serves = append(serves, func() error {
+			return c.serve(listener, c.handleLocalConn)
+		})
+	}
+
+	// 创建本地HTTP代理监听器
+	if c.config.HTTPAddr != "" {
+		httpListener, err := net.Listen("tcp", c.config.HTTPAddr)
+		if err != nil {
+			c.closeListeners()
+			return fmt.Errorf("failed to listen on %s: %w", c.config.HTTPAddr, err)
+		}
+		c.addListener(httpListener)
+
+		httpServer := httpproxy.NewServer(func(network, addr string) (net.Conn, error) {
+			return c.Dial(addr)
+		})
+		if c.config.Users != nil {
+			httpServer.Authenticate = httpproxy.NewUserManagerAuth(c.config.Users)
+		}
+		logrus.Infof("Local HTTP proxy listening on %s", c.config.HTTPAddr)
+		serves = append(serves, func() error {
+			return c.serve(httpListener, httpServer.HandleConn)
+		})
+	}
+
+	// 创建透明代理监听器
+	if c.config.Transparent.Addr != "" {
+		transparentServes, err := c.startTransparent()
+		if err != nil {
+			c.closeListeners()
+			return err
+		}
+		serves = append(serves, transparentServes...)
+	}
+
+	if len(serves) == 0 {
+		return fmt.Errorf("no local listen address configured")
+	}
+	for _, serve := range serves[1:] {
+		go serve()
 	}
+	return serves[0]()
+}
+
+// addListener 记录本地监听器，停止时关闭
+func (c *Client) addListener(listener io.Closer) {
+	c.listenerMu.Lock()
+	c.listeners = append(c.listeners, listener)
+	c.listenerMu.Unlock()
+}
+
+// closeListeners 关闭所有本地监听器
+func (c *Client) closeListeners() {
+	c.listenerMu.Lock()
+	for _, listener := range c.listeners {
+		listener.Close()
+	}
+	c.listeners = nil
+	c.listenerMu.Unlock()
+}
+
+// serve 接受本地连接并交给handle处理，客户端停止后返回
+func (c *Client) serve(listener net.Listener, handle func(net.Conn) error) error {
 	defer listener.Close()
 
 	for {
 		localConn, err := listener.Accept()
 		if err != nil {
+			// 已停止，退出循环
+			if atomic.LoadInt32(&c.closed) == 1 {
+				return nil
+			}
 			continue
 		}
 
-		go c.handleLocalConn(localConn)
+		go handle(localConn)
 	}
 }
 
-// handleLocalConn 处理本地连接
+// Stop 停止客户端（关闭本地监听器和连接池）
+func (c *Client) Stop() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return nil
+	}
+	c.closeListeners()
+	if c.tproxyRouting != nil {
+		c.tproxyRouting.Cleanup()
+	}
+	c.muxMu.Lock()
+	if c.muxSession != nil {
+		c.muxSession.Close()
+	}
+	c.muxMu.Unlock()
+	if c.connPool != nil {
+		return c.connPool.Close()
+	}
+	return nil
+}
+
+// handleLocalConn 处理本地SOCKS5连接（SOCKS4/4a连接交给socks4Server处理）
 func (c *Client) handleLocalConn(localConn net.Conn) error {
 	defer localConn.Close()
 
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(localConn, version); err != nil {
+		return err
+	}
+	localConn = &prefixedConn{Conn: localConn, reader: io.MultiReader(bytes.NewReader(version), localConn)}
+	if version[0] == socks5.Version4 {
+		return c.socks4Server().HandleConn(localConn)
+	}
+
 	// 读取SOCKS5请求
-	addr, err := c.readSOCKS5Request(localConn)
+	cmd, addr, user, err := c.readSOCKS5Request(localConn)
 	if err != nil {
 		return err
 	}
+	switch cmd {
+	case socks5CmdUDPAssociate:
+		return c.handleUDPAssociate(localConn)
+	case socks5CmdBind:
+		return c.handleBind(localConn, user, addr)
+	}
 
-	// 连接到服务端（带重连和连接池）
-	var serverConn net.Conn
-	// 使用可取消的上下文（支持超时和取消）
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+	targetConn, err := c.DialUser(user, addr)
+	if err != nil {
+		c.sendSOCKS5Response(localConn, 0x05) // 连接失败
+		return err
+	}
+	defer targetConn.Close()
 
-	// 如果启用了连接池，优先使用连接池
-	if c.connPool != nil {
-		pooledConn, err := c.connPool.Get(ctx)
-		if err == nil {
-			serverConn = pooledConn
-			defer func() {
-				// 连接使用完毕后归还到池中
-				if pooledConn, ok := serverConn.(*PooledConnection); ok {
-					c.connPool.Return(pooledConn)
-				} else {
-					serverConn.Close()
-				}
-			}()
-		} else {
-			// 连接池获取失败，回退到直接连接
-			logrus.Debugf("Failed to get connection from pool: %v, falling back to direct connection", err)
+	// 发送SOCKS5成功响应
+	if err := c.sendSOCKS5Response(localConn, 0x00); err != nil {
+		return err
+	}
+
+	return relayConn(localConn, targetConn)
+}
+
+// Dial 经服务端建立到目标地址的连接，本地SOCKS5和HTTP代理入站共用
+// 返回的连接读写目标的明文数据，加密、分帧和多路复用由客户端完成
+func (c *Client) Dial(addr string) (net.Conn, error) {
+	return c.DialUser("", addr)
+}
+
+// DialUser 同Dial，user为本地代理认证的用户名（为空表示未认证），随连接请求发送给服务端，服务端按用户选择出口IP
+func (c *Client) DialUser(user, addr string) (net.Conn, error) {
+	reqData, err := buildRequest(protocol.MsgTypeConnect, addr, user)
+	if err != nil {
+		return nil, err
+	}
+
+	// 多路复用模式：在共享会话上打开新流
+	if c.config.Mux.Enabled {
+		stream, err := c.openMuxStream(reqData, addr)
+		if err != nil {
+			return nil, err
 		}
+		return stream, nil
 	}
 
-	// 如果没有使用连接池，使用重连管理器连接
-	if serverConn == nil {
-		err = c.reconnectMgr.Do(ctx, func() error {
-			conn, err := c.connectToServer()
-			if err != nil {
-				return err
-			}
-			serverConn = conn
-			return nil
-		})
+	// 连接到服务端（带重连和连接池）
+	serverConn, err := c.getServerConn()
+	if err != nil {
+		return nil, err
+	}
+
+	// v2：连接请求和数据均使用AEAD记录分帧
+	if c.protocolVersion() == protocol.Version2 {
+		readCipher, writeCipher, err := c.handshake(serverConn, 0)
 		if err != nil {
-			c.sendSOCKS5Response(localConn, 0x05) // 连接失败
-			return fmt.Errorf("failed to connect to server after retries: %w", err)
+			serverConn.Close()
+			return nil, err
 		}
-		defer serverConn.Close()
+		tunnel, err := c.connectV2(serverConn, reqData, addr, readCipher, writeCipher)
+		if err != nil {
+			serverConn.Close()
+			return nil, err
+		}
+		return tunnel, nil
 	}
 
 	// 为每个连接创建独立的加密上下文（避免nonce冲突，提升并发性能）
@@ -174,41 +334,223 @@ func (c *Client) handleLocalConn(localConn net.Conn) error {
 
 	// 发送握手消息
 	if err := c.sendHandshakeWithCipher(serverConn, connCipher); err != nil {
-		c.sendSOCKS5Response(localConn, 0x05)
-		return err
+		serverConn.Close()
+		return nil, err
 	}
 
 	// 发送连接请求
-	if err := c.sendConnectRequestWithCipher(serverConn, addr, connCipher); err != nil {
-		c.sendSOCKS5Response(localConn, 0x05)
-		return err
+	ciphertext, err := connCipher.Encrypt(reqData)
+	if err == nil {
+		_, err = serverConn.Write(ciphertext)
+	}
+	if err != nil {
+		serverConn.Close()
+		return nil, err
 	}
 
 	// 读取响应
 	response, err := c.readResponseWithCipher(serverConn, connCipher)
-	if err != nil || response[0] != 0x00 {
-		c.sendSOCKS5Response(localConn, 0x05)
-		return fmt.Errorf("server rejected connection")
+	if err != nil || len(response) == 0 || response[0] != 0x00 {
+		serverConn.Close()
+		return nil, fmt.Errorf("server rejected connection to %s", addr)
 	}
 
-	// 发送SOCKS5成功响应
-	if err := c.sendSOCKS5Response(localConn, 0x00); err != nil {
-		return err
+	return newLegacyConn(serverConn, connCipher), nil
+}
+
+// getServerConn 获取到服务端的连接：启用连接池时优先从池中获取（关闭时归还），否则使用重连管理器连接
+func (c *Client) getServerConn() (net.Conn, error) {
+	if c.connPool != nil {
+		// 使用可取消的上下文（支持超时和取消）
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		pooledConn, err := c.connPool.Get(ctx)
+		if err == nil {
+			return &pooledServerConn{PooledConnection: pooledConn, pool: c.connPool}, nil
+		}
+		// 连接池获取失败，回退到直接连接
+		logrus.Debugf("Failed to get connection from pool: %v, falling back to direct connection", err)
 	}
 
-	// 双向转发数据
+	return c.dialServerWithRetry()
+}
+
+// pooledServerConn 从连接池获取的服务端连接，关闭时归还到池中
+type pooledServerConn struct {
+	*PooledConnection
+	pool *ConnectionPool
+}
+
+// Close 归还连接到池中
+func (pc *pooledServerConn) Close() error {
+	pc.pool.Return(pc.PooledConnection)
+	return nil
+}
+
+// relayConn 在本地连接和隧道之间双向转发数据，任一方向结束即返回
+func relayConn(localConn, tunnel net.Conn) error {
 	errCh := make(chan error, 2)
 
 	go func() {
-		errCh <- c.copyDataWithCipher(serverConn, localConn, connCipher, true)
+		buf := bufferPool.Get().([]byte)
+		defer bufferPool.Put(buf)
+		_, err := io.CopyBuffer(tunnel, localConn, buf)
+		errCh <- err
 	}()
 
 	go func() {
-		errCh <- c.copyDataWithCipher(localConn, serverConn, connCipher, false)
+		buf := bufferPool.Get().([]byte)
+		defer bufferPool.Put(buf)
+		_, err := io.CopyBuffer(localConn, tunnel, buf)
+		errCh <- err
 	}()
 
-	err = <-errCh
-	return err
+	return <-errCh
+}
+
+// openRequestTunnel 发送请求（UDP关联、BIND等）并在服务端接受后返回隧道（多路复用模式下为会话中的流，否则为独立的v2连接）
+// name仅用于错误信息
+func (c *Client) openRequestTunnel(reqData []byte, name string) (net.Conn, error) {
+	if c.config.Mux.Enabled {
+		stream, err := c.openMuxStreamWith(func(session *MuxSession) (*MuxStream, error) {
+			return session.openStream(reqData, name)
+		})
+		if err == ErrMuxStreamRejected {
+			return nil, fmt.Errorf("server rejected %s", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return stream, nil
+	}
+
+	serverConn, err := c.dialServerWithRetry()
+	if err != nil {
+		return nil, err
+	}
+	readCipher, writeCipher, err := c.handshake(serverConn, 0)
+	if err != nil {
+		serverConn.Close()
+		return nil, err
+	}
+
+	tunnel := newAEADConn(serverConn, readCipher, writeCipher)
+	if err := tunnel.writer.WriteRecord(reqData); err != nil {
+		serverConn.Close()
+		return nil, err
+	}
+	response, err := tunnel.reader.ReadRecord()
+	if err != nil || len(response) == 0 || response[0] != 0x00 {
+		serverConn.Close()
+		return nil, fmt.Errorf("server rejected %s", name)
+	}
+	return tunnel, nil
+}
+
+// openMuxStream 在多路复用会话上发送到目标地址addr的连接请求reqData打开流，会话失效时重建一次
+func (c *Client) openMuxStream(reqData []byte, addr string) (*MuxStream, error) {
+	stream, err := c.openMuxStreamWith(func(session *MuxSession) (*MuxStream, error) {
+		return session.openStream(reqData, addr)
+	})
+	if err == ErrMuxStreamRejected {
+		return nil, fmt.Errorf("server rejected connection to %s", addr)
+	}
+	return stream, err
+}
+
+// openMuxStreamWith 使用open在多路复用会话上打开流，会话失效时重建一次（对端拒绝时返回ErrMuxStreamRejected）
+func (c *Client) openMuxStreamWith(open func(*MuxSession) (*MuxStream, error)) (*MuxStream, error) {
+	var lastErr error
+	for attempt := 0; attempt < 2; attempt++ {
+		session, err := c.getMuxSession()
+		if err != nil {
+			return nil, err
+		}
+
+		stream, err := open(session)
+		if err == nil {
+			return stream, nil
+		}
+		if err == ErrMuxStreamRejected {
+			return nil, err
+		}
+
+		// 会话失效，关闭后重建
+		lastErr = err
+		session.Close()
+	}
+	return nil, fmt.Errorf("failed to open mux stream: %w", lastErr)
+}
+
+// getMuxSession 获取多路复用会话，不存在或已关闭时重新建立
+func (c *Client) getMuxSession() (*MuxSession, error) {
+	c.muxMu.Lock()
+	defer c.muxMu.Unlock()
+
+	if c.muxSession != nil && !c.muxSession.IsClosed() {
+		return c.muxSession, nil
+	}
+
+	serverConn, err := c.dialServerWithRetry()
+	if err != nil {
+		return nil, err
+	}
+
+	readCipher, writeCipher, err := c.handshake(serverConn, protocol.HandshakeFlagMux)
+	if err != nil {
+		serverConn.Close()
+		return nil, err
+	}
+
+	c.muxSession = newMuxSession(serverConn, readCipher, writeCipher, true)
+	logrus.Debugf("Mux session established to %s", c.config.ServerAddr)
+	return c.muxSession, nil
+}
+
+// dialServerWithRetry 使用重连管理器连接服务端
+func (c *Client) dialServerWithRetry() (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var serverConn net.Conn
+	err := c.reconnectMgr.Do(ctx, func() error {
+		conn, err := c.connectToServer()
+		if err != nil {
+			return err
+		}
+		serverConn = conn
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to server after retries: %w", err)
+	}
+	return serverConn, nil
+}
+
+// connectV2 使用v2记录分帧发送到目标地址addr的连接请求reqData，服务端接受后返回隧道连接
+func (c *Client) connectV2(serverConn net.Conn, reqData []byte, addr string, readCipher, writeCipher protocol.RecordCipher) (*aeadConn, error) {
+	tunnel := newAEADConn(serverConn, readCipher, writeCipher)
+
+	// 发送连接请求
+	if err := tunnel.writer.WriteRecord(reqData); err != nil {
+		return nil, err
+	}
+
+	// 读取响应
+	response, err := tunnel.reader.ReadRecord()
+	if err != nil || len(response) == 0 || response[0] != 0x00 {
+		return nil, fmt.Errorf("server rejected connection to %s", addr)
+	}
+	return tunnel, nil
+}
+
+// protocolVersion 获取使用的协议版本
+func (c *Client) protocolVersion() uint8 {
+	if c.config.ProtocolVersion == 0 {
+		return protocol.Version2
+	}
+	return c.config.ProtocolVersion
 }
 
 // connectToServer 连接到服务端
@@ -226,13 +568,29 @@ func (c *Client) sendHandshake(conn net.Conn) error {
 
 // sendHandshakeWithCipher 使用指定的加密上下文发送握手消息
 func (c *Client) sendHandshakeWithCipher(conn net.Conn, cipher *protocol.ConnectionCipher) error {
+	return c.sendHandshakeWithFlags(conn, cipher, 0)
+}
+
+// sendHandshakeWithFlags 发送带标志位的PSK握手消息（标志位见protocol.HandshakeFlag*）
+func (c *Client) sendHandshakeWithFlags(conn net.Conn, cipher *protocol.ConnectionCipher, flags uint16) error {
+	_, ciphertext, err := c.encodeHandshake(cipher, protocol.MethodPSK, flags)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(ciphertext)
+	return err
+}
+
+// encodeHandshake 构建握手消息，返回明文和加密后的数据
+func (c *Client) encodeHandshake(cipher *protocol.ConnectionCipher, method uint8, flags uint16) ([]byte, []byte, error) {
 	nonce := make([]byte, 16)
 	rand.Read(nonce)
 
 	handshake := &protocol.HandshakeMessage{
-		Version:   protocol.Version,
-		Method:    0x01,
-		Reserved:  0x0000,
+		Version:   c.protocolVersion(),
+		Method:    method,
+		Reserved:  flags,
 		Nonce:     [16]byte(nonce),
 		Timestamp: time.Now().Unix(),
 	}
@@ -241,15 +599,110 @@ func (c *Client) sendHandshakeWithCipher(conn net.Conn, cipher *protocol.Connect
 	handshakeData := protocol.EncodeHandshake(handshake)
 	handshake.HMAC = [4]byte(c.cipher.ComputeHMAC(handshakeData[:28]))
 
-	// 加密并发送（使用连接级加密上下文）
+	// 加密（使用连接级加密上下文）
 	encrypted := protocol.EncodeHandshake(handshake)
 	ciphertext, err := cipher.Encrypt(encrypted)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
+	return encrypted, ciphertext, nil
+}
 
-	_, err = conn.Write(ciphertext)
-	return err
+// handshake 完成v2握手，返回隧道的读写加密器
+// 握手时广播支持的数据加密算法，服务端回复选择的算法（PSK握手时后跟服务端随机盐，X25519握手时附在服务端公钥之后）
+// PSK握手时使用由握手随机数和服务端随机盐派生的两个方向的密钥；X25519握手时使用本会话派生的两个方向的密钥
+func (c *Client) handshake(conn net.Conn, flags uint16) (readCipher, writeCipher protocol.RecordCipher, err error) {
+	suites := c.cipherSuites()
+	flags |= protocol.EncodeCipherSuites(suites)
+
+	if c.config.HandshakeMethod != protocol.MethodX25519 {
+		handshakeData, ciphertext, err := c.encodeHandshake(protocol.NewConnectionCipher(c.cipher), protocol.MethodPSK, flags)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := conn.Write(ciphertext); err != nil {
+			return nil, nil, err
+		}
+
+		// 1字节算法协商结果 + 服务端随机盐
+		reply := make([]byte, 1+protocol.PSKSaltSize)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return nil, nil, fmt.Errorf("failed to read cipher negotiation: %w", err)
+		}
+		suiteReply, salt := reply[:1], reply[1:]
+		dataCipher, err := c.negotiatedCipher(suites, suiteReply[0])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		transcript := append(append([]byte{}, handshakeData...), suiteReply...)
+		send, recv, err := dataCipher.NewPSKSessionCiphers(transcript, salt, true, c.config.KeyRotation)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to derive session keys: %w", err)
+		}
+		return recv, send, nil
+	}
+
+	kx, err := protocol.NewKeyExchange()
+	if err != nil {
+		return nil, nil, err
+	}
+	handshakeData, ciphertext, err := c.encodeHandshake(protocol.NewConnectionCipher(c.cipher), protocol.MethodX25519, flags)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 握手消息后紧跟客户端临时公钥，一次写入
+	clientPublic := kx.PublicKey()
+	if _, err := conn.Write(append(ciphertext, clientPublic...)); err != nil {
+		return nil, nil, err
+	}
+
+	// 服务端公钥 + 1字节算法协商结果
+	reply := make([]byte, protocol.X25519PublicKeySize+1)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, nil, fmt.Errorf("failed to read server public key: %w", err)
+	}
+	serverPublic, suiteReply := reply[:protocol.X25519PublicKeySize], reply[protocol.X25519PublicKeySize:]
+	dataCipher, err := c.negotiatedCipher(suites, suiteReply[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	sharedSecret, err := kx.SharedSecret(serverPublic)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	transcript := make([]byte, 0, len(handshakeData)+len(reply)+protocol.X25519PublicKeySize)
+	transcript = append(transcript, handshakeData...)
+	transcript = append(transcript, clientPublic...)
+	transcript = append(transcript, reply...)
+
+	send, recv, err := dataCipher.NewSessionCiphers(sharedSecret, transcript, true, c.config.KeyRotation)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to derive session keys: %w", err)
+	}
+	return recv, send, nil
+}
+
+// cipherSuites 客户端支持的数据加密算法（未配置时按本机硬件排序）
+func (c *Client) cipherSuites() []protocol.CipherSuite {
+	if len(c.config.CipherSuites) > 0 {
+		return c.config.CipherSuites
+	}
+	return protocol.DefaultCipherSuites()
+}
+
+// negotiatedCipher 校验服务端选择的算法是否在本端广播的列表中
+func (c *Client) negotiatedCipher(offered []protocol.CipherSuite, selected byte) (*protocol.Cipher, error) {
+	suite := protocol.CipherSuite(selected)
+	for _, s := range offered {
+		if s == suite {
+			logrus.Debugf("Negotiated cipher %s with %s", suite, c.config.ServerAddr)
+			return c.ciphers[suite], nil
+		}
+	}
+	return nil, fmt.Errorf("server selected unsupported cipher: %s", suite)
 }
 
 // sendConnectRequest 发送连接请求（保留用于兼容）
@@ -259,34 +712,52 @@ func (c *Client) sendConnectRequest(conn net.Conn, addr string) error {
 
 // sendConnectRequestWithCipher 使用指定的加密上下文发送连接请求
 func (c *Client) sendConnectRequestWithCipher(conn net.Conn, addr string, cipher *protocol.ConnectionCipher) error {
-	addrType, address, err := protocol.ParseAddress(addr)
+	reqData, err := buildConnectRequest(addr)
+	if err != nil {
+		return err
+	}
+
+	ciphertext, err := cipher.Encrypt(reqData)
 	if err != nil {
 		return err
 	}
 
+	_, err = conn.Write(ciphertext)
+	return err
+}
+
+// buildConnectRequest 构建并编码连接请求
+func buildConnectRequest(addr string) ([]byte, error) {
+	return buildRequest(protocol.MsgTypeConnect, addr, "")
+}
+
+// buildRequest 构建并编码msgType类型的请求（连接目标或BIND预期的对端地址为addr），user为本地代理认证的用户名（可为空）
+func buildRequest(msgType uint8, addr, user string) ([]byte, error) {
+	if len(user) > protocol.MaxUserLen {
+		return nil, fmt.Errorf("username too long")
+	}
+	addrType, address, err := protocol.ParseAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+
 	_, portStr, _ := net.SplitHostPort(addr)
 	portInt, err := strconv.Atoi(portStr)
 	if err != nil {
-		return fmt.Errorf("invalid port: %w", err)
+		return nil, fmt.Errorf("invalid port: %w", err)
 	}
 	port := uint16(portInt)
 
 	req := &protocol.ConnectRequest{
-		Type:     protocol.MsgTypeConnect,
+		Type:     msgType,
 		AddrType: addrType,
 		AddrLen:  uint8(len(address)),
 		Address:  address,
 		Port:     port,
+		User:     user,
 	}
 
-	reqData := protocol.EncodeConnectRequest(req)
-	ciphertext, err := cipher.Encrypt(reqData)
-	if err != nil {
-		return err
-	}
-
-	_, err = conn.Write(ciphertext)
-	return err
+	return protocol.EncodeConnectRequest(req), nil
 }
 
 // readResponse 读取响应（保留用于兼容）
@@ -310,35 +781,29 @@ func (c *Client) readResponseWithCipher(conn net.Conn, cipher *protocol.Connecti
 	return plaintext, nil
 }
 
-// readSOCKS5Request 读取SOCKS5请求（简化版）
-func (c *Client) readSOCKS5Request(conn net.Conn) (string, error) {
+// readSOCKS5Request 读取SOCKS5请求（简化版），返回命令、目标地址和认证的用户名（未认证时为空）
+func (c *Client) readSOCKS5Request(conn net.Conn) (byte, string, string, error) {
 	buf := make([]byte, 256)
 
-	// 读取版本和方法
-	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
-		return "", err
-	}
-
-	if buf[0] != 0x05 {
-		return "", fmt.Errorf("invalid SOCKS version")
-	}
-
-	// 读取方法列表
-	nMethods := int(buf[1])
-	if _, err := io.ReadFull(conn, buf[:nMethods]); err != nil {
-		return "", err
+	// 协商认证方法
+	identity, err := socks5.NegotiateAuth(conn, c.socks5Authenticators())
+	if err != nil {
+		return 0, "", "", err
 	}
-
-	// 发送无认证响应
-	conn.Write([]byte{0x05, 0x00})
+	user := identity.Username
 
 	// 读取请求
 	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
-		return "", err
+		return 0, "", "", err
 	}
 
-	if buf[0] != 0x05 || buf[1] != 0x01 {
-		return "", fmt.Errorf("unsupported command")
+	cmd := buf[1]
+	if buf[0] != 0x05 {
+		return 0, "", "", fmt.Errorf("invalid SOCKS version")
+	}
+	if cmd != socks5CmdConnect && cmd != socks5CmdBind && cmd != socks5CmdUDPAssociate {
+		c.sendSOCKS5Response(conn, 0x07) // 不支持的命令
+		return 0, "", "", fmt.Errorf("unsupported command: %d", cmd)
 	}
 
 	// 读取地址
@@ -346,34 +811,50 @@ func (c *Client) readSOCKS5Request(conn net.Conn) (string, error) {
 	var addr string
 
 	switch addrType {
-	case 0x01: // IPv4
+	case socks5AddrIPv4:
 		if _, err := io.ReadFull(conn, buf[:6]); err != nil {
-			return "", err
+			return 0, "", "", err
 		}
 		ip := net.IP(buf[:4])
 		port := uint16(buf[4])<<8 | uint16(buf[5])
 		addr = fmt.Sprintf("%s:%d", ip.String(), port)
 
-	case 0x03: // Domain
+	case socks5AddrDomain:
 		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
-			return "", err
+			return 0, "", "", err
 		}
 		domainLen := int(buf[0])
 		domain := make([]byte, domainLen)
 		if _, err := io.ReadFull(conn, domain); err != nil {
-			return "", err
+			return 0, "", "", err
 		}
 		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
-			return "", err
+			return 0, "", "", err
 		}
 		port := uint16(buf[0])<<8 | uint16(buf[1])
 		addr = fmt.Sprintf("%s:%d", string(domain), port)
 
+	case socks5AddrIPv6:
+		if _, err := io.ReadFull(conn, buf[:18]); err != nil {
+			return 0, "", "", err
+		}
+		ip := net.IP(buf[:16])
+		port := uint16(buf[16])<<8 | uint16(buf[17])
+		addr = net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+
 	default:
-		return "", fmt.Errorf("unsupported address type")
+		return 0, "", "", fmt.Errorf("unsupported address type")
 	}
 
-	return addr, nil
+	return cmd, addr, user, nil
+}
+
+// socks5Authenticators 本地SOCKS5认证方法（未配置用户时为无认证）
+func (c *Client) socks5Authenticators() []socks5.Authenticator {
+	if c.config.Users == nil {
+		return nil
+	}
+	return []socks5.Authenticator{socks5.NewUserManagerAuthenticator(c.config.Users)}
 }
 
 // sendSOCKS5Response 发送SOCKS5响应
@@ -383,6 +864,21 @@ func (c *Client) sendSOCKS5Response(conn net.Conn, reply byte) error {
 	return err
 }
 
+// sendSOCKS5ResponseAddr 发送带绑定地址的SOCKS5响应（UDP ASSOCIATE返回本地UDP端口，BIND返回服务端监听地址和对端地址）
+func (c *Client) sendSOCKS5ResponseAddr(conn net.Conn, reply byte, ip net.IP, port int) error {
+	response := []byte{0x05, reply, 0x00}
+	if ip4 := ip.To4(); ip4 != nil {
+		response = append(response, socks5AddrIPv4)
+		response = append(response, ip4...)
+	} else {
+		response = append(response, socks5AddrIPv6)
+		response = append(response, ip.To16()...)
+	}
+	response = append(response, uint8(port>>8), uint8(port))
+	_, err := conn.Write(response)
+	return err
+}
+
 // copyData 复制数据并加密/解密（使用buffer池优化，保留用于兼容）
 func (c *Client) copyData(dst, src net.Conn, encrypt bool) error {
 	return c.copyDataWithCipher(dst, src, protocol.NewConnectionCipher(c.cipher), encrypt)
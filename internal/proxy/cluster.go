@@ -29,6 +29,8 @@ type ClusterManager struct {
 	healthCheck func(node *ClusterNode) bool
 	lbStrategy  string // "round_robin", "weighted", "least_connections"
 	currentIdx  int64  // 当前轮询索引（原子操作）
+	stopCh      chan struct{}
+	stopOnce    sync.Once
 }
 
 // ClusterConfig 集群配置
@@ -50,6 +52,7 @@ func NewClusterManager(config ClusterConfig) *ClusterManager {
 	manager := &ClusterManager{
 		nodes:      make(map[string]*ClusterNode),
 		lbStrategy: config.Strategy,
+		stopCh:     make(chan struct{}),
 		healthCheck: func(node *ClusterNode) bool {
 			// 默认健康检查：尝试连接
 			conn, err := net.DialTimeout("tcp", node.Address, 3*time.Second)
@@ -163,7 +166,13 @@ func (cm *ClusterManager) startHealthCheck(interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-ticker.C:
+		case <-cm.stopCh:
+			return
+		}
+
 		cm.mu.RLock()
 		nodes := make([]*ClusterNode, 0, len(cm.nodes))
 		for _, node := range cm.nodes {
@@ -191,6 +200,11 @@ func (cm *ClusterManager) startHealthCheck(interval time.Duration) {
 	}
 }
 
+// Stop 停止健康检查（可重复调用）
+func (cm *ClusterManager) Stop() {
+	cm.stopOnce.Do(func() { close(cm.stopCh) })
+}
+
 // OnNodeConnectionStart 节点连接开始
 func (cm *ClusterManager) OnNodeConnectionStart(nodeID string) {
 	cm.mu.RLock()
@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClusterManager_Stop(t *testing.T) {
+	manager := NewClusterManager(ClusterConfig{
+		Nodes: []ClusterNodeConfig{{ID: "node1", Address: "127.0.0.1:1"}},
+	})
+	var checks int64
+	manager.healthCheck = func(node *ClusterNode) bool {
+		atomic.AddInt64(&checks, 1)
+		return true
+	}
+	go manager.startHealthCheck(10 * time.Millisecond)
+
+	time.Sleep(50 * time.Millisecond)
+	manager.Stop()
+	manager.Stop()
+	time.Sleep(20 * time.Millisecond)
+
+	// 停止后不再检查
+	stopped := atomic.LoadInt64(&checks)
+	if stopped == 0 {
+		t.Fatal("Expected health checks before Stop")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if after := atomic.LoadInt64(&checks); after != stopped {
+		t.Errorf("Health check ran %d more times after Stop", after-stopped)
+	}
+}
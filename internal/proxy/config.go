@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"fmt"
+
+	"multiexit-proxy/internal/auth"
+	"multiexit-proxy/internal/config"
+	"multiexit-proxy/internal/protocol"
+	"multiexit-proxy/internal/snat"
+	"multiexit-proxy/internal/transport"
+
+	"github.com/sirupsen/logrus"
+)
+
+// BuildServerConfig 将配置文件（config.ServerConfig）转换为代理服务端配置
+func BuildServerConfig(cfg *config.ServerConfig) (*ServerConfig, error) {
+	serverConfig := &ServerConfig{
+		ListenAddr: cfg.Server.Listen,
+		TLSConfig: &transport.ServerTLSConfig{
+			Cert:    cfg.Server.TLS.Cert,
+			Key:     cfg.Server.TLS.Key,
+			SNIFake: cfg.Server.TLS.SNIFake,
+		},
+		AuthKey:       cfg.Auth.Key,
+		ExitIPs:       cfg.ExitIPs,
+		Strategy:      cfg.Strategy.Type,
+		StrategyParam: cfg.Strategy.Param,
+		HashKey:       cfg.Strategy.HashKey,
+		Weights:       cfg.Strategy.Weights,
+		EnableStats:   cfg.Monitor.Enabled,
+	}
+	if len(cfg.Strategy.Limits) > 0 {
+		serverConfig.Limits = make(map[string]snat.ExitLimit, len(cfg.Strategy.Limits))
+		for ipStr, limit := range cfg.Strategy.Limits {
+			serverConfig.Limits[ipStr] = snat.ExitLimit{
+				MaxConnections: limit.MaxConnections,
+				MaxBandwidth:   limit.MaxBandwidth,
+			}
+		}
+	}
+	for _, pr := range cfg.Strategy.PortRanges {
+		serverConfig.PortRanges = append(serverConfig.PortRanges, PortRangeConfig{
+			Range:  pr.Range,
+			IP:     pr.IP,
+			Backup: pr.Backup,
+		})
+	}
+
+	// 出口IP未配置时自动检测
+	if len(serverConfig.ExitIPs) == 0 && cfg.IPDetection.Enabled {
+		ips, err := detectExitIPs(cfg.IPDetection.Interface)
+		if err != nil {
+			return nil, fmt.Errorf("failed to detect exit IPs: %w", err)
+		}
+		logrus.Infof("Detected %d exit IP(s): %v", len(ips), ips)
+		serverConfig.ExitIPs = ips
+	}
+	if len(serverConfig.ExitIPs) == 0 {
+		return nil, fmt.Errorf("no exit IPs configured")
+	}
+
+	// 健康检查
+	serverConfig.HealthCheck.Enabled = cfg.HealthCheck.Enabled
+	serverConfig.HealthCheck.Interval = cfg.GetHealthCheckInterval()
+	serverConfig.HealthCheck.Timeout = cfg.GetHealthCheckTimeout()
+
+	// 连接管理
+	serverConfig.Connection.ReadTimeout = cfg.GetReadTimeout()
+	serverConfig.Connection.WriteTimeout = cfg.GetWriteTimeout()
+	serverConfig.Connection.IdleTimeout = cfg.GetIdleTimeout()
+	serverConfig.Connection.DialTimeout = cfg.GetDialTimeout()
+	serverConfig.Connection.MaxConnections = cfg.Connection.MaxConnections
+	serverConfig.Connection.KeepAlive = cfg.Connection.KeepAlive
+	serverConfig.Connection.KeepAliveTime = cfg.GetKeepAliveTime()
+
+	// SNAT
+	serverConfig.SNAT.Enabled = cfg.SNAT.Enabled
+	serverConfig.SNAT.Gateway = cfg.SNAT.Gateway
+	serverConfig.SNAT.Interface = cfg.SNAT.Interface
+	serverConfig.SNAT.Backend = cfg.SNAT.Backend
+	serverConfig.SNAT.GatewayV6 = cfg.SNAT.GatewayV6
+	serverConfig.Egress.Mode = cfg.Egress.Mode
+	serverConfig.Egress.BindNoPort = cfg.Egress.BindNoPort
+	serverConfig.Egress.FamilyPolicy = cfg.Egress.FamilyPolicy
+
+	// 地理位置
+	serverConfig.GeoLocation.Enabled = cfg.GeoLocation.Enabled
+	serverConfig.GeoLocation.APIURL = cfg.GeoLocation.APIURL
+	serverConfig.GeoLocation.LatencyOptimize = cfg.GeoLocation.LatencyOptimize
+	serverConfig.GeoLocation.DBPath = cfg.GeoLocation.DBPath
+
+	// 粘性会话
+	serverConfig.Sticky.Enabled = cfg.Sticky.Enabled
+	serverConfig.Sticky.Key = cfg.Sticky.Key
+	serverConfig.Sticky.IdleTTL = cfg.GetStickyIdleTTL()
+	serverConfig.Sticky.MaxLifetime = cfg.GetStickyMaxLifetime()
+
+	// 出口IP选择规则
+	serverConfig.Rules = make([]SelectorRuleConfig, 0, len(cfg.Rules))
+	for _, rule := range cfg.Rules {
+		serverConfig.Rules = append(serverConfig.Rules, SelectorRuleConfig{
+			Name:         rule.Name,
+			Priority:     rule.Priority,
+			MatchDomain:  rule.MatchDomain,
+			MatchIP:      rule.MatchIP,
+			MatchPort:    rule.MatchPort,
+			TargetIP:     rule.TargetIP,
+			Action:       rule.Action,
+			Enabled:      rule.Enabled,
+			FamilyPolicy: rule.FamilyPolicy,
+		})
+	}
+
+	// 流量分析
+	serverConfig.EnableTrafficAnalysis = cfg.TrafficAnalysis.Enabled
+	serverConfig.TrafficAnalysis.Enabled = cfg.TrafficAnalysis.Enabled
+	serverConfig.TrafficAnalysis.TrendWindow = cfg.GetTrendWindow()
+	serverConfig.TrafficAnalysis.AnomalyThreshold = cfg.TrafficAnalysis.AnomalyThreshold
+
+	// 动态规则引擎的规则通过Web API管理，启用Web时一并启用
+	serverConfig.RuleEngine.Enabled = cfg.Web.Enabled
+
+	// 集群（节点地址同时作为节点ID）
+	serverConfig.Cluster.Enabled = cfg.Cluster.Enabled
+	serverConfig.Cluster.Strategy = cfg.Cluster.LoadBalancer
+	serverConfig.Cluster.HealthInterval = cfg.GetClusterHealthInterval()
+	for _, addr := range cfg.Cluster.Nodes {
+		serverConfig.Cluster.Nodes = append(serverConfig.Cluster.Nodes, ClusterNodeConfig{
+			ID:      addr,
+			Address: addr,
+			Weight:  1,
+		})
+	}
+
+	// 速率限制
+	serverConfig.RateLimit.Enabled = cfg.RateLimit.Enabled
+	serverConfig.RateLimit.IPMaxConnections = cfg.RateLimit.IPMaxConnections
+	serverConfig.RateLimit.IPRateLimit = cfg.RateLimit.IPRateLimit
+	serverConfig.RateLimit.UserMaxConnections = cfg.RateLimit.UserMaxConnections
+	serverConfig.RateLimit.UserRateLimit = cfg.RateLimit.UserRateLimit
+	serverConfig.RateLimit.UserBandwidthLimit = cfg.RateLimit.UserBandwidthLimit
+	serverConfig.RateLimit.GlobalMaxConnections = cfg.RateLimit.GlobalMaxConnections
+	serverConfig.RateLimit.GlobalRateLimit = cfg.RateLimit.GlobalRateLimit
+
+	// 握手方法和会话密钥轮换
+	serverConfig.RequireForwardSecrecy = cfg.Auth.Method == "x25519"
+	serverConfig.KeyRotation = protocol.KeyRotationPolicy{
+		MaxBytes: cfg.Auth.KeyRotation.MaxBytes,
+		Interval: cfg.GetKeyRotationInterval(),
+	}
+	cipherSuites, err := protocol.ParseCipherSuites(cfg.Auth.Ciphers)
+	if err != nil {
+		return nil, err
+	}
+	serverConfig.CipherSuites = cipherSuites
+
+	// 握手重放过滤
+	serverConfig.ReplayProtection.Mode = cfg.ReplayProtection.Mode
+	serverConfig.ReplayProtection.MaxEntries = cfg.ReplayProtection.MaxEntries
+	serverConfig.ReplayProtection.FalsePositiveRate = cfg.ReplayProtection.FalsePositiveRate
+
+	// UDP中继
+	serverConfig.UDP.Enabled = cfg.UDP.Enabled
+	serverConfig.UDP.Timeout = cfg.GetUDPTimeout()
+
+	// Trojan入站（入站协议由启动程序选择）
+	serverConfig.Trojan.Password = cfg.Trojan.Password
+	serverConfig.Trojan.Fallback = cfg.Trojan.Fallback
+	serverConfig.Trojan.FallbackALPN = cfg.Trojan.FallbackALPN
+	for _, user := range cfg.Trojan.Users {
+		serverConfig.Trojan.Users = append(serverConfig.Trojan.Users, TrojanUserConfig{
+			Username:   user.Username,
+			Password:   user.Password,
+			Quota:      user.Quota,
+			AllowedIPs: user.AllowedIPs,
+		})
+	}
+
+	return serverConfig, nil
+}
+
+// BuildClientConfig 将配置文件（config.ClientConfig）转换为代理客户端配置
+func BuildClientConfig(cfg *config.ClientConfig) *ClientConfig {
+	clientConfig := &ClientConfig{
+		ServerAddr: cfg.Server.Address,
+		SNI:        cfg.Server.SNI,
+		AuthKey:    cfg.Auth.Key,
+		LocalAddr:  cfg.Local.SOCKS5,
+		HTTPAddr:   cfg.Local.HTTP,
+	}
+
+	if cfg.Server.ProtocolVersion > 0 {
+		clientConfig.ProtocolVersion = uint8(cfg.Server.ProtocolVersion)
+	}
+	if cfg.Auth.Method == "x25519" {
+		clientConfig.HandshakeMethod = protocol.MethodX25519
+	}
+	clientConfig.KeyRotation = protocol.KeyRotationPolicy{
+		MaxBytes: cfg.Auth.KeyRotation.MaxBytes,
+		Interval: cfg.GetKeyRotationInterval(),
+	}
+	if cipherSuites, err := protocol.ParseCipherSuites(cfg.Auth.Ciphers); err != nil {
+		logrus.Warnf("Ignoring auth.ciphers: %v", err)
+	} else {
+		clientConfig.CipherSuites = cipherSuites
+	}
+
+	backoffFactor := cfg.Reconnect.BackoffFactor
+	if backoffFactor <= 0 {
+		backoffFactor = 2.0
+	}
+	clientConfig.Reconnect = &ReconnectConfig{
+		MaxRetries:    cfg.Reconnect.MaxRetries,
+		InitialDelay:  cfg.GetReconnectInitialDelay(),
+		MaxDelay:      cfg.GetReconnectMaxDelay(),
+		BackoffFactor: backoffFactor,
+		Jitter:        cfg.Reconnect.Jitter,
+	}
+
+	clientConfig.Pool.Enabled = cfg.Pool.Enabled
+	clientConfig.Pool.MaxSize = cfg.Pool.MaxSize
+	clientConfig.Pool.MaxIdle = cfg.Pool.MaxIdle
+	clientConfig.Pool.IdleTimeout = cfg.GetPoolIdleTimeout()
+
+	clientConfig.Mux.Enabled = cfg.Mux.Enabled
+	clientConfig.Users = BuildLocalUsers(cfg)
+
+	clientConfig.Transparent.Addr = cfg.Local.Transparent.Listen
+	clientConfig.Transparent.Mode = cfg.Local.Transparent.Mode
+	clientConfig.Transparent.UDP = cfg.Local.Transparent.UDP
+	clientConfig.Transparent.Mark = cfg.Local.Transparent.Mark
+	clientConfig.Transparent.Table = cfg.Local.Transparent.Table
+
+	return clientConfig
+}
+
+// BuildLocalUsers 根据local.users创建本地SOCKS5和HTTP代理的用户（未配置用户时返回nil，即无认证）
+func BuildLocalUsers(cfg *config.ClientConfig) *auth.UserManager {
+	if len(cfg.Local.Users) == 0 {
+		return nil
+	}
+
+	users := auth.NewUserManager()
+	for _, user := range cfg.Local.Users {
+		if err := users.AddUser(user.Username, user.Password, 0, user.AllowedIPs); err != nil {
+			logrus.Warnf("Ignoring local user %s: %v", user.Username, err)
+		}
+	}
+	return users
+}
+
+// detectExitIPs 自动检测出口IP（指定接口时只检测该接口）
+func detectExitIPs(iface string) ([]string, error) {
+	detector := snat.NewIPDetector()
+	if iface != "" {
+		return detector.DetectByInterface(iface)
+	}
+	return detector.DetectAllPublicIPs()
+}
@@ -12,7 +12,7 @@ import (
 type ConnectionManager struct {
 	maxConnections int64
 	activeCount    int64
-	connections    sync.Map // map[net.Conn]context.CancelFunc
+	connections    sync.Map // map[net.Conn]*trackedConn
 	mu             sync.RWMutex
 	readTimeout    time.Duration
 	writeTimeout   time.Duration
@@ -22,6 +22,20 @@ type ConnectionManager struct {
 	keepAliveTime  time.Duration
 }
 
+// trackedConn 已登记连接的信息
+type trackedConn struct {
+	cancel context.CancelFunc
+	since  time.Time
+	cipher atomic.Value // string，协商出的数据加密算法
+}
+
+// ConnectionInfo 单个连接的信息（用于Web界面）
+type ConnectionInfo struct {
+	RemoteAddr string    `json:"remote_addr"`
+	Since      time.Time `json:"since"`
+	Cipher     string    `json:"cipher,omitempty"` // 数据加密算法（Trojan连接和尚未完成握手的连接为空）
+}
+
 // NewConnectionManager 创建连接管理器
 func NewConnectionManager(maxConnections int, readTimeout, writeTimeout, idleTimeout, dialTimeout time.Duration, keepAlive bool, keepAliveTime time.Duration) *ConnectionManager {
 	return &ConnectionManager{
@@ -51,22 +65,26 @@ func (cm *ConnectionManager) AddConnection(conn net.Conn) bool {
 		return false
 	}
 
+	cm.mu.RLock()
+	keepAlive, keepAliveTime, idleTimeout := cm.keepAlive, cm.keepAliveTime, cm.idleTimeout
+	cm.mu.RUnlock()
+
 	// 设置TCP KeepAlive
-	if tcpConn, ok := conn.(*net.TCPConn); ok && cm.keepAlive {
+	if tcpConn, ok := conn.(*net.TCPConn); ok && keepAlive {
 		tcpConn.SetKeepAlive(true)
-		if cm.keepAliveTime > 0 {
-			tcpConn.SetKeepAlivePeriod(cm.keepAliveTime)
+		if keepAliveTime > 0 {
+			tcpConn.SetKeepAlivePeriod(keepAliveTime)
 		}
 	}
 
 	// 创建取消上下文（使用可取消的上下文，支持超时）
 	ctx, cancel := context.WithCancel(context.Background())
-	cm.connections.Store(conn, cancel)
+	cm.connections.Store(conn, &trackedConn{cancel: cancel, since: time.Now()})
 	atomic.AddInt64(&cm.activeCount, 1)
 
 	// 启动空闲超时检测
-	if cm.idleTimeout > 0 {
-		go cm.monitorIdleTimeout(conn, ctx)
+	if idleTimeout > 0 {
+		go cm.monitorIdleTimeout(conn, ctx, idleTimeout)
 	}
 
 	return true
@@ -74,24 +92,54 @@ func (cm *ConnectionManager) AddConnection(conn net.Conn) bool {
 
 // RemoveConnection 移除连接
 func (cm *ConnectionManager) RemoveConnection(conn net.Conn) {
-	if cancel, ok := cm.connections.LoadAndDelete(conn); ok {
-		if cancelFunc, ok := cancel.(context.CancelFunc); ok {
-			cancelFunc()
-		}
+	if value, ok := cm.connections.LoadAndDelete(conn); ok {
+		value.(*trackedConn).cancel()
 		atomic.AddInt64(&cm.activeCount, -1)
 	}
 }
 
+// SetCipher 记录连接协商出的数据加密算法
+func (cm *ConnectionManager) SetCipher(conn net.Conn, cipher string) {
+	if value, ok := cm.connections.Load(conn); ok {
+		value.(*trackedConn).cipher.Store(cipher)
+	}
+}
+
+// Cipher 获取连接协商出的数据加密算法（未记录时返回空字符串）
+func (cm *ConnectionManager) Cipher(conn net.Conn) string {
+	if value, ok := cm.connections.Load(conn); ok {
+		cipher, _ := value.(*trackedConn).cipher.Load().(string)
+		return cipher
+	}
+	return ""
+}
+
+// Connections 列出当前登记的连接
+func (cm *ConnectionManager) Connections() []ConnectionInfo {
+	conns := make([]ConnectionInfo, 0, atomic.LoadInt64(&cm.activeCount))
+	cm.connections.Range(func(key, value interface{}) bool {
+		tracked := value.(*trackedConn)
+		info := ConnectionInfo{Since: tracked.since}
+		if addr := key.(net.Conn).RemoteAddr(); addr != nil {
+			info.RemoteAddr = addr.String()
+		}
+		info.Cipher, _ = tracked.cipher.Load().(string)
+		conns = append(conns, info)
+		return true
+	})
+	return conns
+}
+
 // monitorIdleTimeout 监控空闲超时
-func (cm *ConnectionManager) monitorIdleTimeout(conn net.Conn, ctx context.Context) {
-	if cm.idleTimeout <= 0 {
+func (cm *ConnectionManager) monitorIdleTimeout(conn net.Conn, ctx context.Context, idleTimeout time.Duration) {
+	if idleTimeout <= 0 {
 		return
 	}
 	
-	ticker := time.NewTicker(cm.idleTimeout / 2)
+	ticker := time.NewTicker(idleTimeout / 2)
 	defer ticker.Stop()
 
-	conn.SetReadDeadline(time.Now().Add(cm.idleTimeout))
+	conn.SetReadDeadline(time.Now().Add(idleTimeout))
 
 	for {
 		select {
@@ -107,7 +155,7 @@ func (cm *ConnectionManager) monitorIdleTimeout(conn net.Conn, ctx context.Conte
 				return
 			}
 			// 重新设置读取超时
-			conn.SetReadDeadline(now.Add(cm.idleTimeout))
+			conn.SetReadDeadline(now.Add(idleTimeout))
 		}
 	}
 }
@@ -124,30 +172,59 @@ func (cm *ConnectionManager) SetTimeouts(conn net.Conn, readTimeout, writeTimeou
 
 // ResetReadDeadline 重置读取超时
 func (cm *ConnectionManager) ResetReadDeadline(conn net.Conn) {
-	if cm.readTimeout > 0 {
-		conn.SetReadDeadline(time.Now().Add(cm.readTimeout))
+	cm.mu.RLock()
+	readTimeout, idleTimeout := cm.readTimeout, cm.idleTimeout
+	cm.mu.RUnlock()
+
+	if readTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
 	}
-	if cm.idleTimeout > 0 {
-		conn.SetReadDeadline(time.Now().Add(cm.idleTimeout))
+	if idleTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
 	}
 }
 
 // ResetWriteDeadline 重置写入超时
 func (cm *ConnectionManager) ResetWriteDeadline(conn net.Conn) {
-	if cm.writeTimeout > 0 {
-		conn.SetWriteDeadline(time.Now().Add(cm.writeTimeout))
+	cm.mu.RLock()
+	writeTimeout := cm.writeTimeout
+	cm.mu.RUnlock()
+
+	if writeTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
 	}
 }
 
 // DialWithTimeout 使用超时连接
 func (cm *ConnectionManager) DialWithTimeout(network, address string) (net.Conn, error) {
+	return cm.Dialer().Dial(network, address)
+}
+
+// Dialer 按当前超时和KeepAlive设置创建拨号器（调用方可再设置源地址和Control）
+func (cm *ConnectionManager) Dialer() *net.Dialer {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
 	dialer := &net.Dialer{
 		Timeout: cm.dialTimeout,
 	}
 	if cm.keepAlive {
 		dialer.KeepAlive = cm.keepAliveTime
 	}
-	return dialer.Dial(network, address)
+	return dialer
+}
+
+// UpdateSettings 更新连接限制和超时设置（只影响之后的读写和新连接，不中断已有连接）
+func (cm *ConnectionManager) UpdateSettings(maxConnections int, readTimeout, writeTimeout, idleTimeout, dialTimeout time.Duration, keepAlive bool, keepAliveTime time.Duration) {
+	atomic.StoreInt64(&cm.maxConnections, int64(maxConnections))
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.readTimeout = readTimeout
+	cm.writeTimeout = writeTimeout
+	cm.idleTimeout = idleTimeout
+	cm.dialTimeout = dialTimeout
+	cm.keepAlive = keepAlive
+	cm.keepAliveTime = keepAliveTime
 }
 
 // GetActiveCount 获取当前活跃连接数
@@ -161,8 +238,8 @@ func (cm *ConnectionManager) CloseAll() {
 		if conn, ok := key.(net.Conn); ok {
 			conn.Close()
 		}
-		if cancel, ok := value.(context.CancelFunc); ok {
-			cancel()
+		if tracked, ok := value.(*trackedConn); ok {
+			tracked.cancel()
 		}
 		return true
 	})
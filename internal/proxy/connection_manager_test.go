@@ -46,6 +46,25 @@ func TestConnectionManager_AddRemove(t *testing.T) {
 	}
 }
 
+func TestConnectionManager_Cipher(t *testing.T) {
+	cm := NewConnectionManager(10, 30*time.Second, 30*time.Second, 0, 10*time.Second, true, 30*time.Second)
+
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	cm.AddConnection(conn)
+	cm.SetCipher(conn, "chacha20-poly1305")
+
+	conns := cm.Connections()
+	if len(conns) != 1 || conns[0].Cipher != "chacha20-poly1305" {
+		t.Fatalf("Expected one connection using chacha20-poly1305, got %+v", conns)
+	}
+
+	cm.RemoveConnection(conn)
+	if cm.Cipher(conn) != "" || len(cm.Connections()) != 0 {
+		t.Error("Removed connection should not be listed")
+	}
+}
+
 func TestConnectionManager_Timeouts(t *testing.T) {
 	cm := NewConnectionManager(10, 5*time.Second, 5*time.Second, 10*time.Second, 5*time.Second, true, 30*time.Second)
 	
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// 出口模式：出站连接如何使用选定的出口IP
+const (
+	EgressModeBind = "bind" // 绑定源地址为出口IP（不需要SNAT）
+	EgressModeMark = "mark" // 设置fwmark，由策略路由和SNAT改写源地址（需要启用SNAT）
+	EgressModeBoth = "both" // 同时绑定源地址和设置fwmark
+)
+
+// socketControl net.Dialer和net.ListenConfig的Control函数
+type socketControl func(network, address string, c syscall.RawConn) error
+
+// egressMode 实际生效的出口模式：未配置时启用SNAT为both，否则为bind
+func egressMode(config *ServerConfig) string {
+	if config.Egress.Mode != "" {
+		return config.Egress.Mode
+	}
+	if config.SNAT.Enabled {
+		return EgressModeBoth
+	}
+	return EgressModeBind
+}
+
+// egressControl 按出口模式构造套接字设置，返回是否绑定源地址和connect之前执行的Control函数
+func egressControl(st serverState, exitIP net.IP, stream bool) (bool, socketControl, error) {
+	mode := egressMode(st.config)
+	bind := mode != EgressModeMark
+
+	var controls []socketControl
+	if mode != EgressModeBind {
+		if st.routingMgr == nil {
+			return false, nil, fmt.Errorf("egress mode %s requires SNAT to be enabled", mode)
+		}
+		markControl, err := st.routingMgr.MarkControl(exitIP)
+		if err != nil {
+			return false, nil, err
+		}
+		controls = append(controls, markControl)
+	}
+	if bind && stream && st.config.Egress.BindNoPort {
+		controls = append(controls, bindNoPortControl)
+	}
+
+	switch len(controls) {
+	case 0:
+		return bind, nil, nil
+	case 1:
+		return bind, controls[0], nil
+	}
+	return bind, func(network, address string, c syscall.RawConn) error {
+		for _, control := range controls {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+// dialEgress 经出口IP连接目标：源地址和fwmark在connect之前设置，对握手报文的路由生效
+func (s *Server) dialEgress(st serverState, network, addr string, exitIP net.IP) (net.Conn, error) {
+	return s.dialEgressContext(context.Background(), st, network, addr, exitIP)
+}
+
+// dialEgressContext 同dialEgress，ctx取消时放弃连接
+func (s *Server) dialEgressContext(ctx context.Context, st serverState, network, addr string, exitIP net.IP) (net.Conn, error) {
+	bind, control, err := egressControl(st, exitIP, true)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := s.connManager.Dialer()
+	if bind {
+		dialer.LocalAddr = &net.TCPAddr{IP: exitIP}
+	}
+	dialer.Control = control
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// dialEgressAddrs 经出口IP依次连接addrs（同一目标解析出的地址），返回第一个建立的连接
+// 连接超时由所有地址共用，与net.Dialer连接域名时一致
+func (s *Server) dialEgressAddrs(ctx context.Context, st serverState, network string, addrs []string, exitIP net.IP) (net.Conn, error) {
+	if len(addrs) == 1 {
+		return s.dialEgressContext(ctx, st, network, addrs[0], exitIP)
+	}
+	if timeout := s.connManager.Dialer().Timeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var firstErr error
+	for _, addr := range addrs {
+		conn, err := s.dialEgressContext(ctx, st, network, addr, exitIP)
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// listenEgressUDP 创建经出口IP发送的UDP套接字
+func (s *Server) listenEgressUDP(st serverState, network string, exitIP net.IP) (*net.UDPConn, error) {
+	bind, control, err := egressControl(st, exitIP, false)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := ":0"
+	if bind {
+		addr = net.JoinHostPort(exitIP.String(), "0")
+	}
+	lc := net.ListenConfig{Control: control}
+	conn, err := lc.ListenPacket(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// listenEgressTCP 在出口IP上监听随机端口（反向连接，如BIND），对端连入的连接与出站连接一样设置fwmark
+// 对端连接的目标地址为出口IP，因此总是绑定出口IP
+func (s *Server) listenEgressTCP(st serverState, exitIP net.IP) (net.Listener, error) {
+	_, control, err := egressControl(st, exitIP, false)
+	if err != nil {
+		return nil, err
+	}
+
+	lc := net.ListenConfig{Control: control}
+	return lc.Listen(context.Background(), "tcp", net.JoinHostPort(exitIP.String(), "0"))
+}
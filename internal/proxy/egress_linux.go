@@ -0,0 +1,17 @@
+//go:build linux
+
+package proxy
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// bindNoPortControl 设置IP_BIND_ADDRESS_NO_PORT，绑定源地址时推迟到connect再分配源端口
+// 同一出口IP的并发连接只需四元组唯一，不会耗尽临时端口（内核不支持时忽略）
+func bindNoPortControl(network, address string, c syscall.RawConn) error {
+	return c.Control(func(fd uintptr) {
+		unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_BIND_ADDRESS_NO_PORT, 1)
+	})
+}
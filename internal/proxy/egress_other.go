@@ -0,0 +1,10 @@
+//go:build !linux
+
+package proxy
+
+import "syscall"
+
+// bindNoPortControl IP_BIND_ADDRESS_NO_PORT仅Linux支持，其他系统不做设置
+func bindNoPortControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestEgressMode(t *testing.T) {
+	config := &ServerConfig{}
+	if mode := egressMode(config); mode != EgressModeBind {
+		t.Errorf("Expected bind without SNAT, got %s", mode)
+	}
+	config.SNAT.Enabled = true
+	if mode := egressMode(config); mode != EgressModeBoth {
+		t.Errorf("Expected both with SNAT, got %s", mode)
+	}
+	config.Egress.Mode = EgressModeMark
+	if mode := egressMode(config); mode != EgressModeMark {
+		t.Errorf("Expected configured mode, got %s", mode)
+	}
+}
+
+func TestServer_DialEgressBind(t *testing.T) {
+	s, _ := newTunnelTestServer(t)
+	s.config.Egress.BindNoPort = true
+	echoAddr := startEchoServer(t)
+
+	conn, err := s.dialEgress(s.snapshot(), "tcp", echoAddr, net.ParseIP("127.0.0.1"))
+	if err != nil {
+		t.Fatalf("dialEgress failed: %v", err)
+	}
+	defer conn.Close()
+	if local := conn.LocalAddr().(*net.TCPAddr); !local.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Expected source address 127.0.0.1, got %s", local.IP)
+	}
+
+	udpConn, err := s.listenEgressUDP(s.snapshot(), "udp4", net.ParseIP("127.0.0.1"))
+	if err != nil {
+		t.Fatalf("listenEgressUDP failed: %v", err)
+	}
+	defer udpConn.Close()
+	if local := udpConn.LocalAddr().(*net.UDPAddr); !local.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Expected UDP socket bound to 127.0.0.1, got %s", local.IP)
+	}
+}
+
+func TestServer_DialEgressMarkRequiresSNAT(t *testing.T) {
+	s, _ := newTunnelTestServer(t)
+	s.config.Egress.Mode = EgressModeMark
+
+	if _, err := s.dialEgress(s.snapshot(), "tcp", "127.0.0.1:1", net.ParseIP("127.0.0.1")); err == nil {
+		t.Error("Expected error for mark mode without SNAT")
+	}
+}
@@ -0,0 +1,386 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"multiexit-proxy/internal/snat"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 出口IP状态
+const (
+	ExitIPActive   = "active"   // 参与出口IP选择
+	ExitIPDraining = "draining" // 不再分配给新连接，活跃连接结束后移除
+)
+
+// ExitIPStatus 出口IP的运行时状态
+type ExitIPStatus struct {
+	IP                string `json:"ip"`
+	State             string `json:"state"`
+	Healthy           bool   `json:"healthy"`
+	ActiveConnections int    `json:"active_connections"`
+}
+
+// drainState 一个正在排空的出口IP
+type drainState struct {
+	done   chan struct{} // 活跃连接归零或排空取消时关闭
+	closed bool
+}
+
+// exitIPPool 出口IP池的运行时状态：每个出口IP的活跃连接数和正在排空的IP（零值可用）
+type exitIPPool struct {
+	mu       sync.Mutex
+	active   map[string]int
+	draining map[string]*drainState
+	load     *snat.LoadTracker // 出口IP的并发连接数和带宽，供按负载选择和容量上限使用（可为nil）
+}
+
+// acquire 出口IP上建立了一个连接（或UDP套接字）
+func (p *exitIPPool) acquire(ip net.IP) {
+	if p.load != nil {
+		p.load.OnConnectionStart(ip)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.active == nil {
+		p.active = make(map[string]int)
+	}
+	p.active[ip.String()]++
+}
+
+// release 出口IP上的一个连接结束，正在排空的IP连接归零时通知排空完成
+func (p *exitIPPool) release(ip net.IP) {
+	if p.load != nil {
+		p.load.OnConnectionEnd(ip)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := ip.String()
+	if p.active[key] > 1 {
+		p.active[key]--
+		return
+	}
+	delete(p.active, key)
+	if state := p.draining[key]; state != nil {
+		state.close()
+	}
+}
+
+// transferred 出口IP上传输了bytes字节
+func (p *exitIPPool) transferred(ip net.IP, bytes int64) {
+	if p.load != nil {
+		p.load.OnBytesTransferred(ip, bytes)
+	}
+}
+
+// startDrain 开始排空出口IP，返回活跃连接归零时关闭的通道
+func (p *exitIPPool) startDrain(ip string) <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if state := p.draining[ip]; state != nil {
+		return state.done
+	}
+	if p.draining == nil {
+		p.draining = make(map[string]*drainState)
+	}
+	state := &drainState{done: make(chan struct{})}
+	p.draining[ip] = state
+	if p.active[ip] == 0 {
+		state.close()
+	}
+	return state.done
+}
+
+// stopDrain 结束排空（完成、取消或强制移除），返回该IP是否正在排空
+func (p *exitIPPool) stopDrain(ip string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state := p.draining[ip]
+	if state == nil {
+		return false
+	}
+	state.close()
+	delete(p.draining, ip)
+	return true
+}
+
+// isDraining 出口IP是否正在排空
+func (p *exitIPPool) isDraining(ip string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.draining[ip] != nil
+}
+
+// drainingIPs 正在排空的出口IP
+func (p *exitIPPool) drainingIPs() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ips := make([]string, 0, len(p.draining))
+	for ip := range p.draining {
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// activeConnections 出口IP上的活跃连接数
+func (p *exitIPPool) activeConnections(ip string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.active[ip]
+}
+
+// close 关闭通知通道（调用方持有p.mu）
+func (d *drainState) close() {
+	if !d.closed {
+		d.closed = true
+		close(d.done)
+	}
+}
+
+// ExitIPs 获取所有出口IP的状态（包括正在排空的IP）
+func (s *Server) ExitIPs() []ExitIPStatus {
+	s.mu.RLock()
+	exitIPs := s.config.ExitIPs
+	healthChecker := s.healthChecker
+	s.mu.RUnlock()
+
+	statuses := make([]ExitIPStatus, 0, len(exitIPs))
+	status := func(ipStr, state string) ExitIPStatus {
+		ip := net.ParseIP(ipStr)
+		ipStr = ip.String()
+		healthy := true
+		if healthChecker != nil {
+			healthy = healthChecker.IsHealthy(ip)
+		}
+		return ExitIPStatus{
+			IP:                ipStr,
+			State:             state,
+			Healthy:           healthy,
+			ActiveConnections: s.exitPool.activeConnections(ipStr),
+		}
+	}
+	for _, ipStr := range exitIPs {
+		statuses = append(statuses, status(ipStr, ExitIPActive))
+	}
+	for _, ipStr := range s.exitPool.drainingIPs() {
+		statuses = append(statuses, status(ipStr, ExitIPDraining))
+	}
+	return statuses
+}
+
+// AddExitIP 添加出口IP，同步到IP选择器、健康检查和SNAT路由后即可分配给新连接
+// 正在排空的IP重新添加时取消排空
+func (s *Server) AddExitIP(ipStr string) error {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return fmt.Errorf("invalid IP address: %s", ipStr)
+	}
+	ipStr = ip.String()
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if containsExitIP(s.config.ExitIPs, ipStr) {
+		return fmt.Errorf("exit IP %s already exists", ipStr)
+	}
+	exitIPs := append(append([]string(nil), s.config.ExitIPs...), ipStr)
+	if err := s.applyExitIPs(exitIPs); err != nil {
+		return err
+	}
+	s.exitPool.stopDrain(ipStr)
+
+	logrus.Infof("Exit IP %s added (%d exit IPs)", ipStr, len(exitIPs))
+	return nil
+}
+
+// DrainExitIP 排空出口IP：立即停止分配给新连接，已有连接结束后移除其SNAT路由
+// 返回的通道在IP移除（或排空被AddExitIP、RemoveExitIP结束）后关闭
+func (s *Server) DrainExitIP(ipStr string) (<-chan struct{}, error) {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address: %s", ipStr)
+	}
+	ipStr = ip.String()
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	exitIPs, err := removeExitIP(s.config.ExitIPs, ipStr)
+	if err != nil {
+		return nil, err
+	}
+	// 先标记排空，路由管理器保留该IP直到排空完成
+	done := s.exitPool.startDrain(ipStr)
+	if err := s.applyExitIPs(exitIPs); err != nil {
+		s.exitPool.stopDrain(ipStr)
+		return nil, err
+	}
+	logrus.Infof("Draining exit IP %s (%d active connections)", ipStr, s.exitPool.activeConnections(ipStr))
+
+	var shutdown <-chan struct{}
+	if s.shutdownCtx != nil {
+		shutdown = s.shutdownCtx.Done()
+	}
+	removed := make(chan struct{})
+	go func() {
+		defer close(removed)
+		select {
+		case <-done:
+			s.finishDrain(ipStr)
+		case <-shutdown:
+		}
+	}()
+	return removed, nil
+}
+
+// RemoveExitIP 立即移除出口IP（包括正在排空的IP），其上的活跃连接不再经过SNAT路由
+func (s *Server) RemoveExitIP(ipStr string) error {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return fmt.Errorf("invalid IP address: %s", ipStr)
+	}
+	ipStr = ip.String()
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.exitPool.stopDrain(ipStr) {
+		if err := s.syncRoutingIPs(); err != nil {
+			return err
+		}
+	} else {
+		exitIPs, err := removeExitIP(s.config.ExitIPs, ipStr)
+		if err != nil {
+			return err
+		}
+		if err := s.applyExitIPs(exitIPs); err != nil {
+			return err
+		}
+	}
+
+	if active := s.exitPool.activeConnections(ipStr); active > 0 {
+		logrus.Warnf("Exit IP %s removed with %d active connections", ipStr, active)
+	} else {
+		logrus.Infof("Exit IP %s removed", ipStr)
+	}
+	return nil
+}
+
+// finishDrain 排空完成后移除出口IP的SNAT路由
+func (s *Server) finishDrain(ipStr string) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 排空期间已被重新添加或强制移除
+	if !s.exitPool.stopDrain(ipStr) {
+		return
+	}
+	if err := s.syncRoutingIPs(); err != nil {
+		logrus.Errorf("Failed to remove routing for drained exit IP %s: %v", ipStr, err)
+		return
+	}
+	logrus.Infof("Exit IP %s drained and removed", ipStr)
+}
+
+// applyExitIPs 将出口IP集合同步到IP选择器、健康检查器和路由管理器（调用方持有reloadMu和s.mu）
+func (s *Server) applyExitIPs(exitIPs []string) error {
+	ipList, err := parseExitIPs(exitIPs)
+	if err != nil {
+		return err
+	}
+	selector, ok := s.ipSelector.(snat.DynamicIPSelector)
+	if !ok {
+		return fmt.Errorf("IP selector does not support runtime exit IP changes")
+	}
+
+	// 路由最先更新：失败时不影响选择器
+	if s.routingMgr != nil {
+		if err := s.routingMgr.SetIPs(s.routedIPs(ipList)); err != nil {
+			return err
+		}
+	}
+	selector.SetIPs(ipList)
+	if s.healthChecker != nil {
+		for _, ip := range ipList {
+			if !containsExitIP(s.config.ExitIPs, ip.String()) {
+				s.healthChecker.AddIP(ip)
+			}
+		}
+		for _, ipStr := range s.config.ExitIPs {
+			if !containsExitIP(exitIPs, ipStr) {
+				s.healthChecker.RemoveIP(net.ParseIP(ipStr))
+			}
+		}
+	}
+
+	// 已建立连接持有的配置快照不受影响
+	config := *s.config
+	config.ExitIPs = exitIPs
+	s.config = &config
+	return nil
+}
+
+// syncRoutingIPs 按当前出口IP和正在排空的IP同步路由（调用方持有s.mu）
+func (s *Server) syncRoutingIPs() error {
+	if s.routingMgr == nil {
+		return nil
+	}
+	ipList, err := parseExitIPs(s.config.ExitIPs)
+	if err != nil {
+		return err
+	}
+	return s.routingMgr.SetIPs(s.routedIPs(ipList))
+}
+
+// routedIPs 需要SNAT路由的IP：参与选择的出口IP加上正在排空的IP
+func (s *Server) routedIPs(ipList []net.IP) []net.IP {
+	routed := append([]net.IP(nil), ipList...)
+	for _, ipStr := range s.exitPool.drainingIPs() {
+		routed = append(routed, net.ParseIP(ipStr))
+	}
+	return routed
+}
+
+// containsExitIP 出口IP列表是否包含ipStr（按规范形式比较）
+func containsExitIP(exitIPs []string, ipStr string) bool {
+	for _, existing := range exitIPs {
+		if existingIP := net.ParseIP(existing); existingIP != nil && existingIP.String() == ipStr {
+			return true
+		}
+	}
+	return false
+}
+
+// removeExitIP 从出口IP列表中删除ipStr，不能删除最后一个出口IP
+func removeExitIP(exitIPs []string, ipStr string) ([]string, error) {
+	if !containsExitIP(exitIPs, ipStr) {
+		return nil, fmt.Errorf("exit IP %s not found", ipStr)
+	}
+	if len(exitIPs) == 1 {
+		return nil, fmt.Errorf("cannot remove the last exit IP")
+	}
+	remaining := make([]string, 0, len(exitIPs)-1)
+	for _, existing := range exitIPs {
+		if !containsExitIP([]string{existing}, ipStr) {
+			remaining = append(remaining, existing)
+		}
+	}
+	return remaining, nil
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer_AddAndRemoveExitIP(t *testing.T) {
+	s := newReloadTestServer(t, &ServerConfig{
+		ExitIPs:  []string{"10.0.0.1"},
+		Strategy: "round_robin",
+	})
+
+	if err := s.AddExitIP("10.0.0.2"); err != nil {
+		t.Fatalf("AddExitIP failed: %v", err)
+	}
+	if err := s.AddExitIP("10.0.0.2"); err == nil {
+		t.Error("Expected error when adding an existing exit IP")
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		ip, err := s.snapshot().ipSelector.SelectIP("example.com", 80)
+		if err != nil {
+			t.Fatalf("SelectIP failed: %v", err)
+		}
+		seen[ip.String()] = true
+	}
+	if !seen["10.0.0.1"] || !seen["10.0.0.2"] {
+		t.Errorf("Expected both exit IPs to be selected, got %v", seen)
+	}
+
+	if err := s.RemoveExitIP("10.0.0.1"); err != nil {
+		t.Fatalf("RemoveExitIP failed: %v", err)
+	}
+	if err := s.RemoveExitIP("10.0.0.2"); err == nil {
+		t.Error("Expected error when removing the last exit IP")
+	}
+	if statuses := s.ExitIPs(); len(statuses) != 1 || statuses[0].IP != "10.0.0.2" {
+		t.Errorf("Unexpected exit IPs: %+v", statuses)
+	}
+}
+
+func TestServer_DrainExitIP(t *testing.T) {
+	s := newReloadTestServer(t, &ServerConfig{
+		ExitIPs:  []string{"10.0.0.1", "10.0.0.2"},
+		Strategy: "round_robin",
+	})
+	draining := net.ParseIP("10.0.0.1")
+	s.exitPool.acquire(draining)
+
+	removed, err := s.DrainExitIP("10.0.0.1")
+	if err != nil {
+		t.Fatalf("DrainExitIP failed: %v", err)
+	}
+
+	// 排空期间不再分配给新连接，但仍报告活跃连接
+	for i := 0; i < 4; i++ {
+		if ip, _ := s.snapshot().ipSelector.SelectIP("example.com", 80); ip.Equal(draining) {
+			t.Fatal("Draining exit IP selected for a new connection")
+		}
+	}
+	statuses := s.ExitIPs()
+	if len(statuses) != 2 || statuses[1].State != ExitIPDraining || statuses[1].ActiveConnections != 1 {
+		t.Errorf("Unexpected exit IP statuses: %+v", statuses)
+	}
+	select {
+	case <-removed:
+		t.Fatal("Drain finished with an active connection")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.exitPool.release(draining)
+	select {
+	case <-removed:
+	case <-time.After(time.Second):
+		t.Fatal("Drain did not finish after the last connection ended")
+	}
+	if statuses := s.ExitIPs(); len(statuses) != 1 || statuses[0].IP != "10.0.0.2" {
+		t.Errorf("Unexpected exit IPs after drain: %+v", statuses)
+	}
+}
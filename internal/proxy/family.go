@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"multiexit-proxy/internal/snat"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// happyEyeballsDelay 首选地址族连接尝试之后发起另一地址族连接尝试的延迟（RFC 8305建议250ms）
+	happyEyeballsDelay = 250 * time.Millisecond
+
+	// familyLookupTimeout 判断域名目标支持哪些地址族时DNS解析的超时
+	familyLookupTimeout = 5 * time.Second
+)
+
+// familyPolicy 目标使用的地址族策略：匹配的选择规则指定的策略优先，其次为egress.family_policy
+func familyPolicy(st serverState, host string, port int) string {
+	if provider, ok := st.ipSelector.(snat.FamilyPolicyProvider); ok {
+		if policy := provider.FamilyPolicy(host, port); policy != "" {
+			return policy
+		}
+	}
+	return st.config.Egress.FamilyPolicy
+}
+
+// targetFamilies 按顺序尝试的出口IP地址族、生效的地址族策略，以及判断地址族时解析到的目标地址
+// 目标为IP时只能使用同一地址族；目标为域名且出口IP为双栈时，通过DNS排除目标没有记录的地址族，
+// 解析到的地址（未解析时为nil）在连接时直接使用，不再重复解析
+func targetFamilies(st serverState, host string, port int) ([]snat.IPFamily, string, []net.IP) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []snat.IPFamily{snat.FamilyOf(ip)}, "", nil
+	}
+
+	policy := familyPolicy(st, host, port)
+	families := snat.FamilyPolicyFamilies(policy)
+	if len(families) == 1 {
+		return families, policy, nil
+	}
+
+	// 出口IP只有一个地址族时无需解析目标
+	hasV4, hasV6 := exitIPFamilies(st.config.ExitIPs)
+	switch {
+	case hasV4 && !hasV6:
+		return []snat.IPFamily{snat.FamilyIPv4}, policy, nil
+	case hasV6 && !hasV4:
+		return []snat.IPFamily{snat.FamilyIPv6}, policy, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), familyLookupTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		// 解析失败时按策略尝试，由连接返回错误
+		logrus.Debugf("Failed to resolve %s for address family selection: %v", host, err)
+		return families, policy, nil
+	}
+	resolved := make([]net.IP, 0, len(addrs))
+	var resolvedV4, resolvedV6 bool
+	for _, addr := range addrs {
+		resolved = append(resolved, addr.IP)
+		if snat.FamilyOf(addr.IP) == snat.FamilyIPv4 {
+			resolvedV4 = true
+		} else {
+			resolvedV6 = true
+		}
+	}
+
+	reachable := make([]snat.IPFamily, 0, len(families))
+	for _, family := range families {
+		if (family == snat.FamilyIPv4 && resolvedV4) || (family == snat.FamilyIPv6 && resolvedV6) {
+			reachable = append(reachable, family)
+		}
+	}
+	if len(reachable) == 0 {
+		return families, policy, resolved
+	}
+	return reachable, policy, resolved
+}
+
+// dialAddrs 经family的出口IP连接目标时依次尝试的地址：已解析时为该地址族的目标地址，否则为目标地址本身（由连接时解析）
+func dialAddrs(targetAddr string, resolved []net.IP, family snat.IPFamily) []string {
+	_, port, _ := net.SplitHostPort(targetAddr)
+	var addrs []string
+	for _, ip := range resolved {
+		if family.Matches(ip) {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+		}
+	}
+	if len(addrs) == 0 {
+		return []string{targetAddr}
+	}
+	return addrs
+}
+
+// exitIPFamilies 出口IP中是否有IPv4和IPv6地址
+func exitIPFamilies(exitIPs []string) (hasV4, hasV6 bool) {
+	for _, ipStr := range exitIPs {
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			continue
+		}
+		if snat.FamilyOf(ip) == snat.FamilyIPv4 {
+			hasV4 = true
+		} else {
+			hasV6 = true
+		}
+	}
+	return hasV4, hasV6
+}
+
+// familyNetwork 地址族对应的网络类型（如tcp4、udp6）
+func familyNetwork(network string, family snat.IPFamily) string {
+	switch family {
+	case snat.FamilyIPv4:
+		return network + "4"
+	case snat.FamilyIPv6:
+		return network + "6"
+	}
+	return network
+}
+
+// selectExitIPForTarget 按地址族依次选择出口IP，返回选中的IP及其地址族
+// 某个地址族没有可用的出口IP时尝试下一个，其他错误（如规则拒绝）直接返回
+func (s *Server) selectExitIPForTarget(st serverState, client snat.ClientInfo, targetAddr, host string, port int, families []snat.IPFamily) (net.IP, snat.IPFamily, error) {
+	var lastErr error
+	for _, family := range families {
+		ip, err := s.selectExitIP(st, client, targetAddr, host, port, family)
+		if err == nil {
+			return ip, family, nil
+		}
+		if !snat.IsNoIPAvailable(err) {
+			return nil, family, err
+		}
+		lastErr = err
+	}
+	return nil, snat.FamilyAny, lastErr
+}
+
+// dialHappyEyeballs 分别经两个地址族的出口IP连接目标（RFC 8305）：先经primary连接primaryAddrs，
+// 失败或超过happyEyeballsDelay仍未建立时才调用selectFallback选择另一地址族的出口IP并连接，返回先建立的连接及其出口IP
+func (s *Server) dialHappyEyeballs(st serverState, targetAddr string, primary net.IP, primaryAddrs []string, selectFallback func() (net.IP, []string, error)) (net.Conn, net.IP, error) {
+	type dialResult struct {
+		conn   net.Conn
+		exitIP net.IP
+		err    error
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	feedback := snat.FeedbackOf(st.ipSelector)
+	results := make(chan dialResult, 2)
+	dial := func(exitIP net.IP, addrs []string) {
+		dialStart := time.Now()
+		conn, err := s.dialEgressAddrs(ctx, st, familyNetwork("tcp", snat.FamilyOf(exitIP)), addrs, exitIP)
+		// 另一个出口IP先建立连接而被取消的尝试不计为失败
+		if err == nil || ctx.Err() == nil {
+			feedback.OnDialResult(exitIP, time.Since(dialStart), err)
+		}
+		results <- dialResult{conn: conn, exitIP: exitIP, err: err}
+	}
+
+	go dial(primary, primaryAddrs)
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+
+	pending := 1
+	fallbackStarted := false
+	startFallback := func() {
+		if fallbackStarted {
+			return
+		}
+		fallbackStarted = true
+		fallback, fallbackAddrs, err := selectFallback()
+		if err != nil {
+			logrus.Debugf("Happy eyeballs: no fallback exit IP for %s: %v", targetAddr, err)
+			return
+		}
+		pending++
+		go dial(fallback, fallbackAddrs)
+	}
+
+	var firstErr error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			startFallback()
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				// 关闭之后建立的连接
+				cancel()
+				go func(remaining int) {
+					for i := 0; i < remaining; i++ {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return result.conn, result.exitIP, nil
+			}
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			logrus.Debugf("Happy eyeballs: dial %s via %s failed: %v", targetAddr, result.exitIP, result.err)
+			startFallback()
+		}
+	}
+	return nil, primary, fmt.Errorf("failed to dial target: %w", firstErr)
+}
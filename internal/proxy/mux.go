@@ -0,0 +1,657 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"multiexit-proxy/internal/protocol"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 多路复用默认参数
+const (
+	muxStreamWindow      = 256 * 1024       // 每个流的接收窗口（字节）
+	muxKeepAliveInterval = 30 * time.Second // 会话心跳间隔
+	muxKeepAliveTimeout  = 90 * time.Second // 超过该时间未收到任何帧则关闭会话
+	muxOpenTimeout       = 30 * time.Second // 等待打开流响应的超时
+	muxAcceptBacklog     = 256              // 等待服务端接受的流数量上限
+	muxControlBacklog    = 256              // 等待发送的控制帧数量上限，超出时对端长时间不读取，关闭会话
+	muxWriteTimeout      = 30 * time.Second // 单帧写入超时
+)
+
+// 一帧对应一条v2记录，帧数据长度需扣除DataMessage头部（类型、流ID、长度）和HMAC字段
+const (
+	muxFrameOverhead = 1 + 4 + 2 + 4
+	muxMaxFrameData  = protocol.MaxRecordSize - muxFrameOverhead
+)
+
+var (
+	ErrMuxSessionClosed  = errors.New("mux session closed")
+	ErrMuxStreamClosed   = errors.New("mux stream closed")
+	ErrMuxStreamRejected = errors.New("mux stream rejected by server")
+)
+
+// MuxSession 多路复用会话，在一条已认证的加密连接上承载多个逻辑流
+// 每帧为一条v2 AEAD记录，明文为编码后的DataMessage
+// 所有帧由写循环串行写入：读循环和心跳只把控制帧放入队列，不会因对端不读取而阻塞
+type MuxSession struct {
+	conn      net.Conn
+	reader    *protocol.AEADReader
+	writer    *protocol.AEADWriter // 仅由写循环使用（AEADWriter非并发安全）
+	isClient  bool
+	frameCh   chan muxFrame // 流的数据帧和打开、关闭帧，写入结果返回给调用方
+	controlCh chan []byte   // 读循环和心跳发出的控制帧，优先于frameCh写入
+	mu        sync.Mutex
+	streams   map[uint32]*MuxStream
+	nextID    uint32
+	acceptCh  chan *MuxStream
+	closeCh   chan struct{}
+	closeOnce sync.Once
+	lastRecv  int64 // 原子操作，最后收到帧的时间（UnixNano）
+}
+
+// muxFrame 等待写循环写入的帧
+type muxFrame struct {
+	plaintext []byte
+	result    chan error
+}
+
+// NewMuxSession 创建多路复用会话并启动读循环和心跳
+// conn必须已完成握手认证，cipher用于加密本端发出的帧
+func NewMuxSession(conn net.Conn, cipher *protocol.ConnectionCipher, isClient bool) *MuxSession {
+	return newMuxSession(conn, cipher, cipher, isClient)
+}
+
+// newMuxSession 使用独立的读写加密器创建多路复用会话（会话密钥握手）
+func newMuxSession(conn net.Conn, readCipher, writeCipher protocol.RecordCipher, isClient bool) *MuxSession {
+	nextID := uint32(2)
+	if isClient {
+		nextID = 1 // 客户端使用奇数流ID，服务端使用偶数流ID
+	}
+	sess := &MuxSession{
+		conn:      conn,
+		reader:    protocol.NewAEADReader(conn, readCipher),
+		writer:    protocol.NewAEADWriter(conn, writeCipher),
+		isClient:  isClient,
+		streams:   make(map[uint32]*MuxStream),
+		nextID:    nextID,
+		frameCh:   make(chan muxFrame),
+		controlCh: make(chan []byte, muxControlBacklog),
+		acceptCh:  make(chan *MuxStream, muxAcceptBacklog),
+		closeCh:   make(chan struct{}),
+		lastRecv:  time.Now().UnixNano(),
+	}
+	go sess.readLoop()
+	go sess.writeLoop()
+	go sess.keepAlive()
+	return sess
+}
+
+// OpenStream 打开到目标地址的流，等待对端连接目标后返回
+func (sess *MuxSession) OpenStream(targetAddr string) (*MuxStream, error) {
+	reqData, err := buildConnectRequest(targetAddr)
+	if err != nil {
+		return nil, err
+	}
+	return sess.openStream(reqData, targetAddr)
+}
+
+// OpenUDPStream 打开UDP关联流，流中传输UDP数据报帧（protocol.UDPDatagram）
+func (sess *MuxSession) OpenUDPStream() (*MuxStream, error) {
+	return sess.openStream(protocol.EncodeUDPAssociateRequest(), "udp associate")
+}
+
+// openStream 发送打开流请求并等待对端响应（target仅用于错误信息）
+func (sess *MuxSession) openStream(reqData []byte, target string) (*MuxStream, error) {
+	sess.mu.Lock()
+	if sess.IsClosed() {
+		sess.mu.Unlock()
+		return nil, ErrMuxSessionClosed
+	}
+	id := sess.nextID
+	sess.nextID += 2
+	stream := newMuxStream(sess, id, nil)
+	sess.streams[id] = stream
+	sess.mu.Unlock()
+
+	if err := sess.writeFrame(protocol.MsgTypeOpen, id, reqData); err != nil {
+		sess.removeStream(id)
+		return nil, err
+	}
+
+	timer := time.NewTimer(muxOpenTimeout)
+	defer timer.Stop()
+
+	select {
+	case ok := <-stream.openResult:
+		if !ok {
+			sess.removeStream(id)
+			if sess.IsClosed() {
+				return nil, ErrMuxSessionClosed
+			}
+			return nil, ErrMuxStreamRejected
+		}
+		return stream, nil
+	case <-timer.C:
+		stream.Close()
+		return nil, fmt.Errorf("open stream to %s: timeout", target)
+	case <-sess.closeCh:
+		return nil, ErrMuxSessionClosed
+	}
+}
+
+// AcceptStream 接受对端打开的流（服务端使用）
+func (sess *MuxSession) AcceptStream() (*MuxStream, error) {
+	select {
+	case stream := <-sess.acceptCh:
+		return stream, nil
+	case <-sess.closeCh:
+		return nil, ErrMuxSessionClosed
+	}
+}
+
+// NumStreams 获取当前活跃流数量
+func (sess *MuxSession) NumStreams() int {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return len(sess.streams)
+}
+
+// IsClosed 会话是否已关闭
+func (sess *MuxSession) IsClosed() bool {
+	select {
+	case <-sess.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// CloseNotify 返回会话关闭时关闭的通道
+func (sess *MuxSession) CloseNotify() <-chan struct{} {
+	return sess.closeCh
+}
+
+// Close 关闭会话及其所有流
+func (sess *MuxSession) Close() error {
+	sess.closeWithError(ErrMuxSessionClosed)
+	return nil
+}
+
+// closeWithError 关闭会话并记录原因
+func (sess *MuxSession) closeWithError(err error) {
+	sess.closeOnce.Do(func() {
+		sess.mu.Lock()
+		streams := sess.streams
+		sess.streams = make(map[uint32]*MuxStream)
+		sess.mu.Unlock()
+
+		close(sess.closeCh)
+		sess.conn.Close()
+
+		for _, stream := range streams {
+			stream.remoteClose()
+		}
+		if err != ErrMuxSessionClosed {
+			logrus.Debugf("Mux session closed: %v", err)
+		}
+	})
+}
+
+// readLoop 读取并分发帧
+func (sess *MuxSession) readLoop() {
+	for {
+		plaintext, err := sess.reader.ReadRecord()
+		if err != nil {
+			sess.closeWithError(err)
+			return
+		}
+		atomic.StoreInt64(&sess.lastRecv, time.Now().UnixNano())
+
+		msg, err := protocol.DecodeDataMessage(plaintext)
+		if err != nil {
+			sess.closeWithError(fmt.Errorf("failed to decode frame: %w", err))
+			return
+		}
+
+		switch msg.Type {
+		case protocol.MsgTypeOpen:
+			sess.handleOpen(msg)
+		case protocol.MsgTypeOpenAck:
+			if stream := sess.getStream(msg.StreamID); stream != nil {
+				ok := len(msg.Data) > 0 && msg.Data[0] == 0x00
+				select {
+				case stream.openResult <- ok:
+				default:
+				}
+			}
+		case protocol.MsgTypeData:
+			stream := sess.getStream(msg.StreamID)
+			if stream == nil {
+				continue
+			}
+			if !stream.pushData(msg.Data) {
+				// 对端未遵守流控窗口，重置该流
+				logrus.Warnf("Mux stream %d exceeded receive window, resetting", msg.StreamID)
+				sess.removeStream(msg.StreamID)
+				stream.remoteClose()
+				sess.sendControl(protocol.MsgTypeClose, msg.StreamID, nil)
+			}
+		case protocol.MsgTypeWindowUpdate:
+			if stream := sess.getStream(msg.StreamID); stream != nil && len(msg.Data) >= 4 {
+				stream.addSendWindow(binary.BigEndian.Uint32(msg.Data[:4]))
+			}
+		case protocol.MsgTypeClose:
+			if stream := sess.getStream(msg.StreamID); stream != nil {
+				sess.removeStream(msg.StreamID)
+				stream.remoteClose()
+			}
+		case protocol.MsgTypePing:
+			sess.sendControl(protocol.MsgTypePong, 0, nil)
+		case protocol.MsgTypePong:
+			// lastRecv已更新
+		default:
+			logrus.Debugf("Mux session ignoring unknown frame type 0x%02x", msg.Type)
+		}
+	}
+}
+
+// handleOpen 处理对端打开流的请求
+func (sess *MuxSession) handleOpen(msg *protocol.DataMessage) {
+	if sess.isClient {
+		// 客户端不接受服务端发起的流
+		sess.sendControl(protocol.MsgTypeOpenAck, msg.StreamID, []byte{0x01})
+		return
+	}
+
+	stream := newMuxStream(sess, msg.StreamID, msg.Data)
+	sess.mu.Lock()
+	if _, exists := sess.streams[msg.StreamID]; exists {
+		sess.mu.Unlock()
+		sess.sendControl(protocol.MsgTypeOpenAck, msg.StreamID, []byte{0x01})
+		return
+	}
+	sess.streams[msg.StreamID] = stream
+	sess.mu.Unlock()
+
+	select {
+	case sess.acceptCh <- stream:
+	default:
+		// 积压过多，拒绝新流
+		sess.removeStream(msg.StreamID)
+		sess.sendControl(protocol.MsgTypeOpenAck, msg.StreamID, []byte{0x01})
+	}
+}
+
+// keepAlive 定期发送心跳，超时未收到任何帧时关闭会话
+func (sess *MuxSession) keepAlive() {
+	ticker := time.NewTicker(muxKeepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sess.closeCh:
+			return
+		case <-ticker.C:
+			lastRecv := time.Unix(0, atomic.LoadInt64(&sess.lastRecv))
+			if time.Since(lastRecv) > muxKeepAliveTimeout {
+				sess.closeWithError(fmt.Errorf("mux keepalive timeout"))
+				return
+			}
+			sess.sendControl(protocol.MsgTypePing, 0, nil)
+		}
+	}
+}
+
+// encodeFrame 编码一帧（AEAD已保证完整性，DataMessage的HMAC字段置零）
+func encodeFrame(msgType uint8, streamID uint32, data []byte) []byte {
+	return protocol.EncodeDataMessage(&protocol.DataMessage{
+		Type:     msgType,
+		StreamID: streamID,
+		Length:   uint16(len(data)),
+		Data:     data,
+	})
+}
+
+// writeFrame 由写循环加密并写入一帧，等待写入完成
+func (sess *MuxSession) writeFrame(msgType uint8, streamID uint32, data []byte) error {
+	frame := muxFrame{
+		plaintext: encodeFrame(msgType, streamID, data),
+		result:    make(chan error, 1),
+	}
+	select {
+	case sess.frameCh <- frame:
+	case <-sess.closeCh:
+		return ErrMuxSessionClosed
+	}
+	select {
+	case err := <-frame.result:
+		return err
+	case <-sess.closeCh:
+		return ErrMuxSessionClosed
+	}
+}
+
+// sendControl 将控制帧放入发送队列，不等待写入
+// 队列已满说明对端长时间不读取，关闭会话
+func (sess *MuxSession) sendControl(msgType uint8, streamID uint32, data []byte) {
+	select {
+	case sess.controlCh <- encodeFrame(msgType, streamID, data):
+	case <-sess.closeCh:
+	default:
+		sess.closeWithError(fmt.Errorf("mux control queue full"))
+	}
+}
+
+// writeLoop 串行写入帧，控制帧优先；每帧设置写超时，写入失败时关闭会话
+func (sess *MuxSession) writeLoop() {
+	for {
+		var frame muxFrame
+		select {
+		case frame.plaintext = <-sess.controlCh:
+		default:
+			select {
+			case frame.plaintext = <-sess.controlCh:
+			case frame = <-sess.frameCh:
+			case <-sess.closeCh:
+				return
+			}
+		}
+
+		sess.conn.SetWriteDeadline(time.Now().Add(muxWriteTimeout))
+		err := sess.writer.WriteRecord(frame.plaintext)
+		if frame.result != nil {
+			frame.result <- err
+		}
+		if err != nil {
+			sess.closeWithError(err)
+			return
+		}
+	}
+}
+
+// getStream 获取流
+func (sess *MuxSession) getStream(id uint32) *MuxStream {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.streams[id]
+}
+
+// removeStream 移除流
+func (sess *MuxSession) removeStream(id uint32) {
+	sess.mu.Lock()
+	delete(sess.streams, id)
+	sess.mu.Unlock()
+}
+
+// MuxStream 多路复用会话中的逻辑流（实现net.Conn）
+type MuxStream struct {
+	id          uint32
+	session     *MuxSession
+	openRequest []byte    // 对端打开流时携带的连接请求
+	openResult  chan bool // 打开流响应（客户端使用）
+
+	mu            sync.Mutex
+	readBuf       bytes.Buffer
+	unacked       uint32 // 已读取但尚未通知对端的字节数
+	sendWindow    int64  // 对端剩余接收窗口
+	localClosed   bool
+	remoteClosed  bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readNotify    chan struct{}
+	writeNotify   chan struct{}
+}
+
+// newMuxStream 创建流
+func newMuxStream(sess *MuxSession, id uint32, openRequest []byte) *MuxStream {
+	return &MuxStream{
+		id:          id,
+		session:     sess,
+		openRequest: openRequest,
+		openResult:  make(chan bool, 1),
+		sendWindow:  muxStreamWindow,
+		readNotify:  make(chan struct{}, 1),
+		writeNotify: make(chan struct{}, 1),
+	}
+}
+
+// ID 获取流ID
+func (st *MuxStream) ID() uint32 {
+	return st.id
+}
+
+// OpenRequest 获取打开流时携带的连接请求（服务端使用）
+func (st *MuxStream) OpenRequest() []byte {
+	return st.openRequest
+}
+
+// Accept 通知对端流已建立（服务端连接目标成功后调用）
+func (st *MuxStream) Accept() error {
+	return st.session.writeFrame(protocol.MsgTypeOpenAck, st.id, []byte{0x00})
+}
+
+// Reject 通知对端打开流失败并关闭流
+func (st *MuxStream) Reject() error {
+	st.mu.Lock()
+	st.localClosed = true
+	st.mu.Unlock()
+	st.session.removeStream(st.id)
+	notifyChan(st.readNotify)
+	notifyChan(st.writeNotify)
+	return st.session.writeFrame(protocol.MsgTypeOpenAck, st.id, []byte{0x01})
+}
+
+// Read 读取数据
+func (st *MuxStream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.readBuf.Len() > 0 {
+			n, _ := st.readBuf.Read(p)
+			st.unacked += uint32(n)
+			var update uint32
+			if st.unacked >= muxStreamWindow/2 && !st.remoteClosed {
+				update = st.unacked
+				st.unacked = 0
+			}
+			st.mu.Unlock()
+
+			if update > 0 {
+				var data [4]byte
+				binary.BigEndian.PutUint32(data[:], update)
+				st.session.writeFrame(protocol.MsgTypeWindowUpdate, st.id, data[:])
+			}
+			return n, nil
+		}
+		if st.remoteClosed || st.session.IsClosed() {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		if st.localClosed {
+			st.mu.Unlock()
+			return 0, ErrMuxStreamClosed
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err := st.wait(st.readNotify, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write 写入数据（受对端接收窗口限制）
+func (st *MuxStream) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		st.mu.Lock()
+		if st.localClosed || st.remoteClosed {
+			st.mu.Unlock()
+			return total, ErrMuxStreamClosed
+		}
+		if st.session.IsClosed() {
+			st.mu.Unlock()
+			return total, ErrMuxSessionClosed
+		}
+		if st.sendWindow <= 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := st.wait(st.writeNotify, deadline); err != nil {
+				return total, err
+			}
+			continue
+		}
+		n := len(p)
+		if n > muxMaxFrameData {
+			n = muxMaxFrameData
+		}
+		if int64(n) > st.sendWindow {
+			n = int(st.sendWindow)
+		}
+		st.sendWindow -= int64(n)
+		st.mu.Unlock()
+
+		if err := st.session.writeFrame(protocol.MsgTypeData, st.id, p[:n]); err != nil {
+			return total, err
+		}
+		total += n
+		p = p[n:]
+	}
+	return total, nil
+}
+
+// Close 关闭流并通知对端
+func (st *MuxStream) Close() error {
+	st.mu.Lock()
+	if st.localClosed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	remoteClosed := st.remoteClosed
+	st.mu.Unlock()
+
+	notifyChan(st.readNotify)
+	notifyChan(st.writeNotify)
+	st.session.removeStream(st.id)
+
+	if !remoteClosed {
+		err := st.session.writeFrame(protocol.MsgTypeClose, st.id, nil)
+		if err != nil && err != ErrMuxSessionClosed {
+			return err
+		}
+	}
+	return nil
+}
+
+// LocalAddr 本地地址
+func (st *MuxStream) LocalAddr() net.Addr {
+	return st.session.conn.LocalAddr()
+}
+
+// RemoteAddr 远端地址
+func (st *MuxStream) RemoteAddr() net.Addr {
+	return st.session.conn.RemoteAddr()
+}
+
+// SetDeadline 设置读写超时
+func (st *MuxStream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+// SetReadDeadline 设置读超时
+func (st *MuxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notifyChan(st.readNotify)
+	return nil
+}
+
+// SetWriteDeadline 设置写超时
+func (st *MuxStream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notifyChan(st.writeNotify)
+	return nil
+}
+
+// pushData 写入对端发来的数据，超出接收窗口时返回false
+func (st *MuxStream) pushData(data []byte) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.localClosed {
+		return true // 本端已关闭，丢弃
+	}
+	if st.readBuf.Len()+len(data) > muxStreamWindow {
+		return false
+	}
+	st.readBuf.Write(data)
+	notifyChan(st.readNotify)
+	return true
+}
+
+// addSendWindow 增加发送窗口
+func (st *MuxStream) addSendWindow(delta uint32) {
+	st.mu.Lock()
+	st.sendWindow += int64(delta)
+	st.mu.Unlock()
+	notifyChan(st.writeNotify)
+}
+
+// remoteClose 标记对端已关闭
+func (st *MuxStream) remoteClose() {
+	st.mu.Lock()
+	st.remoteClosed = true
+	st.mu.Unlock()
+
+	select {
+	case st.openResult <- false:
+	default:
+	}
+	notifyChan(st.readNotify)
+	notifyChan(st.writeNotify)
+}
+
+// wait 等待通知、超时或会话关闭
+func (st *MuxStream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-st.session.closeCh:
+		return nil // 会话关闭时流已被标记为对端关闭
+	}
+}
+
+// notifyChan 非阻塞通知
+func notifyChan(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
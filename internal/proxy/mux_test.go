@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"multiexit-proxy/internal/protocol"
+)
+
+// newTestMuxPair 创建一对通过内存管道连接的多路复用会话
+func newTestMuxPair(t *testing.T) (*MuxSession, *MuxSession) {
+	cipher, err := protocol.NewCipher(protocol.DeriveKeyFromPSK("test-key"), true)
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+	clientConn, serverConn := net.Pipe()
+	client := NewMuxSession(clientConn, protocol.NewConnectionCipher(cipher), true)
+	server := NewMuxSession(serverConn, protocol.NewConnectionCipher(cipher), false)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestMuxSession_Echo(t *testing.T) {
+	client, server := newTestMuxPair(t)
+
+	// 服务端：接受流并回显
+	go func() {
+		for {
+			stream, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			req, err := protocol.DecodeConnectRequest(stream.OpenRequest())
+			if err != nil || protocol.BuildAddress(req.AddrType, req.Address, req.Port) != "example.com:443" {
+				stream.Reject()
+				continue
+			}
+			stream.Accept()
+			go func(s *MuxStream) {
+				io.Copy(s, s)
+				s.Close()
+			}(stream)
+		}
+	}()
+
+	// 多个流并发使用同一会话
+	for i := 0; i < 3; i++ {
+		stream, err := client.OpenStream("example.com:443")
+		if err != nil {
+			t.Fatalf("OpenStream failed: %v", err)
+		}
+
+		// 发送超过接收窗口的数据，验证流控
+		data := make([]byte, muxStreamWindow*2+123)
+		rand.Read(data)
+		go stream.Write(data)
+
+		received := make([]byte, len(data))
+		stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(stream, received); err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if !bytes.Equal(data, received) {
+			t.Fatal("Echoed data mismatch")
+		}
+		stream.Close()
+	}
+}
+
+func TestMuxSession_Reject(t *testing.T) {
+	client, server := newTestMuxPair(t)
+
+	go func() {
+		stream, err := server.AcceptStream()
+		if err != nil {
+			return
+		}
+		stream.Reject()
+	}()
+
+	if _, err := client.OpenStream("example.com:80"); err != ErrMuxStreamRejected {
+		t.Errorf("Expected ErrMuxStreamRejected, got %v", err)
+	}
+}
+
+func TestMuxSession_CloseStream(t *testing.T) {
+	client, server := newTestMuxPair(t)
+
+	accepted := make(chan *MuxStream, 1)
+	go func() {
+		stream, err := server.AcceptStream()
+		if err != nil {
+			return
+		}
+		stream.Accept()
+		accepted <- stream
+	}()
+
+	stream, err := client.OpenStream("10.0.0.1:22")
+	if err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+	serverStream := <-accepted
+
+	// 服务端发送数据后关闭，客户端读完数据后收到EOF
+	serverStream.Write([]byte("bye"))
+	serverStream.Close()
+
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if string(data) != "bye" {
+		t.Errorf("Expected 'bye', got %q", data)
+	}
+	if _, err := stream.Write([]byte("x")); err == nil {
+		t.Error("Write after remote close should fail")
+	}
+}
+
+func TestMuxSession_SessionClose(t *testing.T) {
+	client, server := newTestMuxPair(t)
+
+	go func() {
+		stream, err := server.AcceptStream()
+		if err != nil {
+			return
+		}
+		stream.Accept()
+	}()
+
+	stream, err := client.OpenStream("10.0.0.1:22")
+	if err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+
+	server.Close()
+
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stream.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected EOF after session close, got %v", err)
+	}
+	select {
+	case <-client.CloseNotify():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client session should close when peer closes")
+	}
+	if _, err := client.OpenStream("10.0.0.1:22"); err != ErrMuxSessionClosed {
+		t.Errorf("Expected ErrMuxSessionClosed, got %v", err)
+	}
+}
+
+func TestMuxStream_ReadDeadline(t *testing.T) {
+	client, server := newTestMuxPair(t)
+
+	go func() {
+		stream, err := server.AcceptStream()
+		if err != nil {
+			return
+		}
+		stream.Accept()
+	}()
+
+	stream, err := client.OpenStream("10.0.0.1:22")
+	if err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+
+	stream.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = stream.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("Expected timeout error, got %v", err)
+	}
+}
+
+func TestMuxSession_PeerNotReading(t *testing.T) {
+	cipher, err := protocol.NewCipher(protocol.DeriveKeyFromPSK("test-key"), true)
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+	peerConn, serverConn := net.Pipe()
+	defer peerConn.Close()
+	server := NewMuxSession(serverConn, protocol.NewConnectionCipher(cipher), false)
+	defer server.Close()
+
+	// 对端只发送心跳不读取：读循环不能因回复Pong而阻塞，控制帧积压超出上限后关闭会话
+	go func() {
+		writer := protocol.NewAEADWriter(peerConn, protocol.NewConnectionCipher(cipher))
+		ping := encodeFrame(protocol.MsgTypePing, 0, nil)
+		for i := 0; i < muxControlBacklog+16; i++ {
+			if err := writer.WriteRecord(ping); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-server.CloseNotify():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Session blocked on a peer that does not read")
+	}
+}
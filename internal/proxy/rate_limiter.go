@@ -21,6 +21,9 @@ type RateLimiter struct {
 	
 	// 全局限流
 	globalLimit   *GlobalLimit
+	
+	// 新用户的默认限制（未通过SetUserLimit设置的用户）
+	userDefaults  RateLimitConfig
 }
 
 // IPLimit IP限流配置
@@ -74,6 +77,7 @@ func NewRateLimiter(config RateLimitConfig) *RateLimiter {
 	return &RateLimiter{
 		ipLimits: make(map[string]*IPLimit),
 		userLimits: make(map[string]*UserLimit),
+		userDefaults: config,
 		globalLimit: &GlobalLimit{
 			MaxConnections: int64(config.GlobalMaxConnections),
 			RateLimit:      config.GlobalRateLimit,
@@ -153,8 +157,15 @@ func (rl *RateLimiter) CheckUser(username string) bool {
 		limit = &UserLimit{
 			MaxConnections: 10, // 默认值
 			RateLimit:      5,  // 默认值
+			BandwidthLimit: rl.userDefaults.UserBandwidthLimit,
 			LastReset:      time.Now(),
 		}
+		if rl.userDefaults.UserMaxConnections > 0 {
+			limit.MaxConnections = rl.userDefaults.UserMaxConnections
+		}
+		if rl.userDefaults.UserRateLimit > 0 {
+			limit.RateLimit = rl.userDefaults.UserRateLimit
+		}
 		rl.userLimits[username] = limit
 	}
 	rl.userMu.Unlock()
@@ -0,0 +1,266 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+
+	"multiexit-proxy/internal/snat"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ReloadResult 配置热重载结果
+type ReloadResult struct {
+	Applied         []string `json:"applied"`          // 已在运行时生效的配置段
+	RestartRequired []string `json:"restart_required"` // 已变更但需要重启才能生效的配置段
+}
+
+// NeedsRestart 是否存在需要重启才能生效的变更
+func (r *ReloadResult) NeedsRestart() bool {
+	return len(r.RestartRequired) > 0
+}
+
+// ApplyConfig 将新配置应用到运行中的服务端
+// 出口IP、选择器链、规则、速率限制、超时和健康检查会原子替换，已建立的连接不受影响；
+// 监听地址、TLS证书、认证密钥、重放过滤等无法在运行时替换的变更只记录在RestartRequired中，保持旧值继续运行
+func (s *Server) ApplyConfig(newConfig *ServerConfig) (*ReloadResult, error) {
+	if newConfig == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	s.mu.RLock()
+	oldConfig := s.config
+	s.mu.RUnlock()
+
+	result := &ReloadResult{}
+	merged := *newConfig
+
+	// 需要重启的配置段：保留旧值，下次重载时仍会报告
+	if newConfig.ListenAddr != oldConfig.ListenAddr {
+		result.RestartRequired = append(result.RestartRequired, "server.listen")
+		merged.ListenAddr = oldConfig.ListenAddr
+	}
+	if !reflect.DeepEqual(newConfig.TLSConfig, oldConfig.TLSConfig) {
+		result.RestartRequired = append(result.RestartRequired, "server.tls")
+		merged.TLSConfig = oldConfig.TLSConfig
+	}
+	if newConfig.AuthKey != oldConfig.AuthKey {
+		result.RestartRequired = append(result.RestartRequired, "auth")
+		merged.AuthKey = oldConfig.AuthKey
+	}
+	if newConfig.EnableStats != oldConfig.EnableStats {
+		result.RestartRequired = append(result.RestartRequired, "monitor")
+		merged.EnableStats = oldConfig.EnableStats
+	}
+	if newConfig.EnableTrafficAnalysis != oldConfig.EnableTrafficAnalysis ||
+		!reflect.DeepEqual(newConfig.TrafficAnalysis, oldConfig.TrafficAnalysis) {
+		result.RestartRequired = append(result.RestartRequired, "traffic_analysis")
+		merged.EnableTrafficAnalysis = oldConfig.EnableTrafficAnalysis
+		merged.TrafficAnalysis = oldConfig.TrafficAnalysis
+	}
+	if !reflect.DeepEqual(newConfig.Cluster, oldConfig.Cluster) {
+		result.RestartRequired = append(result.RestartRequired, "cluster")
+		merged.Cluster = oldConfig.Cluster
+	}
+	if newConfig.Protocol != oldConfig.Protocol || !reflect.DeepEqual(newConfig.Trojan, oldConfig.Trojan) {
+		result.RestartRequired = append(result.RestartRequired, "trojan")
+		merged.Protocol = oldConfig.Protocol
+		merged.Trojan = oldConfig.Trojan
+	}
+	if newConfig.ReplayProtection != oldConfig.ReplayProtection {
+		result.RestartRequired = append(result.RestartRequired, "replay_protection")
+		merged.ReplayProtection = oldConfig.ReplayProtection
+	}
+
+	// 可热重载的配置段
+	exitIPsChanged := !reflect.DeepEqual(merged.ExitIPs, oldConfig.ExitIPs)
+	strategyChanged := merged.Strategy != oldConfig.Strategy || merged.StrategyParam != oldConfig.StrategyParam ||
+		!reflect.DeepEqual(merged.PortRanges, oldConfig.PortRanges) || merged.HashKey != oldConfig.HashKey ||
+		!reflect.DeepEqual(merged.Weights, oldConfig.Weights) || !reflect.DeepEqual(merged.Limits, oldConfig.Limits)
+	healthChanged := merged.HealthCheck != oldConfig.HealthCheck
+	geoChanged := merged.GeoLocation != oldConfig.GeoLocation
+	stickyChanged := !reflect.DeepEqual(merged.Sticky, oldConfig.Sticky)
+	rulesChanged := !reflect.DeepEqual(merged.Rules, oldConfig.Rules)
+	snatChanged := merged.SNAT != oldConfig.SNAT || (merged.SNAT.Enabled && exitIPsChanged)
+	egressChanged := merged.Egress != oldConfig.Egress
+	connectionChanged := merged.Connection != oldConfig.Connection
+	rateLimitChanged := merged.RateLimit != oldConfig.RateLimit
+	ruleEngineChanged := merged.RuleEngine.Enabled != oldConfig.RuleEngine.Enabled
+	keyExchangeChanged := merged.RequireForwardSecrecy != oldConfig.RequireForwardSecrecy ||
+		merged.KeyRotation != oldConfig.KeyRotation
+	ciphersChanged := !reflect.DeepEqual(merged.CipherSuites, oldConfig.CipherSuites)
+	udpChanged := merged.UDP != oldConfig.UDP
+
+	for _, section := range []struct {
+		name    string
+		changed bool
+	}{
+		{"exit_ips", exitIPsChanged},
+		{"strategy", strategyChanged},
+		{"health_check", healthChanged},
+		{"geo_location", geoChanged},
+		{"sticky", stickyChanged},
+		{"rules", rulesChanged},
+		{"snat", snatChanged},
+		{"egress", egressChanged},
+		{"connection", connectionChanged},
+		{"rate_limit", rateLimitChanged},
+		{"rule_engine", ruleEngineChanged},
+		{"auth.key_exchange", keyExchangeChanged},
+		{"auth.ciphers", ciphersChanged},
+		{"udp", udpChanged},
+	} {
+		if section.changed {
+			result.Applied = append(result.Applied, section.name)
+		}
+	}
+
+	if len(result.Applied) == 0 {
+		s.logReloadResult(result)
+		return result, nil
+	}
+
+	// 先创建所有新组件，失败时不影响当前运行状态
+	var newSelector snat.IPSelector
+	var newHealthChecker *snat.IPHealthChecker
+	var newStickySelector *snat.StickySelector
+	selectorChanged := exitIPsChanged || strategyChanged || healthChanged || geoChanged || stickyChanged || rulesChanged
+	if selectorChanged {
+		ipList, err := parseExitIPs(merged.ExitIPs)
+		if err != nil {
+			return nil, err
+		}
+		if len(ipList) == 0 {
+			return nil, fmt.Errorf("no exit IPs configured")
+		}
+		newSelector, newHealthChecker, newStickySelector, err = buildIPSelector(&merged, ipList, s.exitPool.load)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var newRuleEngine *RuleEngine
+	if ruleEngineChanged && merged.RuleEngine.Enabled {
+		newRuleEngine = NewRuleEngine()
+		for _, rule := range merged.RuleEngine.Rules {
+			if err := newRuleEngine.AddRule(rule); err != nil {
+				logrus.Warnf("Failed to add rule %s: %v", rule.ID, err)
+			}
+		}
+	}
+
+	// SNAT配置变化：先按新配置创建并设置路由管理器，替换后再清理旧的路由管理器，期间不持有s.mu
+	// 后端相同时沿用旧后端，新路由管理器的Setup直接把路由调整为新配置，旧路由管理器无需清理
+	s.mu.RLock()
+	oldRoutingMgr := s.routingMgr
+	s.mu.RUnlock()
+	rebuildRouting := snatChanged && (merged.SNAT != oldConfig.SNAT || oldRoutingMgr == nil)
+	reuseBackend := false
+	var newRoutingMgr *snat.RoutingManager
+	if rebuildRouting {
+		var backend snat.RoutingBackend
+		if oldRoutingMgr != nil && merged.SNAT.Enabled && merged.SNAT.Backend == oldConfig.SNAT.Backend {
+			backend = oldRoutingMgr.Backend()
+			reuseBackend = true
+		}
+		var err error
+		newRoutingMgr, err = newRoutingManager(&merged, backend)
+		if err != nil {
+			// 共用的后端可能已按新配置改动部分路由，恢复旧的路由规则
+			if reuseBackend {
+				if restoreErr := oldRoutingMgr.Setup(); restoreErr != nil {
+					logrus.Errorf("Failed to restore routing after reload error: %v", restoreErr)
+				}
+			}
+			if newHealthChecker != nil {
+				newHealthChecker.Stop()
+			}
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+
+	if rebuildRouting {
+		s.routingMgr = newRoutingMgr
+	} else if snatChanged && s.routingMgr != nil {
+		// 只有出口IP变化：在原路由管理器上增删，其他IP的标记和已建立的连接不受影响
+		ipList, err := parseExitIPs(merged.ExitIPs)
+		if err == nil {
+			err = s.routingMgr.SetIPs(s.routedIPs(ipList))
+		}
+		if err != nil {
+			s.mu.Unlock()
+			if newHealthChecker != nil {
+				newHealthChecker.Stop()
+			}
+			return nil, err
+		}
+	}
+
+	// 重新加入配置的IP结束排空
+	for _, ipStr := range merged.ExitIPs {
+		if ip := net.ParseIP(ipStr); ip != nil {
+			s.exitPool.stopDrain(ip.String())
+		}
+	}
+
+	var oldHealthChecker *snat.IPHealthChecker
+	if selectorChanged {
+		oldHealthChecker = s.healthChecker
+		// 保持仍然有效的粘性会话，避免重载后客户端的出口IP跳变
+		if newStickySelector != nil && s.stickySelector != nil {
+			newStickySelector.ImportSessions(s.stickySelector)
+		}
+		s.ipSelector = newSelector
+		s.healthChecker = newHealthChecker
+		s.stickySelector = newStickySelector
+	}
+	if connectionChanged {
+		s.connManager.UpdateSettings(
+			merged.Connection.MaxConnections,
+			merged.Connection.ReadTimeout,
+			merged.Connection.WriteTimeout,
+			merged.Connection.IdleTimeout,
+			merged.Connection.DialTimeout,
+			merged.Connection.KeepAlive,
+			merged.Connection.KeepAliveTime,
+		)
+	}
+	if rateLimitChanged {
+		// 新限制器从零开始计数，已建立的连接仍归还到旧限制器
+		s.rateLimiter = newRateLimiter(&merged)
+	}
+	if ruleEngineChanged {
+		s.ruleEngine = newRuleEngine
+	}
+	s.config = &merged
+
+	s.mu.Unlock()
+
+	if oldHealthChecker != nil {
+		oldHealthChecker.Stop()
+	}
+	if rebuildRouting && oldRoutingMgr != nil && !reuseBackend {
+		oldRoutingMgr.CleanupExcept(newRoutingMgr)
+	}
+
+	s.logReloadResult(result)
+	return result, nil
+}
+
+// logReloadResult 记录热重载结果
+func (s *Server) logReloadResult(result *ReloadResult) {
+	if len(result.Applied) > 0 {
+		logrus.Infof("Config reloaded, applied sections: %v", result.Applied)
+	} else {
+		logrus.Info("Config reloaded, no runtime changes")
+	}
+	if result.NeedsRestart() {
+		logrus.Warnf("Config sections changed but require restart to take effect: %v", result.RestartRequired)
+	}
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"multiexit-proxy/internal/snat"
+)
+
+// newReloadTestServer 创建不监听端口的服务端（仅用于热重载测试）
+func newReloadTestServer(t *testing.T, config *ServerConfig) *Server {
+	ipList, err := parseExitIPs(config.ExitIPs)
+	if err != nil {
+		t.Fatalf("parseExitIPs failed: %v", err)
+	}
+	selector, healthChecker, stickySelector, err := buildIPSelector(config, ipList, nil)
+	if err != nil {
+		t.Fatalf("buildIPSelector failed: %v", err)
+	}
+	return &Server{
+		config:         config,
+		ipSelector:     selector,
+		healthChecker:  healthChecker,
+		stickySelector: stickySelector,
+		connManager:    NewConnectionManager(0, 0, 0, 0, 0, false, 0),
+	}
+}
+
+func TestServer_ApplyConfig_ExitIPs(t *testing.T) {
+	s := newReloadTestServer(t, &ServerConfig{
+		ListenAddr: "127.0.0.1:0",
+		AuthKey:    "test-key",
+		ExitIPs:    []string{"10.0.0.1"},
+		Strategy:   "round_robin",
+	})
+
+	newConfig := *s.config
+	newConfig.ExitIPs = []string{"10.0.0.2", "10.0.0.3"}
+	newConfig.Connection.MaxConnections = 5
+
+	result, err := s.ApplyConfig(&newConfig)
+	if err != nil {
+		t.Fatalf("ApplyConfig failed: %v", err)
+	}
+	if result.NeedsRestart() {
+		t.Errorf("Expected no restart required, got %v", result.RestartRequired)
+	}
+	if len(result.Applied) != 2 || result.Applied[0] != "exit_ips" || result.Applied[1] != "connection" {
+		t.Errorf("Unexpected applied sections: %v", result.Applied)
+	}
+
+	// 新选择器只返回新的出口IP
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		ip, err := s.ipSelector.SelectIP("example.com", 443)
+		if err != nil {
+			t.Fatalf("SelectIP failed: %v", err)
+		}
+		seen[ip.String()] = true
+	}
+	if seen["10.0.0.1"] || !seen["10.0.0.2"] || !seen["10.0.0.3"] {
+		t.Errorf("Selector not swapped, selected: %v", seen)
+	}
+
+	if s.connManager.maxConnections != 5 {
+		t.Errorf("Expected max connections 5, got %d", s.connManager.maxConnections)
+	}
+}
+
+func TestServer_ApplyConfig_RestartRequired(t *testing.T) {
+	s := newReloadTestServer(t, &ServerConfig{
+		ListenAddr: "127.0.0.1:0",
+		AuthKey:    "test-key",
+		ExitIPs:    []string{"10.0.0.1"},
+		Strategy:   "round_robin",
+	})
+
+	newConfig := *s.config
+	newConfig.ListenAddr = "127.0.0.1:8443"
+	newConfig.AuthKey = "other-key"
+
+	result, err := s.ApplyConfig(&newConfig)
+	if err != nil {
+		t.Fatalf("ApplyConfig failed: %v", err)
+	}
+	if len(result.Applied) != 0 {
+		t.Errorf("Expected nothing applied, got %v", result.Applied)
+	}
+	if len(result.RestartRequired) != 2 || result.RestartRequired[0] != "server.listen" || result.RestartRequired[1] != "auth" {
+		t.Errorf("Unexpected restart required sections: %v", result.RestartRequired)
+	}
+
+	// 需要重启的配置保持旧值，再次应用仍会报告
+	if s.config.ListenAddr != "127.0.0.1:0" || s.config.AuthKey != "test-key" {
+		t.Errorf("Restart-only fields should keep old values")
+	}
+	result, err = s.ApplyConfig(&newConfig)
+	if err != nil {
+		t.Fatalf("ApplyConfig failed: %v", err)
+	}
+	if len(result.RestartRequired) != 2 {
+		t.Errorf("Expected pending restart to be reported again, got %v", result.RestartRequired)
+	}
+}
+
+func TestServer_ApplyConfig_InvalidKeepsState(t *testing.T) {
+	s := newReloadTestServer(t, &ServerConfig{
+		ListenAddr: "127.0.0.1:0",
+		AuthKey:    "test-key",
+		ExitIPs:    []string{"10.0.0.1"},
+		Strategy:   "round_robin",
+	})
+	oldSelector := s.ipSelector
+
+	newConfig := *s.config
+	newConfig.ExitIPs = []string{"not-an-ip"}
+	if _, err := s.ApplyConfig(&newConfig); err == nil {
+		t.Fatal("Expected error for invalid exit IP")
+	}
+
+	if s.ipSelector != oldSelector {
+		t.Error("Selector should not change when reload fails")
+	}
+	ip, err := s.ipSelector.SelectIP("example.com", 443)
+	if err != nil || !ip.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("Expected old exit IP, got %v (%v)", ip, err)
+	}
+}
+
+func TestServer_ApplyConfig_RateLimiter(t *testing.T) {
+	s := newReloadTestServer(t, &ServerConfig{
+		ListenAddr: "127.0.0.1:0",
+		AuthKey:    "test-key",
+		ExitIPs:    []string{"10.0.0.1"},
+		Strategy:   "round_robin",
+	})
+
+	newConfig := *s.config
+	newConfig.RateLimit.Enabled = true
+	newConfig.RateLimit.IPMaxConnections = 1
+	if _, err := s.ApplyConfig(&newConfig); err != nil {
+		t.Fatalf("ApplyConfig failed: %v", err)
+	}
+	if s.rateLimiter == nil {
+		t.Fatal("Rate limiter should be created")
+	}
+
+	newConfig.RateLimit.Enabled = false
+	if _, err := s.ApplyConfig(&newConfig); err != nil {
+		t.Fatalf("ApplyConfig failed: %v", err)
+	}
+	if s.rateLimiter != nil {
+		t.Error("Rate limiter should be removed")
+	}
+}
+
+func TestServer_ApplyConfig_StickySessions(t *testing.T) {
+	config := &ServerConfig{
+		ListenAddr: "127.0.0.1:0",
+		AuthKey:    "test-key",
+		ExitIPs:    []string{"10.0.0.1", "10.0.0.2"},
+		Strategy:   "round_robin",
+	}
+	config.Sticky.Enabled = true
+	s := newReloadTestServer(t, config)
+
+	client := snat.ClientInfo{Addr: net.ParseIP("192.168.1.10")}
+	first, err := snat.SelectIPForClient(s.ipSelector, client, "example.com", 443, snat.FamilyAny)
+	if err != nil {
+		t.Fatalf("SelectIPForClient failed: %v", err)
+	}
+
+	// 增加出口IP重建选择器链后会话仍然有效
+	newConfig := *s.config
+	newConfig.ExitIPs = []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	if _, err := s.ApplyConfig(&newConfig); err != nil {
+		t.Fatalf("ApplyConfig failed: %v", err)
+	}
+	if ip, _ := snat.SelectIPForClient(s.ipSelector, client, "example.com", 443, snat.FamilyAny); !ip.Equal(first) {
+		t.Errorf("Expected sticky IP %s after reload, got %s", first, ip)
+	}
+
+	sessions, err := s.StickySessions()
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("Expected 1 session, got %v, %v", sessions, err)
+	}
+	if evicted, err := s.EvictStickySessions("", first.String()); err != nil || evicted != 1 {
+		t.Errorf("Expected 1 session evicted, got %d, %v", evicted, err)
+	}
+
+	// 关闭粘性会话
+	newConfig.Sticky.Enabled = false
+	if _, err := s.ApplyConfig(&newConfig); err != nil {
+		t.Fatalf("ApplyConfig failed: %v", err)
+	}
+	if _, err := s.StickySessions(); err != ErrStickyDisabled {
+		t.Errorf("Expected ErrStickyDisabled, got %v", err)
+	}
+}
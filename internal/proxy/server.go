@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"context"
+	"crypto/rand"
 	"fmt"
 	"io"
 	"net"
@@ -12,18 +13,25 @@ import (
 
 	"multiexit-proxy/internal/monitor"
 	"multiexit-proxy/internal/protocol"
+	"multiexit-proxy/internal/security"
 	"multiexit-proxy/internal/snat"
 	"multiexit-proxy/internal/transport"
+	"multiexit-proxy/internal/trojan"
 
 	"github.com/sirupsen/logrus"
 )
 
+// handshakeMaxSkew 握手时间戳与服务端时间允许的最大偏差
+const handshakeMaxSkew = 5 * time.Minute
+
 // Server 代理服务端
 type Server struct {
 	config          *ServerConfig
-	cipher          *protocol.Cipher
+	cipher          *protocol.Cipher                          // 握手加密器（固定为AES-256-GCM）
+	ciphers         map[protocol.CipherSuite]*protocol.Cipher // 可协商的数据加密器
 	ipSelector      snat.IPSelector
 	healthChecker   *snat.IPHealthChecker
+	stickySelector  *snat.StickySelector // 粘性会话表（未启用时为nil）
 	routingMgr      *snat.RoutingManager
 	listener        net.Listener
 	connManager     *ConnectionManager
@@ -31,6 +39,12 @@ type Server struct {
 	trafficAnalyzer *monitor.TrafficAnalyzer // 流量分析器
 	ruleEngine      *RuleEngine              // 规则引擎
 	rateLimiter     *RateLimiter             // 速率限制器
+	clusterMgr      *ClusterManager          // 集群管理器
+	replayFilter    security.ReplayFilter    // 握手重放过滤器（nil表示关闭）
+	trojan          *trojan.Server           // Trojan入站（入站协议为trojan时）
+	exitPool        exitIPPool               // 出口IP的活跃连接数和排空状态
+	mu              sync.RWMutex             // 保护可热重载的字段（config、ipSelector、healthChecker、stickySelector、routingMgr、ruleEngine、rateLimiter）
+	reloadMu        sync.Mutex               // 串行化配置热重载
 	shutdownCtx     context.Context
 	shutdownCancel  context.CancelFunc
 	shutdownWg      sync.WaitGroup
@@ -40,11 +54,16 @@ type Server struct {
 // ServerConfig 服务端配置（简化版，实际应从config包导入）
 type ServerConfig struct {
 	ListenAddr    string
+	Protocol      string // 入站协议：native（默认）或 trojan
 	TLSConfig     *transport.ServerTLSConfig
 	AuthKey       string
 	ExitIPs       []string
 	Strategy      string
-	StrategyParam string // load_balanced策略参数：connections 或 traffic
+	StrategyParam string                    // load_balanced策略参数：connections 或 traffic；least_load策略参数：connections 或 bandwidth
+	PortRanges    []PortRangeConfig         // port_based策略的端口范围
+	HashKey       string                    // destination_based策略的哈希键（见snat.HashKey*）
+	Weights       map[string]float64        // 出口IP的权重（IP -> 权重）
+	Limits        map[string]snat.ExitLimit // 出口IP的容量上限（IP -> 上限），weighted_round_robin和least_load策略使用
 	HealthCheck   struct {
 		Enabled  bool
 		Interval time.Duration
@@ -63,6 +82,13 @@ type ServerConfig struct {
 		Enabled   bool
 		Gateway   string
 		Interface string
+		Backend   string
+		GatewayV6 string // IPv6出口IP的网关（为空时经接口直接出站）
+	}
+	Egress struct {
+		Mode         string // bind、mark或both（空表示启用SNAT时为both，否则为bind）
+		BindNoPort   bool   // 绑定源地址时设置IP_BIND_ADDRESS_NO_PORT
+		FamilyPolicy string // 目标为域名时的地址族策略（见snat.FamilyPolicy*，空表示prefer_v4）
 	}
 	EnableStats bool // 是否启用统计
 	GeoLocation struct {
@@ -71,16 +97,13 @@ type ServerConfig struct {
 		LatencyOptimize bool
 		DBPath          string // GeoIP数据库路径（可选）
 	}
-	Rules []struct {
-		Name        string
-		Priority    int
-		MatchDomain []string
-		MatchIP     []string
-		MatchPort   []int
-		TargetIP    string
-		Action      string
+	Sticky struct {
 		Enabled     bool
+		Key         []string      // 会话键的组成部分（见snat.StickyKey*）
+		IdleTTL     time.Duration // 会话空闲超时（0表示默认值）
+		MaxLifetime time.Duration // 会话最长存活时间（0表示默认值）
 	}
+	Rules                 []SelectorRuleConfig
 	EnableTrafficAnalysis bool
 	TrafficAnalysis       struct {
 		Enabled          bool
@@ -92,9 +115,10 @@ type ServerConfig struct {
 		Rules   []*Rule
 	}
 	Cluster struct {
-		Enabled  bool
-		Nodes    []ClusterNodeConfig
-		Strategy string
+		Enabled        bool
+		Nodes          []ClusterNodeConfig
+		Strategy       string
+		HealthInterval time.Duration
 	}
 	RateLimit struct {
 		Enabled              bool
@@ -106,149 +130,89 @@ type ServerConfig struct {
 		GlobalMaxConnections int
 		GlobalRateLimit      int
 	}
+	RequireForwardSecrecy bool                       // 只接受X25519握手（拒绝PSK握手）
+	CipherSuites          []protocol.CipherSuite     // 数据加密算法偏好（空表示AES-256-GCM优先）
+	KeyRotation           protocol.KeyRotationPolicy // X25519会话中服务端发送方向的密钥轮换策略
+	ReplayProtection      struct {
+		Mode              string // exact（默认）、bloom 或 off
+		MaxEntries        int
+		FalsePositiveRate float64 // 仅bloom模式
+	}
+	UDP struct {
+		Enabled bool          // 允许客户端建立UDP关联
+		Timeout time.Duration // 出口UDP映射的空闲超时（0表示defaultUDPTimeout）
+	}
+	Trojan struct {
+		Password     string
+		Users        []TrojanUserConfig
+		Fallback     string            // 认证失败时的回落后端
+		FallbackALPN map[string]string // 按ALPN选择的回落后端
+	}
+}
+
+// SelectorRuleConfig 出口IP选择规则配置（对应snat.Rule）
+type SelectorRuleConfig struct {
+	Name         string
+	Priority     int
+	MatchDomain  []string
+	MatchIP      []string
+	MatchPort    []int
+	TargetIP     string
+	Action       string
+	Enabled      bool
+	FamilyPolicy string
+}
+
+// PortRangeConfig 端口范围配置（对应snat.PortRangeConfig）
+type PortRangeConfig struct {
+	Range  string
+	IP     string
+	Backup string // 端口范围的IP故障或移除时使用的备用IP
 }
 
 // NewServer 创建代理服务端
 func NewServer(config *ServerConfig) (*Server, error) {
-	// 创建加密器（优先使用AES-GCM硬件加速）
+	// 创建加密器（握手固定使用AES-GCM，握手后的数据按协商结果选择）
 	masterKey := protocol.DeriveKeyFromPSK(config.AuthKey)
-	cipher, err := protocol.NewCipher(masterKey, true) // true = 使用AES-GCM
+	ciphers, err := newDataCiphers(masterKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %w", err)
-	}
-
-	// 创建IP列表
-	ipList := make([]net.IP, 0, len(config.ExitIPs))
-	for _, ipStr := range config.ExitIPs {
-		ip := net.ParseIP(ipStr)
-		if ip == nil {
-			return nil, fmt.Errorf("invalid IP address: %s", ipStr)
-		}
-		ipList = append(ipList, ip)
-	}
-
-	// 创建健康检查器（如果配置启用）
-	var healthChecker *snat.IPHealthChecker
-	if config.HealthCheck.Enabled && len(config.ExitIPs) > 0 {
-		checkInterval := config.HealthCheck.Interval
-		if checkInterval == 0 {
-			checkInterval = 30 * time.Second
-		}
-		checkTimeout := config.HealthCheck.Timeout
-		if checkTimeout == 0 {
-			checkTimeout = 5 * time.Second
-		}
-
-		healthChecker = snat.NewIPHealthChecker(ipList, checkInterval, checkTimeout)
-	}
-
-	// 创建基础IP选择器
-	var baseSelector snat.IPSelector
-	switch config.Strategy {
-	case "round_robin":
-		baseSelector, err = snat.NewRoundRobinSelector(config.ExitIPs)
-	case "destination_based":
-		baseSelector, err = snat.NewDestinationBasedSelector(config.ExitIPs)
-	case "load_balanced":
-		strategyParam := config.StrategyParam
-		if strategyParam == "" {
-			strategyParam = "connections"
-		}
-		baseSelector, err = snat.NewLoadBalancedSelector(config.ExitIPs, strategyParam)
-	default:
-		baseSelector, err = snat.NewRoundRobinSelector(config.ExitIPs)
+		return nil, err
 	}
+	cipher := ciphers[protocol.CipherAES256GCM]
+
+	// 创建握手重放过滤器（窗口与握手时间戳允许的偏差一致）
+	replayFilter, err := security.NewReplayFilter(
+		config.ReplayProtection.Mode,
+		handshakeMaxSkew,
+		config.ReplayProtection.MaxEntries,
+		config.ReplayProtection.FalsePositiveRate,
+	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create IP selector: %w", err)
+		return nil, err
 	}
 
-	// 创建健康感知的IP选择器（包装基础选择器）
-	var ipSelector snat.IPSelector
-	if healthChecker != nil {
-		ipSelector = snat.NewHealthAwareIPSelector(baseSelector, healthChecker, config.ExitIPs, config.Strategy, config.StrategyParam)
-		// 启动健康检查
-		go healthChecker.Start()
-	} else {
-		ipSelector = baseSelector
+	// 创建IP列表
+	ipList, err := parseExitIPs(config.ExitIPs)
+	if err != nil {
+		return nil, err
 	}
 
-	// 如果启用地理位置选择，包装选择器
-	if config.GeoLocation.Enabled {
-		geoService := snat.NewGeoLocationService(config.GeoLocation.APIURL)
-
-		// 如果提供了GeoIP数据库路径，使用增强的地理位置服务
-		if config.GeoLocation.DBPath != "" {
-			enhancedService, err := snat.NewEnhancedGeoLocationService(
-				config.GeoLocation.DBPath,
-				config.GeoLocation.APIURL,
-				true, // 优先使用本地数据库
-			)
-			if err != nil {
-				logrus.Warnf("Failed to create enhanced geo service: %v, using API only", err)
-				enhancedService = nil
-			}
-
-			if enhancedService != nil {
-				geoSelector, err := snat.NewGeoLocationSelector(ipSelector, enhancedService, config.ExitIPs)
-				if err != nil {
-					return nil, fmt.Errorf("failed to create geo location selector: %w", err)
-				}
-				ipSelector = geoSelector
-			} else {
-				geoSelector, err := snat.NewGeoLocationSelector(ipSelector, geoService, config.ExitIPs)
-				if err != nil {
-					return nil, fmt.Errorf("failed to create geo location selector: %w", err)
-				}
-				ipSelector = geoSelector
-			}
-		} else {
-			geoSelector, err := snat.NewGeoLocationSelector(ipSelector, geoService, config.ExitIPs)
-			if err != nil {
-				return nil, fmt.Errorf("failed to create geo location selector: %w", err)
-			}
-			ipSelector = geoSelector
-		}
-	}
+	// 出口IP的负载在服务端的生命周期内持续统计，热重载重建的选择器链共用
+	exitLoad := snat.NewLoadTracker()
 
-	// 如果配置了规则引擎，包装选择器
-	if len(config.Rules) > 0 {
-		ruleEngine := snat.NewRuleEngine()
-		for _, ruleConfig := range config.Rules {
-			rule := &snat.Rule{
-				Name:        ruleConfig.Name,
-				Priority:    ruleConfig.Priority,
-				MatchDomain: ruleConfig.MatchDomain,
-				MatchIP:     ruleConfig.MatchIP,
-				MatchPort:   ruleConfig.MatchPort,
-				TargetIP:    ruleConfig.TargetIP,
-				Action:      ruleConfig.Action,
-				Enabled:     ruleConfig.Enabled,
-			}
-			if err := ruleEngine.AddRule(rule); err != nil {
-				return nil, fmt.Errorf("failed to add rule %s: %w", rule.Name, err)
-			}
-		}
-		ruleSelector := snat.NewRuleBasedSelector(ipSelector, ruleEngine, config.ExitIPs)
-		ipSelector = ruleSelector
-		logrus.Infof("Rule engine enabled with %d rules", len(config.Rules))
+	// 创建IP选择器链（基础选择器 -> 健康感知 -> 地理位置 -> 粘性会话 -> 规则）
+	ipSelector, healthChecker, stickySelector, err := buildIPSelector(config, ipList, exitLoad)
+	if err != nil {
+		return nil, err
 	}
 
 	// 创建路由管理器
-	var routingMgr *snat.RoutingManager
-	if config.SNAT.Enabled {
-		ips := make([]net.IP, 0, len(config.ExitIPs))
-		for _, ipStr := range config.ExitIPs {
-			ips = append(ips, net.ParseIP(ipStr))
-		}
-		routingMgr, err = snat.NewRoutingManager(ips, config.SNAT.Gateway, config.SNAT.Interface)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create routing manager: %w", err)
-		}
-
-		// 设置路由规则
-		if err := routingMgr.Setup(); err != nil {
-			return nil, fmt.Errorf("failed to setup routing: %w", err)
+	routingMgr, err := newRoutingManager(config, nil)
+	if err != nil {
+		if healthChecker != nil {
+			healthChecker.Stop()
 		}
+		return nil, err
 	}
 
 	// 创建TLS监听器
@@ -310,28 +274,29 @@ func NewServer(config *ServerConfig) (*Server, error) {
 	}
 
 	// 创建速率限制器
-	var rateLimiter *RateLimiter
-	if config.RateLimit.Enabled {
-		rateLimiter = NewRateLimiter(RateLimitConfig{
-			IPMaxConnections:     config.RateLimit.IPMaxConnections,
-			IPRateLimit:          config.RateLimit.IPRateLimit,
-			UserMaxConnections:   config.RateLimit.UserMaxConnections,
-			UserRateLimit:        config.RateLimit.UserRateLimit,
-			UserBandwidthLimit:   config.RateLimit.UserBandwidthLimit,
-			GlobalMaxConnections: config.RateLimit.GlobalMaxConnections,
-			GlobalRateLimit:      config.RateLimit.GlobalRateLimit,
+	rateLimiter := newRateLimiter(config)
+
+	// 创建集群管理器
+	var clusterMgr *ClusterManager
+	if config.Cluster.Enabled {
+		clusterMgr = NewClusterManager(ClusterConfig{
+			Nodes:               config.Cluster.Nodes,
+			Strategy:            config.Cluster.Strategy,
+			HealthCheckInterval: config.Cluster.HealthInterval,
 		})
-		logrus.Info("Rate limiter enabled")
+		logrus.Infof("Cluster enabled with %d nodes", len(config.Cluster.Nodes))
 	}
 
 	// 创建关闭上下文（使用可取消的上下文）
 	shutdownCtx, shutdownCancel := context.WithCancel(context.Background())
 
-	return &Server{
+	s := &Server{
 		config:          config,
 		cipher:          cipher,
+		ciphers:         ciphers,
 		ipSelector:      ipSelector,
 		healthChecker:   healthChecker,
+		stickySelector:  stickySelector,
 		routingMgr:      routingMgr,
 		listener:        listener,
 		connManager:     connManager,
@@ -339,10 +304,258 @@ func NewServer(config *ServerConfig) (*Server, error) {
 		trafficAnalyzer: trafficAnalyzer,
 		ruleEngine:      ruleEngine,
 		rateLimiter:     rateLimiter,
+		clusterMgr:      clusterMgr,
+		replayFilter:    replayFilter,
+		exitPool:        exitIPPool{load: exitLoad},
 		shutdownCtx:     shutdownCtx,
 		shutdownCancel:  shutdownCancel,
 		accepting:       1,
-	}, nil
+	}
+
+	// Trojan入站复用本服务端的连接处理流程
+	switch config.Protocol {
+	case "", ProtocolNative:
+	case ProtocolTrojan:
+		if s.trojan, err = s.newTrojanInbound(); err != nil {
+			s.Shutdown(0)
+			return nil, err
+		}
+	default:
+		s.Shutdown(0)
+		return nil, fmt.Errorf("unsupported protocol: %s", config.Protocol)
+	}
+
+	return s, nil
+}
+
+// parseExitIPs 解析出口IP列表
+func parseExitIPs(exitIPs []string) ([]net.IP, error) {
+	ipList := make([]net.IP, 0, len(exitIPs))
+	for _, ipStr := range exitIPs {
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address: %s", ipStr)
+		}
+		ipList = append(ipList, ip)
+	}
+	return ipList, nil
+}
+
+// buildIPSelector 根据配置创建IP选择器链，同时返回已启动的健康检查器和粘性会话选择器（未启用时为nil）
+// load为出口IP的当前负载，供weighted_round_robin和least_load策略检查容量上限（可为nil）
+func buildIPSelector(config *ServerConfig, ipList []net.IP, load *snat.LoadTracker) (snat.IPSelector, *snat.IPHealthChecker, *snat.StickySelector, error) {
+	// 创建健康检查器（如果配置启用）
+	var healthChecker *snat.IPHealthChecker
+	if config.HealthCheck.Enabled && len(config.ExitIPs) > 0 {
+		checkInterval := config.HealthCheck.Interval
+		if checkInterval == 0 {
+			checkInterval = 30 * time.Second
+		}
+		checkTimeout := config.HealthCheck.Timeout
+		if checkTimeout == 0 {
+			checkTimeout = 5 * time.Second
+		}
+
+		healthChecker = snat.NewIPHealthChecker(ipList, checkInterval, checkTimeout)
+	}
+
+	// 创建基础IP选择器
+	var baseSelector snat.IPSelector
+	var err error
+	switch config.Strategy {
+	case "round_robin":
+		baseSelector, err = snat.NewRoundRobinSelector(config.ExitIPs)
+	case "destination_based":
+		baseSelector, err = snat.NewDestinationBasedSelectorWithOptions(config.ExitIPs, snat.DestinationOptions{
+			HashKey: config.HashKey,
+			Weights: config.Weights,
+		})
+	case "port_based":
+		baseSelector, err = newPortBasedSelector(config.PortRanges, ipList)
+	case "load_balanced":
+		strategyParam := config.StrategyParam
+		if strategyParam == "" {
+			strategyParam = "connections"
+		}
+		baseSelector, err = snat.NewLoadBalancedSelector(config.ExitIPs, strategyParam)
+	case "weighted_round_robin":
+		baseSelector, err = snat.NewWeightedRoundRobinSelector(config.ExitIPs, snat.CapacityOptions{
+			Weights: config.Weights,
+			Limits:  config.Limits,
+			Load:    load,
+		})
+	case "least_load":
+		baseSelector, err = snat.NewLeastLoadSelector(config.ExitIPs, snat.CapacityOptions{
+			Weights: config.Weights,
+			Limits:  config.Limits,
+			Load:    load,
+			Metric:  config.StrategyParam,
+		})
+	default:
+		baseSelector, err = snat.NewRoundRobinSelector(config.ExitIPs)
+	}
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create IP selector: %w", err)
+	}
+
+	// 创建健康感知的IP选择器（包装基础选择器）
+	ipSelector := baseSelector
+	if healthChecker != nil {
+		ipSelector = snat.NewHealthAwareIPSelector(baseSelector, healthChecker, config.ExitIPs, config.Strategy, config.StrategyParam)
+	}
+
+	// 如果启用地理位置选择，包装选择器
+	if config.GeoLocation.Enabled {
+		var geoService snat.GeoLocationServiceInterface = snat.NewGeoLocationService(config.GeoLocation.APIURL)
+
+		// 如果提供了GeoIP数据库路径，使用增强的地理位置服务
+		if config.GeoLocation.DBPath != "" {
+			enhancedService, err := snat.NewEnhancedGeoLocationService(
+				config.GeoLocation.DBPath,
+				config.GeoLocation.APIURL,
+				true, // 优先使用本地数据库
+			)
+			if err != nil {
+				logrus.Warnf("Failed to create enhanced geo service: %v, using API only", err)
+			} else {
+				geoService = enhancedService
+			}
+		}
+
+		geoSelector, err := snat.NewGeoLocationSelector(ipSelector, geoService, config.ExitIPs)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to create geo location selector: %w", err)
+		}
+		ipSelector = geoSelector
+	}
+
+	// 如果启用粘性会话，包装选择器（规则优先于粘性会话）
+	var stickySelector *snat.StickySelector
+	if config.Sticky.Enabled {
+		var err error
+		stickySelector, err = snat.NewStickySelector(ipSelector, config.ExitIPs, snat.StickyOptions{
+			Key:           config.Sticky.Key,
+			IdleTTL:       config.Sticky.IdleTTL,
+			MaxLifetime:   config.Sticky.MaxLifetime,
+			HealthChecker: healthChecker,
+		})
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to create sticky selector: %w", err)
+		}
+		ipSelector = stickySelector
+	}
+
+	// 如果配置了规则引擎，包装选择器
+	if len(config.Rules) > 0 {
+		ruleEngine := snat.NewRuleEngine()
+		for _, ruleConfig := range config.Rules {
+			rule := &snat.Rule{
+				Name:         ruleConfig.Name,
+				Priority:     ruleConfig.Priority,
+				MatchDomain:  ruleConfig.MatchDomain,
+				MatchIP:      ruleConfig.MatchIP,
+				MatchPort:    ruleConfig.MatchPort,
+				TargetIP:     ruleConfig.TargetIP,
+				Action:       ruleConfig.Action,
+				Enabled:      ruleConfig.Enabled,
+				FamilyPolicy: ruleConfig.FamilyPolicy,
+			}
+			if err := ruleEngine.AddRule(rule); err != nil {
+				return nil, nil, nil, fmt.Errorf("failed to add rule %s: %w", rule.Name, err)
+			}
+		}
+		ipSelector = snat.NewRuleBasedSelector(ipSelector, ruleEngine, config.ExitIPs)
+		logrus.Infof("Rule engine enabled with %d rules", len(config.Rules))
+	}
+
+	// 选择器链创建成功后再启动健康检查
+	if healthChecker != nil {
+		go healthChecker.Start()
+	}
+
+	return ipSelector, healthChecker, stickySelector, nil
+}
+
+// newPortBasedSelector 创建按端口选择器，只选择出口IP集合中的IP
+func newPortBasedSelector(portRanges []PortRangeConfig, ipList []net.IP) (*snat.PortBasedSelector, error) {
+	if len(portRanges) == 0 {
+		return nil, fmt.Errorf("port_based strategy requires port_ranges")
+	}
+	ranges := make([]snat.PortRangeConfig, 0, len(portRanges))
+	for _, pr := range portRanges {
+		ranges = append(ranges, snat.PortRangeConfig{Range: pr.Range, IP: pr.IP, Backup: pr.Backup})
+	}
+	selector, err := snat.NewPortBasedSelector(ranges)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range selector.IPs() {
+		isExitIP := false
+		for _, exitIP := range ipList {
+			if exitIP.Equal(ip) {
+				isExitIP = true
+				break
+			}
+		}
+		if !isExitIP {
+			logrus.Warnf("Port range IP %s is not an exit IP and will not be selected", ip)
+		}
+	}
+	selector.SetIPs(ipList)
+	return selector, nil
+}
+
+// newRoutingManager 创建并设置路由管理器（未启用SNAT时返回nil）
+// backend非nil时使用该后端（热重载时沿用旧路由管理器的后端），否则按配置创建
+func newRoutingManager(config *ServerConfig, backend snat.RoutingBackend) (*snat.RoutingManager, error) {
+	if !config.SNAT.Enabled {
+		return nil, nil
+	}
+
+	ips := make([]net.IP, 0, len(config.ExitIPs))
+	for _, ipStr := range config.ExitIPs {
+		ips = append(ips, net.ParseIP(ipStr))
+	}
+	if backend == nil {
+		var err error
+		backend, err = snat.NewRoutingBackend(config.SNAT.Backend)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create routing backend: %w", err)
+		}
+	}
+	routingMgr, err := snat.NewRoutingManagerWithBackend(ips, config.SNAT.Gateway, config.SNAT.Interface, backend)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create routing manager: %w", err)
+	}
+	if config.SNAT.GatewayV6 != "" {
+		if err := routingMgr.SetIPv6Gateway(config.SNAT.GatewayV6); err != nil {
+			return nil, err
+		}
+	}
+
+	// 设置路由规则
+	if err := routingMgr.Setup(); err != nil {
+		return nil, fmt.Errorf("failed to setup routing: %w", err)
+	}
+	return routingMgr, nil
+}
+
+// newRateLimiter 创建速率限制器（未启用时返回nil）
+func newRateLimiter(config *ServerConfig) *RateLimiter {
+	if !config.RateLimit.Enabled {
+		return nil
+	}
+	logrus.Info("Rate limiter enabled")
+	return NewRateLimiter(RateLimitConfig{
+		IPMaxConnections:     config.RateLimit.IPMaxConnections,
+		IPRateLimit:          config.RateLimit.IPRateLimit,
+		UserMaxConnections:   config.RateLimit.UserMaxConnections,
+		UserRateLimit:        config.RateLimit.UserRateLimit,
+		UserBandwidthLimit:   config.RateLimit.UserBandwidthLimit,
+		GlobalMaxConnections: config.RateLimit.GlobalMaxConnections,
+		GlobalRateLimit:      config.RateLimit.GlobalRateLimit,
+	})
 }
 
 // Start 启动服务端
@@ -366,46 +579,71 @@ func (s *Server) Start() error {
 		// 获取客户端IP
 		clientIP := getClientIP(conn)
 
-		// 检查全局连接数限制
-		if !s.connManager.CanAccept() {
-			logrus.Warnf("Max connections reached (%d), rejecting new connection from %s", s.connManager.GetActiveCount(), clientIP)
+		// 检查全局连接数限制和速率限制
+		release, ok := s.admitConnection(conn, clientIP)
+		if !ok {
 			conn.Close()
 			continue
 		}
 
-		// 检查速率限制
-		if s.rateLimiter != nil {
-			// 检查全局限流
-			if !s.rateLimiter.CheckGlobal() {
-				logrus.Debugf("Global rate limit exceeded, rejecting connection from %s", clientIP)
-				conn.Close()
-				continue
-			}
-			defer s.rateLimiter.OnGlobalConnectionEnd()
-
-			// 检查IP限流
-			if !s.rateLimiter.CheckIP(clientIP) {
-				logrus.Debugf("IP rate limit exceeded for %s, rejecting connection", clientIP)
-				conn.Close()
-				s.rateLimiter.OnGlobalConnectionEnd()
-				continue
+		s.shutdownWg.Add(1)
+		go func(c net.Conn, clientIP net.IP) {
+			defer s.shutdownWg.Done()
+			defer release()
+			if s.trojan != nil {
+				if err := s.trojan.HandleConn(c); err != nil {
+					logrus.Debugf("Trojan connection from %s error: %v", clientIP, err)
+				}
+				return
 			}
-			defer s.rateLimiter.OnIPConnectionEnd(clientIP)
+			s.handleConn(c)
+		}(conn, clientIP)
+	}
+}
+
+// admitConnection 检查全局连接数限制和速率限制并登记连接，返回连接结束时调用的释放函数
+// 多路复用流与TCP连接同样计数；连接结束时归还到检查时使用的限制器，热重载替换限制器后也能正确计数
+func (s *Server) admitConnection(conn net.Conn, clientIP net.IP) (release func(), ok bool) {
+	// 检查全局连接数限制
+	if !s.connManager.CanAccept() {
+		logrus.Warnf("Max connections reached (%d), rejecting new connection from %s", s.connManager.GetActiveCount(), clientIP)
+		return nil, false
+	}
+
+	s.mu.RLock()
+	rateLimiter := s.rateLimiter
+	s.mu.RUnlock()
+	if rateLimiter != nil {
+		// 检查全局限流
+		if !rateLimiter.CheckGlobal() {
+			logrus.Debugf("Global rate limit exceeded, rejecting connection from %s", clientIP)
+			return nil, false
 		}
 
-		// 添加连接管理
-		if !s.connManager.AddConnection(conn) {
-			conn.Close()
-			continue
+		// 检查IP限流
+		if !rateLimiter.CheckIP(clientIP) {
+			logrus.Debugf("IP rate limit exceeded for %s, rejecting connection", clientIP)
+			rateLimiter.OnGlobalConnectionEnd()
+			return nil, false
 		}
+	}
 
-		s.shutdownWg.Add(1)
-		go func(c net.Conn) {
-			defer s.shutdownWg.Done()
-			defer s.connManager.RemoveConnection(c)
-			s.handleConn(c)
-		}(conn)
+	// 添加连接管理
+	if !s.connManager.AddConnection(conn) {
+		if rateLimiter != nil {
+			rateLimiter.OnIPConnectionEnd(clientIP)
+			rateLimiter.OnGlobalConnectionEnd()
+		}
+		return nil, false
 	}
+
+	return func() {
+		s.connManager.RemoveConnection(conn)
+		if rateLimiter != nil {
+			rateLimiter.OnIPConnectionEnd(clientIP)
+			rateLimiter.OnGlobalConnectionEnd()
+		}
+	}, true
 }
 
 // Stop 停止服务端（立即关闭）
@@ -448,14 +686,22 @@ func (s *Server) Shutdown(timeout time.Duration) error {
 		s.connManager.CloseAll()
 	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	// 停止健康检查
 	if s.healthChecker != nil {
 		s.healthChecker.Stop()
+		s.healthChecker = nil
+	}
+	if s.clusterMgr != nil {
+		s.clusterMgr.Stop()
 	}
 
 	// 清理路由
 	if s.routingMgr != nil {
 		s.routingMgr.Cleanup()
+		s.routingMgr = nil
 	}
 
 	logrus.Info("Server shutdown complete")
@@ -470,6 +716,20 @@ func (s *Server) GetStats() interface{} {
 	return nil
 }
 
+// GetReplayStats 获取握手重放过滤统计（未启用时返回nil）
+func (s *Server) GetReplayStats() *security.ReplayStats {
+	if s.replayFilter == nil {
+		return nil
+	}
+	stats := s.replayFilter.Stats()
+	return &stats
+}
+
+// ActiveConnections 列出当前连接及其协商的加密算法（用于Web界面）
+func (s *Server) ActiveConnections() []ConnectionInfo {
+	return s.connManager.Connections()
+}
+
 // GetTrafficAnalyzer 获取流量分析器（用于Web界面）
 func (s *Server) GetTrafficAnalyzer() *monitor.TrafficAnalyzer {
 	return s.trafficAnalyzer
@@ -477,40 +737,54 @@ func (s *Server) GetTrafficAnalyzer() *monitor.TrafficAnalyzer {
 
 // GetRuleEngine 获取规则引擎（用于Web界面）
 func (s *Server) GetRuleEngine() *RuleEngine {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.ruleEngine
 }
 
-// handleConn 处理客户端连接
-func (s *Server) handleConn(conn net.Conn) error {
-	connStartTime := time.Now()
-	var exitIP net.IP
-	var targetAddr string
+// GetClusterManager 获取集群管理器（未启用集群时返回nil）
+func (s *Server) GetClusterManager() *ClusterManager {
+	return s.clusterMgr
+}
+
+// serverState 可热重载组件的快照
+type serverState struct {
+	config     *ServerConfig
+	ipSelector snat.IPSelector
+	routingMgr *snat.RoutingManager
+	ruleEngine *RuleEngine
+}
+
+// snapshot 获取当前配置快照（热重载只影响新连接，已建立的连接继续使用旧的选择器和路由）
+func (s *Server) snapshot() serverState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return serverState{
+		config:     s.config,
+		ipSelector: s.ipSelector,
+		routingMgr: s.routingMgr,
+		ruleEngine: s.ruleEngine,
+	}
+}
+
+// handleConn 处理客户端连接
+func (s *Server) handleConn(conn net.Conn) error {
+	connStartTime := time.Now()
+	var exitIP net.IP
+	var targetAddr string
 	var bytesUp, bytesDown int64 // 用于流量分析
 
+	st := s.snapshot()
 	defer func() {
-		// 记录连接结束统计
-		if s.statsManager != nil && exitIP != nil {
-			duration := time.Since(connStartTime)
-			s.statsManager.OnConnectionEnd(exitIP, duration)
-		}
-
-		// 记录流量分析（如果启用）
-		if s.trafficAnalyzer != nil && targetAddr != "" {
-			host, _, _ := net.SplitHostPort(targetAddr)
-			if host != "" {
-				duration := time.Since(connStartTime)
-				s.trafficAnalyzer.RecordDomainAccess(host, bytesUp, bytesDown, duration)
-			}
-		}
-
+		s.recordConnEnd(st, exitIP, targetAddr, connStartTime, atomic.LoadInt64(&bytesUp), atomic.LoadInt64(&bytesDown))
 		conn.Close()
 	}()
 
 	// 设置初始超时
-	s.connManager.SetTimeouts(conn, s.config.Connection.ReadTimeout, s.config.Connection.WriteTimeout)
+	s.connManager.SetTimeouts(conn, st.config.Connection.ReadTimeout, st.config.Connection.WriteTimeout)
 
 	// 读取握手消息
-	handshakeBuf := make([]byte, 32)
+	handshakeBuf := make([]byte, protocol.EncryptedHandshakeSize)
 	s.connManager.ResetReadDeadline(conn)
 	if _, err := io.ReadFull(conn, handshakeBuf); err != nil {
 		return err
@@ -527,14 +801,14 @@ func (s *Server) handleConn(conn net.Conn) error {
 		return fmt.Errorf("failed to decode handshake: %w", err)
 	}
 
-	// 验证版本
-	if handshake.Version != protocol.Version {
+	// 验证版本（同时支持v1和v2，便于客户端逐步迁移）
+	if handshake.Version != protocol.Version && handshake.Version != protocol.Version2 {
 		return protocol.ErrInvalidVersion
 	}
 
 	// 验证时间戳（防重放攻击）
 	now := time.Now().Unix()
-	if abs(now-handshake.Timestamp) > 300 { // 5分钟窗口
+	if abs(now-handshake.Timestamp) > int64(handshakeMaxSkew/time.Second) {
 		return fmt.Errorf("timestamp out of range")
 	}
 
@@ -543,17 +817,99 @@ func (s *Server) handleConn(conn net.Conn) error {
 		return protocol.ErrAuthFailed
 	}
 
+	// 时间窗口内同一nonce只能使用一次（在认证之后检查，避免未认证的数据占用过滤器容量）
+	if s.replayFilter != nil && !s.replayFilter.Check(handshake.Nonce[:], time.Unix(handshake.Timestamp, 0)) {
+		logrus.Warnf("Rejected replayed handshake from %s", conn.RemoteAddr())
+		return protocol.ErrReplayDetected
+	}
+
+	// 协商数据加密算法：客户端在握手标志位中广播支持的算法，服务端按偏好选择后回复1字节算法ID
+	// 未广播的旧客户端使用AES-256-GCM，不回复
+	suite := protocol.CipherAES256GCM
+	var suiteReply []byte
+	if protocol.OfferedCipherSuites(handshake.Reserved) {
+		preference := st.config.CipherSuites
+		if len(preference) == 0 {
+			preference = protocol.SupportedCipherSuites()
+		}
+		var ok bool
+		suite, ok = protocol.NegotiateCipherSuite(preference, handshake.Reserved)
+		if !ok {
+			return fmt.Errorf("no common cipher suite with client")
+		}
+		suiteReply = []byte{byte(suite)}
+	}
+	dataCipher := s.ciphers[suite]
+	s.connManager.SetCipher(conn, suite.String())
+	if s.statsManager != nil {
+		s.statsManager.OnCipherNegotiated(suite.String())
+	}
+	logrus.Debugf("Connection from %s uses %s", conn.RemoteAddr(), suite)
+
+	// 为每个连接创建独立的加密上下文（避免nonce冲突，提升并发性能）
+	connCipher := protocol.NewConnectionCipher(dataCipher)
+
+	// 协商v2隧道的加密器：PSK握手使用由握手随机数和服务端随机盐派生的本连接密钥，X25519握手使用本会话派生的密钥
+	// v1读写共用connCipher
+	var readCipher, writeCipher protocol.RecordCipher = connCipher, connCipher
+	switch handshake.Method {
+	case protocol.MethodPSK:
+		if st.config.RequireForwardSecrecy {
+			return fmt.Errorf("PSK handshake rejected: forward secrecy required")
+		}
+		if handshake.Version == protocol.Version2 {
+			readCipher, writeCipher, err = s.derivePSKSessionKeys(conn, decryptedHandshake, dataCipher, suiteReply, st.config.KeyRotation)
+			if err != nil {
+				return err
+			}
+		} else if len(suiteReply) > 0 {
+			s.connManager.ResetWriteDeadline(conn)
+			if _, err := conn.Write(suiteReply); err != nil {
+				return err
+			}
+		}
+	case protocol.MethodX25519:
+		if handshake.Version != protocol.Version2 {
+			return fmt.Errorf("X25519 handshake requires protocol v2")
+		}
+		readCipher, writeCipher, err = s.exchangeSessionKeys(conn, decryptedHandshake, dataCipher, suiteReply, st.config.KeyRotation)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported handshake method: %d", handshake.Method)
+	}
+
+	// 多路复用会话：后续由会话层处理各个流
+	if handshake.Reserved&protocol.HandshakeFlagMux != 0 {
+		return s.serveMux(conn, readCipher, writeCipher)
+	}
+
+	// v2使用AEAD记录分帧，v1按单次读取的数据解密
+	var tunnel *aeadConn
+	if handshake.Version == protocol.Version2 {
+		tunnel = newAEADConn(conn, readCipher, writeCipher)
+	}
+
 	// 读取连接请求
-	reqBuf := make([]byte, 1024)
+	var decryptedReq []byte
 	s.connManager.ResetReadDeadline(conn)
-	n, err := conn.Read(reqBuf)
-	if err != nil {
-		return err
-	}
+	if tunnel != nil {
+		decryptedReq, err = tunnel.reader.ReadRecord()
+		if err != nil {
+			return fmt.Errorf("failed to read request: %w", err)
+		}
+	} else {
+		reqBuf := make([]byte, 1024)
+		n, err := conn.Read(reqBuf)
+		if err != nil {
+			return err
+		}
 
-	decryptedReq, err := s.cipher.Decrypt(reqBuf[:n])
-	if err != nil {
-		return fmt.Errorf("failed to decrypt request: %w", err)
+		decryptedReq, err = connCipher.Decrypt(reqBuf[:n])
+		if err != nil {
+			return fmt.Errorf("failed to decrypt request: %w", err)
+		}
 	}
 
 	req, err := protocol.DecodeConnectRequest(decryptedReq)
@@ -561,40 +917,293 @@ func (s *Server) handleConn(conn net.Conn) error {
 		return fmt.Errorf("failed to decode request: %w", err)
 	}
 
+	// UDP关联：隧道中传输UDP数据报帧（仅v2）
+	if req.Type == protocol.MsgTypeUDPAssociate {
+		if tunnel == nil {
+			return fmt.Errorf("UDP associate requires protocol v2")
+		}
+		s.connManager.ResetWriteDeadline(conn)
+		if !st.config.UDP.Enabled {
+			tunnel.writer.WriteRecord([]byte{0x01})
+			return fmt.Errorf("UDP associate rejected: UDP relay disabled")
+		}
+		if err := tunnel.writer.WriteRecord([]byte{0x00}); err != nil {
+			return err
+		}
+		return s.serveUDP(st, tunnel, &bytesUp, &bytesDown)
+	}
+
+	// 反向连接：在出口IP上监听，转发连入的对端连接（仅v2）
+	if req.Type == protocol.MsgTypeBind {
+		if tunnel == nil {
+			return fmt.Errorf("BIND requires protocol v2")
+		}
+		targetAddr = protocol.BuildAddress(req.AddrType, req.Address, req.Port)
+		listener, selectedIP, err := s.listenBind(st, requestClient(conn.RemoteAddr(), req), targetAddr)
+		exitIP = selectedIP
+		s.connManager.ResetWriteDeadline(conn)
+		if err != nil {
+			tunnel.writer.WriteRecord([]byte{0x01})
+			return err
+		}
+		defer listener.Close()
+		if err := tunnel.writer.WriteRecord([]byte{0x00}); err != nil {
+			return err
+		}
+		return s.serveBind(st, tunnel, listener, targetAddr, exitIP, &bytesUp, &bytesDown)
+	}
+
 	// 构建目标地址
 	targetAddr = protocol.BuildAddress(req.AddrType, req.Address, req.Port)
 	if targetAddr == "" {
 		return fmt.Errorf("invalid target address")
 	}
 
+	// 选择出口IP并连接目标
+	targetConn, selectedIP, err := s.dialTarget(st, requestClient(conn.RemoteAddr(), req), targetAddr)
+	exitIP = selectedIP // 赋值给defer中使用的变量
+	if err != nil {
+		return err
+	}
+	defer targetConn.Close()
+
+	// 发送成功响应（加密）
+	response := []byte{0x00} // 成功
+	s.connManager.ResetWriteDeadline(conn)
+	if tunnel != nil {
+		if err := tunnel.writer.WriteRecord(response); err != nil {
+			return err
+		}
+		return s.relayWithStats(st, tunnel, targetConn, exitIP, &bytesUp, &bytesDown)
+	}
+	encryptedResp, err := connCipher.Encrypt(response)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(encryptedResp); err != nil {
+		return err
+	}
+
+	// 双向转发数据
+	errCh := make(chan error, 2)
+
+	go func() {
+		errCh <- s.copyDataWithCipher(st, targetConn, conn, connCipher, true, exitIP, &bytesUp, &bytesDown)
+	}()
+
+	go func() {
+		errCh <- s.copyDataWithCipher(st, conn, targetConn, connCipher, false, exitIP, &bytesUp, &bytesDown)
+	}()
+
+	// 等待任一方向出错
+	err = <-errCh
+	return err
+}
+
+// exchangeSessionKeys 完成X25519临时密钥交换，返回本会话的读写加密器
+// 客户端在握手消息后紧跟其临时公钥，服务端回复自己的临时公钥和算法协商结果（suiteReply，可为空）
+func (s *Server) exchangeSessionKeys(conn net.Conn, handshakeData []byte, dataCipher *protocol.Cipher, suiteReply []byte, policy protocol.KeyRotationPolicy) (readCipher, writeCipher protocol.RecordCipher, err error) {
+	clientPublic := make([]byte, protocol.X25519PublicKeySize)
+	s.connManager.ResetReadDeadline(conn)
+	if _, err := io.ReadFull(conn, clientPublic); err != nil {
+		return nil, nil, fmt.Errorf("failed to read client public key: %w", err)
+	}
+
+	kx, err := protocol.NewKeyExchange()
+	if err != nil {
+		return nil, nil, err
+	}
+	sharedSecret, err := kx.SharedSecret(clientPublic)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serverPublic := kx.PublicKey()
+	s.connManager.ResetWriteDeadline(conn)
+	if _, err := conn.Write(append(serverPublic, suiteReply...)); err != nil {
+		return nil, nil, err
+	}
+
+	transcript := make([]byte, 0, len(handshakeData)+2*protocol.X25519PublicKeySize+len(suiteReply))
+	transcript = append(transcript, handshakeData...)
+	transcript = append(transcript, clientPublic...)
+	transcript = append(transcript, serverPublic...)
+	transcript = append(transcript, suiteReply...)
+
+	send, recv, err := dataCipher.NewSessionCiphers(sharedSecret, transcript, false, policy)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to derive session keys: %w", err)
+	}
+	return recv, send, nil
+}
+
+// derivePSKSessionKeys v2 PSK握手：回复算法协商结果和服务端随机盐，派生本连接两个方向的会话密钥
+// 随机盐保证即使握手消息被重放（如未启用重放过滤），派生的密钥也与原连接不同
+func (s *Server) derivePSKSessionKeys(conn net.Conn, handshakeData []byte, dataCipher *protocol.Cipher, suiteReply []byte, policy protocol.KeyRotationPolicy) (readCipher, writeCipher protocol.RecordCipher, err error) {
+	salt := make([]byte, protocol.PSKSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	s.connManager.ResetWriteDeadline(conn)
+	if _, err := conn.Write(append(append([]byte{}, suiteReply...), salt...)); err != nil {
+		return nil, nil, err
+	}
+
+	transcript := append(append([]byte{}, handshakeData...), suiteReply...)
+	send, recv, err := dataCipher.NewPSKSessionCiphers(transcript, salt, false, policy)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to derive session keys: %w", err)
+	}
+	return recv, send, nil
+}
+
+// relayWithStats 在客户端侧连接（v2隧道或多路复用流，读写的均为明文）和目标连接之间双向转发数据
+func (s *Server) relayWithStats(st serverState, clientConn, targetConn net.Conn, exitIP net.IP, bytesUp, bytesDown *int64) error {
+	errCh := make(chan error, 2)
+
+	go func() {
+		errCh <- s.copyWithStats(st, targetConn, clientConn, exitIP, true, bytesUp)
+	}()
+
+	go func() {
+		errCh <- s.copyWithStats(st, clientConn, targetConn, exitIP, false, bytesDown)
+	}()
+
+	// 等待任一方向出错
+	return <-errCh
+}
+
+// requestClient 发起请求的客户端：客户端地址和请求中携带的本地代理认证用户名
+func requestClient(addr net.Addr, req *protocol.ConnectRequest) snat.ClientInfo {
+	client := snat.ClientInfoFromAddr(addr)
+	client.User = req.User
+	return client
+}
+
+// dialTarget 根据规则引擎和IP选择器确定出口IP并连接目标地址
+// 返回的出口IP非nil时已记录连接开始统计，调用方需在连接结束时调用recordConnEnd
+func (s *Server) dialTarget(st serverState, client snat.ClientInfo, targetAddr string) (net.Conn, net.IP, error) {
 	host, portStr, err := net.SplitHostPort(targetAddr)
 	if err != nil {
-		return fmt.Errorf("invalid target address: %w", err)
+		return nil, nil, fmt.Errorf("invalid target address: %w", err)
 	}
 	targetPort, err := strconv.Atoi(portStr)
 	if err != nil {
-		return fmt.Errorf("invalid port: %w", err)
+		return nil, nil, fmt.Errorf("invalid port: %w", err)
+	}
+
+	// 按目标和地址族策略确定出口IP的地址族
+	families, policy, resolved := targetFamilies(st, host, targetPort)
+	if policy == snat.FamilyPolicyHappyEyeballs && len(families) == 2 {
+		primary, err := s.selectExitIP(st, client, targetAddr, host, targetPort, families[0])
+		if err == nil {
+			return s.dialTargetHappyEyeballs(st, client, targetAddr, host, targetPort, primary, families[1], resolved)
+		}
+		if !snat.IsNoIPAvailable(err) {
+			return nil, nil, err
+		}
+		// 首选地址族没有可用的出口IP时只使用另一地址族
+		families = families[1:]
+	}
+	selectedIP, family, err := s.selectExitIPForTarget(st, client, targetAddr, host, targetPort, families)
+	if err != nil {
+		return nil, nil, err
 	}
-	_ = host // 避免未使用变量警告
 
+	// 记录流量分析（如果启用）
+	if s.trafficAnalyzer != nil && host != "" {
+		// 记录域名访问（延迟在连接结束时计算）
+		s.trafficAnalyzer.RecordDomainAccess(host, 0, 0, 0)
+	}
+
+	// 记录连接开始统计
+	s.exitConnStart(st, selectedIP)
+
+	// 经出口IP建立到目标的连接（使用连接管理器的超时），只连接出口IP地址族的目标地址
+	dialStart := time.Now()
+	targetConn, err := s.dialEgressAddrs(context.Background(), st, familyNetwork("tcp", family), dialAddrs(targetAddr, resolved, family), selectedIP)
+	snat.FeedbackOf(st.ipSelector).OnDialResult(selectedIP, time.Since(dialStart), err)
+	if err != nil {
+		return nil, selectedIP, fmt.Errorf("failed to dial target: %w", err)
+	}
+
+	// 设置目标连接超时
+	s.connManager.SetTimeouts(targetConn, st.config.Connection.ReadTimeout, st.config.Connection.WriteTimeout)
+
+	return targetConn, selectedIP, nil
+}
+
+// dialTargetHappyEyeballs 经首选地址族的出口IP连接目标，需要时再选择另一地址族的出口IP并发连接，使用先建立的连接
+func (s *Server) dialTargetHappyEyeballs(st serverState, client snat.ClientInfo, targetAddr, host string, targetPort int, primary net.IP, fallbackFamily snat.IPFamily, resolved []net.IP) (net.Conn, net.IP, error) {
+	if s.trafficAnalyzer != nil && host != "" {
+		s.trafficAnalyzer.RecordDomainAccess(host, 0, 0, 0)
+	}
+
+	var fallback net.IP
+	selectFallback := func() (net.IP, []string, error) {
+		var err error
+		fallback, err = s.selectExitIP(st, client, targetAddr, host, targetPort, fallbackFamily)
+		if err != nil {
+			return nil, nil, err
+		}
+		return fallback, dialAddrs(targetAddr, resolved, fallbackFamily), nil
+	}
+	primaryAddrs := dialAddrs(targetAddr, resolved, snat.FamilyOf(primary))
+	targetConn, selectedIP, err := s.dialHappyEyeballs(st, targetAddr, primary, primaryAddrs, selectFallback)
+
+	// 未使用的出口IP释放选择时预留的容量
+	for _, ip := range []net.IP{primary, fallback} {
+		if ip != nil && !ip.Equal(selectedIP) {
+			s.unreserveExitIP(st, ip)
+		}
+	}
+
+	// 连接统计记录在最终使用的出口IP上（失败时为首选的出口IP）
+	s.exitConnStart(st, selectedIP)
+	if err != nil {
+		return nil, selectedIP, err
+	}
+
+	s.connManager.SetTimeouts(targetConn, st.config.Connection.ReadTimeout, st.config.Connection.WriteTimeout)
+	return targetConn, selectedIP, nil
+}
+
+// selectExitIP 根据规则引擎和IP选择器为client确定目标地址使用的family的出口IP
+// 返回的出口IP已在选择器中为连接预留容量：调用方随后调用exitConnStart，或放弃时调用unreserveExitIP
+func (s *Server) selectExitIP(st serverState, client snat.ClientInfo, targetAddr, host string, targetPort int, family snat.IPFamily) (net.IP, error) {
 	// 规则引擎匹配
 	var selectedIP net.IP
-	if s.ruleEngine != nil {
-		rule, err := s.ruleEngine.Match(targetAddr)
+	if st.ruleEngine != nil {
+		rule, err := st.ruleEngine.Match(targetAddr)
 		if err == nil && rule != nil {
 			switch rule.Action {
 			case "block":
-				return fmt.Errorf("connection blocked by rule: %s", rule.Name)
+				return nil, fmt.Errorf("connection blocked by rule: %s", rule.Name)
 			case "use_ip":
 				selectedIP = net.ParseIP(rule.TargetIP)
 				if selectedIP == nil {
-					return fmt.Errorf("invalid target IP in rule: %s", rule.TargetIP)
+					return nil, fmt.Errorf("invalid target IP in rule: %s", rule.TargetIP)
+				}
+				// 正在排空的IP不分配给新连接，改用选择器
+				if s.exitPool.isDraining(selectedIP.String()) {
+					logrus.Debugf("IP %s from rule %s is draining, using selector", rule.TargetIP, rule.Name)
+					selectedIP = nil
+					break
+				}
+				if !family.Matches(selectedIP) {
+					logrus.Debugf("IP %s from rule %s is not %s, using selector", rule.TargetIP, rule.Name, family)
+					selectedIP = nil
+					break
 				}
 				logrus.Debugf("Using IP %s from rule %s for %s", rule.TargetIP, rule.Name, targetAddr)
 			case "redirect":
 				// 重定向到新地址（这里简化处理，使用规则中的目标IP）
 				if rule.TargetIP != "" {
 					selectedIP = net.ParseIP(rule.TargetIP)
+					if selectedIP != nil && !family.Matches(selectedIP) {
+						selectedIP = nil
+					}
 					if selectedIP != nil {
 						logrus.Debugf("Redirecting %s to %s via rule %s", targetAddr, rule.TargetIP, rule.Name)
 					}
@@ -603,93 +1212,227 @@ func (s *Server) handleConn(conn net.Conn) error {
 		}
 	}
 
+	// 规则指定的IP同样为连接预留容量，达到容量上限时改用选择器
+	if selectedIP != nil && !snat.ReserverOf(st.ipSelector).Reserve(selectedIP) {
+		logrus.Debugf("IP %s from rule is at capacity, using selector", selectedIP)
+		selectedIP = nil
+	}
+
 	// 如果没有规则匹配或规则没有指定IP，使用选择器
 	if selectedIP == nil {
-		selectedIP, err = s.ipSelector.SelectIP(host, targetPort)
+		var err error
+		selectedIP, err = snat.SelectIPForClient(st.ipSelector, client, host, targetPort, family)
 		if err != nil {
-			return fmt.Errorf("failed to select IP: %w", err)
+			return nil, fmt.Errorf("failed to select IP: %w", err)
 		}
 	}
-	exitIP = selectedIP // 赋值给defer中使用的变量
 
-	// 记录流量分析（如果启用）
-	if s.trafficAnalyzer != nil && host != "" {
-		// 记录域名访问（延迟在连接结束时计算）
-		s.trafficAnalyzer.RecordDomainAccess(host, 0, 0, 0)
-	}
+	return selectedIP, nil
+}
 
-	// 记录连接开始统计
+// exitConnStart 记录出口IP上的连接开始：出口IP池、连接统计和选择器反馈
+func (s *Server) exitConnStart(st serverState, exitIP net.IP) {
+	s.exitPool.acquire(exitIP)
 	if s.statsManager != nil {
 		s.statsManager.OnConnectionStart(exitIP)
 	}
+	snat.FeedbackOf(st.ipSelector).OnConnectionStart(exitIP)
+}
 
-	// 建立到目标的连接（使用连接管理器的超时）
-	var targetConn net.Conn
-	if s.routingMgr != nil {
-		// 使用SNAT
-		targetConn, err = s.connManager.DialWithTimeout("tcp", targetAddr)
-		if err != nil {
-			return fmt.Errorf("failed to dial target: %w", err)
+// unreserveExitIP 释放选中但未使用的出口IP在选择器中预留的容量
+func (s *Server) unreserveExitIP(st serverState, exitIP net.IP) {
+	snat.ReserverOf(st.ipSelector).Unreserve(exitIP)
+}
+
+// exitConnEnd 记录出口IP上的连接结束（st与连接开始时相同，反馈给选择该出口IP的选择器）
+func (s *Server) exitConnEnd(st serverState, exitIP net.IP, duration time.Duration) {
+	s.exitPool.release(exitIP)
+	if s.statsManager != nil {
+		s.statsManager.OnConnectionEnd(exitIP, duration)
+	}
+	snat.FeedbackOf(st.ipSelector).OnConnectionEnd(exitIP)
+}
+
+// exitTransferred 记录出口IP上的上行和下行流量
+func (s *Server) exitTransferred(st serverState, exitIP net.IP, up, down int64) {
+	s.exitPool.transferred(exitIP, up+down)
+	if s.statsManager != nil {
+		s.statsManager.OnBytesTransferred(exitIP, up, down)
+	}
+	snat.FeedbackOf(st.ipSelector).OnBytesTransferred(exitIP, up+down)
+}
+
+// recordConnEnd 记录连接结束统计和流量分析
+func (s *Server) recordConnEnd(st serverState, exitIP net.IP, targetAddr string, startTime time.Time, bytesUp, bytesDown int64) {
+	duration := time.Since(startTime)
+
+	// 记录连接结束统计
+	if exitIP != nil {
+		s.exitConnEnd(st, exitIP, duration)
+	}
+
+	// 记录流量分析（如果启用）
+	if s.trafficAnalyzer != nil && targetAddr != "" {
+		host, _, _ := net.SplitHostPort(targetAddr)
+		if host != "" {
+			s.trafficAnalyzer.RecordDomainAccess(host, bytesUp, bytesDown, duration)
 		}
+	}
+}
+
+// serveMux 处理多路复用会话，每个流独立选择出口IP并连接目标
+func (s *Server) serveMux(conn net.Conn, readCipher, writeCipher protocol.RecordCipher) error {
+	// 会话由心跳检测存活，清除握手阶段设置的超时（写超时由会话的写循环按帧设置）
+	conn.SetDeadline(time.Time{})
 
-		// 标记连接
-		if err := s.routingMgr.MarkConnection(targetConn, exitIP); err != nil {
-			targetConn.Close()
-			return fmt.Errorf("failed to mark connection: %w", err)
+	session := newMuxSession(conn, readCipher, writeCipher, false)
+	defer session.Close()
+
+	// 服务端关闭时关闭会话
+	go func() {
+		select {
+		case <-s.shutdownCtx.Done():
+			session.Close()
+		case <-session.CloseNotify():
 		}
-	} else {
-		// 不使用SNAT，直接连接
-		targetConn, err = s.connManager.DialWithTimeout("tcp", targetAddr)
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		stream, err := session.AcceptStream()
 		if err != nil {
-			return fmt.Errorf("failed to dial target: %w", err)
+			return nil
 		}
+
+		wg.Add(1)
+		go func(stream *MuxStream) {
+			defer wg.Done()
+			defer stream.Close()
+			if err := s.handleMuxStream(stream); err != nil {
+				logrus.Debugf("Mux stream %d error: %v", stream.ID(), err)
+			}
+		}(stream)
 	}
-	defer targetConn.Close()
+}
 
-	// 注意：targetConn已经在defer中关闭，不需要添加到管理器
-	// 只在需要超时管理时添加
+// handleMuxStream 处理多路复用流（对应非复用模式下的单个连接）
+// 每个流与TCP连接一样受全局连接数和速率限制
+func (s *Server) handleMuxStream(stream *MuxStream) error {
+	release, ok := s.admitConnection(stream, getClientIP(stream))
+	if !ok {
+		stream.Reject()
+		return fmt.Errorf("mux stream rejected: connection limit exceeded")
+	}
+	defer release()
+	// 流使用所属会话协商的加密算法
+	s.connManager.SetCipher(stream, s.connManager.Cipher(stream.session.conn))
 
-	// 设置目标连接超时
-	s.connManager.SetTimeouts(targetConn, s.config.Connection.ReadTimeout, s.config.Connection.WriteTimeout)
+	connStartTime := time.Now()
+	var exitIP net.IP
+	var targetAddr string
+	var bytesUp, bytesDown int64
 
-	// 为每个连接创建独立的加密上下文（避免nonce冲突，提升并发性能）
-	connCipher := protocol.NewConnectionCipher(s.cipher)
+	st := s.snapshot()
+	defer func() {
+		s.recordConnEnd(st, exitIP, targetAddr, connStartTime, atomic.LoadInt64(&bytesUp), atomic.LoadInt64(&bytesDown))
+	}()
 
-	// 发送成功响应（加密）
-	response := []byte{0x00} // 成功
-	encryptedResp, err := connCipher.Encrypt(response)
+	req, err := protocol.DecodeConnectRequest(stream.OpenRequest())
 	if err != nil {
+		stream.Reject()
+		return fmt.Errorf("failed to decode request: %w", err)
+	}
+
+	if req.Type == protocol.MsgTypeUDPAssociate {
+		if !st.config.UDP.Enabled {
+			stream.Reject()
+			return fmt.Errorf("UDP associate rejected: UDP relay disabled")
+		}
+		if err := stream.Accept(); err != nil {
+			return err
+		}
+		return s.serveUDP(st, stream, &bytesUp, &bytesDown)
+	}
+
+	if req.Type == protocol.MsgTypeBind {
+		targetAddr = protocol.BuildAddress(req.AddrType, req.Address, req.Port)
+		listener, selectedIP, err := s.listenBind(st, requestClient(stream.RemoteAddr(), req), targetAddr)
+		exitIP = selectedIP
+		if err != nil {
+			stream.Reject()
+			return err
+		}
+		defer listener.Close()
+		if err := stream.Accept(); err != nil {
+			return err
+		}
+		return s.serveBind(st, stream, listener, targetAddr, exitIP, &bytesUp, &bytesDown)
+	}
+
+	targetAddr = protocol.BuildAddress(req.AddrType, req.Address, req.Port)
+	if targetAddr == "" {
+		stream.Reject()
+		return fmt.Errorf("invalid target address")
+	}
+
+	targetConn, selectedIP, err := s.dialTarget(st, requestClient(stream.RemoteAddr(), req), targetAddr)
+	exitIP = selectedIP
+	if err != nil {
+		stream.Reject()
 		return err
 	}
-	s.connManager.ResetWriteDeadline(conn)
-	if _, err := conn.Write(encryptedResp); err != nil {
+	defer targetConn.Close()
+
+	if err := stream.Accept(); err != nil {
 		return err
 	}
 
-	// 双向转发数据
-	errCh := make(chan error, 2)
+	return s.relayWithStats(st, stream, targetConn, exitIP, &bytesUp, &bytesDown)
+}
 
-	go func() {
-		errCh <- s.copyDataWithCipher(targetConn, conn, connCipher, true, exitIP, &bytesUp, &bytesDown)
-	}()
+// copyWithStats 复制明文数据并更新流量统计（upstream为true表示客户端到目标方向）
+func (s *Server) copyWithStats(st serverState, dst, src net.Conn, exitIP net.IP, upstream bool, counter *int64) error {
+	buf := bufferPool.Get().([]byte)
+	defer bufferPool.Put(buf)
 
-	go func() {
-		errCh <- s.copyDataWithCipher(conn, targetConn, connCipher, false, exitIP, &bytesUp, &bytesDown)
-	}()
+	for {
+		s.connManager.ResetReadDeadline(src)
+		n, err := src.Read(buf)
+		if n > 0 {
+			s.connManager.ResetWriteDeadline(dst)
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
 
-	// 等待任一方向出错
-	err = <-errCh
-	return err
+			bytes := int64(n)
+			atomic.AddInt64(counter, bytes)
+			if exitIP != nil {
+				if upstream {
+					s.exitTransferred(st, exitIP, bytes, 0)
+				} else {
+					s.exitTransferred(st, exitIP, 0, bytes)
+				}
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
 }
 
 // copyData 复制数据并加密/解密（使用buffer池优化，保留用于兼容）
-func (s *Server) copyData(dst, src net.Conn, encrypt bool, exitIP net.IP, bytesUp, bytesDown *int64) error {
+func (s *Server) copyData(st serverState, dst, src net.Conn, encrypt bool, exitIP net.IP, bytesUp, bytesDown *int64) error {
 	connCipher := protocol.NewConnectionCipher(s.cipher)
-	return s.copyDataWithCipher(dst, src, connCipher, encrypt, exitIP, bytesUp, bytesDown)
+	return s.copyDataWithCipher(st, dst, src, connCipher, encrypt, exitIP, bytesUp, bytesDown)
 }
 
 // copyDataWithCipher 使用指定的加密上下文复制数据（连接级优化）
-func (s *Server) copyDataWithCipher(dst, src net.Conn, cipher *protocol.ConnectionCipher, encrypt bool, exitIP net.IP, bytesUp, bytesDown *int64) error {
+func (s *Server) copyDataWithCipher(st serverState, dst, src net.Conn, cipher *protocol.ConnectionCipher, encrypt bool, exitIP net.IP, bytesUp, bytesDown *int64) error {
 	// 从buffer池获取buffer
 	buf := bufferPool.Get().([]byte)
 	defer bufferPool.Put(buf)
@@ -734,17 +1477,21 @@ func (s *Server) copyDataWithCipher(dst, src net.Conn, cipher *protocol.Connecti
 			// 更新流量统计
 			bytes := int64(len(data))
 			totalBytes += bytes
-			if s.statsManager != nil && exitIP != nil {
-				if encrypt {
-					s.statsManager.OnBytesTransferred(exitIP, 0, bytes) // 下行
-					if bytesDown != nil {
-						atomic.AddInt64(bytesDown, bytes)
-					}
-				} else {
-					s.statsManager.OnBytesTransferred(exitIP, bytes, 0) // 上行
-					if bytesUp != nil {
-						atomic.AddInt64(bytesUp, bytes)
-					}
+			if encrypt {
+				// 下行
+				if exitIP != nil {
+					s.exitTransferred(st, exitIP, 0, bytes)
+				}
+				if bytesDown != nil {
+					atomic.AddInt64(bytesDown, bytes)
+				}
+			} else {
+				// 上行
+				if exitIP != nil {
+					s.exitTransferred(st, exitIP, bytes, 0)
+				}
+				if bytesUp != nil {
+					atomic.AddInt64(bytesUp, bytes)
 				}
 			}
 		}
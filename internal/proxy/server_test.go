@@ -1,8 +1,15 @@
 package proxy
 
 import (
+	"bytes"
+	"context"
+	"io"
+	"net"
 	"testing"
 	"time"
+
+	"multiexit-proxy/internal/protocol"
+	"multiexit-proxy/internal/security"
 )
 
 func TestServer_GetStats(t *testing.T) {
@@ -37,5 +44,405 @@ func TestServer_GetStats(t *testing.T) {
 	t.Logf("Stats enabled: %v", config.EnableStats)
 }
 
+// newTunnelTestServer 创建用于隧道测试的服务端（不监听端口，直接调用handleConn）
+func newTunnelTestServer(t *testing.T) (*Server, *protocol.Cipher) {
+	ciphers, err := newDataCiphers(protocol.DeriveKeyFromPSK("test-key"))
+	if err != nil {
+		t.Fatalf("Failed to create ciphers: %v", err)
+	}
+	cipher := ciphers[protocol.CipherAES256GCM]
+	s := newReloadTestServer(t, &ServerConfig{
+		ListenAddr: "127.0.0.1:0",
+		AuthKey:    "test-key",
+		ExitIPs:    []string{"127.0.0.1"},
+		Strategy:   "round_robin",
+	})
+	s.cipher = cipher
+	s.ciphers = ciphers
+	s.replayFilter = security.NewReplayCache(handshakeMaxSkew, 0)
+	s.shutdownCtx, s.shutdownCancel = context.WithCancel(context.Background())
+	t.Cleanup(s.shutdownCancel)
+	return s, cipher
+}
+
+// startEchoServer 启动本地回显服务
+func startEchoServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestServer_HandleConnV2(t *testing.T) {
+	s, cipher := newTunnelTestServer(t)
+	echoAddr := startEchoServer(t)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go s.handleConn(serverConn)
+
+	client := &Client{config: &ClientConfig{}, cipher: cipher, ciphers: s.ciphers}
+	readCipher, writeCipher, err := client.handshake(clientConn, 0)
+	if err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+
+	tunnel := newAEADConn(clientConn, readCipher, writeCipher)
+	reqData, err := buildConnectRequest(echoAddr)
+	if err != nil {
+		t.Fatalf("buildConnectRequest failed: %v", err)
+	}
+	if err := tunnel.writer.WriteRecord(reqData); err != nil {
+		t.Fatalf("WriteRecord failed: %v", err)
+	}
+	response, err := tunnel.reader.ReadRecord()
+	if err != nil || len(response) != 1 || response[0] != 0x00 {
+		t.Fatalf("Unexpected response %v (%v)", response, err)
+	}
+
+	// 超过单条记录大小的数据
+	data := bytes.Repeat([]byte("multiexit"), protocol.MaxRecordSize/4)
+	go tunnel.Write(data)
+	received := make([]byte, len(data))
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(tunnel, received); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(data, received) {
+		t.Error("Echoed data mismatch")
+	}
+}
+
+func TestServer_HandleConnMux(t *testing.T) {
+	s, cipher := newTunnelTestServer(t)
+	echoAddr := startEchoServer(t)
+
+	clientConn, serverConn := net.Pipe()
+	go s.handleConn(serverConn)
+
+	client := &Client{config: &ClientConfig{}, cipher: cipher, ciphers: s.ciphers}
+	readCipher, writeCipher, err := client.handshake(clientConn, protocol.HandshakeFlagMux)
+	if err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	session := newMuxSession(clientConn, readCipher, writeCipher, true)
+	defer session.Close()
+
+	for i := 0; i < 3; i++ {
+		stream, err := session.OpenStream(echoAddr)
+		if err != nil {
+			t.Fatalf("OpenStream failed: %v", err)
+		}
+		stream.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(stream, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("Unexpected echo %q (%v)", buf, err)
+		}
+		stream.Close()
+	}
+}
+
+func TestServer_MuxStreamConnectionLimit(t *testing.T) {
+	s, cipher := newTunnelTestServer(t)
+	s.connManager.UpdateSettings(1, 0, 0, 0, 0, false, 0)
+	echoAddr := startEchoServer(t)
+
+	clientConn, serverConn := net.Pipe()
+	go s.handleConn(serverConn)
 
+	client := &Client{config: &ClientConfig{}, cipher: cipher, ciphers: s.ciphers}
+	readCipher, writeCipher, err := client.handshake(clientConn, protocol.HandshakeFlagMux)
+	if err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	session := newMuxSession(clientConn, readCipher, writeCipher, true)
+	defer session.Close()
 
+	// 每个流单独计入连接数：第一个流占满上限后，第二个流被拒绝
+	first, err := session.OpenStream(echoAddr)
+	if err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+	if _, err := session.OpenStream(echoAddr); err != ErrMuxStreamRejected {
+		t.Fatalf("Expected stream over the connection limit to be rejected, got %v", err)
+	}
+
+	// 流结束后释放名额
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.connManager.GetActiveCount() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := session.OpenStream(echoAddr); err != nil {
+		t.Errorf("OpenStream after release failed: %v", err)
+	}
+}
+
+func TestServer_HandleConnBadKey(t *testing.T) {
+	s, _ := newTunnelTestServer(t)
+
+	otherCipher, _ := protocol.NewCipher(protocol.DeriveKeyFromPSK("wrong-key"), true)
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.handleConn(serverConn)
+	}()
+
+	client := &Client{config: &ClientConfig{}, cipher: otherCipher}
+	client.sendHandshakeWithCipher(clientConn, protocol.NewConnectionCipher(otherCipher))
+
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Error("Expected handshake with wrong key to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleConn did not return")
+	}
+}
+
+func TestServer_HandleConnReplay(t *testing.T) {
+	s, cipher := newTunnelTestServer(t)
+
+	// 记录一次合法握手的原始字节
+	var captured bytes.Buffer
+	client := &Client{config: &ClientConfig{}, cipher: cipher}
+	recorder := &recordingConn{Writer: &captured}
+	if err := client.sendHandshakeWithCipher(recorder, protocol.NewConnectionCipher(cipher)); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+
+	replay := func() error {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- s.handleConn(serverConn)
+		}()
+		clientConn.Write(captured.Bytes())
+		clientConn.Close()
+		return <-errCh
+	}
+
+	// 第一次握手通过认证（随后因连接关闭而失败），第二次被识别为重放
+	if err := replay(); err == protocol.ErrReplayDetected {
+		t.Fatal("First handshake should not be treated as replay")
+	}
+	if err := replay(); err != protocol.ErrReplayDetected {
+		t.Errorf("Expected ErrReplayDetected, got %v", err)
+	}
+	if stats := s.GetReplayStats(); stats == nil || stats.Rejected != 1 {
+		t.Errorf("Unexpected replay stats: %+v", stats)
+	}
+}
+
+// recordingConn 只记录写入数据的连接
+type recordingConn struct {
+	net.Conn
+	io.Writer
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	return c.Writer.Write(p)
+}
+
+func TestServer_HandleConnX25519(t *testing.T) {
+	s, cipher := newTunnelTestServer(t)
+	echoAddr := startEchoServer(t)
+
+	// 服务端只接受X25519握手，并在每条记录后轮换密钥
+	s.config.RequireForwardSecrecy = true
+	s.config.KeyRotation = protocol.KeyRotationPolicy{MaxBytes: 1}
+
+	client := &Client{
+		config: &ClientConfig{
+			HandshakeMethod: protocol.MethodX25519,
+			KeyRotation:     protocol.KeyRotationPolicy{MaxBytes: 1},
+		},
+		cipher:  cipher,
+		ciphers: s.ciphers,
+	}
+
+	// 单连接模式
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go s.handleConn(serverConn)
+
+	readCipher, writeCipher, err := client.handshake(clientConn, 0)
+	if err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	tunnel := newAEADConn(clientConn, readCipher, writeCipher)
+	reqData, _ := buildConnectRequest(echoAddr)
+	tunnel.writer.WriteRecord(reqData)
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if response, err := tunnel.reader.ReadRecord(); err != nil || response[0] != 0x00 {
+		t.Fatalf("Unexpected response %v (%v)", response, err)
+	}
+	for i := 0; i < 3; i++ {
+		tunnel.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(tunnel, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("Unexpected echo %q (%v)", buf, err)
+		}
+	}
+
+	// 多路复用模式
+	muxConn, muxServerConn := net.Pipe()
+	go s.handleConn(muxServerConn)
+	readCipher, writeCipher, err = client.handshake(muxConn, protocol.HandshakeFlagMux)
+	if err != nil {
+		t.Fatalf("Mux handshake failed: %v", err)
+	}
+	session := newMuxSession(muxConn, readCipher, writeCipher, true)
+	defer session.Close()
+	stream, err := session.OpenStream(echoAddr)
+	if err != nil {
+		t.Fatalf("OpenStream failed: %v", err)
+	}
+	stream.Write([]byte("pong"))
+	buf := make([]byte, 4)
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(stream, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("Unexpected echo %q (%v)", buf, err)
+	}
+}
+
+func TestServer_PSKSessionKeysPerConnection(t *testing.T) {
+	s, cipher := newTunnelTestServer(t)
+	client := &Client{config: &ClientConfig{}, cipher: cipher, ciphers: s.ciphers}
+
+	// 两个PSK连接加密相同的明文，密文必须不同（密钥按连接派生）
+	var records [][]byte
+	for i := 0; i < 2; i++ {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		go s.handleConn(serverConn)
+
+		_, writeCipher, err := client.handshake(clientConn, 0)
+		if err != nil {
+			t.Fatalf("Handshake failed: %v", err)
+		}
+		record, err := writeCipher.Encrypt([]byte("same plaintext"))
+		if err != nil {
+			t.Fatalf("Encrypt failed: %v", err)
+		}
+		records = append(records, append([]byte(nil), record...))
+	}
+	if bytes.Equal(records[0], records[1]) {
+		t.Error("Two PSK connections produced the same ciphertext for the same plaintext")
+	}
+}
+
+func TestServer_RequireForwardSecrecy(t *testing.T) {
+	s, cipher := newTunnelTestServer(t)
+	s.config.RequireForwardSecrecy = true
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.handleConn(serverConn)
+	}()
+
+	client := &Client{config: &ClientConfig{}, cipher: cipher}
+	client.sendHandshakeWithCipher(clientConn, protocol.NewConnectionCipher(cipher))
+
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Error("PSK handshake should be rejected when forward secrecy is required")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleConn did not return")
+	}
+}
+
+func TestServer_HandleConnCipherNegotiation(t *testing.T) {
+	s, cipher := newTunnelTestServer(t)
+	echoAddr := startEchoServer(t)
+
+	tests := []struct {
+		name   string
+		client []protocol.CipherSuite
+		server []protocol.CipherSuite
+		method uint8
+	}{
+		{"chacha preferred by client", []protocol.CipherSuite{protocol.CipherChaCha20Poly1305, protocol.CipherAES256GCM}, nil, protocol.MethodPSK},
+		{"aes only server", []protocol.CipherSuite{protocol.CipherChaCha20Poly1305, protocol.CipherAES256GCM}, []protocol.CipherSuite{protocol.CipherAES256GCM}, protocol.MethodPSK},
+		{"chacha x25519", []protocol.CipherSuite{protocol.CipherChaCha20Poly1305}, nil, protocol.MethodX25519},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.config.CipherSuites = tt.server
+			client := &Client{
+				config:  &ClientConfig{HandshakeMethod: tt.method, CipherSuites: tt.client},
+				cipher:  cipher,
+				ciphers: s.ciphers,
+			}
+
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			go s.handleConn(serverConn)
+
+			clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+			readCipher, writeCipher, err := client.handshake(clientConn, 0)
+			if err != nil {
+				t.Fatalf("Handshake failed: %v", err)
+			}
+			tunnel := newAEADConn(clientConn, readCipher, writeCipher)
+			reqData, _ := buildConnectRequest(echoAddr)
+			tunnel.writer.WriteRecord(reqData)
+			if response, err := tunnel.reader.ReadRecord(); err != nil || response[0] != 0x00 {
+				t.Fatalf("Unexpected response %v (%v)", response, err)
+			}
+			tunnel.Write([]byte("ping"))
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(tunnel, buf); err != nil || string(buf) != "ping" {
+				t.Fatalf("Unexpected echo %q (%v)", buf, err)
+			}
+		})
+	}
+}
+
+func TestServer_HandleConnNoCommonCipher(t *testing.T) {
+	s, cipher := newTunnelTestServer(t)
+	s.config.CipherSuites = []protocol.CipherSuite{protocol.CipherAES256GCM}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.handleConn(serverConn)
+	}()
+
+	client := &Client{config: &ClientConfig{}, cipher: cipher}
+	flags := protocol.EncodeCipherSuites([]protocol.CipherSuite{protocol.CipherChaCha20Poly1305})
+	client.sendHandshakeWithFlags(clientConn, protocol.NewConnectionCipher(cipher), flags)
+
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Error("Expected handshake without a common cipher to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleConn did not return")
+	}
+}
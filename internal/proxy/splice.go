@@ -3,10 +3,8 @@
 package proxy
 
 import (
-	"io"
 	"os"
 	"syscall"
-	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
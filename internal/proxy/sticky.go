@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"multiexit-proxy/internal/snat"
+)
+
+// ErrStickyDisabled 未启用粘性会话
+var ErrStickyDisabled = errors.New("sticky sessions are not enabled")
+
+// StickySessions 当前有效的粘性会话，未启用粘性会话时返回ErrStickyDisabled
+func (s *Server) StickySessions() ([]snat.StickySession, error) {
+	s.mu.RLock()
+	stickySelector := s.stickySelector
+	s.mu.RUnlock()
+
+	if stickySelector == nil {
+		return nil, ErrStickyDisabled
+	}
+	return stickySelector.Sessions(), nil
+}
+
+// EvictStickySessions 删除粘性会话，之后的连接重新选择出口IP
+// key非空时只删除该会话，ip非空时删除使用该出口IP的会话，都为空时删除全部；返回删除的数量
+func (s *Server) EvictStickySessions(key, ip string) (int, error) {
+	s.mu.RLock()
+	stickySelector := s.stickySelector
+	s.mu.RUnlock()
+
+	if stickySelector == nil {
+		return 0, ErrStickyDisabled
+	}
+	switch {
+	case key != "":
+		if stickySelector.Evict(key) {
+			return 1, nil
+		}
+		return 0, nil
+	case ip != "":
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return 0, fmt.Errorf("invalid IP address: %s", ip)
+		}
+		return stickySelector.EvictIP(parsed), nil
+	default:
+		return stickySelector.Clear(), nil
+	}
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"multiexit-proxy/internal/protocol"
+	"multiexit-proxy/pkg/tproxy"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultTProxyTable 透明代理策略路由默认使用的路由表
+const defaultTProxyTable = 100
+
+// startTransparent 创建透明代理入站：TCP连接和UDP数据报的原始目标地址经隧道转发
+// 返回各监听的处理循环
+func (c *Client) startTransparent() ([]func() error, error) {
+	config := c.config.Transparent
+	server, err := tproxy.NewServer(config.Mode, func(network, addr string) (net.Conn, error) {
+		return c.Dial(addr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if config.UDP && c.protocolVersion() != protocol.Version2 {
+		return nil, fmt.Errorf("transparent UDP requires protocol v2")
+	}
+	server.PacketDialFunc = c.DialUDP
+
+	listener, err := server.Listen(config.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", config.Addr, err)
+	}
+	c.addListener(listener)
+	serves := []func() error{func() error {
+		return c.serve(listener, server.HandleConn)
+	}}
+
+	if config.UDP {
+		udpConn, err := server.ListenUDP(config.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen UDP on %s: %w", config.Addr, err)
+		}
+		c.addListener(udpConn)
+		serves = append(serves, func() error {
+			if err := server.ServeUDP(udpConn); err != nil && atomic.LoadInt32(&c.closed) == 0 {
+				return err
+			}
+			return nil
+		})
+	}
+
+	// 配置了fwmark时添加TPROXY策略路由
+	if config.Mark != 0 {
+		table := config.Table
+		if table == 0 {
+			table = defaultTProxyTable
+		}
+		routing, err := tproxy.NewRouting(config.Mark, table)
+		if err != nil {
+			return nil, err
+		}
+		if err := routing.Setup(); err != nil {
+			return nil, fmt.Errorf("failed to setup transparent proxy routing: %w", err)
+		}
+		c.tproxyRouting = routing
+	}
+
+	logrus.Infof("Transparent proxy (%s) listening on %s, UDP %v", config.Mode, config.Addr, config.UDP)
+	return serves, nil
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"multiexit-proxy/internal/snat"
+	"multiexit-proxy/internal/trojan"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 入站协议
+const (
+	ProtocolNative = "native"
+	ProtocolTrojan = "trojan"
+)
+
+// TrojanUserConfig Trojan用户配置
+type TrojanUserConfig struct {
+	Username   string
+	Password   string
+	Quota      int64 // 流量配额（字节，0表示不限）
+	AllowedIPs []string
+}
+
+// newTrojanInbound 创建Trojan入站：认证、回落和协议解析由trojan.Server完成，
+// 连接由本服务端的监听循环接受，请求交给trojanHandler处理
+func (s *Server) newTrojanInbound() (*trojan.Server, error) {
+	config := s.config
+	inbound, err := trojan.NewServer(&trojan.ServerConfig{
+		Password:         config.Trojan.Password,
+		UDPEnabled:       true, // 由trojanHandler按当前配置检查
+		Fallback:         config.Trojan.Fallback,
+		FallbackALPN:     config.Trojan.FallbackALPN,
+		RateLimiter:      &trojanUserLimiter{server: s},
+		StatsManager:     s.statsManager,
+		Handler:          &trojanHandler{server: s},
+		HandshakeTimeout: config.Connection.ReadTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, user := range config.Trojan.Users {
+		if err := inbound.AddUser(user.Username, user.Password, user.Quota, user.AllowedIPs); err != nil {
+			return nil, fmt.Errorf("failed to add trojan user %s: %w", user.Username, err)
+		}
+	}
+	logrus.Infof("Trojan inbound enabled with %d user(s)", len(config.Trojan.Users))
+	return inbound, nil
+}
+
+// GetTrojanServer 获取Trojan入站（入站协议不是trojan时返回nil），可用于运行时增删用户
+func (s *Server) GetTrojanServer() *trojan.Server {
+	return s.trojan
+}
+
+// trojanHandler 处理已认证的Trojan请求，与原生协议共用出口选择、拨号、统计和转发流程
+type trojanHandler struct {
+	server *Server
+}
+
+// HandleConnect 连接目标并双向转发
+func (h *trojanHandler) HandleConnect(conn net.Conn, targetAddr string) error {
+	s := h.server
+	connStartTime := time.Now()
+	var exitIP net.IP
+	var bytesUp, bytesDown int64
+
+	st := s.snapshot()
+	defer func() {
+		s.recordConnEnd(st, exitIP, targetAddr, connStartTime, atomic.LoadInt64(&bytesUp), atomic.LoadInt64(&bytesDown))
+	}()
+
+	targetConn, selectedIP, err := s.dialTarget(st, trojanClientInfo(conn), targetAddr)
+	exitIP = selectedIP
+	if err != nil {
+		return err
+	}
+	defer targetConn.Close()
+
+	return s.relayWithStats(st, conn, targetConn, exitIP, &bytesUp, &bytesDown)
+}
+
+// HandleUDP 处理UDP关联
+func (h *trojanHandler) HandleUDP(conn *trojan.PacketConn) error {
+	st := h.server.snapshot()
+	if !st.config.UDP.Enabled {
+		return fmt.Errorf("UDP associate rejected: UDP relay disabled")
+	}
+
+	var bytesUp, bytesDown int64
+	return h.server.relayUDP(st, trojanClientInfo(conn), conn, &bytesUp, &bytesDown)
+}
+
+// trojanClientInfo Trojan连接的客户端地址和认证用户
+func trojanClientInfo(conn net.Conn) snat.ClientInfo {
+	client := snat.ClientInfoFromAddr(conn.RemoteAddr())
+	client.User = trojan.ConnUser(conn)
+	return client
+}
+
+// trojanUserLimiter 使用当前的速率限制器限制Trojan用户连接数（未启用速率限制时不限制）
+type trojanUserLimiter struct {
+	server *Server
+}
+
+// AdmitUser 检查用户是否允许连接，连接结束时归还到检查时使用的限制器（与admitConnection相同，热重载替换限制器后也能正确计数）
+func (l *trojanUserLimiter) AdmitUser(username string) (func(), bool) {
+	l.server.mu.RLock()
+	rateLimiter := l.server.rateLimiter
+	l.server.mu.RUnlock()
+	if rateLimiter == nil {
+		return func() {}, true
+	}
+	if !rateLimiter.CheckUser(username) {
+		return nil, false
+	}
+	return func() { rateLimiter.OnUserConnectionEnd(username) }, true
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"multiexit-proxy/internal/monitor"
+	"multiexit-proxy/internal/snat"
+	"multiexit-proxy/internal/trojan"
+)
+
+// newTrojanTestServer 创建使用Trojan入站的测试服务端
+func newTrojanTestServer(t *testing.T) *Server {
+	s, _ := newTunnelTestServer(t)
+	s.statsManager = monitor.NewStatsManager()
+	s.config.Trojan.Password = "trojan-password"
+	s.config.Trojan.Users = []TrojanUserConfig{{Username: "alice", Password: "alice-password"}}
+
+	inbound, err := s.newTrojanInbound()
+	if err != nil {
+		t.Fatalf("newTrojanInbound failed: %v", err)
+	}
+	s.trojan = inbound
+	return s
+}
+
+// dialTrojan 在管道上发送Trojan协议头和请求
+func dialTrojan(t *testing.T, s *Server, password string, cmd byte, target string) net.Conn {
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close() })
+	go s.trojan.HandleConn(serverConn)
+
+	header := trojan.NewHeader(password)
+	req, err := trojan.ParseTargetAddr(target, cmd)
+	if err != nil {
+		t.Fatalf("ParseTargetAddr failed: %v", err)
+	}
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := clientConn.Write(append(header[:], trojan.BuildRequest(req)...)); err != nil {
+		t.Fatalf("Failed to write trojan request: %v", err)
+	}
+	return clientConn
+}
+
+func TestServer_TrojanConnect(t *testing.T) {
+	s := newTrojanTestServer(t)
+	echoAddr := startEchoServer(t)
+
+	for _, password := range []string{"trojan-password", "alice-password"} {
+		conn := dialTrojan(t, s, password, trojan.CmdConnect, echoAddr)
+		conn.Write([]byte("hello"))
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+			t.Fatalf("Unexpected echo %q (%v)", buf, err)
+		}
+		conn.Close()
+	}
+
+	// 出口统计和用户统计都生效
+	deadline := time.Now().Add(2 * time.Second)
+	for s.statsManager.GetStats().ActiveConnections != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := s.statsManager.GetStats()
+	if stats.TotalConnections != 2 || stats.ActiveConnections != 0 {
+		t.Errorf("Expected 2 finished connections, got %d total, %d active", stats.TotalConnections, stats.ActiveConnections)
+	}
+	if ipStats := s.statsManager.GetIPStats(net.IPv4(127, 0, 0, 1)); ipStats == nil || ipStats.BytesUp != 10 {
+		t.Errorf("Unexpected exit IP stats %+v", ipStats)
+	}
+	if userStats := s.statsManager.GetUserStats("alice"); userStats == nil || userStats.Connections != 1 {
+		t.Errorf("Unexpected user stats %+v", userStats)
+	}
+}
+
+func TestServer_TrojanSelectorFeedback(t *testing.T) {
+	s := newTrojanTestServer(t)
+	loadBalanced, err := snat.NewLoadBalancedSelector([]string{"127.0.0.1"}, "traffic")
+	if err != nil {
+		t.Fatalf("Failed to create selector: %v", err)
+	}
+	s.ipSelector = snat.NewRuleBasedSelector(loadBalanced, snat.NewRuleEngine(), []string{"127.0.0.1"})
+	echoAddr := startEchoServer(t)
+
+	conn := dialTrojan(t, s, "trojan-password", trojan.CmdConnect, echoAddr)
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Failed to read echo: %v", err)
+	}
+	conn.Close()
+
+	// 规则选择器将连接、流量和拨号结果转发给负载均衡选择器
+	var stats map[string]interface{}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		stats = loadBalanced.GetStats()["127.0.0.1"].(map[string]interface{})
+		if stats["active_connections"] == int64(0) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats["active_connections"] != int64(0) || stats["total_bytes"] != int64(10) || stats["dial_errors"] != int64(0) {
+		t.Errorf("Unexpected selector stats: %v", stats)
+	}
+}
+
+func TestServer_TrojanUDP(t *testing.T) {
+	s := newTrojanTestServer(t)
+	echoAddr, sources := startUDPEchoServer(t)
+
+	// 未启用UDP中继时拒绝
+	pc := &trojan.PacketConn{Conn: dialTrojan(t, s, "trojan-password", trojan.CmdUDP, "0.0.0.0:0")}
+	pc.WriteTo([]byte("ping"), trojan.Addr(echoAddr))
+	if _, _, err := pc.ReadFrom(make([]byte, 16)); err == nil {
+		t.Error("UDP associate should be rejected when UDP relay is disabled")
+	}
+
+	s.config.UDP.Enabled = true
+	pc = &trojan.PacketConn{Conn: dialTrojan(t, s, "trojan-password", trojan.CmdUDP, "0.0.0.0:0")}
+	if _, err := pc.WriteTo([]byte("ping"), trojan.Addr(echoAddr)); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	buf := make([]byte, 16)
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if string(buf[:n]) != "ping" || from.String() != echoAddr {
+		t.Errorf("Got %q from %s, want ping from %s", buf[:n], from, echoAddr)
+	}
+	if source := <-sources; !source.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Datagram sent from %s, want exit IP 127.0.0.1", source)
+	}
+}
+
+func TestTrojanUserLimiter_ReleasesToAdmittingLimiter(t *testing.T) {
+	s, _ := newTunnelTestServer(t)
+	limiter := &trojanUserLimiter{server: s}
+	oldLimiter := NewRateLimiter(RateLimitConfig{UserMaxConnections: 1})
+	s.rateLimiter = oldLimiter
+
+	release, ok := limiter.AdmitUser("alice")
+	if !ok {
+		t.Fatal("Expected the first connection to be admitted")
+	}
+
+	// 热重载替换限制器后，重载前的连接结束时归还到原来的限制器
+	newLimiter := NewRateLimiter(RateLimitConfig{UserMaxConnections: 1})
+	s.rateLimiter = newLimiter
+	if _, ok := limiter.AdmitUser("alice"); !ok {
+		t.Fatal("Expected a connection to be admitted by the new limiter")
+	}
+	release()
+	if _, ok := limiter.AdmitUser("alice"); ok {
+		t.Error("New limiter admitted a connection over its limit after an old connection ended")
+	}
+	if !oldLimiter.CheckUser("alice") {
+		t.Error("Old limiter did not get its connection back")
+	}
+}
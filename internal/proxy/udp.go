@@ -0,0 +1,624 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"multiexit-proxy/internal/protocol"
+	"multiexit-proxy/internal/snat"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultUDPTimeout 出口UDP映射默认空闲超时
+	defaultUDPTimeout = 60 * time.Second
+
+	// udpMaxTargets 单个UDP关联缓存的目标地址数量上限（超出后清空缓存重新选择）
+	udpMaxTargets = 1024
+
+	// udpBufferSize UDP读缓冲区大小（可容纳最大的UDP数据报）
+	udpBufferSize = 64 * 1024
+
+	// udpPendingMax 域名目标解析期间缓存的数据报数量上限（超出的丢弃）
+	udpPendingMax = 16
+
+	// udpResolveFailureTTL 域名目标解析或选择出口IP失败后，在该时间内直接丢弃发往它的数据报
+	udpResolveFailureTTL = 10 * time.Second
+
+	// SOCKS5命令
+	socks5CmdConnect      = 0x01
+	socks5CmdBind         = 0x02
+	socks5CmdUDPAssociate = 0x03
+
+	// SOCKS5地址类型
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+)
+
+// handleUDPAssociate 处理SOCKS5 UDP ASSOCIATE：本地UDP端口收到的数据报经隧道转发，服务端返回的数据报发回客户端
+// 关联在SOCKS5控制连接关闭时结束
+func (c *Client) handleUDPAssociate(localConn net.Conn) error {
+	if c.protocolVersion() != protocol.Version2 {
+		c.sendSOCKS5Response(localConn, 0x07) // 不支持的命令
+		return fmt.Errorf("UDP associate requires protocol v2")
+	}
+
+	// 只接受SOCKS5控制连接所在主机发来的数据报
+	controlIP := tcpAddrIP(localConn.RemoteAddr())
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: tcpAddrIP(localConn.LocalAddr())})
+	if err != nil {
+		c.sendSOCKS5Response(localConn, 0x01)
+		return fmt.Errorf("failed to listen UDP: %w", err)
+	}
+	defer udpConn.Close()
+
+	tunnel, err := c.openUDPTunnel()
+	if err != nil {
+		c.sendSOCKS5Response(localConn, 0x05)
+		return err
+	}
+	defer tunnel.Close()
+
+	relayAddr := udpConn.LocalAddr().(*net.UDPAddr)
+	if err := c.sendSOCKS5ResponseAddr(localConn, 0x00, relayAddr.IP, relayAddr.Port); err != nil {
+		return err
+	}
+
+	// 控制连接关闭时结束关联
+	go func() {
+		io.Copy(io.Discard, localConn)
+		udpConn.Close()
+		tunnel.Close()
+	}()
+
+	var clientAddr atomic.Pointer[net.UDPAddr]
+
+	// 服务端 -> 客户端
+	go func() {
+		defer udpConn.Close()
+		for {
+			d, err := protocol.ReadUDPDatagram(tunnel)
+			if err != nil {
+				return
+			}
+			addr := clientAddr.Load()
+			if addr == nil {
+				continue
+			}
+			packet, err := buildSOCKS5UDPPacket(d)
+			if err != nil {
+				continue
+			}
+			udpConn.WriteToUDP(packet, addr)
+		}
+	}()
+
+	// 客户端 -> 服务端
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, from, err := udpConn.ReadFromUDP(buf)
+		if err != nil {
+			return nil
+		}
+		if controlIP != nil && !controlIP.IsUnspecified() && !from.IP.Equal(controlIP) {
+			continue
+		}
+		d, err := parseSOCKS5UDPPacket(buf[:n])
+		if err != nil {
+			logrus.Debugf("Dropping SOCKS5 UDP packet from %s: %v", from, err)
+			continue
+		}
+		clientAddr.Store(from)
+		if err := protocol.WriteUDPDatagram(tunnel, d); err != nil {
+			return err
+		}
+	}
+}
+
+// openUDPTunnel 建立UDP关联隧道（多路复用模式下为会话中的流，否则为独立的v2连接）
+func (c *Client) openUDPTunnel() (net.Conn, error) {
+	return c.openRequestTunnel(protocol.EncodeUDPAssociateRequest(), "UDP associate")
+}
+
+// DialUDP 建立经服务端转发的UDP通道：WriteTo的地址为目标地址（可为域名），ReadFrom返回数据报来源地址（需要协议v2）
+func (c *Client) DialUDP() (net.PacketConn, error) {
+	if c.protocolVersion() != protocol.Version2 {
+		return nil, fmt.Errorf("UDP associate requires protocol v2")
+	}
+	tunnel, err := c.openUDPTunnel()
+	if err != nil {
+		return nil, err
+	}
+	return &datagramConn{Conn: tunnel}, nil
+}
+
+// parseSOCKS5UDPPacket 解析SOCKS5 UDP请求头（RSV、FRAG、地址），不支持分片
+func parseSOCKS5UDPPacket(packet []byte) (*protocol.UDPDatagram, error) {
+	if len(packet) < 4 {
+		return nil, errors.New("packet too short")
+	}
+	if packet[2] != 0x00 {
+		return nil, errors.New("fragmentation not supported")
+	}
+
+	d := &protocol.UDPDatagram{}
+	offset := 4
+	switch packet[3] {
+	case socks5AddrIPv4:
+		d.AddrType = protocol.AddrTypeIPv4
+		offset += net.IPv4len
+	case socks5AddrIPv6:
+		d.AddrType = protocol.AddrTypeIPv6
+		offset += net.IPv6len
+	case socks5AddrDomain:
+		if len(packet) < 5 {
+			return nil, errors.New("packet too short")
+		}
+		d.AddrType = protocol.AddrTypeDomain
+		offset += 1 + int(packet[4])
+	default:
+		return nil, fmt.Errorf("unsupported address type: %d", packet[3])
+	}
+	if len(packet) < offset+2 {
+		return nil, errors.New("packet too short")
+	}
+
+	if d.AddrType == protocol.AddrTypeDomain {
+		d.Address = packet[5:offset]
+	} else {
+		d.Address = packet[4:offset]
+	}
+	d.Port = uint16(packet[offset])<<8 | uint16(packet[offset+1])
+	d.Payload = packet[offset+2:]
+	return d, nil
+}
+
+// buildSOCKS5UDPPacket 为服务端返回的数据报添加SOCKS5 UDP头
+func buildSOCKS5UDPPacket(d *protocol.UDPDatagram) ([]byte, error) {
+	packet := make([]byte, 0, 4+1+len(d.Address)+2+len(d.Payload))
+	packet = append(packet, 0x00, 0x00, 0x00)
+	switch d.AddrType {
+	case protocol.AddrTypeIPv4:
+		packet = append(packet, socks5AddrIPv4)
+	case protocol.AddrTypeIPv6:
+		packet = append(packet, socks5AddrIPv6)
+	case protocol.AddrTypeDomain:
+		packet = append(packet, socks5AddrDomain, uint8(len(d.Address)))
+	default:
+		return nil, fmt.Errorf("unsupported address type: %d", d.AddrType)
+	}
+	packet = append(packet, d.Address...)
+	packet = append(packet, uint8(d.Port>>8), uint8(d.Port))
+	return append(packet, d.Payload...), nil
+}
+
+// tcpAddrIP 获取TCP地址中的IP（非TCP地址返回nil）
+func tcpAddrIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	return nil
+}
+
+// udpClientConn UDP关联的客户端侧：按数据报读写，地址为目标（读）或来源（写）
+// 原生隧道使用datagramConn，Trojan入站使用trojan.PacketConn
+type udpClientConn interface {
+	net.Conn
+	ReadFrom(p []byte) (int, net.Addr, error)
+	WriteTo(p []byte, addr net.Addr) (int, error)
+}
+
+// udpRelay 服务端UDP关联：每个数据报按目标地址选择出口IP，从绑定该出口IP的UDP套接字发出
+// 同一出口IP的目标共用一个套接字（端口保持不变，便于游戏和QUIC等协议穿越NAT），空闲超时后关闭
+// 域名目标在后台解析，解析期间发往它的数据报暂存，不阻塞其他目标的转发
+type udpRelay struct {
+	server    *Server
+	st        serverState
+	client    snat.ClientInfo // 发起关联的客户端
+	tunnel    udpClientConn
+	timeout   time.Duration
+	bytesUp   *int64
+	bytesDown *int64
+	lookupIP  func(ctx context.Context, network, host string) ([]net.IP, error)
+	writeMu   sync.Mutex // 串行化写入隧道的数据报
+	mu        sync.Mutex
+	sockets   map[string]*udpExitSocket // 出口IP -> 套接字
+	targets   map[string]*udpTarget     // 目标地址 -> 出口套接字和解析后的地址
+	pending   map[string]*udpPending    // 正在解析的域名目标 -> 暂存的数据报
+	failed    map[string]udpFailure     // 解析或选择出口IP失败的目标
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// udpPending 正在解析的目标
+type udpPending struct {
+	queue [][]byte
+}
+
+// udpFailure 目标解析或选择出口IP失败的结果
+type udpFailure struct {
+	err     error
+	expires time.Time
+}
+
+// udpExitSocket 绑定到出口IP的UDP套接字
+type udpExitSocket struct {
+	conn       *net.UDPConn
+	exitIP     net.IP
+	created    time.Time
+	lastActive int64 // 原子操作，UnixNano
+}
+
+// udpTarget 已选择出口IP的目标
+type udpTarget struct {
+	addr   *net.UDPAddr
+	socket *udpExitSocket
+}
+
+// serveUDP 处理原生隧道上的UDP关联，直到隧道关闭
+func (s *Server) serveUDP(st serverState, tunnel net.Conn, bytesUp, bytesDown *int64) error {
+	return s.relayUDP(st, snat.ClientInfoFromAddr(tunnel.RemoteAddr()), &datagramConn{Conn: tunnel}, bytesUp, bytesDown)
+}
+
+// newUDPRelay 创建client的UDP关联
+func newUDPRelay(s *Server, st serverState, client snat.ClientInfo, tunnel udpClientConn, timeout time.Duration, bytesUp, bytesDown *int64) *udpRelay {
+	return &udpRelay{
+		server:    s,
+		st:        st,
+		client:    client,
+		tunnel:    tunnel,
+		timeout:   timeout,
+		bytesUp:   bytesUp,
+		bytesDown: bytesDown,
+		lookupIP:  net.DefaultResolver.LookupIP,
+		sockets:   make(map[string]*udpExitSocket),
+		targets:   make(map[string]*udpTarget),
+		pending:   make(map[string]*udpPending),
+		failed:    make(map[string]udpFailure),
+	}
+}
+
+// relayUDP 处理client的UDP关联，直到客户端侧连接关闭
+func (s *Server) relayUDP(st serverState, client snat.ClientInfo, tunnel udpClientConn, bytesUp, bytesDown *int64) error {
+	timeout := st.config.UDP.Timeout
+	if timeout <= 0 {
+		timeout = defaultUDPTimeout
+	}
+	relay := newUDPRelay(s, st, client, tunnel, timeout, bytesUp, bytesDown)
+	defer relay.close()
+
+	// 关联期间由UDP映射的空闲超时控制，不使用TCP读超时
+	tunnel.SetReadDeadline(time.Time{})
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, addr, err := tunnel.ReadFrom(buf)
+		if err != nil {
+			if err == io.EOF || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if err := relay.send(addr.String(), buf[:n]); err != nil {
+			logrus.Debugf("Dropping UDP datagram to %s: %v", addr, err)
+		}
+	}
+}
+
+// send 将数据报从目标对应的出口套接字发出，首次出现的域名目标在后台解析（数据报暂存到解析完成）
+func (r *udpRelay) send(targetAddr string, payload []byte) error {
+	r.mu.Lock()
+	if target, ok := r.targets[targetAddr]; ok {
+		r.mu.Unlock()
+		return r.write(target, payload)
+	}
+	if failure, ok := r.failed[targetAddr]; ok {
+		if time.Now().Before(failure.expires) {
+			r.mu.Unlock()
+			return failure.err
+		}
+		delete(r.failed, targetAddr)
+	}
+	if pending, ok := r.pending[targetAddr]; ok {
+		if len(pending.queue) >= udpPendingMax {
+			r.mu.Unlock()
+			return fmt.Errorf("too many datagrams waiting for %s to resolve", targetAddr)
+		}
+		pending.queue = append(pending.queue, append([]byte(nil), payload...))
+		r.mu.Unlock()
+		return nil
+	}
+	host, _, err := net.SplitHostPort(targetAddr)
+	if err != nil {
+		r.mu.Unlock()
+		return fmt.Errorf("invalid target address: %w", err)
+	}
+	if net.ParseIP(host) == nil {
+		pending := &udpPending{queue: [][]byte{append([]byte(nil), payload...)}}
+		r.pending[targetAddr] = pending
+		r.mu.Unlock()
+		go r.resolve(targetAddr, pending)
+		return nil
+	}
+	r.mu.Unlock()
+
+	// IP目标不需要解析，直接选择出口IP
+	target, err := r.newTarget(targetAddr)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.addTarget(targetAddr, target)
+	r.mu.Unlock()
+	return r.write(target, payload)
+}
+
+// resolve 在后台解析域名目标并选择出口IP，然后按顺序发出暂存的数据报；失败时丢弃暂存的数据报并记录失败
+func (r *udpRelay) resolve(targetAddr string, pending *udpPending) {
+	target, err := r.newTarget(targetAddr)
+
+	r.mu.Lock()
+	if err != nil {
+		delete(r.pending, targetAddr)
+		if len(r.failed) >= udpMaxTargets {
+			r.failed = make(map[string]udpFailure)
+		}
+		r.failed[targetAddr] = udpFailure{err: err, expires: time.Now().Add(udpResolveFailureTTL)}
+		r.mu.Unlock()
+		logrus.Debugf("Dropping UDP datagrams to %s: %v", targetAddr, err)
+		return
+	}
+	// 发出暂存的数据报，期间到达的数据报继续暂存，全部发出后目标才生效，保持数据报顺序
+	for len(pending.queue) > 0 {
+		queue := pending.queue
+		pending.queue = nil
+		r.mu.Unlock()
+		for _, payload := range queue {
+			if err := r.write(target, payload); err != nil {
+				logrus.Debugf("Dropping UDP datagram to %s: %v", targetAddr, err)
+			}
+		}
+		r.mu.Lock()
+	}
+	delete(r.pending, targetAddr)
+	r.addTarget(targetAddr, target)
+	r.mu.Unlock()
+}
+
+// write 从目标的出口套接字发出数据报
+func (r *udpRelay) write(target *udpTarget, payload []byte) error {
+	target.socket.touch()
+	n, err := target.socket.conn.WriteToUDP(payload, target.addr)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(r.bytesUp, int64(n))
+	r.server.exitTransferred(r.st, target.socket.exitIP, int64(n), 0)
+	return nil
+}
+
+// addTarget 缓存目标（调用方持有r.mu），出口套接字已空闲关闭时不缓存，下一个数据报重新选择
+func (r *udpRelay) addTarget(targetAddr string, target *udpTarget) {
+	if r.sockets[target.socket.exitIP.String()] != target.socket {
+		return
+	}
+	if len(r.targets) >= udpMaxTargets {
+		r.targets = make(map[string]*udpTarget)
+	}
+	r.targets[targetAddr] = target
+}
+
+// newTarget 通过规则引擎和IP选择器为目标选择出口IP，解析目标并获取出口套接字
+func (r *udpRelay) newTarget(key string) (*udpTarget, error) {
+	host, portStr, err := net.SplitHostPort(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target address: %w", err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %w", err)
+	}
+	// UDP不并发尝试两个地址族，happy_eyeballs按IPv6优先处理
+	families, _, resolved := targetFamilies(r.st, host, port)
+	exitIP, family, err := r.server.selectExitIPForTarget(r.st, r.client, key, host, port, families)
+	if err != nil {
+		return nil, err
+	}
+
+	// 按出口IP的地址族解析目标（判断地址族时已解析的直接使用）
+	network := familyNetwork("udp", family)
+	addr, err := r.resolveAddr(network, dialAddrs(key, resolved, family)[0])
+	if err != nil {
+		r.server.unreserveExitIP(r.st, exitIP)
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		r.server.unreserveExitIP(r.st, exitIP)
+		return nil, net.ErrClosed
+	}
+	socket, err := r.socket(network, exitIP)
+	if err != nil {
+		r.server.unreserveExitIP(r.st, exitIP)
+		return nil, err
+	}
+	return &udpTarget{addr: addr, socket: socket}, nil
+}
+
+// resolveAddr 解析network（udp、udp4或udp6）的目标地址，域名的解析有超时
+func (r *udpRelay) resolveAddr(network, addr string) (*net.UDPAddr, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %w", err)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), familyLookupTimeout)
+	defer cancel()
+	ips, err := r.lookupIP(ctx, "ip"+strings.TrimPrefix(network, "udp"), host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no %s address for %s", network, host)
+	}
+	return &net.UDPAddr{IP: ips[0], Port: port}, nil
+}
+
+// socket 获取或创建绑定到出口IP的套接字（调用方持有r.mu）
+// 出口IP的预留在创建套接字时使用，已有套接字时释放（连接统计按套接字计数）
+func (r *udpRelay) socket(network string, exitIP net.IP) (*udpExitSocket, error) {
+	if socket, ok := r.sockets[exitIP.String()]; ok {
+		r.server.unreserveExitIP(r.st, exitIP)
+		return socket, nil
+	}
+
+	conn, err := r.server.listenEgressUDP(r.st, network, exitIP)
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind UDP socket to %s: %w", exitIP, err)
+	}
+
+	socket := &udpExitSocket{conn: conn, exitIP: exitIP, created: time.Now()}
+	socket.touch()
+	r.sockets[exitIP.String()] = socket
+	r.server.exitConnStart(r.st, exitIP)
+
+	r.wg.Add(1)
+	go r.readLoop(socket)
+	return socket, nil
+}
+
+// readLoop 将目标返回的数据报写回隧道，空闲超时后关闭套接字
+func (r *udpRelay) readLoop(socket *udpExitSocket) {
+	defer r.wg.Done()
+	defer r.removeSocket(socket)
+
+	buf := make([]byte, udpBufferSize)
+	for {
+		socket.conn.SetReadDeadline(time.Now().Add(r.timeout))
+		n, from, err := socket.conn.ReadFromUDP(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && !socket.idle(r.timeout) {
+				continue
+			}
+			return
+		}
+		socket.touch()
+
+		r.writeMu.Lock()
+		r.server.connManager.ResetWriteDeadline(r.tunnel)
+		_, err = r.tunnel.WriteTo(buf[:n], from)
+		r.writeMu.Unlock()
+		if err != nil {
+			r.tunnel.Close()
+			return
+		}
+
+		atomic.AddInt64(r.bytesDown, int64(n))
+		r.server.exitTransferred(r.st, socket.exitIP, 0, int64(n))
+	}
+}
+
+// removeSocket 关闭套接字并移除使用它的目标
+func (r *udpRelay) removeSocket(socket *udpExitSocket) {
+	socket.conn.Close()
+
+	r.mu.Lock()
+	if r.sockets[socket.exitIP.String()] == socket {
+		delete(r.sockets, socket.exitIP.String())
+	}
+	for key, target := range r.targets {
+		if target.socket == socket {
+			delete(r.targets, key)
+		}
+	}
+	r.mu.Unlock()
+
+	r.server.exitConnEnd(r.st, socket.exitIP, time.Since(socket.created))
+}
+
+// close 关闭所有出口套接字并等待读循环退出
+func (r *udpRelay) close() {
+	r.mu.Lock()
+	r.closed = true
+	for _, socket := range r.sockets {
+		socket.conn.Close()
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+}
+
+// touch 记录活动时间
+func (s *udpExitSocket) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+// idle 是否已空闲超过timeout
+func (s *udpExitSocket) idle(timeout time.Duration) bool {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActive))) >= timeout
+}
+
+// datagramConn 原生隧道上的UDP关联：按UDPDatagram帧读写（服务端和客户端共用）
+type datagramConn struct {
+	net.Conn
+}
+
+// ReadFrom 读取一个数据报，返回帧中的地址（服务端为目标地址，客户端为来源地址）
+func (c *datagramConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	d, err := protocol.ReadUDPDatagram(c.Conn)
+	if err != nil {
+		return 0, nil, err
+	}
+	addr := d.Addr()
+	if addr == "" {
+		return 0, nil, fmt.Errorf("invalid target address")
+	}
+	return copy(p, d.Payload), datagramAddr(addr), nil
+}
+
+// WriteTo 写入一个数据报（服务端addr为来源地址，客户端addr为目标地址）
+func (c *datagramConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	var d *protocol.UDPDatagram
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		d = protocol.NewUDPDatagramFromAddr(udpAddr, p)
+	} else {
+		var err error
+		if d, err = protocol.NewUDPDatagram(addr.String(), p); err != nil {
+			return 0, err
+		}
+	}
+	if err := protocol.WriteUDPDatagram(c.Conn, d); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// datagramAddr 数据报地址（host:port，host可为域名）
+type datagramAddr string
+
+// Network 网络类型
+func (a datagramAddr) Network() string {
+	return "udp"
+}
+
+// String 地址字符串
+func (a datagramAddr) String() string {
+	return string(a)
+}
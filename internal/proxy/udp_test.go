@@ -0,0 +1,284 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"multiexit-proxy/internal/protocol"
+	"multiexit-proxy/internal/snat"
+)
+
+// startUDPEchoServer 启动本地UDP回显服务，返回地址和收到数据报的来源地址
+func startUDPEchoServer(t *testing.T) (string, <-chan *net.UDPAddr) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen UDP: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	sources := make(chan *net.UDPAddr, 16)
+	go func() {
+		buf := make([]byte, udpBufferSize)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			select {
+			case sources <- from:
+			default:
+			}
+			conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return conn.LocalAddr().String(), sources
+}
+
+// openServerUDPTunnel 完成握手并建立v2 UDP关联隧道
+func openServerUDPTunnel(t *testing.T, s *Server, cipher *protocol.Cipher) (*aeadConn, byte) {
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close() })
+	go s.handleConn(serverConn)
+
+	client := &Client{config: &ClientConfig{}, cipher: cipher, ciphers: s.ciphers}
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	readCipher, writeCipher, err := client.handshake(clientConn, 0)
+	if err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	tunnel := newAEADConn(clientConn, readCipher, writeCipher)
+	if err := tunnel.writer.WriteRecord(protocol.EncodeUDPAssociateRequest()); err != nil {
+		t.Fatalf("WriteRecord failed: %v", err)
+	}
+	response, err := tunnel.reader.ReadRecord()
+	if err != nil || len(response) != 1 {
+		t.Fatalf("Unexpected response %v (%v)", response, err)
+	}
+	return tunnel, response[0]
+}
+
+// udpExchange 通过隧道发送一个数据报并等待回显
+func udpExchange(t *testing.T, tunnel net.Conn, target, payload string) {
+	d, err := protocol.NewUDPDatagram(target, []byte(payload))
+	if err != nil {
+		t.Fatalf("NewUDPDatagram failed: %v", err)
+	}
+	if err := protocol.WriteUDPDatagram(tunnel, d); err != nil {
+		t.Fatalf("WriteUDPDatagram failed: %v", err)
+	}
+	reply, err := protocol.ReadUDPDatagram(tunnel)
+	if err != nil {
+		t.Fatalf("ReadUDPDatagram failed: %v", err)
+	}
+	if reply.Addr() != target || string(reply.Payload) != payload {
+		t.Fatalf("Unexpected reply from %s: %q", reply.Addr(), reply.Payload)
+	}
+}
+
+func TestServer_HandleConnUDP(t *testing.T) {
+	s, cipher := newTunnelTestServer(t)
+	s.config.UDP.Enabled = true
+	s.config.UDP.Timeout = 200 * time.Millisecond
+	echoAddr, sources := startUDPEchoServer(t)
+
+	tunnel, status := openServerUDPTunnel(t, s, cipher)
+	if status != 0x00 {
+		t.Fatalf("UDP associate rejected: %d", status)
+	}
+
+	// 同一目标连续的数据报使用同一出口映射（源端口不变），源地址为出口IP
+	udpExchange(t, tunnel, echoAddr, "ping")
+	udpExchange(t, tunnel, echoAddr, "pong")
+	first, second := <-sources, <-sources
+	if !first.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Datagram sent from %s, want exit IP 127.0.0.1", first)
+	}
+	if first.Port != second.Port {
+		t.Errorf("Exit port changed within the NAT timeout: %d -> %d", first.Port, second.Port)
+	}
+
+	// 空闲超时后映射关闭，之后的数据报使用新的套接字
+	time.Sleep(3 * s.config.UDP.Timeout)
+	udpExchange(t, tunnel, echoAddr, "again")
+	if third := <-sources; third.Port == first.Port {
+		t.Errorf("Exit socket was not closed after the NAT timeout")
+	}
+}
+
+func TestServer_HandleConnUDPDisabled(t *testing.T) {
+	s, cipher := newTunnelTestServer(t)
+
+	if _, status := openServerUDPTunnel(t, s, cipher); status == 0x00 {
+		t.Error("UDP associate should be rejected when UDP relay is disabled")
+	}
+}
+
+func TestClient_SOCKS5UDPAssociate(t *testing.T) {
+	s, cipher := newTunnelTestServer(t)
+	s.config.UDP.Enabled = true
+	echoAddr, _ := startUDPEchoServer(t)
+
+	// 客户端使用已建立的多路复用会话
+	muxConn, muxServerConn := net.Pipe()
+	go s.handleConn(muxServerConn)
+	client := &Client{config: &ClientConfig{}, cipher: cipher, ciphers: s.ciphers}
+	client.config.Mux.Enabled = true
+	readCipher, writeCipher, err := client.handshake(muxConn, protocol.HandshakeFlagMux)
+	if err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	client.muxSession = newMuxSession(muxConn, readCipher, writeCipher, true)
+	defer client.muxSession.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			client.handleLocalConn(conn)
+		}
+	}()
+
+	control, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer control.Close()
+	control.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// 无认证协商 + UDP ASSOCIATE 0.0.0.0:0
+	control.Write([]byte{0x05, 0x01, 0x00})
+	control.Write([]byte{0x05, socks5CmdUDPAssociate, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(control, reply); err != nil {
+		t.Fatalf("Failed to read SOCKS5 reply: %v", err)
+	}
+	if reply[3] != 0x00 || reply[5] != socks5AddrIPv4 {
+		t.Fatalf("Unexpected SOCKS5 reply: %v", reply)
+	}
+	relayAddr := &net.UDPAddr{IP: net.IP(reply[6:10]), Port: int(reply[10])<<8 | int(reply[11])}
+
+	udpConn, err := net.DialUDP("udp4", nil, relayAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial relay: %v", err)
+	}
+	defer udpConn.Close()
+	udpConn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	host, portStr, _ := net.SplitHostPort(echoAddr)
+	port, _ := strconv.Atoi(portStr)
+	request := append([]byte{0x00, 0x00, 0x00, socks5AddrIPv4}, net.ParseIP(host).To4()...)
+	request = append(request, byte(port>>8), byte(port))
+	request = append(request, "hello"...)
+	if _, err := udpConn.Write(request); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	buf := make([]byte, udpBufferSize)
+	n, err := udpConn.Read(buf)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	// 返回的数据报携带来源地址（回显服务）
+	if !bytes.Equal(buf[:n], request) {
+		t.Errorf("Unexpected relayed datagram %v, want %v", buf[:n], request)
+	}
+}
+
+func TestUDPRelay_ResolvesDomainsInBackground(t *testing.T) {
+	s, _ := newTunnelTestServer(t)
+	echoAddr, _ := startUDPEchoServer(t)
+	_, echoPort, _ := net.SplitHostPort(echoAddr)
+
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close() })
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	client := &datagramConn{Conn: clientConn}
+
+	var bytesUp, bytesDown int64
+	relay := newUDPRelay(s, s.snapshot(), snat.ClientInfo{}, &datagramConn{Conn: serverConn}, time.Minute, &bytesUp, &bytesDown)
+	defer relay.close()
+	release := make(chan struct{})
+	var failedLookups int64
+	relay.lookupIP = func(ctx context.Context, network, host string) ([]net.IP, error) {
+		if host == "slow.test" {
+			<-release
+			return []net.IP{net.IPv4(127, 0, 0, 1)}, nil
+		}
+		atomic.AddInt64(&failedLookups, 1)
+		return nil, errors.New("no such host")
+	}
+
+	readReply := func(want string) {
+		buf := make([]byte, 64)
+		n, _, err := client.ReadFrom(buf)
+		if err != nil || string(buf[:n]) != want {
+			t.Fatalf("Got reply %q (%v), want %q", buf[:n], err, want)
+		}
+	}
+
+	// 慢速解析的域名目标不阻塞其他目标
+	if err := relay.send(net.JoinHostPort("slow.test", echoPort), []byte("queued")); err != nil {
+		t.Fatalf("send to slow target failed: %v", err)
+	}
+	if err := relay.send(echoAddr, []byte("direct")); err != nil {
+		t.Fatalf("send to IP target failed: %v", err)
+	}
+	readReply("direct")
+
+	// 解析完成后发出暂存的数据报
+	close(release)
+	readReply("queued")
+
+	// 解析失败的结果在一段时间内直接返回，不再重复解析
+	failing := "missing.test:53"
+	relay.send(failing, []byte("x"))
+	deadline := time.Now().Add(5 * time.Second)
+	for relay.send(failing, []byte("x")) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Failed resolution was not cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := relay.send(failing, []byte("x")); err == nil {
+		t.Error("Expected cached resolution failure")
+	}
+	if lookups := atomic.LoadInt64(&failedLookups); lookups != 1 {
+		t.Errorf("Expected 1 lookup for the failing target, got %d", lookups)
+	}
+}
+
+func TestParseSOCKS5UDPPacket(t *testing.T) {
+	packet := append([]byte{0x00, 0x00, 0x00, socks5AddrDomain, 11}, "example.com"...)
+	packet = append(packet, 0x01, 0xBB, 'q', 'u', 'i', 'c')
+
+	d, err := parseSOCKS5UDPPacket(packet)
+	if err != nil {
+		t.Fatalf("parseSOCKS5UDPPacket failed: %v", err)
+	}
+	if d.Addr() != "example.com:443" || string(d.Payload) != "quic" {
+		t.Errorf("Unexpected datagram %s %q", d.Addr(), d.Payload)
+	}
+	rebuilt, err := buildSOCKS5UDPPacket(d)
+	if err != nil || !bytes.Equal(rebuilt, packet) {
+		t.Errorf("buildSOCKS5UDPPacket() = %v (%v), want %v", rebuilt, err, packet)
+	}
+
+	// 分片和截断的数据报被丢弃
+	if _, err := parseSOCKS5UDPPacket([]byte{0x00, 0x00, 0x01, socks5AddrIPv4, 1, 2, 3, 4, 0, 53}); err == nil {
+		t.Error("Expected fragmented packet to be rejected")
+	}
+	if _, err := parseSOCKS5UDPPacket([]byte{0x00, 0x00, 0x00, socks5AddrIPv6, 1, 2, 3}); err == nil {
+		t.Error("Expected truncated packet to be rejected")
+	}
+}
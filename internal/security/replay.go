@@ -0,0 +1,327 @@
+package security
+
+import (
+	"fmt"
+	"hash/maphash"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 重放过滤模式
+const (
+	ReplayModeExact = "exact" // 精确去重（默认）
+	ReplayModeBloom = "bloom" // 布隆过滤器，内存占用小，存在极低的误拒概率
+	ReplayModeOff   = "off"   // 关闭
+)
+
+const (
+	// DefaultReplayWindow 默认时间窗口（与握手时间戳允许的偏差一致）
+	DefaultReplayWindow = 5 * time.Minute
+	// DefaultReplayMaxEntries 默认最多记录的key数量
+	DefaultReplayMaxEntries = 1 << 20
+	// DefaultReplayFalsePositiveRate 布隆过滤器默认误判率
+	DefaultReplayFalsePositiveRate = 0.0001
+
+	// replayBucketsPerWindow 每个窗口划分的时间桶数量
+	replayBucketsPerWindow = 4
+)
+
+// ReplayFilter 重放过滤器：在时间窗口内拒绝重复出现的key（如握手nonce）
+// 仅用于原生协议握手；Trojan请求不携带nonce，同一密码访问同一目标的合法连接字节完全相同，
+// 无法据此区分重放，其防重放由TLS握手保证
+type ReplayFilter interface {
+	// Check 检查key是否首次出现，首次出现时记录并返回true
+	// ts为消息携带的时间戳，超出[now-window, now+window]的key直接拒绝
+	Check(key []byte, ts time.Time) bool
+	// Stats 获取统计信息
+	Stats() ReplayStats
+}
+
+// ReplayStats 重放过滤统计
+type ReplayStats struct {
+	Mode     string `json:"mode"`
+	Checked  uint64 `json:"checked"`  // 检查次数
+	Rejected uint64 `json:"rejected"` // 因重放被拒绝的次数
+	Expired  uint64 `json:"expired"`  // 因时间戳超出窗口被拒绝的次数
+	Overflow uint64 `json:"overflow"` // 因容量已满被拒绝的次数
+	Entries  int    `json:"entries"`  // 当前记录的key数量
+}
+
+// NewReplayFilter 按模式创建重放过滤器，mode为off时返回nil
+func NewReplayFilter(mode string, window time.Duration, maxEntries int, falsePositiveRate float64) (ReplayFilter, error) {
+	switch mode {
+	case "", ReplayModeExact:
+		return NewReplayCache(window, maxEntries), nil
+	case ReplayModeBloom:
+		return NewBloomReplayFilter(window, maxEntries, falsePositiveRate), nil
+	case ReplayModeOff:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown replay protection mode: %s", mode)
+	}
+}
+
+// replayCounters 过滤器共用的统计计数
+type replayCounters struct {
+	checked  uint64
+	rejected uint64
+	expired  uint64
+	overflow uint64
+}
+
+func (c *replayCounters) stats(mode string, entries int) ReplayStats {
+	return ReplayStats{
+		Mode:     mode,
+		Checked:  atomic.LoadUint64(&c.checked),
+		Rejected: atomic.LoadUint64(&c.rejected),
+		Expired:  atomic.LoadUint64(&c.expired),
+		Overflow: atomic.LoadUint64(&c.overflow),
+		Entries:  entries,
+	}
+}
+
+// replayWindow 时间桶划分：key按消息时间戳归入桶，整桶过期后一次性丢弃
+type replayWindow struct {
+	window      time.Duration
+	bucketWidth int64 // 秒
+}
+
+func newReplayWindow(window time.Duration) replayWindow {
+	if window <= 0 {
+		window = DefaultReplayWindow
+	}
+	width := int64(window/time.Second) / replayBucketsPerWindow
+	if width < 1 {
+		width = 1
+	}
+	return replayWindow{window: window, bucketWidth: width}
+}
+
+// inWindow 时间戳是否在允许范围内
+func (w replayWindow) inWindow(ts, now time.Time) bool {
+	return ts.After(now.Add(-w.window)) && ts.Before(now.Add(w.window))
+}
+
+// bucketOf 时间戳所属的桶
+func (w replayWindow) bucketOf(ts time.Time) int64 {
+	return ts.Unix() / w.bucketWidth
+}
+
+// oldestLive 仍需保留的最早的桶（更早的桶中所有时间戳都已超出窗口）
+func (w replayWindow) oldestLive(now time.Time) int64 {
+	return w.bucketOf(now.Add(-w.window))
+}
+
+// bucketCount 同时存活的最大桶数
+func (w replayWindow) bucketCount() int {
+	return int(2*int64(w.window/time.Second)/w.bucketWidth) + 2
+}
+
+// ReplayCache 精确重放过滤器：按时间桶保存key集合
+type ReplayCache struct {
+	timing     replayWindow
+	maxEntries int
+	buckets    map[int64]map[string]struct{}
+	entries    int
+	mu         sync.Mutex
+	counters   replayCounters
+}
+
+// NewReplayCache 创建精确重放过滤器
+func NewReplayCache(window time.Duration, maxEntries int) *ReplayCache {
+	if maxEntries <= 0 {
+		maxEntries = DefaultReplayMaxEntries
+	}
+	return &ReplayCache{
+		timing:     newReplayWindow(window),
+		maxEntries: maxEntries,
+		buckets:    make(map[int64]map[string]struct{}),
+	}
+}
+
+// Check 检查key是否首次出现
+func (c *ReplayCache) Check(key []byte, ts time.Time) bool {
+	atomic.AddUint64(&c.counters.checked, 1)
+
+	now := time.Now()
+	if !c.timing.inWindow(ts, now) {
+		atomic.AddUint64(&c.counters.expired, 1)
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire(now)
+
+	k := string(key)
+	for _, bucket := range c.buckets {
+		if _, exists := bucket[k]; exists {
+			atomic.AddUint64(&c.counters.rejected, 1)
+			return false
+		}
+	}
+
+	// 容量已满时拒绝（而不是淘汰旧key），保证窗口内不会漏过重放
+	if c.entries >= c.maxEntries {
+		atomic.AddUint64(&c.counters.overflow, 1)
+		return false
+	}
+
+	idx := c.timing.bucketOf(ts)
+	bucket, ok := c.buckets[idx]
+	if !ok {
+		bucket = make(map[string]struct{})
+		c.buckets[idx] = bucket
+	}
+	bucket[k] = struct{}{}
+	c.entries++
+	return true
+}
+
+// expire 丢弃过期的桶
+func (c *ReplayCache) expire(now time.Time) {
+	oldest := c.timing.oldestLive(now)
+	for idx, bucket := range c.buckets {
+		if idx < oldest {
+			c.entries -= len(bucket)
+			delete(c.buckets, idx)
+		}
+	}
+}
+
+// Stats 获取统计信息
+func (c *ReplayCache) Stats() ReplayStats {
+	c.mu.Lock()
+	entries := c.entries
+	c.mu.Unlock()
+	return c.counters.stats(ReplayModeExact, entries)
+}
+
+// BloomReplayFilter 布隆重放过滤器：每个时间桶一个布隆过滤器
+// 内存占用远小于精确模式（默认配置下每个key约3字节），误判时合法握手会被拒绝，客户端重连即可
+type BloomReplayFilter struct {
+	timing         replayWindow
+	bucketCapacity int
+	bits           uint64 // 每个布隆过滤器的位数
+	hashes         int    // 哈希函数个数
+	seed1, seed2   maphash.Seed
+	buckets        map[int64]*bloomBucket
+	mu             sync.Mutex
+	counters       replayCounters
+}
+
+// bloomBucket 单个时间桶的布隆过滤器
+type bloomBucket struct {
+	words []uint64
+	count int
+}
+
+// NewBloomReplayFilter 创建布隆重放过滤器
+func NewBloomReplayFilter(window time.Duration, maxEntries int, falsePositiveRate float64) *BloomReplayFilter {
+	if maxEntries <= 0 {
+		maxEntries = DefaultReplayMaxEntries
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		falsePositiveRate = DefaultReplayFalsePositiveRate
+	}
+
+	timing := newReplayWindow(window)
+	bucketCapacity := maxEntries / timing.bucketCount()
+	if bucketCapacity < 1 {
+		bucketCapacity = 1
+	}
+
+	// 一次查询会检查所有存活的桶，按桶数分摊误判率
+	perBucketRate := falsePositiveRate / float64(timing.bucketCount())
+	bits := uint64(math.Ceil(-float64(bucketCapacity) * math.Log(perBucketRate) / (math.Ln2 * math.Ln2)))
+	bits = (bits + 63) &^ 63
+	hashes := int(math.Round(float64(bits) / float64(bucketCapacity) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+
+	return &BloomReplayFilter{
+		timing:         timing,
+		bucketCapacity: bucketCapacity,
+		bits:           bits,
+		hashes:         hashes,
+		seed1:          maphash.MakeSeed(),
+		seed2:          maphash.MakeSeed(),
+		buckets:        make(map[int64]*bloomBucket),
+	}
+}
+
+// Check 检查key是否首次出现
+func (f *BloomReplayFilter) Check(key []byte, ts time.Time) bool {
+	atomic.AddUint64(&f.counters.checked, 1)
+
+	now := time.Now()
+	if !f.timing.inWindow(ts, now) {
+		atomic.AddUint64(&f.counters.expired, 1)
+		return false
+	}
+
+	// 双重哈希：第i个位置为 h1 + i*h2
+	h1 := maphash.Bytes(f.seed1, key)
+	h2 := maphash.Bytes(f.seed2, key) | 1
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	oldest := f.timing.oldestLive(now)
+	for idx, bucket := range f.buckets {
+		if idx < oldest {
+			delete(f.buckets, idx)
+			continue
+		}
+		if f.contains(bucket, h1, h2) {
+			atomic.AddUint64(&f.counters.rejected, 1)
+			return false
+		}
+	}
+
+	idx := f.timing.bucketOf(ts)
+	bucket, ok := f.buckets[idx]
+	if !ok {
+		bucket = &bloomBucket{words: make([]uint64, f.bits/64)}
+		f.buckets[idx] = bucket
+	}
+
+	// 超过桶容量后误判率会迅速上升，按容量已满处理
+	if bucket.count >= f.bucketCapacity {
+		atomic.AddUint64(&f.counters.overflow, 1)
+		return false
+	}
+
+	for i := 0; i < f.hashes; i++ {
+		pos := (h1 + uint64(i)*h2) % f.bits
+		bucket.words[pos/64] |= 1 << (pos % 64)
+	}
+	bucket.count++
+	return true
+}
+
+// contains 布隆过滤器是否可能包含key
+func (f *BloomReplayFilter) contains(bucket *bloomBucket, h1, h2 uint64) bool {
+	for i := 0; i < f.hashes; i++ {
+		pos := (h1 + uint64(i)*h2) % f.bits
+		if bucket.words[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Stats 获取统计信息（Entries为已记录的key数量，可能包含已过期但尚未清理的桶）
+func (f *BloomReplayFilter) Stats() ReplayStats {
+	f.mu.Lock()
+	entries := 0
+	for _, bucket := range f.buckets {
+		entries += bucket.count
+	}
+	f.mu.Unlock()
+	return f.counters.stats(ReplayModeBloom, entries)
+}
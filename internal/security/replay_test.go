@@ -0,0 +1,87 @@
+package security
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func testReplayFilter(t *testing.T, filter ReplayFilter) {
+	now := time.Now()
+
+	if !filter.Check([]byte("nonce-1"), now) {
+		t.Fatal("First use of nonce should be accepted")
+	}
+	if filter.Check([]byte("nonce-1"), now) {
+		t.Error("Replayed nonce should be rejected")
+	}
+	// 时间戳不同但nonce相同仍视为重放
+	if filter.Check([]byte("nonce-1"), now.Add(-2*time.Minute)) {
+		t.Error("Replayed nonce with different timestamp should be rejected")
+	}
+	if !filter.Check([]byte("nonce-2"), now) {
+		t.Error("Different nonce should be accepted")
+	}
+
+	// 超出时间窗口
+	if filter.Check([]byte("nonce-3"), now.Add(-10*time.Minute)) {
+		t.Error("Expired timestamp should be rejected")
+	}
+	if filter.Check([]byte("nonce-4"), now.Add(10*time.Minute)) {
+		t.Error("Future timestamp should be rejected")
+	}
+
+	stats := filter.Stats()
+	if stats.Checked != 6 || stats.Rejected != 2 || stats.Expired != 2 || stats.Entries != 2 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestReplayCache(t *testing.T) {
+	testReplayFilter(t, NewReplayCache(5*time.Minute, 0))
+}
+
+func TestBloomReplayFilter(t *testing.T) {
+	testReplayFilter(t, NewBloomReplayFilter(5*time.Minute, 0, 0))
+}
+
+func TestReplayCache_Overflow(t *testing.T) {
+	cache := NewReplayCache(5*time.Minute, 2)
+	now := time.Now()
+	cache.Check([]byte("a"), now)
+	cache.Check([]byte("b"), now)
+
+	if cache.Check([]byte("c"), now) {
+		t.Error("Check should fail when cache is full")
+	}
+	if stats := cache.Stats(); stats.Overflow != 1 {
+		t.Errorf("Expected 1 overflow, got %d", stats.Overflow)
+	}
+}
+
+func TestBloomReplayFilter_FalsePositiveRate(t *testing.T) {
+	filter := NewBloomReplayFilter(5*time.Minute, 100000, 0.001)
+	now := time.Now()
+
+	rejected := 0
+	for i := 0; i < 5000; i++ {
+		if !filter.Check([]byte(fmt.Sprintf("nonce-%d", i)), now) {
+			rejected++
+		}
+	}
+	if rejected > 5 {
+		t.Errorf("Too many false positives: %d of 5000", rejected)
+	}
+}
+
+func TestNewReplayFilter(t *testing.T) {
+	if filter, err := NewReplayFilter(ReplayModeOff, 0, 0, 0); err != nil || filter != nil {
+		t.Errorf("Expected nil filter for off mode, got %v (%v)", filter, err)
+	}
+	if _, err := NewReplayFilter("unknown", 0, 0, 0); err == nil {
+		t.Error("Expected error for unknown mode")
+	}
+	if filter, _ := NewReplayFilter("", 0, 0, 0); filter.Stats().Mode != ReplayModeExact {
+		t.Error("Default mode should be exact")
+	}
+}
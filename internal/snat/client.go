@@ -0,0 +1,37 @@
+package snat
+
+import "net"
+
+// ClientInfo 发起连接的客户端
+type ClientInfo struct {
+	Addr net.IP // 客户端IP（未知时为nil）
+	User string // 认证用户名（没有用户认证时为空）
+}
+
+// ClientSelector 能按客户端选择出口IP的选择器
+type ClientSelector interface {
+	IPSelector
+	// SelectIPForClient 为client在family的出口IP中选择（client为空时等同于SelectIPForFamily）
+	SelectIPForClient(client ClientInfo, targetAddr string, targetPort int, family IPFamily) (net.IP, error)
+}
+
+// SelectIPForClient 从选择器中为client选择family的出口IP
+// 选择器不区分客户端时按SelectIPForFamily选择
+func SelectIPForClient(selector IPSelector, client ClientInfo, targetAddr string, targetPort int, family IPFamily) (net.IP, error) {
+	if cs, ok := selector.(ClientSelector); ok {
+		return cs.SelectIPForClient(client, targetAddr, targetPort, family)
+	}
+	return SelectIPForFamily(selector, targetAddr, targetPort, family)
+}
+
+// ClientInfoFromAddr 由客户端连接的远端地址构造ClientInfo
+func ClientInfoFromAddr(addr net.Addr) ClientInfo {
+	if addr == nil {
+		return ClientInfo{}
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return ClientInfo{Addr: net.ParseIP(host)}
+}
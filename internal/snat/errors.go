@@ -12,10 +12,20 @@ func (e *InvalidIPError) Error() string {
 }
 
 // NoIPAvailableError 没有可用IP错误
-type NoIPAvailableError struct{}
+type NoIPAvailableError struct {
+	Family     IPFamily // 要求的地址族（FamilyAny表示不限）
+	AtCapacity bool     // 有该地址族的出口IP，但都已达到容量上限
+}
 
 func (e *NoIPAvailableError) Error() string {
-	return "no IP available"
+	msg := "no IP available"
+	if e.Family != FamilyAny {
+		msg = fmt.Sprintf("no %s IP available", e.Family)
+	}
+	if e.AtCapacity {
+		msg += ": all exit IPs at capacity"
+	}
+	return msg
 }
 
 
@@ -0,0 +1,121 @@
+package snat
+
+import (
+	"errors"
+	"net"
+)
+
+// IPFamily 地址族
+type IPFamily int
+
+const (
+	FamilyAny  IPFamily = iota // 不限地址族
+	FamilyIPv4                 // IPv4
+	FamilyIPv6                 // IPv6
+)
+
+// 地址族策略：目标为域名时按策略决定使用哪个地址族的出口IP（目标为IP时总是使用同一地址族的出口IP）
+const (
+	FamilyPolicyPreferV4      = "prefer_v4"      // 优先IPv4，目标或出口没有IPv4时使用IPv6（默认）
+	FamilyPolicyPreferV6      = "prefer_v6"      // 优先IPv6，目标或出口没有IPv6时使用IPv4
+	FamilyPolicyV4Only        = "v4_only"        // 只使用IPv4
+	FamilyPolicyV6Only        = "v6_only"        // 只使用IPv6
+	FamilyPolicyHappyEyeballs = "happy_eyeballs" // 两个地址族并发连接（IPv6先发起），使用先建立的连接
+)
+
+// ValidFamilyPolicy 地址族策略是否有效（空字符串表示默认策略）
+func ValidFamilyPolicy(policy string) bool {
+	switch policy {
+	case "", FamilyPolicyPreferV4, FamilyPolicyPreferV6, FamilyPolicyV4Only, FamilyPolicyV6Only, FamilyPolicyHappyEyeballs:
+		return true
+	}
+	return false
+}
+
+// FamilyPolicyFamilies 策略依次尝试的地址族
+func FamilyPolicyFamilies(policy string) []IPFamily {
+	switch policy {
+	case FamilyPolicyV4Only:
+		return []IPFamily{FamilyIPv4}
+	case FamilyPolicyV6Only:
+		return []IPFamily{FamilyIPv6}
+	case FamilyPolicyPreferV6, FamilyPolicyHappyEyeballs:
+		return []IPFamily{FamilyIPv6, FamilyIPv4}
+	default:
+		return []IPFamily{FamilyIPv4, FamilyIPv6}
+	}
+}
+
+// FamilyOf IP地址的地址族
+func FamilyOf(ip net.IP) IPFamily {
+	if ip.To4() != nil {
+		return FamilyIPv4
+	}
+	return FamilyIPv6
+}
+
+// Matches IP地址是否属于该地址族
+func (f IPFamily) Matches(ip net.IP) bool {
+	return f == FamilyAny || FamilyOf(ip) == f
+}
+
+// String 地址族名称
+func (f IPFamily) String() string {
+	switch f {
+	case FamilyIPv4:
+		return "IPv4"
+	case FamilyIPv6:
+		return "IPv6"
+	default:
+		return "any"
+	}
+}
+
+// FamilySelector 能按地址族选择出口IP的选择器
+type FamilySelector interface {
+	IPSelector
+	// SelectIPForFamily 只在family的出口IP中选择（FamilyAny等同于SelectIP）
+	SelectIPForFamily(targetAddr string, targetPort int, family IPFamily) (net.IP, error)
+}
+
+// FamilyPolicyProvider 能为目标指定地址族策略的选择器（如规则选择器按匹配的规则）
+type FamilyPolicyProvider interface {
+	// FamilyPolicy 目标的地址族策略，没有指定时返回空字符串
+	FamilyPolicy(targetAddr string, targetPort int) string
+}
+
+// SelectIPForFamily 从选择器中选择family的出口IP
+// 选择器不支持按地址族选择时，结果的地址族不符视为没有可用IP
+func SelectIPForFamily(selector IPSelector, targetAddr string, targetPort int, family IPFamily) (net.IP, error) {
+	if fs, ok := selector.(FamilySelector); ok {
+		return fs.SelectIPForFamily(targetAddr, targetPort, family)
+	}
+	ip, err := selector.SelectIP(targetAddr, targetPort)
+	if err != nil {
+		return nil, err
+	}
+	if !family.Matches(ip) {
+		return nil, &NoIPAvailableError{Family: family}
+	}
+	return ip, nil
+}
+
+// IsNoIPAvailable 错误是否表示没有可用的出口IP
+func IsNoIPAvailable(err error) bool {
+	var noIP *NoIPAvailableError
+	return errors.As(err, &noIP)
+}
+
+// filterFamily 返回ips中属于family的IP（FamilyAny时直接返回ips）
+func filterFamily(ips []net.IP, family IPFamily) []net.IP {
+	if family == FamilyAny {
+		return ips
+	}
+	filtered := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if family.Matches(ip) {
+			filtered = append(filtered, ip)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,79 @@
+package snat
+
+import (
+	"net"
+	"testing"
+)
+
+func TestFamilyPolicyFamilies(t *testing.T) {
+	tests := []struct {
+		policy   string
+		expected []IPFamily
+	}{
+		{"", []IPFamily{FamilyIPv4, FamilyIPv6}},
+		{FamilyPolicyPreferV6, []IPFamily{FamilyIPv6, FamilyIPv4}},
+		{FamilyPolicyV4Only, []IPFamily{FamilyIPv4}},
+		{FamilyPolicyV6Only, []IPFamily{FamilyIPv6}},
+		{FamilyPolicyHappyEyeballs, []IPFamily{FamilyIPv6, FamilyIPv4}},
+	}
+	for _, tt := range tests {
+		families := FamilyPolicyFamilies(tt.policy)
+		if len(families) != len(tt.expected) {
+			t.Errorf("Policy %q: expected %v, got %v", tt.policy, tt.expected, families)
+			continue
+		}
+		for i := range families {
+			if families[i] != tt.expected[i] {
+				t.Errorf("Policy %q: expected %v, got %v", tt.policy, tt.expected, families)
+			}
+		}
+	}
+
+	if ValidFamilyPolicy("ipv6") {
+		t.Error("Expected unknown policy to be invalid")
+	}
+}
+
+func TestSelectIPForFamily(t *testing.T) {
+	ips := []string{"192.168.1.1", "2001:db8::1", "192.168.1.2", "2001:db8::2"}
+	roundRobin, _ := NewRoundRobinSelector(ips)
+	destination, _ := NewDestinationBasedSelector(ips)
+	loadBalanced, _ := NewLoadBalancedSelector(ips, "connections")
+
+	for _, selector := range []IPSelector{roundRobin, destination, loadBalanced} {
+		for _, family := range []IPFamily{FamilyIPv4, FamilyIPv6} {
+			for i := 0; i < 4; i++ {
+				ip, err := SelectIPForFamily(selector, "example.com", 443, family)
+				if err != nil {
+					t.Fatalf("%T: failed to select %s IP: %v", selector, family, err)
+				}
+				if !family.Matches(ip) {
+					t.Errorf("%T: selected %s for %s", selector, ip, family)
+				}
+			}
+		}
+	}
+}
+
+func TestSelectIPForFamily_NoIPAvailable(t *testing.T) {
+	selector, _ := NewRoundRobinSelector([]string{"192.168.1.1"})
+	_, err := SelectIPForFamily(selector, "example.com", 443, FamilyIPv6)
+	if !IsNoIPAvailable(err) {
+		t.Errorf("Expected NoIPAvailableError, got %v", err)
+	}
+
+	// 不支持按地址族选择的选择器，结果地址族不符时同样视为没有可用IP
+	_, err = SelectIPForFamily(staticSelector{net.ParseIP("192.168.1.1")}, "example.com", 443, FamilyIPv6)
+	if !IsNoIPAvailable(err) {
+		t.Errorf("Expected NoIPAvailableError, got %v", err)
+	}
+}
+
+// staticSelector 总是返回同一个IP、不支持按地址族选择的选择器
+type staticSelector struct {
+	ip net.IP
+}
+
+func (s staticSelector) SelectIP(targetAddr string, targetPort int) (net.IP, error) {
+	return s.ip, nil
+}
@@ -0,0 +1,58 @@
+package snat
+
+import (
+	"net"
+	"time"
+)
+
+// SelectorFeedback 接收出口IP使用情况的选择器
+// 代理在选择出口IP后按连接的生命周期调用选择器链最外层的选择器，包装器转发给内层选择器
+type SelectorFeedback interface {
+	// OnConnectionStart 出口IP上建立了一个连接（或UDP关联）
+	OnConnectionStart(ip net.IP)
+	// OnConnectionEnd 出口IP上的一个连接结束（与OnConnectionStart成对调用）
+	OnConnectionEnd(ip net.IP)
+	// OnBytesTransferred 出口IP上传输了bytes字节（上行和下行）
+	OnBytesTransferred(ip net.IP, bytes int64)
+	// OnDialResult 经出口IP连接目标的耗时和结果（err为nil表示连接成功）
+	OnDialResult(ip net.IP, latency time.Duration, err error)
+}
+
+// FeedbackOf 选择器的反馈接口，选择器不接收反馈时返回忽略所有反馈的实现
+func FeedbackOf(selector IPSelector) SelectorFeedback {
+	if feedback, ok := selector.(SelectorFeedback); ok {
+		return feedback
+	}
+	return noFeedback{}
+}
+
+// noFeedback 忽略所有反馈
+type noFeedback struct{}
+
+func (noFeedback) OnConnectionStart(ip net.IP)                              {}
+func (noFeedback) OnConnectionEnd(ip net.IP)                                {}
+func (noFeedback) OnBytesTransferred(ip net.IP, bytes int64)                {}
+func (noFeedback) OnDialResult(ip net.IP, latency time.Duration, err error) {}
+
+// CapacityReserver 按出口IP容量上限分配连接的选择器（包装器转发给内层选择器）
+// 选择器返回的IP已为连接预留容量：代理在连接开始时（OnConnectionStart）使用预留，选中但未使用的IP调用Unreserve释放
+type CapacityReserver interface {
+	// Reserve 出口IP未达到容量上限时为一个连接预留容量，返回是否成功（包装器不经内层选择器选择而返回IP时调用）
+	Reserve(ip net.IP) bool
+	// Unreserve 释放选中但未使用的IP的预留
+	Unreserve(ip net.IP)
+}
+
+// ReserverOf 选择器的容量预留接口，选择器没有容量上限时返回总是成功的实现
+func ReserverOf(selector IPSelector) CapacityReserver {
+	if reserver, ok := selector.(CapacityReserver); ok {
+		return reserver
+	}
+	return noReserve{}
+}
+
+// noReserve 不限制容量
+type noReserve struct{}
+
+func (noReserve) Reserve(ip net.IP) bool { return true }
+func (noReserve) Unreserve(ip net.IP)    {}
@@ -0,0 +1,80 @@
+package snat
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSelectorFeedback_ForwardedThroughChain(t *testing.T) {
+	ips := []string{"192.168.1.1", "192.168.1.2"}
+	ip1, ip2 := net.ParseIP(ips[0]), net.ParseIP(ips[1])
+	loadBalanced, err := NewLoadBalancedSelector(ips, "traffic")
+	if err != nil {
+		t.Fatalf("Failed to create selector: %v", err)
+	}
+
+	// 基础选择器 -> 健康感知 -> 粘性会话 -> 规则，反馈经每层包装器到达基础选择器
+	healthChecker := NewIPHealthChecker([]net.IP{ip1, ip2}, 30*time.Second, 5*time.Second)
+	healthChecker.updateHealth(HealthCheckResult{IP: ip1, Healthy: true})
+	healthChecker.updateHealth(HealthCheckResult{IP: ip2, Healthy: true})
+	var chain IPSelector = NewHealthAwareIPSelector(loadBalanced, healthChecker, ips, "load_balanced", "traffic")
+	chain, err = NewStickySelector(chain, ips, StickyOptions{HealthChecker: healthChecker})
+	if err != nil {
+		t.Fatalf("Failed to create sticky selector: %v", err)
+	}
+	chain = NewRuleBasedSelector(chain, NewRuleEngine(), ips)
+
+	feedback := FeedbackOf(chain)
+	feedback.OnConnectionStart(ip1)
+	feedback.OnBytesTransferred(ip1, 1000)
+	feedback.OnDialResult(ip1, 20*time.Millisecond, nil)
+	feedback.OnDialResult(ip2, time.Second, errors.New("connection refused"))
+
+	// 按流量选择时选择流量较少的IP
+	if ip, _ := chain.SelectIP("example.com", 443); !ip.Equal(ip2) {
+		t.Errorf("Expected %s with less traffic, got %s", ip2, ip)
+	}
+
+	stats := loadBalanced.GetStats()
+	ip1Stats := stats[ips[0]].(map[string]interface{})
+	if ip1Stats["active_connections"] != int64(1) || ip1Stats["total_bytes"] != int64(1000) || ip1Stats["dial_latency_ms"] != int64(20) {
+		t.Errorf("Unexpected stats for %s: %v", ip1, ip1Stats)
+	}
+	if errs := stats[ips[1]].(map[string]interface{})["dial_errors"]; errs != int64(1) {
+		t.Errorf("Expected 1 dial error for %s, got %v", ip2, errs)
+	}
+
+	feedback.OnConnectionEnd(ip1)
+	if active := loadBalanced.GetStats()[ips[0]].(map[string]interface{})["active_connections"]; active != int64(0) {
+		t.Errorf("Expected 0 active connections, got %v", active)
+	}
+
+	// 不接收反馈的选择器忽略反馈
+	roundRobin, _ := NewRoundRobinSelector(ips)
+	FeedbackOf(roundRobin).OnConnectionStart(ip1)
+}
+
+func TestLoadBalancedSelector_StatsSurviveSetIPs(t *testing.T) {
+	// 配置中的IPv6地址不是规范形式，统计按规范形式记录
+	loadBalanced, err := NewLoadBalancedSelector([]string{"192.168.1.1", "2001:0db8::0001"}, "connections")
+	if err != nil {
+		t.Fatalf("Failed to create selector: %v", err)
+	}
+	ip1, ip2 := net.ParseIP("192.168.1.1"), net.ParseIP("2001:db8::1")
+	loadBalanced.OnConnectionStart(ip2)
+	if active := loadBalanced.GetStats()["2001:db8::1"].(map[string]interface{})["active_connections"]; active != int64(1) {
+		t.Errorf("Expected 1 active connection for %s, got %v", ip2, active)
+	}
+
+	// 健康检查抖动：IP被移出后重新加入，期间开始的连接结束时计数不丢失也不为负
+	loadBalanced.OnConnectionStart(ip1)
+	loadBalanced.SetIPs([]net.IP{ip2})
+	loadBalanced.SetIPs([]net.IP{ip1, ip2})
+	loadBalanced.OnConnectionEnd(ip1)
+	loadBalanced.OnConnectionEnd(ip1)
+	if active := loadBalanced.GetStats()["192.168.1.1"].(map[string]interface{})["active_connections"]; active != int64(0) {
+		t.Errorf("Expected 0 active connections for %s after flap, got %v", ip1, active)
+	}
+}
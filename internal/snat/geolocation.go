@@ -168,14 +168,14 @@ func NewGeoLocationSelector(baseSelector IPSelector, geoService GeoLocationServi
 	}
 
 	// 异步加载所有出口IP的地理位置
-	go selector.loadExitIPLocations()
+	go selector.loadExitIPLocations(exitIPs)
 
 	return selector, nil
 }
 
-// loadExitIPLocations 加载所有出口IP的地理位置
-func (g *GeoLocationSelector) loadExitIPLocations() {
-	for _, ipStr := range g.exitIPs {
+// loadExitIPLocations 加载出口IP的地理位置
+func (g *GeoLocationSelector) loadExitIPLocations(exitIPs []string) {
+	for _, ipStr := range exitIPs {
 		ip := net.ParseIP(ipStr)
 		if ip == nil {
 			continue
@@ -188,6 +188,11 @@ func (g *GeoLocationSelector) loadExitIPLocations() {
 		}
 
 		g.mu.Lock()
+		if !containsString(g.exitIPs, ipStr) {
+			// 加载期间已移除
+			g.mu.Unlock()
+			continue
+		}
 		g.exitLocations[ipStr] = location
 		g.mu.Unlock()
 
@@ -196,8 +201,59 @@ func (g *GeoLocationSelector) loadExitIPLocations() {
 	}
 }
 
+// SetIPs 替换出口IP集合：移除的IP不再参与就近选择，新增的IP异步加载地理位置
+func (g *GeoLocationSelector) SetIPs(ips []net.IP) {
+	exitIPs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		exitIPs = append(exitIPs, ip.String())
+	}
+
+	g.mu.Lock()
+	var added []string
+	for _, ipStr := range exitIPs {
+		if _, ok := g.exitLocations[ipStr]; !ok {
+			added = append(added, ipStr)
+		}
+	}
+	for ipStr := range g.exitLocations {
+		if !containsString(exitIPs, ipStr) {
+			delete(g.exitLocations, ipStr)
+		}
+	}
+	g.exitIPs = exitIPs
+	baseSelector := g.baseSelector
+	g.mu.Unlock()
+
+	if dynamic, ok := baseSelector.(DynamicIPSelector); ok {
+		dynamic.SetIPs(ips)
+	}
+	if len(added) > 0 {
+		go g.loadExitIPLocations(added)
+	}
+}
+
+// containsString 字符串列表是否包含s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
 // SelectIP 选择IP（基于地理位置）
 func (g *GeoLocationSelector) SelectIP(targetAddr string, targetPort int) (net.IP, error) {
+	return g.SelectIPForFamily(targetAddr, targetPort, FamilyAny)
+}
+
+// SelectIPForFamily 在family的出口IP中选择距离目标最近的IP
+func (g *GeoLocationSelector) SelectIPForFamily(targetAddr string, targetPort int, family IPFamily) (net.IP, error) {
+	return g.SelectIPForClient(ClientInfo{}, targetAddr, targetPort, family)
+}
+
+// SelectIPForClient 在family的出口IP中选择距离目标最近的IP，回退到基础选择器时传递client
+func (g *GeoLocationSelector) SelectIPForClient(client ClientInfo, targetAddr string, targetPort int, family IPFamily) (net.IP, error) {
 	host, _, err := net.SplitHostPort(targetAddr)
 	if err != nil {
 		host = targetAddr
@@ -208,7 +264,7 @@ func (g *GeoLocationSelector) SelectIP(targetAddr string, targetPort int) (net.I
 	if err != nil {
 		logrus.Warnf("Failed to get location for target %s, using base selector: %v", host, err)
 		// 如果无法获取目标位置，回退到基础选择器
-		return g.baseSelector.SelectIP(targetAddr, targetPort)
+		return SelectIPForClient(g.baseSelector, client, targetAddr, targetPort, family)
 	}
 
 	// 找到距离最近的出口IP
@@ -220,6 +276,9 @@ func (g *GeoLocationSelector) SelectIP(targetAddr string, targetPort int) (net.I
 		if exitLocation.Latitude == 0 && exitLocation.Longitude == 0 {
 			continue // 跳过无效位置
 		}
+		if !family.Matches(net.ParseIP(ipStr)) {
+			continue
+		}
 
 		distance := CalculateDistance(
 			targetLocation.Latitude, targetLocation.Longitude,
@@ -233,6 +292,12 @@ func (g *GeoLocationSelector) SelectIP(targetAddr string, targetPort int) (net.I
 	}
 	g.mu.RUnlock()
 
+	// 最近的出口IP达到容量上限时回退到基础选择器
+	if bestIP != nil && !ReserverOf(g.base()).Reserve(bestIP) {
+		logrus.Debugf("Nearest exit IP %s is at capacity, using base selector", bestIP)
+		bestIP = nil
+	}
+
 	if bestIP != nil {
 		logrus.Debugf("Selected IP %s for target %s (distance: %.2f km, target: %s, %s)",
 			bestIP.String(), host, minDistance, targetLocation.Country, targetLocation.City)
@@ -241,6 +306,42 @@ func (g *GeoLocationSelector) SelectIP(targetAddr string, targetPort int) (net.I
 
 	// 如果没有找到合适的IP，回退到基础选择器
 	logrus.Debugf("No geo-located exit IP found, using base selector")
-	return g.baseSelector.SelectIP(targetAddr, targetPort)
+	return SelectIPForClient(g.baseSelector, client, targetAddr, targetPort, family)
+}
+
+// base 基础选择器
+func (g *GeoLocationSelector) base() IPSelector {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.baseSelector
+}
+
+// Reserve 转发给基础选择器
+func (g *GeoLocationSelector) Reserve(ip net.IP) bool {
+	return ReserverOf(g.base()).Reserve(ip)
+}
+
+// Unreserve 转发给基础选择器
+func (g *GeoLocationSelector) Unreserve(ip net.IP) {
+	ReserverOf(g.base()).Unreserve(ip)
+}
+
+// OnConnectionStart 转发给基础选择器
+func (g *GeoLocationSelector) OnConnectionStart(ip net.IP) {
+	FeedbackOf(g.base()).OnConnectionStart(ip)
 }
 
+// OnConnectionEnd 转发给基础选择器
+func (g *GeoLocationSelector) OnConnectionEnd(ip net.IP) {
+	FeedbackOf(g.base()).OnConnectionEnd(ip)
+}
+
+// OnBytesTransferred 转发给基础选择器
+func (g *GeoLocationSelector) OnBytesTransferred(ip net.IP, bytes int64) {
+	FeedbackOf(g.base()).OnBytesTransferred(ip, bytes)
+}
+
+// OnDialResult 转发给基础选择器
+func (g *GeoLocationSelector) OnDialResult(ip net.IP, latency time.Duration, err error) {
+	FeedbackOf(g.base()).OnDialResult(ip, latency, err)
+}
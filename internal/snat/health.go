@@ -73,12 +73,48 @@ func (h *IPHealthChecker) Stop() {
 	close(h.stopCh)
 }
 
+// AddIP 添加需要检查的IP（下次检查前视为健康）
+func (h *IPHealthChecker) AddIP(ip net.IP) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.containsIP(ip) {
+		return
+	}
+	h.ips = append(copyIPs(h.ips), ip)
+	h.healthyIPs[ip.String()] = true
+	h.failureCount[ip.String()] = 0
+}
+
+// RemoveIP 停止检查IP并清除其健康状态
+func (h *IPHealthChecker) RemoveIP(ip net.IP) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ips := make([]net.IP, 0, len(h.ips))
+	for _, existing := range h.ips {
+		if !existing.Equal(ip) {
+			ips = append(ips, existing)
+		}
+	}
+	h.ips = ips
+
+	ipStr := ip.String()
+	delete(h.healthyIPs, ipStr)
+	delete(h.failedIPs, ipStr)
+	delete(h.failureCount, ipStr)
+}
+
 // checkAll 检查所有IP
 func (h *IPHealthChecker) checkAll() {
+	h.mu.RLock()
+	ips := h.ips
+	h.mu.RUnlock()
+
 	var wg sync.WaitGroup
-	results := make(chan HealthCheckResult, len(h.ips))
+	results := make(chan HealthCheckResult, len(ips))
 
-	for _, ip := range h.ips {
+	for _, ip := range ips {
 		wg.Add(1)
 		go func(ip net.IP) {
 			defer wg.Done()
@@ -167,6 +203,11 @@ func (h *IPHealthChecker) updateHealth(result HealthCheckResult) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
+	// 检查期间已移除的IP
+	if !h.containsIP(result.IP) {
+		return
+	}
+
 	wasHealthy := h.healthyIPs[ipStr]
 	
 	if result.Healthy {
@@ -197,6 +238,16 @@ func (h *IPHealthChecker) updateHealth(result HealthCheckResult) {
 	}
 }
 
+// containsIP 是否正在检查该IP（调用方持有h.mu）
+func (h *IPHealthChecker) containsIP(ip net.IP) bool {
+	for _, existing := range h.ips {
+		if existing.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // IsHealthy 检查IP是否健康
 func (h *IPHealthChecker) IsHealthy(ip net.IP) bool {
 	h.mu.RLock()
@@ -206,6 +257,14 @@ func (h *IPHealthChecker) IsHealthy(ip net.IP) bool {
 	return ok && healthy
 }
 
+// IsFailed 检查IP是否已被标记为故障（尚未完成检查的IP不算故障）
+func (h *IPHealthChecker) IsFailed(ip net.IP) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	_, failed := h.failedIPs[ip.String()]
+	return failed
+}
+
 // GetHealthyIPs 获取所有健康的IP
 func (h *IPHealthChecker) GetHealthyIPs() []net.IP {
 	h.mu.RLock()
@@ -3,6 +3,7 @@ package snat
 import (
 	"net"
 	"sync"
+	"time"
 )
 
 // HealthAwareIPSelector 健康感知的IP选择器包装器
@@ -74,7 +75,21 @@ func (h *HealthAwareIPSelector) updateBaseSelectorIPs() {
 		return // 没有健康的IP，保持原状态
 	}
 
-	// 根据基础选择器的类型更新IP列表
+	// 基础选择器支持替换IP集合时原地更新，保留端口范围、哈希权重、负载统计等状态：
+	// 故障IP的端口范围切换到备用IP，按目标哈希时只有哈希到故障IP的目标改变出口IP
+	h.mu.RLock()
+	dynamic, isDynamic := h.baseSelector.(DynamicIPSelector)
+	h.mu.RUnlock()
+	if isDynamic {
+		healthyIPs := make([]net.IP, 0, len(healthyIPStrings))
+		for _, ipStr := range healthyIPStrings {
+			healthyIPs = append(healthyIPs, net.ParseIP(ipStr))
+		}
+		dynamic.SetIPs(healthyIPs)
+		return
+	}
+
+	// 否则根据基础选择器的类型重建
 	var newSelector IPSelector
 	var err error
 	
@@ -101,6 +116,16 @@ func (h *HealthAwareIPSelector) updateBaseSelectorIPs() {
 
 // SelectIP 选择IP（只从健康的IP中选择）
 func (h *HealthAwareIPSelector) SelectIP(targetAddr string, targetPort int) (net.IP, error) {
+	return h.SelectIPForFamily(targetAddr, targetPort, FamilyAny)
+}
+
+// SelectIPForFamily 只从健康的family的IP中选择
+func (h *HealthAwareIPSelector) SelectIPForFamily(targetAddr string, targetPort int, family IPFamily) (net.IP, error) {
+	return h.SelectIPForClient(ClientInfo{}, targetAddr, targetPort, family)
+}
+
+// SelectIPForClient 只从健康的family的IP中为client选择
+func (h *HealthAwareIPSelector) SelectIPForClient(client ClientInfo, targetAddr string, targetPort int, family IPFamily) (net.IP, error) {
 	h.mu.RLock()
 	healthyCount := len(h.healthyIPs)
 	h.mu.RUnlock()
@@ -127,7 +152,7 @@ func (h *HealthAwareIPSelector) SelectIP(targetAddr string, targetPort int) (net
 	selector := h.baseSelector
 	h.mu.RUnlock()
 
-	return selector.SelectIP(targetAddr, targetPort)
+	return SelectIPForClient(selector, client, targetAddr, targetPort, family)
 }
 
 // GetHealthyIPs 获取当前健康的IP列表
@@ -151,3 +176,69 @@ func (h *HealthAwareIPSelector) IsHealthy(ip string) bool {
 	return h.healthyIPs[ip]
 }
 
+// SetIPs 替换出口IP集合：保留已知的健康状态，新增的IP以健康检查器的状态为准
+func (h *HealthAwareIPSelector) SetIPs(ips []net.IP) {
+	// 健康检查器在持有自身锁时回调本选择器，必须在获取h.mu之前查询检查器
+	checkerHealthy := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		checkerHealthy[ip.String()] = h.healthChecker.IsHealthy(ip)
+	}
+
+	h.mu.Lock()
+	allIPs := make([]string, 0, len(ips))
+	healthyIPs := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		ipStr := ip.String()
+		allIPs = append(allIPs, ipStr)
+		if h.healthyIPs[ipStr] || checkerHealthy[ipStr] {
+			healthyIPs[ipStr] = true
+		}
+	}
+	h.allIPs = allIPs
+	h.healthyIPs = healthyIPs
+	baseSelector := h.baseSelector
+	h.mu.Unlock()
+
+	// 先更新基础选择器，没有健康IP时updateBaseSelectorIPs保持原状态，也不能再选中已移除的IP
+	if dynamic, ok := baseSelector.(DynamicIPSelector); ok {
+		dynamic.SetIPs(ips)
+	}
+	h.updateBaseSelectorIPs()
+}
+
+// base 当前的基础选择器（IP故障或恢复时可能被重建）
+func (h *HealthAwareIPSelector) base() IPSelector {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.baseSelector
+}
+
+// Reserve 转发给基础选择器
+func (h *HealthAwareIPSelector) Reserve(ip net.IP) bool {
+	return ReserverOf(h.base()).Reserve(ip)
+}
+
+// Unreserve 转发给基础选择器
+func (h *HealthAwareIPSelector) Unreserve(ip net.IP) {
+	ReserverOf(h.base()).Unreserve(ip)
+}
+
+// OnConnectionStart 转发给基础选择器
+func (h *HealthAwareIPSelector) OnConnectionStart(ip net.IP) {
+	FeedbackOf(h.base()).OnConnectionStart(ip)
+}
+
+// OnConnectionEnd 转发给基础选择器
+func (h *HealthAwareIPSelector) OnConnectionEnd(ip net.IP) {
+	FeedbackOf(h.base()).OnConnectionEnd(ip)
+}
+
+// OnBytesTransferred 转发给基础选择器
+func (h *HealthAwareIPSelector) OnBytesTransferred(ip net.IP, bytes int64) {
+	FeedbackOf(h.base()).OnBytesTransferred(ip, bytes)
+}
+
+// OnDialResult 转发给基础选择器
+func (h *HealthAwareIPSelector) OnDialResult(ip net.IP, latency time.Duration, err error) {
+	FeedbackOf(h.base()).OnDialResult(ip, latency, err)
+}
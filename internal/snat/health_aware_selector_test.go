@@ -58,3 +58,35 @@ func TestHealthAwareIPSelector_GetHealthyIPs(t *testing.T) {
 	t.Logf("Healthy IPs: %v", healthy)
 }
 
+func TestHealthAwareIPSelector_PortBasedFailover(t *testing.T) {
+	ips := []string{"192.168.1.1", "192.168.1.2"}
+	baseSelector, err := NewPortBasedSelector([]PortRangeConfig{
+		{Range: "0-65535", IP: "192.168.1.1", Backup: "192.168.1.2"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create base selector: %v", err)
+	}
+
+	ipList := []net.IP{net.ParseIP(ips[0]), net.ParseIP(ips[1])}
+	healthChecker := NewIPHealthChecker(ipList, 30*time.Second, 5*time.Second)
+	selector := NewHealthAwareIPSelector(baseSelector, healthChecker, ips, "port_based", "")
+
+	for _, ip := range ipList {
+		healthChecker.updateHealth(HealthCheckResult{IP: ip, Healthy: true})
+	}
+	if ip, _ := selector.SelectIP("example.com", 80); ip.String() != "192.168.1.1" {
+		t.Errorf("Expected 192.168.1.1, got %s", ip)
+	}
+
+	// 连续失败达到阈值后切换到备用IP，恢复后切回
+	for i := 0; i < 3; i++ {
+		healthChecker.updateHealth(HealthCheckResult{IP: ipList[0], Healthy: false})
+	}
+	if ip, _ := selector.SelectIP("example.com", 80); ip.String() != "192.168.1.2" {
+		t.Errorf("Expected backup 192.168.1.2, got %s", ip)
+	}
+	healthChecker.updateHealth(HealthCheckResult{IP: ipList[0], Healthy: true})
+	if ip, _ := selector.SelectIP("example.com", 80); ip.String() != "192.168.1.1" {
+		t.Errorf("Expected recovered 192.168.1.1, got %s", ip)
+	}
+}
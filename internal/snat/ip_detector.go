@@ -1,6 +1,7 @@
 package snat
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -11,8 +12,9 @@ import (
 
 // IPDetector 公网IP检测器
 type IPDetector struct {
-	detectionServices []string
-	timeout           time.Duration
+	detectionServices   []string
+	detectionServicesV6 []string // 只有IPv6地址的检测服务，用于检测IPv6出口
+	timeout             time.Duration
 }
 
 // NewIPDetector 创建IP检测器
@@ -25,18 +27,40 @@ func NewIPDetector() *IPDetector {
 			"https://checkip.amazonaws.com",
 			"https://api.ip.sb/ip",
 		},
+		detectionServicesV6: []string{
+			"https://api6.ipify.org",
+			"https://ipv6.icanhazip.com",
+			"https://api-ipv6.ip.sb/ip",
+		},
 		timeout: 5 * time.Second,
 	}
 }
 
 // DetectPublicIP 检测单个公网IP
 func (d *IPDetector) DetectPublicIP() (string, error) {
+	return d.detectPublicIP("tcp", d.detectionServices, FamilyAny)
+}
+
+// DetectPublicIPv6 通过IPv6连接检测服务，检测IPv6出口的公网IP
+func (d *IPDetector) DetectPublicIPv6() (string, error) {
+	return d.detectPublicIP("tcp6", d.detectionServicesV6, FamilyIPv6)
+}
+
+// detectPublicIP 经network连接检测服务，返回属于family的公网IP
+func (d *IPDetector) detectPublicIP(network string, services []string, family IPFamily) (string, error) {
+	dialer := &net.Dialer{Timeout: d.timeout}
 	client := &http.Client{
 		Timeout: d.timeout,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
 	}
 
 	var lastErr error
-	for _, service := range d.detectionServices {
+	for _, service := range services {
 		resp, err := client.Get(service)
 		if err != nil {
 			lastErr = err
@@ -57,8 +81,8 @@ func (d *IPDetector) DetectPublicIP() (string, error) {
 
 		ipStr := strings.TrimSpace(string(body))
 		ip := net.ParseIP(ipStr)
-		if ip != nil && !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsMulticast() {
-			return ipStr, nil
+		if ip != nil && family.Matches(ip) && !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsMulticast() {
+			return ip.String(), nil
 		}
 	}
 
@@ -124,7 +148,7 @@ func (d *IPDetector) DetectLocalIPs() ([]string, error) {
 	return publicIPs, nil
 }
 
-// DetectAllPublicIPs 检测所有公网IP（包括本地绑定和通过API检测）
+// DetectAllPublicIPs 检测所有公网IP（包括本地绑定和通过API检测的IPv4、IPv6出口）
 func (d *IPDetector) DetectAllPublicIPs() ([]string, error) {
 	var allIPs []string
 
@@ -134,9 +158,12 @@ func (d *IPDetector) DetectAllPublicIPs() ([]string, error) {
 		allIPs = append(allIPs, localIPs...)
 	}
 
-	// 2. 通过API检测当前出口IP
-	apiIP, err := d.DetectPublicIP()
-	if err == nil {
+	// 2. 通过API检测当前出口IP（IPv4和IPv6分别检测）
+	for _, detect := range []func() (string, error){d.DetectPublicIP, d.DetectPublicIPv6} {
+		apiIP, err := detect()
+		if err != nil {
+			continue
+		}
 		// 检查是否已存在
 		exists := false
 		for _, existing := range allIPs {
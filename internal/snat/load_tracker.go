@@ -0,0 +1,153 @@
+package snat
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// loadWindow 带宽统计窗口
+const loadWindow = time.Second
+
+// ExitLoad 出口IP的当前负载
+type ExitLoad struct {
+	ActiveConnections int64 // 并发连接数（包括选择时预留的连接）
+	Bandwidth         int64 // 带宽（字节/秒，最近一个统计窗口）
+}
+
+// LoadTracker 跟踪每个出口IP的并发连接数和带宽，由代理在连接开始、结束和传输数据时更新
+// 独立于选择器链，配置热重载重建选择器后负载不丢失
+type LoadTracker struct {
+	loads map[string]*ipLoad
+	mu    sync.RWMutex
+	now   func() time.Time
+}
+
+// ipLoad 一个出口IP的负载
+type ipLoad struct {
+	active      int64 // 原子操作，包括已预留但尚未开始的连接
+	reserved    int64 // 原子操作，选择时预留、尚未开始的连接数
+	mu          sync.Mutex
+	windowStart time.Time
+	windowBytes int64
+	bandwidth   int64 // 上一个统计窗口的带宽
+}
+
+// NewLoadTracker 创建负载跟踪器
+func NewLoadTracker() *LoadTracker {
+	return &LoadTracker{
+		loads: make(map[string]*ipLoad),
+		now:   time.Now,
+	}
+}
+
+// get 获取IP的负载，不存在时创建
+func (t *LoadTracker) get(ip net.IP) *ipLoad {
+	ipStr := ip.String()
+	t.mu.RLock()
+	load := t.loads[ipStr]
+	t.mu.RUnlock()
+	if load != nil {
+		return load
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if load = t.loads[ipStr]; load == nil {
+		load = &ipLoad{windowStart: t.now()}
+		t.loads[ipStr] = load
+	}
+	return load
+}
+
+// OnConnectionStart 出口IP上建立了一个连接（或UDP套接字），有预留时使用预留（已计入并发连接数）
+func (t *LoadTracker) OnConnectionStart(ip net.IP) {
+	load := t.get(ip)
+	if !load.takeReservation() {
+		atomic.AddInt64(&load.active, 1)
+	}
+}
+
+// TryReserve 出口IP的并发连接数未达到maxConnections（0表示不限）时为一个连接预留，返回是否成功
+// 检查和计数是同一个原子操作，并发的选择不会超过上限；预留由OnConnectionStart使用或由Unreserve释放
+func (t *LoadTracker) TryReserve(ip net.IP, maxConnections int64) bool {
+	load := t.get(ip)
+	for {
+		active := atomic.LoadInt64(&load.active)
+		if maxConnections > 0 && active >= maxConnections {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&load.active, active, active+1) {
+			atomic.AddInt64(&load.reserved, 1)
+			return true
+		}
+	}
+}
+
+// Unreserve 释放出口IP上一个未使用的预留
+func (t *LoadTracker) Unreserve(ip net.IP) {
+	load := t.get(ip)
+	if load.takeReservation() {
+		atomic.AddInt64(&load.active, -1)
+	}
+}
+
+// OnConnectionEnd 出口IP上的一个连接结束
+func (t *LoadTracker) OnConnectionEnd(ip net.IP) {
+	atomic.AddInt64(&t.get(ip).active, -1)
+}
+
+// OnBytesTransferred 出口IP上传输了bytes字节（上行和下行都计入带宽）
+func (t *LoadTracker) OnBytesTransferred(ip net.IP, bytes int64) {
+	load := t.get(ip)
+	now := t.now()
+	load.mu.Lock()
+	load.rollLocked(now)
+	load.windowBytes += bytes
+	load.mu.Unlock()
+}
+
+// Load 出口IP的当前负载
+func (t *LoadTracker) Load(ip net.IP) ExitLoad {
+	load := t.get(ip)
+	now := t.now()
+	load.mu.Lock()
+	defer load.mu.Unlock()
+	load.rollLocked(now)
+
+	// 当前窗口未结束但已传输的字节数超过上一个窗口的带宽时，带宽至少为当前窗口的字节数
+	bandwidth := load.bandwidth
+	if load.windowBytes > bandwidth {
+		bandwidth = load.windowBytes
+	}
+	return ExitLoad{
+		ActiveConnections: atomic.LoadInt64(&load.active),
+		Bandwidth:         bandwidth,
+	}
+}
+
+// takeReservation 有预留时取出一个，返回是否取出
+func (l *ipLoad) takeReservation() bool {
+	for {
+		reserved := atomic.LoadInt64(&l.reserved)
+		if reserved <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&l.reserved, reserved, reserved-1) {
+			return true
+		}
+	}
+}
+
+// rollLocked 统计窗口结束时计算带宽并开始新窗口（调用方持有l.mu）
+func (l *ipLoad) rollLocked(now time.Time) {
+	elapsed := now.Sub(l.windowStart)
+	if elapsed < loadWindow {
+		return
+	}
+	// 长时间没有传输时按经过的时间平均
+	l.bandwidth = l.windowBytes * int64(time.Second) / int64(elapsed)
+	l.windowStart = now
+	l.windowBytes = 0
+}
@@ -4,9 +4,11 @@ import (
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // LoadBalancedSelector 负载均衡选择器（按连接数和流量）
+// 连接数和流量由代理通过SelectorFeedback反馈
 type LoadBalancedSelector struct {
 	ips      []net.IP
 	ipStats  map[string]*IPLoadStats
@@ -19,6 +21,8 @@ type IPLoadStats struct {
 	ActiveConnections int64
 	TotalBytes        int64
 	LastSelected      int64 // Unix timestamp
+	DialLatency       int64 // 连接目标耗时的移动平均（纳秒）
+	DialErrors        int64 // 连接目标失败次数
 	mu                sync.RWMutex
 }
 
@@ -33,7 +37,7 @@ func NewLoadBalancedSelector(ips []string, strategy string) (*LoadBalancedSelect
 			return nil, &InvalidIPError{IP: ipStr}
 		}
 		ipList = append(ipList, ip)
-		ipStats[ipStr] = &IPLoadStats{}
+		ipStats[ip.String()] = &IPLoadStats{}
 	}
 	
 	if strategy != "connections" && strategy != "traffic" {
@@ -49,25 +53,31 @@ func NewLoadBalancedSelector(ips []string, strategy string) (*LoadBalancedSelect
 
 // SelectIP 选择IP（基于负载）
 func (l *LoadBalancedSelector) SelectIP(targetAddr string, targetPort int) (net.IP, error) {
-	if len(l.ips) == 0 {
-		return nil, &NoIPAvailableError{}
-	}
-	
+	return l.SelectIPForFamily(targetAddr, targetPort, FamilyAny)
+}
+
+// SelectIPForFamily 在family的IP中选择负载最低的IP
+func (l *LoadBalancedSelector) SelectIPForFamily(targetAddr string, targetPort int, family IPFamily) (net.IP, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 	
+	ips := filterFamily(l.ips, family)
+	if len(ips) == 0 {
+		return nil, &NoIPAvailableError{Family: family}
+	}
+	
 	if l.strategy == "connections" {
-		return l.selectByConnections()
+		return l.selectByConnections(ips)
 	}
-	return l.selectByTraffic()
+	return l.selectByTraffic(ips)
 }
 
 // selectByConnections 按连接数选择（选择连接数最少的）
-func (l *LoadBalancedSelector) selectByConnections() (net.IP, error) {
+func (l *LoadBalancedSelector) selectByConnections(ips []net.IP) (net.IP, error) {
 	var bestIP net.IP
 	var minConnections int64 = -1
 	
-	for _, ip := range l.ips {
+	for _, ip := range ips {
 		ipStr := ip.String()
 		stats := l.ipStats[ipStr]
 		if stats == nil {
@@ -82,12 +92,11 @@ func (l *LoadBalancedSelector) selectByConnections() (net.IP, error) {
 	}
 	
 	if bestIP == nil {
-		return l.ips[0], nil
+		return ips[0], nil
 	}
 	
-	// 更新统计
+	// 更新统计（活跃连接数在连接建立时由OnConnectionStart增加）
 	if stats := l.ipStats[bestIP.String()]; stats != nil {
-		atomic.AddInt64(&stats.ActiveConnections, 1)
 		atomic.StoreInt64(&stats.LastSelected, getCurrentTimestamp())
 	}
 	
@@ -95,11 +104,11 @@ func (l *LoadBalancedSelector) selectByConnections() (net.IP, error) {
 }
 
 // selectByTraffic 按流量选择（选择流量最少的）
-func (l *LoadBalancedSelector) selectByTraffic() (net.IP, error) {
+func (l *LoadBalancedSelector) selectByTraffic(ips []net.IP) (net.IP, error) {
 	var bestIP net.IP
 	var minTraffic int64 = -1
 	
-	for _, ip := range l.ips {
+	for _, ip := range ips {
 		ipStr := ip.String()
 		stats := l.ipStats[ipStr]
 		if stats == nil {
@@ -114,7 +123,7 @@ func (l *LoadBalancedSelector) selectByTraffic() (net.IP, error) {
 	}
 	
 	if bestIP == nil {
-		return l.ips[0], nil
+		return ips[0], nil
 	}
 	
 	// 更新统计
@@ -125,41 +134,93 @@ func (l *LoadBalancedSelector) selectByTraffic() (net.IP, error) {
 	return bestIP, nil
 }
 
-// OnConnectionEnd 连接结束时调用
-func (l *LoadBalancedSelector) OnConnectionEnd(ip net.IP) {
-	ipStr := ip.String()
+// SetIPs 替换出口IP集合
+// 移出集合的IP保留负载统计：健康检查抖动时IP会被移出后再加入，其上的连接在此期间结束仍需正确计数
+func (l *LoadBalancedSelector) SetIPs(ips []net.IP) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, ip := range ips {
+		if l.ipStats[ip.String()] == nil {
+			l.ipStats[ip.String()] = &IPLoadStats{}
+		}
+	}
+	l.ips = copyIPs(ips)
+}
+
+// stats 获取IP的负载统计（从未使用过的IP返回nil）
+func (l *LoadBalancedSelector) stats(ip net.IP) *IPLoadStats {
 	l.mu.RLock()
-	stats := l.ipStats[ipStr]
-	l.mu.RUnlock()
-	
-	if stats != nil {
-		atomic.AddInt64(&stats.ActiveConnections, -1)
+	defer l.mu.RUnlock()
+	return l.ipStats[ip.String()]
+}
+
+// OnConnectionStart 连接建立时调用
+func (l *LoadBalancedSelector) OnConnectionStart(ip net.IP) {
+	if stats := l.stats(ip); stats != nil {
+		atomic.AddInt64(&stats.ActiveConnections, 1)
+	}
+}
+
+// OnConnectionEnd 连接结束时调用（活跃连接数不低于0，统计被重置后结束的连接不会使其为负）
+func (l *LoadBalancedSelector) OnConnectionEnd(ip net.IP) {
+	stats := l.stats(ip)
+	if stats == nil {
+		return
+	}
+	for {
+		active := atomic.LoadInt64(&stats.ActiveConnections)
+		if active <= 0 || atomic.CompareAndSwapInt64(&stats.ActiveConnections, active, active-1) {
+			return
+		}
 	}
 }
 
 // OnBytesTransferred 数据传输时调用
 func (l *LoadBalancedSelector) OnBytesTransferred(ip net.IP, bytes int64) {
-	ipStr := ip.String()
-	l.mu.RLock()
-	stats := l.ipStats[ipStr]
-	l.mu.RUnlock()
-	
-	if stats != nil {
+	if stats := l.stats(ip); stats != nil {
 		atomic.AddInt64(&stats.TotalBytes, bytes)
 	}
 }
 
-// GetStats 获取负载统计
+// OnDialResult 连接目标后调用，记录连接耗时的移动平均和失败次数
+func (l *LoadBalancedSelector) OnDialResult(ip net.IP, latency time.Duration, err error) {
+	stats := l.stats(ip)
+	if stats == nil {
+		return
+	}
+	if err != nil {
+		atomic.AddInt64(&stats.DialErrors, 1)
+		return
+	}
+
+	stats.mu.Lock()
+	if stats.DialLatency == 0 {
+		stats.DialLatency = int64(latency)
+	} else {
+		stats.DialLatency += (int64(latency) - stats.DialLatency) / 8
+	}
+	stats.mu.Unlock()
+}
+
+// GetStats 获取当前出口IP的负载统计
 func (l *LoadBalancedSelector) GetStats() map[string]interface{} {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 	
 	stats := make(map[string]interface{})
-	for ipStr, stat := range l.ipStats {
+	for _, ip := range l.ips {
+		ipStr := ip.String()
+		stat := l.ipStats[ipStr]
+		stat.mu.RLock()
+		dialLatency := time.Duration(stat.DialLatency)
+		stat.mu.RUnlock()
 		stats[ipStr] = map[string]interface{}{
 			"active_connections": atomic.LoadInt64(&stat.ActiveConnections),
 			"total_bytes":        atomic.LoadInt64(&stat.TotalBytes),
 			"last_selected":      atomic.LoadInt64(&stat.LastSelected),
+			"dial_latency_ms":    dialLatency.Milliseconds(),
+			"dial_errors":        atomic.LoadInt64(&stat.DialErrors),
 		}
 	}
 	return stats
@@ -179,6 +240,10 @@ func (l *LoadBalancedSelector) ResetStats() {
 		atomic.StoreInt64(&stat.ActiveConnections, 0)
 		atomic.StoreInt64(&stat.TotalBytes, 0)
 		atomic.StoreInt64(&stat.LastSelected, 0)
+		atomic.StoreInt64(&stat.DialErrors, 0)
+		stat.mu.Lock()
+		stat.DialLatency = 0
+		stat.mu.Unlock()
 	}
 }
 
@@ -3,166 +3,307 @@ package snat
 import (
 	"fmt"
 	"net"
-	"os/exec"
-	"strconv"
+	"os"
 	"sync"
+	"syscall"
 
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 )
 
+const (
+	// routeTableBase 出口IP路由表起始编号（fwmark为N的出口IP使用路由表routeTableBase+N-1）
+	routeTableBase = 100
+
+	// maxRouteTables 路由管理器占用的路由表数量上限，即出口IP数量上限
+	maxRouteTables = 256
+)
+
 // RoutingManager 路由管理器
+// 每个出口IP分配固定的fwmark和路由表，运行时增删IP不改变其他IP的标记
 type RoutingManager struct {
-	ips      []net.IP
-	gateway  net.IP
-	iface    string
-	ipToMark map[string]int
-	markToIP map[int]net.IP
-	mu       sync.Mutex // 保护并发访问
+	ips       []net.IP
+	gateway   net.IP // IPv4出口IP的网关
+	gatewayV6 net.IP // IPv6出口IP的网关（为空时经接口直接出站）
+	iface     string
+	ipToMark  map[string]int
+	markToIP  map[int]net.IP
+	backend   RoutingBackend
+	mu        sync.Mutex // 保护并发访问
 }
 
-// NewRoutingManager 创建路由管理器
+// NewRoutingManager 创建路由管理器（使用exec后端）
 func NewRoutingManager(ips []net.IP, gateway, iface string) (*RoutingManager, error) {
+	return NewRoutingManagerWithBackend(ips, gateway, iface, NewExecBackend())
+}
+
+// NewRoutingManagerWithBackend 创建使用指定后端的路由管理器
+func NewRoutingManagerWithBackend(ips []net.IP, gateway, iface string, backend RoutingBackend) (*RoutingManager, error) {
 	gwIP := net.ParseIP(gateway)
 	if gwIP == nil {
 		return nil, fmt.Errorf("invalid gateway IP: %s", gateway)
 	}
 
-	ipToMark := make(map[string]int)
-	markToIP := make(map[int]net.IP)
+	r := &RoutingManager{
+		iface:    iface,
+		ipToMark: make(map[string]int),
+		markToIP: make(map[int]net.IP),
+		backend:  backend,
+	}
+	if FamilyOf(gwIP) == FamilyIPv6 {
+		r.gatewayV6 = gwIP
+	} else {
+		r.gateway = gwIP
+	}
+	if err := r.assignMarks(ips); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
 
-	for i, ip := range ips {
-		mark := i + 1
-		ipToMark[ip.String()] = mark
-		markToIP[mark] = ip
+// SetIPv6Gateway 设置IPv6出口IP的网关（在Setup之前调用）
+func (r *RoutingManager) SetIPv6Gateway(gateway string) error {
+	gwIP := net.ParseIP(gateway)
+	if gwIP == nil || FamilyOf(gwIP) != FamilyIPv6 {
+		return fmt.Errorf("invalid IPv6 gateway: %s", gateway)
 	}
 
-	return &RoutingManager{
-		ips:      ips,
-		gateway:  gwIP,
-		iface:    iface,
-		ipToMark: ipToMark,
-		markToIP: markToIP,
-	}, nil
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.gatewayV6 = gwIP
+	return nil
 }
 
-// Setup 设置路由规则
-func (r *RoutingManager) Setup() error {
-	// 为每个IP创建路由表和规则
-	for i, ip := range r.ips {
-		mark := i + 1
-		table := 100 + i
-
-		// 创建路由表
-		cmd := exec.Command("ip", "route", "add", "default", "via", r.gateway.String(),
-			"table", strconv.Itoa(table), "src", ip.String())
-		if err := cmd.Run(); err != nil {
-			// 如果路由已存在，记录警告但不返回错误
-			logrus.Warnf("Failed to add route for %s (table %d): %v (may already exist)", ip.String(), table, err)
-		} else {
-			logrus.Debugf("Added route for %s in table %d", ip.String(), table)
+// assignMarks 为ips分配标记：已有的IP沿用原标记，新IP使用最小的空闲标记（调用方持有r.mu）
+func (r *RoutingManager) assignMarks(ips []net.IP) error {
+	ipToMark := make(map[string]int, len(ips))
+	markToIP := make(map[int]net.IP, len(ips))
+	unique := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if _, ok := ipToMark[ip.String()]; ok {
+			continue
 		}
-
-		// 创建路由规则
-		cmd = exec.Command("ip", "rule", "add", "fwmark", strconv.Itoa(mark),
-			"table", strconv.Itoa(table))
-		if err := cmd.Run(); err != nil {
-			// 如果规则已存在，记录警告但不返回错误
-			logrus.Warnf("Failed to add rule for mark %d (table %d): %v (may already exist)", mark, table, err)
-		} else {
-			logrus.Debugf("Added rule for mark %d in table %d", mark, table)
+		unique = append(unique, ip)
+		if mark, ok := r.ipToMark[ip.String()]; ok {
+			ipToMark[ip.String()] = mark
+			markToIP[mark] = ip
 		}
+	}
 
-		// 创建SNAT规则
-		cmd = exec.Command("iptables", "-t", "nat", "-A", "OUTPUT",
-			"-m", "mark", "--mark", strconv.Itoa(mark),
-			"-j", "SNAT", "--to-source", ip.String())
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to add SNAT rule for %s: %w", ip.String(), err)
+	next := 1
+	for _, ip := range unique {
+		if _, ok := ipToMark[ip.String()]; ok {
+			continue
+		}
+		for markToIP[next] != nil {
+			next++
 		}
+		if next > maxRouteTables {
+			return fmt.Errorf("too many exit IPs for SNAT routing (max %d)", maxRouteTables)
+		}
+		ipToMark[ip.String()] = next
+		markToIP[next] = ip
 	}
 
+	r.ips = unique
+	r.ipToMark = ipToMark
+	r.markToIP = markToIP
 	return nil
 }
 
+// Setup 设置路由规则
+func (r *RoutingManager) Setup() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	logrus.Infof("Setting up SNAT routing for %d exit IPs (backend: %s)", len(r.ips), r.backend.Name())
+	routes, err := r.checkedRoutes()
+	if err != nil {
+		return err
+	}
+	return r.backend.Setup(routes)
+}
+
 // Cleanup 清理路由规则
 func (r *RoutingManager) Cleanup() error {
-	var cleanupErrors []error
-
-	for i, ip := range r.ips {
-		mark := i + 1
-		table := 100 + i
-
-		// 删除SNAT规则
-		cmd := exec.Command("iptables", "-t", "nat", "-D", "OUTPUT",
-			"-m", "mark", "--mark", strconv.Itoa(mark),
-			"-j", "SNAT", "--to-source", ip.String())
-		if err := cmd.Run(); err != nil {
-			logrus.Warnf("Failed to delete SNAT rule for %s (mark %d): %v", ip.String(), mark, err)
-			cleanupErrors = append(cleanupErrors, fmt.Errorf("SNAT rule cleanup for %s: %w", ip.String(), err))
-		} else {
-			logrus.Debugf("Deleted SNAT rule for %s (mark %d)", ip.String(), mark)
-		}
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-		// 删除路由规则
-		cmd = exec.Command("ip", "rule", "del", "fwmark", strconv.Itoa(mark),
-			"table", strconv.Itoa(table))
-		if err := cmd.Run(); err != nil {
-			logrus.Warnf("Failed to delete rule for mark %d (table %d): %v", mark, table, err)
-			cleanupErrors = append(cleanupErrors, fmt.Errorf("rule cleanup for mark %d: %w", mark, err))
-		} else {
-			logrus.Debugf("Deleted rule for mark %d (table %d)", mark, table)
+	if err := r.backend.Cleanup(r.routes()); err != nil {
+		// 不返回错误，因为清理失败不应该阻止程序退出
+		logrus.Warnf("Some cleanup operations failed, but continuing: %v", err)
+	}
+	return nil
+}
+
+// CleanupExcept 清理路由规则，保留与next中配置相同的路由（next为nil时全部清理）
+// 用于已经Setup的next（使用另一个后端）替换本路由管理器之后，避免删除next刚配置的相同条目
+func (r *RoutingManager) CleanupExcept(next *RoutingManager) error {
+	var keep []ExitRoute
+	if next != nil {
+		next.mu.Lock()
+		keep = next.routes()
+		next.mu.Unlock()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	routes := make([]ExitRoute, 0, len(r.ips))
+	for _, route := range r.routes() {
+		kept := false
+		for _, other := range keep {
+			if sameRoute(route, other) {
+				kept = true
+				break
+			}
 		}
+		if !kept {
+			routes = append(routes, route)
+		}
+	}
+	if err := r.backend.Cleanup(routes); err != nil {
+		logrus.Warnf("Some cleanup operations failed, but continuing: %v", err)
+	}
+	return nil
+}
+
+// Backend 路由后端（配置热重载时新的路由管理器沿用同一后端，由其Setup直接调整为新配置）
+func (r *RoutingManager) Backend() RoutingBackend {
+	return r.backend
+}
 
-		// 删除路由表
-		cmd = exec.Command("ip", "route", "del", "default", "via", r.gateway.String(),
-			"table", strconv.Itoa(table), "src", ip.String())
-		if err := cmd.Run(); err != nil {
-			logrus.Warnf("Failed to delete route for %s (table %d): %v", ip.String(), table, err)
-			cleanupErrors = append(cleanupErrors, fmt.Errorf("route cleanup for %s: %w", ip.String(), err))
-		} else {
-			logrus.Debugf("Deleted route for %s (table %d)", ip.String(), table)
+// SetIPs 替换出口IP集合并同步路由，失败时恢复原来的集合
+func (r *RoutingManager) SetIPs(ips []net.IP) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	oldIPs, oldIPToMark, oldMarkToIP := r.ips, r.ipToMark, r.markToIP
+	if err := r.assignMarks(ips); err != nil {
+		return err
+	}
+	routes, err := r.checkedRoutes()
+	if err == nil {
+		err = r.backend.Setup(routes)
+	}
+	if err != nil {
+		r.ips, r.ipToMark, r.markToIP = oldIPs, oldIPToMark, oldMarkToIP
+		return fmt.Errorf("failed to update routing: %w", err)
+	}
+	logrus.Infof("SNAT routing updated: %d exit IPs", len(r.ips))
+	return nil
+}
+
+// AddIP 添加出口IP并配置其路由
+func (r *RoutingManager) AddIP(ip net.IP) error {
+	return r.SetIPs(append(r.IPs(), ip))
+}
+
+// RemoveIP 删除出口IP的路由（其标记可分配给之后添加的IP）
+func (r *RoutingManager) RemoveIP(ip net.IP) error {
+	ips := r.IPs()
+	remaining := make([]net.IP, 0, len(ips))
+	for _, existing := range ips {
+		if !existing.Equal(ip) {
+			remaining = append(remaining, existing)
 		}
 	}
+	return r.SetIPs(remaining)
+}
 
-	if len(cleanupErrors) > 0 {
-		logrus.Warnf("Some cleanup operations failed, but continuing...")
-		// 不返回错误，因为清理失败不应该阻止程序退出
+// IPs 当前配置路由的出口IP
+func (r *RoutingManager) IPs() []net.IP {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return copyIPs(r.ips)
+}
+
+// routes 每个出口IP对应的路由配置（调用方持有r.mu）
+func (r *RoutingManager) routes() []ExitRoute {
+	routes := make([]ExitRoute, 0, len(r.ips))
+	for _, ip := range r.ips {
+		mark := r.ipToMark[ip.String()]
+		gateway := r.gateway
+		if FamilyOf(ip) == FamilyIPv6 {
+			gateway = r.gatewayV6
+		}
+		routes = append(routes, ExitRoute{
+			IP:        ip,
+			Mark:      mark,
+			Table:     routeTableBase + mark - 1,
+			Gateway:   gateway,
+			Interface: r.iface,
+		})
 	}
+	return routes
+}
 
-	return nil
+// checkedRoutes 路由配置，出口IP所在地址族既没有网关也没有接口时返回错误（调用方持有r.mu）
+func (r *RoutingManager) checkedRoutes() ([]ExitRoute, error) {
+	routes := r.routes()
+	for _, route := range routes {
+		if route.Gateway == nil && route.Interface == "" {
+			return nil, fmt.Errorf("no %s gateway or interface configured for exit IP %s", FamilyOf(route.IP), route.IP)
+		}
+	}
+	return routes, nil
 }
 
-// MarkConnection 标记连接
+// MarkConnection 标记连接（TCP或UDP）
+// 已连接的TCP套接字设置标记后不影响握手的路由选择，新连接应使用MarkControl
 func (r *RoutingManager) MarkConnection(conn net.Conn, ip net.IP) error {
-	mark, ok := r.ipToMark[ip.String()]
-	if !ok {
-		return fmt.Errorf("IP %s not found in routing manager", ip.String())
+	mark, err := r.GetMarkForIP(ip)
+	if err != nil {
+		return err
 	}
 
-	tcpConn, ok := conn.(*net.TCPConn)
+	fileConn, ok := conn.(interface{ File() (*os.File, error) })
 	if !ok {
-		return fmt.Errorf("connection is not TCP")
+		return fmt.Errorf("connection does not expose a file descriptor")
 	}
 
-	file, err := tcpConn.File()
+	file, err := fileConn.File()
 	if err != nil {
 		return fmt.Errorf("failed to get file descriptor: %w", err)
 	}
 	defer file.Close()
 
-	fd := int(file.Fd())
+	return setMark(int(file.Fd()), mark)
+}
+
+// MarkControl 返回在bind/connect之前设置SO_MARK的Control函数（用于net.Dialer和net.ListenConfig）
+func (r *RoutingManager) MarkControl(ip net.IP) (func(network, address string, c syscall.RawConn) error, error) {
+	mark, err := r.GetMarkForIP(ip)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		if err := c.Control(func(fd uintptr) {
+			sockErr = setMark(int(fd), mark)
+		}); err != nil {
+			return err
+		}
+		return sockErr
+	}, nil
+}
+
+// setMark 设置套接字的SO_MARK
+func setMark(fd, mark int) error {
 	// SO_MARK is Linux-specific (36), use raw value for compatibility
 	const SO_MARK = 36
 	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, SO_MARK, mark); err != nil {
 		return fmt.Errorf("failed to set SO_MARK: %w", err)
 	}
-
 	return nil
 }
 
 // GetMarkForIP 获取IP对应的标记
 func (r *RoutingManager) GetMarkForIP(ip net.IP) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	mark, ok := r.ipToMark[ip.String()]
 	if !ok {
 		return 0, fmt.Errorf("IP %s not found", ip.String())
@@ -0,0 +1,205 @@
+package snat
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 路由后端名称
+const (
+	RoutingBackendNetlink = "netlink" // 通过netlink和nftables直接配置内核（默认）
+	RoutingBackendExec    = "exec"    // 调用ip和iptables命令（兼容旧系统）
+)
+
+// 本程序写入的路由和规则的标记：后端只删除带标记的路由和规则，不影响管理员在同一路由表中配置的条目
+const (
+	routeProtocol = 77    // 路由的RTPROT（ip route ... proto 77）
+	rulePriority  = 20077 // fwmark规则的优先级（ip rule ... priority 20077）
+)
+
+// ExitRoute 一个出口IP的路由配置：带Mark的连接查询Table，经Gateway出站并SNAT为IP
+// Gateway为空时经Interface直接出站（如IPv6没有配置网关）
+type ExitRoute struct {
+	IP        net.IP
+	Mark      int
+	Table     int
+	Gateway   net.IP
+	Interface string
+}
+
+// RoutingBackend 路由后端，负责配置策略路由、路由表和SNAT规则
+type RoutingBackend interface {
+	// Name 后端名称
+	Name() string
+	// Setup 将路由配置为routes描述的状态（可重复调用，用于运行时增删出口IP）
+	Setup(routes []ExitRoute) error
+	// Cleanup 删除Setup配置的路由
+	Cleanup(routes []ExitRoute) error
+}
+
+// NewRoutingBackend 按名称创建路由后端（空字符串为netlink）
+func NewRoutingBackend(name string) (RoutingBackend, error) {
+	switch name {
+	case "", RoutingBackendNetlink:
+		return NewNetlinkBackend()
+	case RoutingBackendExec:
+		return NewExecBackend(), nil
+	default:
+		return nil, fmt.Errorf("unknown routing backend: %s", name)
+	}
+}
+
+// ExecBackend 调用ip route、ip rule和iptables命令配置路由
+// 路由和规则带有routeProtocol和rulePriority标记，删除时按标记匹配，不会删除其他来源的同类条目
+// 已存在的路由和规则只记录警告，进程崩溃后可能残留规则
+type ExecBackend struct {
+	run       func(name string, args ...string) error
+	installed map[int]ExitRoute // 本进程已配置的路由（按标记），重复Setup时只执行差异
+}
+
+// NewExecBackend 创建exec路由后端
+func NewExecBackend() *ExecBackend {
+	return &ExecBackend{
+		run: func(name string, args ...string) error {
+			return exec.Command(name, args...).Run()
+		},
+		installed: make(map[int]ExitRoute),
+	}
+}
+
+// Name 后端名称
+func (b *ExecBackend) Name() string {
+	return RoutingBackendExec
+}
+
+// Setup 设置路由规则：删除不再需要（或已变化）的路由，添加新的路由
+func (b *ExecBackend) Setup(routes []ExitRoute) error {
+	want := make(map[int]ExitRoute, len(routes))
+	for _, route := range routes {
+		want[route.Mark] = route
+	}
+	var stale []ExitRoute
+	for mark, route := range b.installed {
+		if wanted, ok := want[mark]; !ok || !sameRoute(wanted, route) {
+			stale = append(stale, route)
+		}
+	}
+	if len(stale) > 0 {
+		if err := b.Cleanup(stale); err != nil {
+			logrus.Warnf("Failed to remove stale routes: %v", err)
+		}
+	}
+
+	for _, route := range routes {
+		if _, ok := b.installed[route.Mark]; ok {
+			continue
+		}
+		ip := route.IP.String()
+		mark := strconv.Itoa(route.Mark)
+		table := strconv.Itoa(route.Table)
+
+		// 创建路由表
+		if err := b.run("ip", ipArgs(route, defaultRouteArgs(route, "add", table)...)...); err != nil {
+			// 如果路由已存在，记录警告但不返回错误
+			logrus.Warnf("Failed to add route for %s (table %d): %v (may already exist)", ip, route.Table, err)
+		} else {
+			logrus.Debugf("Added route for %s in table %d", ip, route.Table)
+		}
+
+		// 创建路由规则
+		if err := b.run("ip", ipArgs(route, "rule", "add", "fwmark", mark, "table", table, "priority", strconv.Itoa(rulePriority))...); err != nil {
+			// 如果规则已存在，记录警告但不返回错误
+			logrus.Warnf("Failed to add rule for mark %d (table %d): %v (may already exist)", route.Mark, route.Table, err)
+		} else {
+			logrus.Debugf("Added rule for mark %d in table %d", route.Mark, route.Table)
+		}
+
+		// 创建SNAT规则
+		if err := b.run(iptablesCommand(route), "-t", "nat", "-A", "OUTPUT",
+			"-m", "mark", "--mark", mark,
+			"-j", "SNAT", "--to-source", ip); err != nil {
+			return fmt.Errorf("failed to add SNAT rule for %s: %w", ip, err)
+		}
+		b.installed[route.Mark] = route
+	}
+
+	return nil
+}
+
+// ipArgs ip命令的参数，IPv6出口IP的路由和规则加-6
+func ipArgs(route ExitRoute, args ...string) []string {
+	if FamilyOf(route.IP) == FamilyIPv6 {
+		return append([]string{"-6"}, args...)
+	}
+	return args
+}
+
+// defaultRouteArgs 出口IP默认路由的ip route参数（action为add或del，删除时只匹配带本程序标记的路由）
+func defaultRouteArgs(route ExitRoute, action, table string) []string {
+	args := []string{"route", action, "default"}
+	if route.Gateway != nil {
+		args = append(args, "via", route.Gateway.String())
+	} else {
+		args = append(args, "dev", route.Interface)
+	}
+	return append(args, "table", table, "src", route.IP.String(), "proto", strconv.Itoa(routeProtocol))
+}
+
+// iptablesCommand 出口IP地址族对应的iptables命令
+func iptablesCommand(route ExitRoute) string {
+	if FamilyOf(route.IP) == FamilyIPv6 {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+// sameRoute 两个路由配置是否相同
+func sameRoute(a, b ExitRoute) bool {
+	return a.IP.Equal(b.IP) && a.Mark == b.Mark && a.Table == b.Table &&
+		a.Gateway.Equal(b.Gateway) && a.Interface == b.Interface
+}
+
+// Cleanup 清理路由规则
+func (b *ExecBackend) Cleanup(routes []ExitRoute) error {
+	var cleanupErrors []error
+
+	for _, route := range routes {
+		ip := route.IP.String()
+		mark := strconv.Itoa(route.Mark)
+		table := strconv.Itoa(route.Table)
+		delete(b.installed, route.Mark)
+
+		// 删除SNAT规则
+		if err := b.run(iptablesCommand(route), "-t", "nat", "-D", "OUTPUT",
+			"-m", "mark", "--mark", mark,
+			"-j", "SNAT", "--to-source", ip); err != nil {
+			logrus.Warnf("Failed to delete SNAT rule for %s (mark %d): %v", ip, route.Mark, err)
+			cleanupErrors = append(cleanupErrors, fmt.Errorf("SNAT rule cleanup for %s: %w", ip, err))
+		} else {
+			logrus.Debugf("Deleted SNAT rule for %s (mark %d)", ip, route.Mark)
+		}
+
+		// 删除路由规则
+		if err := b.run("ip", ipArgs(route, "rule", "del", "fwmark", mark, "table", table, "priority", strconv.Itoa(rulePriority))...); err != nil {
+			logrus.Warnf("Failed to delete rule for mark %d (table %d): %v", route.Mark, route.Table, err)
+			cleanupErrors = append(cleanupErrors, fmt.Errorf("rule cleanup for mark %d: %w", route.Mark, err))
+		} else {
+			logrus.Debugf("Deleted rule for mark %d (table %d)", route.Mark, route.Table)
+		}
+
+		// 删除路由表
+		if err := b.run("ip", ipArgs(route, defaultRouteArgs(route, "del", table)...)...); err != nil {
+			logrus.Warnf("Failed to delete route for %s (table %d): %v", ip, route.Table, err)
+			cleanupErrors = append(cleanupErrors, fmt.Errorf("route cleanup for %s: %w", ip, err))
+		} else {
+			logrus.Debugf("Deleted route for %s (table %d)", ip, route.Table)
+		}
+	}
+
+	return errors.Join(cleanupErrors...)
+}
@@ -0,0 +1,282 @@
+//go:build linux
+
+package snat
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// nftTableName netlink后端独占的nftables表（inet族），所有SNAT规则都在其中，清理时整表删除
+	nftTableName = "multiexit_proxy"
+	nftChainName = "postrouting"
+)
+
+// NetlinkBackend 通过netlink配置策略路由和路由表、通过nftables配置SNAT
+// Setup可重复调用：路由用replace写入，规则先比对现有状态，nftables表在一个事务中重建
+// 只有带本程序标记（routeProtocol、rulePriority）的路由和规则会被视为残留删除
+type NetlinkBackend struct{}
+
+// NewNetlinkBackend 创建netlink路由后端
+func NewNetlinkBackend() (RoutingBackend, error) {
+	return &NetlinkBackend{}, nil
+}
+
+// Name 后端名称
+func (b *NetlinkBackend) Name() string {
+	return RoutingBackendNetlink
+}
+
+// Setup 将内核状态调整为routes描述的状态
+func (b *NetlinkBackend) Setup(routes []ExitRoute) error {
+	if err := b.syncRoutes(routes, managedTable); err != nil {
+		return err
+	}
+	if err := b.syncRules(routes, managedTable); err != nil {
+		return err
+	}
+	if err := b.replaceNftTable(routes); err != nil {
+		return err
+	}
+	logrus.Debugf("Programmed %d exit routes via netlink and nftables table %s", len(routes), nftTableName)
+	return nil
+}
+
+// Cleanup 删除nftables表以及routes使用的规则和路由
+func (b *NetlinkBackend) Cleanup(routes []ExitRoute) error {
+	tables := make(map[int]bool, len(routes))
+	for _, route := range routes {
+		tables[route.Table] = true
+	}
+	owned := func(table int) bool { return tables[table] }
+
+	var cleanupErrors []error
+	if err := b.deleteNftTable(); err != nil {
+		cleanupErrors = append(cleanupErrors, err)
+	}
+	if err := b.syncRules(nil, owned); err != nil {
+		cleanupErrors = append(cleanupErrors, err)
+	}
+	if err := b.syncRoutes(nil, owned); err != nil {
+		cleanupErrors = append(cleanupErrors, err)
+	}
+	return errors.Join(cleanupErrors...)
+}
+
+// managedTable 路由表是否由后端管理：[routeTableBase, routeTableBase+maxRouteTables)范围内
+// 带本程序标记但不属于当前配置的fwmark规则和路由（上次崩溃或出口IP减少后的残留）在Setup时删除
+func managedTable(table int) bool {
+	return table >= routeTableBase && table < routeTableBase+maxRouteTables
+}
+
+// ipFamily IP地址对应的netlink地址族
+func ipFamily(ip net.IP) int {
+	if ip.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
+
+// syncRoutes 写入routes对应的默认路由，并删除owned路由表中本程序写入的其他路由
+func (b *NetlinkBackend) syncRoutes(routes []ExitRoute, owned func(table int) bool) error {
+	want := make(map[int]*netlink.Route, len(routes))
+	for _, route := range routes {
+		nlRoute, err := buildRoute(route)
+		if err != nil {
+			return err
+		}
+		want[route.Table] = nlRoute
+	}
+
+	existing, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: unix.RT_TABLE_UNSPEC}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return fmt.Errorf("failed to list routes: %w", err)
+	}
+	for i := range existing {
+		route := &existing[i]
+		if route.Protocol != routeProtocol || !owned(route.Table) || routeMatches(route, want[route.Table]) {
+			continue
+		}
+		if err := netlink.RouteDel(route); err != nil && !errors.Is(err, unix.ESRCH) {
+			return fmt.Errorf("failed to delete stale route in table %d: %w", route.Table, err)
+		}
+		logrus.Debugf("Deleted stale route %s in table %d", route, route.Table)
+	}
+
+	for _, route := range routes {
+		if err := netlink.RouteReplace(want[route.Table]); err != nil {
+			return fmt.Errorf("failed to set route for %s (table %d): %w", route.IP, route.Table, err)
+		}
+		logrus.Debugf("Set route for %s in table %d", route.IP, route.Table)
+	}
+	return nil
+}
+
+// buildRoute 出口IP的默认路由：default via Gateway [dev Interface] table Table src IP
+func buildRoute(route ExitRoute) (*netlink.Route, error) {
+	nlRoute := &netlink.Route{
+		Table:    route.Table,
+		Gw:       route.Gateway,
+		Src:      route.IP,
+		Protocol: routeProtocol,
+	}
+	if route.Interface != "" {
+		link, err := netlink.LinkByName(route.Interface)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find interface %s: %w", route.Interface, err)
+		}
+		nlRoute.LinkIndex = link.Attrs().Index
+	}
+	return nlRoute, nil
+}
+
+// routeMatches 现有路由是否就是期望的默认路由
+func routeMatches(existing, want *netlink.Route) bool {
+	if want == nil {
+		return false
+	}
+	if existing.Dst != nil {
+		if ones, _ := existing.Dst.Mask.Size(); ones != 0 {
+			return false
+		}
+	}
+	if want.LinkIndex != 0 && existing.LinkIndex != want.LinkIndex {
+		return false
+	}
+	return existing.Gw.Equal(want.Gw) && existing.Src.Equal(want.Src)
+}
+
+// syncRules 确保每个出口IP恰好有一条fwmark规则，并删除owned路由表中本程序添加（优先级为rulePriority）的其他规则
+func (b *NetlinkBackend) syncRules(routes []ExitRoute, owned func(table int) bool) error {
+	type ruleKey struct {
+		family int
+		mark   uint32
+		table  int
+	}
+	want := make(map[ruleKey]bool, len(routes))
+	for _, route := range routes {
+		want[ruleKey{ipFamily(route.IP), uint32(route.Mark), route.Table}] = true
+	}
+
+	existing, err := netlink.RuleList(netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list rules: %w", err)
+	}
+	present := make(map[ruleKey]bool, len(want))
+	for i := range existing {
+		rule := &existing[i]
+		if rule.Mark == 0 || rule.Priority != rulePriority || !owned(rule.Table) {
+			continue
+		}
+		key := ruleKey{rule.Family, rule.Mark, rule.Table}
+		// 期望的规则保留一条，重复的和残留的删除
+		if want[key] && !present[key] {
+			present[key] = true
+			continue
+		}
+		if err := netlink.RuleDel(rule); err != nil && !errors.Is(err, unix.ENOENT) {
+			return fmt.Errorf("failed to delete stale rule for mark %d (table %d): %w", rule.Mark, rule.Table, err)
+		}
+		logrus.Debugf("Deleted stale rule for mark %d (table %d)", rule.Mark, rule.Table)
+	}
+
+	for _, route := range routes {
+		key := ruleKey{ipFamily(route.IP), uint32(route.Mark), route.Table}
+		if present[key] {
+			continue
+		}
+		rule := netlink.NewRule()
+		rule.Family = key.family
+		rule.Mark = key.mark
+		rule.Table = key.table
+		rule.Priority = rulePriority
+		if err := netlink.RuleAdd(rule); err != nil {
+			return fmt.Errorf("failed to add rule for mark %d (table %d): %w", route.Mark, route.Table, err)
+		}
+		present[key] = true
+		logrus.Debugf("Added rule for mark %d in table %d", route.Mark, route.Table)
+	}
+	return nil
+}
+
+// nftTable 后端独占的nftables表
+func nftTable() *nftables.Table {
+	return &nftables.Table{Family: nftables.TableFamilyINet, Name: nftTableName}
+}
+
+// replaceNftTable 在一个事务中删除并重建nftables表，写入每个出口IP的SNAT规则
+func (b *NetlinkBackend) replaceNftTable(routes []ExitRoute) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("failed to open nftables connection: %w", err)
+	}
+
+	table := nftTable()
+	// 先添加再删除，表不存在时删除也不会失败
+	conn.AddTable(table)
+	conn.DelTable(table)
+	conn.AddTable(table)
+	chain := conn.AddChain(&nftables.Chain{
+		Name:     nftChainName,
+		Table:    table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	})
+	for _, route := range routes {
+		conn.AddRule(&nftables.Rule{
+			Table: table,
+			Chain: chain,
+			Exprs: snatExprs(route),
+		})
+	}
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to program nftables table %s: %w", nftTableName, err)
+	}
+	return nil
+}
+
+// deleteNftTable 删除nftables表（表不存在时不报错）
+func (b *NetlinkBackend) deleteNftTable() error {
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("failed to open nftables connection: %w", err)
+	}
+
+	table := nftTable()
+	conn.AddTable(table)
+	conn.DelTable(table)
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to delete nftables table %s: %w", nftTableName, err)
+	}
+	return nil
+}
+
+// snatExprs SNAT规则：meta nfproto <族> meta mark <Mark> snat to <IP>
+func snatExprs(route ExitRoute) []expr.Any {
+	family := byte(unix.NFPROTO_IPV4)
+	addr := route.IP.To4()
+	if addr == nil {
+		family = unix.NFPROTO_IPV6
+		addr = route.IP.To16()
+	}
+
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family}},
+		&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(uint32(route.Mark))},
+		&expr.Immediate{Register: 1, Data: addr},
+		&expr.NAT{Type: expr.NATTypeSourceNAT, Family: uint32(family), RegAddrMin: 1},
+	}
+}
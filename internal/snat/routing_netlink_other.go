@@ -0,0 +1,10 @@
+//go:build !linux
+
+package snat
+
+import "fmt"
+
+// NewNetlinkBackend netlink后端仅支持Linux
+func NewNetlinkBackend() (RoutingBackend, error) {
+	return nil, fmt.Errorf("%s routing backend is only supported on Linux", RoutingBackendNetlink)
+}
@@ -0,0 +1,191 @@
+package snat
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRoutingManager_Routes(t *testing.T) {
+	ips := []net.IP{net.ParseIP("1.2.3.4"), net.ParseIP("5.6.7.8")}
+	mgr, err := NewRoutingManager(ips, "192.168.1.1", "eth0")
+	if err != nil {
+		t.Fatalf("Failed to create routing manager: %v", err)
+	}
+
+	routes := mgr.routes()
+	if len(routes) != 2 {
+		t.Fatalf("Expected 2 routes, got %d", len(routes))
+	}
+	for i, route := range routes {
+		if !route.IP.Equal(ips[i]) || route.Mark != i+1 || route.Table != routeTableBase+i {
+			t.Errorf("Unexpected route %d: %+v", i, route)
+		}
+		if mark, _ := mgr.GetMarkForIP(ips[i]); mark != route.Mark {
+			t.Errorf("Mark mismatch for %s: %d != %d", ips[i], mark, route.Mark)
+		}
+	}
+}
+
+func TestExecBackend(t *testing.T) {
+	var commands []string
+	backend := NewExecBackend()
+	backend.run = func(name string, args ...string) error {
+		commands = append(commands, name+" "+strings.Join(args, " "))
+		return nil
+	}
+
+	route := ExitRoute{IP: net.ParseIP("1.2.3.4"), Mark: 1, Table: 100, Gateway: net.ParseIP("192.168.1.1")}
+	if err := backend.Setup([]ExitRoute{route}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	expected := []string{
+		"ip route add default via 192.168.1.1 table 100 src 1.2.3.4 proto 77",
+		"ip rule add fwmark 1 table 100 priority 20077",
+		"iptables -t nat -A OUTPUT -m mark --mark 1 -j SNAT --to-source 1.2.3.4",
+	}
+	if strings.Join(commands, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Unexpected setup commands:\n%s", strings.Join(commands, "\n"))
+	}
+
+	// 清理失败的命令汇总为一个错误
+	backend.run = func(name string, args ...string) error {
+		return errors.New("exit status 2")
+	}
+	if err := backend.Cleanup([]ExitRoute{route}); err == nil {
+		t.Error("Expected cleanup error")
+	}
+}
+
+func TestNewRoutingBackend(t *testing.T) {
+	backend, err := NewRoutingBackend(RoutingBackendExec)
+	if err != nil || backend.Name() != RoutingBackendExec {
+		t.Errorf("Expected exec backend, got %v, %v", backend, err)
+	}
+	if _, err := NewRoutingBackend("iproute2"); err == nil {
+		t.Error("Expected error for unknown backend")
+	}
+}
+
+func TestRoutingManager_SetIPsKeepsMarks(t *testing.T) {
+	var commands []string
+	backend := NewExecBackend()
+	backend.run = func(name string, args ...string) error {
+		commands = append(commands, name+" "+strings.Join(args, " "))
+		return nil
+	}
+
+	a, b, c := net.ParseIP("1.2.3.4"), net.ParseIP("5.6.7.8"), net.ParseIP("9.9.9.9")
+	mgr, err := NewRoutingManagerWithBackend([]net.IP{a, b}, "192.168.1.1", "eth0", backend)
+	if err != nil {
+		t.Fatalf("Failed to create routing manager: %v", err)
+	}
+	if err := mgr.Setup(); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	// 删除第一个IP后，其余IP的标记不变，新IP复用空闲标记
+	commands = nil
+	if err := mgr.RemoveIP(a); err != nil {
+		t.Fatalf("RemoveIP failed: %v", err)
+	}
+	if mark, _ := mgr.GetMarkForIP(b); mark != 2 {
+		t.Errorf("Expected mark 2 for %s after removal, got %d", b, mark)
+	}
+	if _, err := mgr.GetMarkForIP(a); err == nil {
+		t.Errorf("Expected %s to be removed", a)
+	}
+	if len(commands) != 3 || !strings.HasPrefix(commands[0], "iptables -t nat -D OUTPUT -m mark --mark 1 ") {
+		t.Errorf("Expected only the removed IP's rules to be deleted, got:\n%s", strings.Join(commands, "\n"))
+	}
+
+	commands = nil
+	if err := mgr.AddIP(c); err != nil {
+		t.Fatalf("AddIP failed: %v", err)
+	}
+	if mark, _ := mgr.GetMarkForIP(c); mark != 1 {
+		t.Errorf("Expected %s to reuse mark 1, got %d", c, mark)
+	}
+	if len(commands) != 3 || commands[0] != "ip route add default via 192.168.1.1 table 100 src 9.9.9.9 proto 77" {
+		t.Errorf("Expected only the added IP's rules to be created, got:\n%s", strings.Join(commands, "\n"))
+	}
+}
+
+func TestExecBackend_IPv6(t *testing.T) {
+	var commands []string
+	backend := NewExecBackend()
+	backend.run = func(name string, args ...string) error {
+		commands = append(commands, name+" "+strings.Join(args, " "))
+		return nil
+	}
+
+	// IPv6没有网关时经接口直接出站
+	route := ExitRoute{IP: net.ParseIP("2001:db8::1"), Mark: 2, Table: 101, Interface: "eth0"}
+	if err := backend.Setup([]ExitRoute{route}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	expected := []string{
+		"ip -6 route add default dev eth0 table 101 src 2001:db8::1 proto 77",
+		"ip -6 rule add fwmark 2 table 101 priority 20077",
+		"ip6tables -t nat -A OUTPUT -m mark --mark 2 -j SNAT --to-source 2001:db8::1",
+	}
+	if strings.Join(commands, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Unexpected setup commands:\n%s", strings.Join(commands, "\n"))
+	}
+}
+
+func TestRoutingManager_DualStackGateways(t *testing.T) {
+	ips := []net.IP{net.ParseIP("1.2.3.4"), net.ParseIP("2001:db8::1")}
+	mgr, err := NewRoutingManager(ips, "192.168.1.1", "")
+	if err != nil {
+		t.Fatalf("Failed to create routing manager: %v", err)
+	}
+
+	// 没有IPv6网关和接口时无法为IPv6出口IP配置路由
+	if _, err := mgr.checkedRoutes(); err == nil {
+		t.Error("Expected error without IPv6 gateway")
+	}
+
+	if err := mgr.SetIPv6Gateway("fe80::1"); err != nil {
+		t.Fatalf("SetIPv6Gateway failed: %v", err)
+	}
+	routes, err := mgr.checkedRoutes()
+	if err != nil {
+		t.Fatalf("checkedRoutes failed: %v", err)
+	}
+	if !routes[0].Gateway.Equal(net.ParseIP("192.168.1.1")) || !routes[1].Gateway.Equal(net.ParseIP("fe80::1")) {
+		t.Errorf("Unexpected gateways: %s, %s", routes[0].Gateway, routes[1].Gateway)
+	}
+
+	if err := mgr.SetIPv6Gateway("192.168.1.1"); err == nil {
+		t.Error("Expected error for IPv4 address as IPv6 gateway")
+	}
+}
+
+func TestRoutingManager_CleanupExcept(t *testing.T) {
+	var commands []string
+	run := func(name string, args ...string) error {
+		commands = append(commands, name+" "+strings.Join(args, " "))
+		return nil
+	}
+	oldBackend, newBackend := NewExecBackend(), NewExecBackend()
+	oldBackend.run, newBackend.run = run, run
+
+	oldMgr, _ := NewRoutingManagerWithBackend([]net.IP{net.ParseIP("1.2.3.4"), net.ParseIP("5.6.7.8")}, "192.168.1.1", "eth0", oldBackend)
+	newMgr, _ := NewRoutingManagerWithBackend([]net.IP{net.ParseIP("1.2.3.4")}, "192.168.1.1", "eth0", newBackend)
+	oldMgr.Setup()
+	newMgr.Setup()
+
+	// 新路由管理器已配置的相同路由不删除，只删除旧的路由管理器独有的路由
+	commands = nil
+	oldMgr.CleanupExcept(newMgr)
+	for _, command := range commands {
+		if strings.Contains(command, "1.2.3.4") || strings.Contains(command, "fwmark 1 ") {
+			t.Errorf("Cleanup removed a route kept by the new manager: %s", command)
+		}
+	}
+	if len(commands) != 3 {
+		t.Errorf("Expected 3 cleanup commands for 5.6.7.8, got:\n%s", strings.Join(commands, "\n"))
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -20,6 +21,7 @@ type Rule struct {
 	TargetIP    string   `yaml:"target_ip"`   // 目标出口IP
 	Action      string   `yaml:"action"`       // 动作：use_ip, skip, reject
 	Enabled     bool     `yaml:"enabled"`
+	FamilyPolicy string  `yaml:"family_policy"` // 地址族策略（见FamilyPolicy*，空表示使用全局策略）
 }
 
 // RuleEngine 规则引擎
@@ -254,6 +256,7 @@ type RuleBasedSelector struct {
 	baseSelector IPSelector
 	ruleEngine   *RuleEngine
 	exitIPs      []string
+	mu           sync.RWMutex
 }
 
 // NewRuleBasedSelector 创建基于规则的选择器
@@ -267,6 +270,16 @@ func NewRuleBasedSelector(baseSelector IPSelector, ruleEngine *RuleEngine, exitI
 
 // SelectIP 选择IP（基于规则）
 func (r *RuleBasedSelector) SelectIP(targetAddr string, targetPort int) (net.IP, error) {
+	return r.SelectIPForFamily(targetAddr, targetPort, FamilyAny)
+}
+
+// SelectIPForFamily 按规则选择family的IP，规则指定的IP地址族不符时回退到基础选择器
+func (r *RuleBasedSelector) SelectIPForFamily(targetAddr string, targetPort int, family IPFamily) (net.IP, error) {
+	return r.SelectIPForClient(ClientInfo{}, targetAddr, targetPort, family)
+}
+
+// SelectIPForClient 按规则为client选择family的IP
+func (r *RuleBasedSelector) SelectIPForClient(client ClientInfo, targetAddr string, targetPort int, family IPFamily) (net.IP, error) {
 	// 匹配规则
 	rule, err := r.ruleEngine.MatchRule(targetAddr, targetPort)
 	if err != nil {
@@ -281,12 +294,28 @@ func (r *RuleBasedSelector) SelectIP(targetAddr string, targetPort int) (net.IP,
 			if ip == nil {
 				return nil, fmt.Errorf("invalid target IP in rule: %s", rule.TargetIP)
 			}
+			// 规则指定的IP已从出口IP池移除（或正在排空）时回退到基础选择器
+			r.mu.RLock()
+			inPool := containsString(r.exitIPs, ip.String())
+			r.mu.RUnlock()
+			if !inPool {
+				logrus.Debugf("Rule-specified IP %s is not in the exit IP pool, using base selector", rule.TargetIP)
+				return SelectIPForClient(r.baseSelector, client, targetAddr, targetPort, family)
+			}
+			if !family.Matches(ip) {
+				logrus.Debugf("Rule-specified IP %s is not %s, using base selector", rule.TargetIP, family)
+				return SelectIPForClient(r.baseSelector, client, targetAddr, targetPort, family)
+			}
+			if !ReserverOf(r.baseSelector).Reserve(ip) {
+				logrus.Debugf("Rule-specified IP %s is at capacity, using base selector", rule.TargetIP)
+				return SelectIPForClient(r.baseSelector, client, targetAddr, targetPort, family)
+			}
 			logrus.Debugf("Using rule-specified IP %s for %s:%d", rule.TargetIP, targetAddr, targetPort)
 			return ip, nil
 		case "skip":
 			// 跳过规则，使用基础选择器
 			logrus.Debugf("Rule matched but skipped, using base selector")
-			return r.baseSelector.SelectIP(targetAddr, targetPort)
+			return SelectIPForClient(r.baseSelector, client, targetAddr, targetPort, family)
 		case "reject":
 			// 拒绝连接
 			return nil, fmt.Errorf("connection rejected by rule: %s", rule.Name)
@@ -294,6 +323,60 @@ func (r *RuleBasedSelector) SelectIP(targetAddr string, targetPort int) (net.IP,
 	}
 
 	// 没有匹配的规则，使用基础选择器
-	return r.baseSelector.SelectIP(targetAddr, targetPort)
+	return SelectIPForClient(r.baseSelector, client, targetAddr, targetPort, family)
+}
+
+// FamilyPolicy 匹配的规则指定的地址族策略
+func (r *RuleBasedSelector) FamilyPolicy(targetAddr string, targetPort int) string {
+	rule, err := r.ruleEngine.MatchRule(targetAddr, targetPort)
+	if err != nil || rule == nil {
+		return ""
+	}
+	return rule.FamilyPolicy
+}
+
+// SetIPs 替换出口IP集合
+func (r *RuleBasedSelector) SetIPs(ips []net.IP) {
+	exitIPs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		exitIPs = append(exitIPs, ip.String())
+	}
+
+	r.mu.Lock()
+	r.exitIPs = exitIPs
+	r.mu.Unlock()
+
+	if dynamic, ok := r.baseSelector.(DynamicIPSelector); ok {
+		dynamic.SetIPs(ips)
+	}
+}
+
+// Reserve 转发给基础选择器
+func (r *RuleBasedSelector) Reserve(ip net.IP) bool {
+	return ReserverOf(r.baseSelector).Reserve(ip)
+}
+
+// Unreserve 转发给基础选择器
+func (r *RuleBasedSelector) Unreserve(ip net.IP) {
+	ReserverOf(r.baseSelector).Unreserve(ip)
 }
 
+// OnConnectionStart 转发给基础选择器
+func (r *RuleBasedSelector) OnConnectionStart(ip net.IP) {
+	FeedbackOf(r.baseSelector).OnConnectionStart(ip)
+}
+
+// OnConnectionEnd 转发给基础选择器
+func (r *RuleBasedSelector) OnConnectionEnd(ip net.IP) {
+	FeedbackOf(r.baseSelector).OnConnectionEnd(ip)
+}
+
+// OnBytesTransferred 转发给基础选择器
+func (r *RuleBasedSelector) OnBytesTransferred(ip net.IP, bytes int64) {
+	FeedbackOf(r.baseSelector).OnBytesTransferred(ip, bytes)
+}
+
+// OnDialResult 转发给基础选择器
+func (r *RuleBasedSelector) OnDialResult(ip net.IP, latency time.Duration, err error) {
+	FeedbackOf(r.baseSelector).OnDialResult(ip, latency, err)
+}
@@ -4,8 +4,12 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
+	"math"
 	"net"
+	"strings"
 	"sync"
+
+	"golang.org/x/net/publicsuffix"
 )
 
 // IPSelector IP选择策略接口
@@ -13,6 +17,18 @@ type IPSelector interface {
 	SelectIP(targetAddr string, targetPort int) (net.IP, error)
 }
 
+// DynamicIPSelector 支持运行时增删出口IP的选择器
+type DynamicIPSelector interface {
+	IPSelector
+	// SetIPs 替换可选择的出口IP集合（只影响之后的选择）
+	SetIPs(ips []net.IP)
+}
+
+// copyIPs 复制IP列表，避免与调用方共享底层数组
+func copyIPs(ips []net.IP) []net.IP {
+	return append([]net.IP(nil), ips...)
+}
+
 // RoundRobinSelector 轮询选择器
 type RoundRobinSelector struct {
 	ips     []net.IP
@@ -39,35 +55,60 @@ func NewRoundRobinSelector(ips []string) (*RoundRobinSelector, error) {
 
 // SelectIP 选择IP（轮询）
 func (r *RoundRobinSelector) SelectIP(targetAddr string, targetPort int) (net.IP, error) {
-	if len(r.ips) == 0 {
-		return nil, &NoIPAvailableError{}
+	return r.SelectIPForFamily(targetAddr, targetPort, FamilyAny)
+}
+
+// SelectIPForFamily 轮询选择family的IP（跳过其他地址族的IP）
+func (r *RoundRobinSelector) SelectIPForFamily(targetAddr string, targetPort int, family IPFamily) (net.IP, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := 0; i < len(r.ips); i++ {
+		index := (r.current + i) % len(r.ips)
+		if family.Matches(r.ips[index]) {
+			r.current = (index + 1) % len(r.ips)
+			return r.ips[index], nil
+		}
 	}
+	return nil, &NoIPAvailableError{Family: family}
+}
 
+// SetIPs 替换出口IP集合
+func (r *RoundRobinSelector) SetIPs(ips []net.IP) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	ip := r.ips[r.current]
-	r.current = (r.current + 1) % len(r.ips)
-	return ip, nil
+	r.ips = copyIPs(ips)
+	if r.current >= len(r.ips) {
+		r.current = 0
+	}
 }
 
 // PortBasedSelector 按端口选择器
+// 端口范围的IP不可用（故障或已移除）时使用该范围的备用IP
 type PortBasedSelector struct {
 	portRanges []PortRange
+	available  map[string]bool // 可用的IP（nil表示端口范围中的IP都可用）
+	mu         sync.RWMutex
 }
 
 // PortRange 端口范围
 type PortRange struct {
-	Start int
-	End   int
-	IP    net.IP
+	Start  int
+	End    int
+	IP     net.IP
+	Backup net.IP // 备用IP（可为空）
+}
+
+// PortRangeConfig 端口范围配置
+type PortRangeConfig struct {
+	Range  string // 起止端口，如"1-1023"
+	IP     string
+	Backup string // 备用IP（可选）
 }
 
 // NewPortBasedSelector 创建按端口选择器
-func NewPortBasedSelector(portRanges []struct {
-	Range string
-	IP    string
-}) (*PortBasedSelector, error) {
+func NewPortBasedSelector(portRanges []PortRangeConfig) (*PortBasedSelector, error) {
 	ranges := make([]PortRange, 0, len(portRanges))
 	for _, pr := range portRanges {
 		var start, end int
@@ -80,10 +121,19 @@ func NewPortBasedSelector(portRanges []struct {
 			return nil, &InvalidIPError{IP: pr.IP}
 		}
 
+		var backup net.IP
+		if pr.Backup != "" {
+			backup = net.ParseIP(pr.Backup)
+			if backup == nil {
+				return nil, &InvalidIPError{IP: pr.Backup}
+			}
+		}
+
 		ranges = append(ranges, PortRange{
-			Start: start,
-			End:   end,
-			IP:    ip,
+			Start:  start,
+			End:    end,
+			IP:     ip,
+			Backup: backup,
 		})
 	}
 
@@ -94,27 +144,116 @@ func NewPortBasedSelector(portRanges []struct {
 
 // SelectIP 选择IP（按端口）
 func (p *PortBasedSelector) SelectIP(targetAddr string, targetPort int) (net.IP, error) {
+	return p.SelectIPForFamily(targetAddr, targetPort, FamilyAny)
+}
+
+// SelectIPForFamily 选择端口范围对应的family的IP，IP不可用时使用备用IP
+func (p *PortBasedSelector) SelectIPForFamily(targetAddr string, targetPort int, family IPFamily) (net.IP, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
 	for _, pr := range p.portRanges {
 		if targetPort >= pr.Start && targetPort <= pr.End {
-			return pr.IP, nil
+			if ip := p.rangeIP(pr, family); ip != nil {
+				return ip, nil
+			}
 		}
 	}
 
-	// 默认返回第一个IP
-	if len(p.portRanges) > 0 {
-		return p.portRanges[0].IP, nil
+	// 默认返回第一个可用的该地址族的IP
+	for _, pr := range p.portRanges {
+		if ip := p.rangeIP(pr, family); ip != nil {
+			return ip, nil
+		}
+	}
+
+	return nil, &NoIPAvailableError{Family: family}
+}
+
+// rangeIP 端口范围可用的family的IP：优先范围的IP，其次备用IP（调用方持有p.mu）
+func (p *PortBasedSelector) rangeIP(pr PortRange, family IPFamily) net.IP {
+	for _, ip := range []net.IP{pr.IP, pr.Backup} {
+		if ip != nil && family.Matches(ip) && p.isAvailable(ip) {
+			return ip
+		}
+	}
+	return nil
+}
+
+// isAvailable IP是否可用（调用方持有p.mu）
+func (p *PortBasedSelector) isAvailable(ip net.IP) bool {
+	return p.available == nil || p.available[ip.String()]
+}
+
+// SetIPs 设置可用的IP：端口范围不变，IP不在集合中的范围使用备用IP
+func (p *PortBasedSelector) SetIPs(ips []net.IP) {
+	available := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		available[ip.String()] = true
 	}
 
-	return nil, &NoIPAvailableError{}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.available = available
+}
+
+// IPs 端口范围中配置的IP和备用IP（去重）
+func (p *PortBasedSelector) IPs() []net.IP {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	var ips []net.IP
+	for _, pr := range p.portRanges {
+		for _, ip := range []net.IP{pr.IP, pr.Backup} {
+			if ip != nil && !seen[ip.String()] {
+				seen[ip.String()] = true
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips
+}
+
+// 按目标地址哈希选择时的哈希键
+const (
+	HashKeyHostPort   = "host_port"   // 目标主机和端口（默认）
+	HashKeyHost       = "host"        // 目标主机
+	HashKeyETLD1      = "etld1"       // 目标域名的注册域（eTLD+1），同一站点的子域名使用同一出口IP
+	HashKeyClientHost = "client_host" // 客户端IP和目标主机
+)
+
+// ValidHashKey 哈希键是否有效（空字符串表示默认的host_port）
+func ValidHashKey(hashKey string) bool {
+	switch hashKey {
+	case "", HashKeyHostPort, HashKeyHost, HashKeyETLD1, HashKeyClientHost:
+		return true
+	}
+	return false
 }
 
 // DestinationBasedSelector 按目标地址选择器
+// 使用加权的最高随机权重（rendezvous）哈希：增删IP时只有哈希到该IP的目标会改变出口IP
 type DestinationBasedSelector struct {
-	ips []net.IP
+	ips     []net.IP
+	hashKey string
+	weights map[string]float64 // IP -> 权重（未配置的IP权重为1）
+	mu      sync.RWMutex
+}
+
+// DestinationOptions 按目标地址选择器的选项
+type DestinationOptions struct {
+	HashKey string             // 哈希键（见HashKey*，空表示host_port）
+	Weights map[string]float64 // IP -> 权重，权重越大分到的目标越多（未配置的IP权重为1）
 }
 
 // NewDestinationBasedSelector 创建按目标地址选择器
 func NewDestinationBasedSelector(ips []string) (*DestinationBasedSelector, error) {
+	return NewDestinationBasedSelectorWithOptions(ips, DestinationOptions{})
+}
+
+// NewDestinationBasedSelectorWithOptions 使用指定的哈希键和权重创建按目标地址选择器
+func NewDestinationBasedSelectorWithOptions(ips []string, options DestinationOptions) (*DestinationBasedSelector, error) {
 	ipList := make([]net.IP, 0, len(ips))
 	for _, ipStr := range ips {
 		ip := net.ParseIP(ipStr)
@@ -124,27 +263,119 @@ func NewDestinationBasedSelector(ips []string) (*DestinationBasedSelector, error
 		ipList = append(ipList, ip)
 	}
 
+	if !ValidHashKey(options.HashKey) {
+		return nil, fmt.Errorf("invalid hash key: %s", options.HashKey)
+	}
+	weights, err := parseWeights(options.Weights)
+	if err != nil {
+		return nil, err
+	}
+
 	return &DestinationBasedSelector{
-		ips: ipList,
+		ips:     ipList,
+		hashKey: options.HashKey,
+		weights: weights,
 	}, nil
 }
 
 // SelectIP 选择IP（按目标地址哈希）
 func (d *DestinationBasedSelector) SelectIP(targetAddr string, targetPort int) (net.IP, error) {
-	if len(d.ips) == 0 {
-		return nil, &NoIPAvailableError{}
+	return d.SelectIPForClient(ClientInfo{}, targetAddr, targetPort, FamilyAny)
+}
+
+// SelectIPForFamily 在family的IP中按目标地址哈希选择
+func (d *DestinationBasedSelector) SelectIPForFamily(targetAddr string, targetPort int, family IPFamily) (net.IP, error) {
+	return d.SelectIPForClient(ClientInfo{}, targetAddr, targetPort, family)
+}
+
+// SelectIPForClient 在family的IP中选择哈希键得分最高的IP
+func (d *DestinationBasedSelector) SelectIPForClient(client ClientInfo, targetAddr string, targetPort int, family IPFamily) (net.IP, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	key := d.key(client, targetAddr, targetPort)
+	var bestIP net.IP
+	bestScore := math.Inf(-1)
+	for _, ip := range d.ips {
+		if !family.Matches(ip) {
+			continue
+		}
+		if score := rendezvousScore(key, ip, d.weight(ip)); bestIP == nil || score > bestScore {
+			bestIP = ip
+			bestScore = score
+		}
+	}
+	if bestIP == nil {
+		return nil, &NoIPAvailableError{Family: family}
 	}
+	return bestIP, nil
+}
+
+// key 目标的哈希键
+func (d *DestinationBasedSelector) key(client ClientInfo, targetAddr string, targetPort int) string {
+	switch d.hashKey {
+	case HashKeyHost:
+		return targetAddr
+	case HashKeyETLD1:
+		return registrableDomain(targetAddr)
+	case HashKeyClientHost:
+		if client.Addr == nil {
+			return targetAddr
+		}
+		return client.Addr.String() + "|" + targetAddr
+	default:
+		return fmt.Sprintf("%s:%d", targetAddr, targetPort)
+	}
+}
 
-	// 使用目标地址和端口计算哈希
-	key := fmt.Sprintf("%s:%d", targetAddr, targetPort)
-	hash := sha256.Sum256([]byte(key))
+// weight IP的权重（调用方持有d.mu）
+func (d *DestinationBasedSelector) weight(ip net.IP) float64 {
+	if weight, ok := d.weights[ip.String()]; ok {
+		return weight
+	}
+	return 1
+}
+
+// parseWeights 校验出口IP权重并以IP的规范形式为键
+func parseWeights(weights map[string]float64) (map[string]float64, error) {
+	parsed := make(map[string]float64, len(weights))
+	for ipStr, weight := range weights {
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			return nil, &InvalidIPError{IP: ipStr}
+		}
+		if weight <= 0 {
+			return nil, fmt.Errorf("invalid weight for %s: %v (must be > 0)", ipStr, weight)
+		}
+		parsed[ip.String()] = weight
+	}
+	return parsed, nil
+}
+
+// rendezvousScore 加权rendezvous哈希得分：-weight/ln(u)，u为key和IP的哈希映射到(0,1)的值
+// 各IP得分相互独立，增删一个IP不影响其他IP之间的相对顺序
+func rendezvousScore(key string, ip net.IP, weight float64) float64 {
+	hash := sha256.Sum256([]byte(key + "|" + ip.String()))
 	hashValue := binary.BigEndian.Uint64(hash[:8])
+	u := (float64(hashValue>>11) + 0.5) / (1 << 53)
+	return -weight / math.Log(u)
+}
 
-	// 确保索引为正数
-	index := int(hashValue % uint64(len(d.ips)))
-	if index < 0 {
-		index = -index % len(d.ips)
+// registrableDomain 域名的注册域（eTLD+1），IP地址或无法识别的域名原样返回
+func registrableDomain(host string) string {
+	if net.ParseIP(host) != nil {
+		return host
 	}
+	domain, err := publicsuffix.EffectiveTLDPlusOne(strings.TrimSuffix(strings.ToLower(host), "."))
+	if err != nil {
+		return host
+	}
+	return domain
+}
 
-	return d.ips[index], nil
+// SetIPs 替换出口IP集合
+func (d *DestinationBasedSelector) SetIPs(ips []net.IP) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ips = copyIPs(ips)
 }
@@ -1,6 +1,8 @@
 package snat
 
 import (
+	"fmt"
+	"net"
 	"testing"
 )
 
@@ -65,3 +67,164 @@ func TestSelectorWithInvalidIP(t *testing.T) {
 	}
 }
 
+
+func TestRoundRobinSelector_SetIPs(t *testing.T) {
+	selector, err := NewRoundRobinSelector([]string{"192.168.1.1", "192.168.1.2"})
+	if err != nil {
+		t.Fatalf("Failed to create selector: %v", err)
+	}
+
+	selector.SetIPs([]net.IP{net.ParseIP("192.168.1.3")})
+	for i := 0; i < 3; i++ {
+		selected, err := selector.SelectIP("example.com", 80)
+		if err != nil {
+			t.Fatalf("SelectIP failed: %v", err)
+		}
+		if selected.String() != "192.168.1.3" {
+			t.Errorf("Expected only the new IP to be selected, got %s", selected)
+		}
+	}
+
+	selector.SetIPs(nil)
+	if _, err := selector.SelectIP("example.com", 80); err == nil {
+		t.Error("Expected error with no IPs")
+	}
+}
+
+func TestPortBasedSelector_Backup(t *testing.T) {
+	selector, err := NewPortBasedSelector([]PortRangeConfig{
+		{Range: "1-1023", IP: "192.168.1.1", Backup: "192.168.1.3"},
+		{Range: "1024-65535", IP: "192.168.1.2"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create selector: %v", err)
+	}
+
+	if ip, _ := selector.SelectIP("example.com", 443); ip.String() != "192.168.1.1" {
+		t.Errorf("Expected 192.168.1.1 for port 443, got %s", ip)
+	}
+	if ip, _ := selector.SelectIP("example.com", 8080); ip.String() != "192.168.1.2" {
+		t.Errorf("Expected 192.168.1.2 for port 8080, got %s", ip)
+	}
+
+	// 端口范围的IP不可用时使用备用IP
+	selector.SetIPs([]net.IP{net.ParseIP("192.168.1.2"), net.ParseIP("192.168.1.3")})
+	if ip, _ := selector.SelectIP("example.com", 443); ip.String() != "192.168.1.3" {
+		t.Errorf("Expected backup 192.168.1.3 for port 443, got %s", ip)
+	}
+
+	// 没有备用IP的端口范围回退到第一个可用的IP
+	selector.SetIPs([]net.IP{net.ParseIP("192.168.1.1")})
+	if ip, _ := selector.SelectIP("example.com", 8080); ip.String() != "192.168.1.1" {
+		t.Errorf("Expected 192.168.1.1 for port 8080, got %s", ip)
+	}
+
+	selector.SetIPs(nil)
+	if _, err := selector.SelectIP("example.com", 443); !IsNoIPAvailable(err) {
+		t.Errorf("Expected NoIPAvailableError, got %v", err)
+	}
+}
+
+func TestDestinationBasedSelector_MinimalReshuffle(t *testing.T) {
+	ips := []string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4"}
+	selector, err := NewDestinationBasedSelector(ips)
+	if err != nil {
+		t.Fatalf("Failed to create selector: %v", err)
+	}
+
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		host := fmt.Sprintf("host%d.example.com", i)
+		ip, _ := selector.SelectIP(host, 443)
+		before[host] = ip.String()
+	}
+
+	// 移除一个IP后只有原来哈希到该IP的目标改变出口IP
+	selector.SetIPs([]net.IP{net.ParseIP(ips[0]), net.ParseIP(ips[1]), net.ParseIP(ips[3])})
+	for host, oldIP := range before {
+		ip, _ := selector.SelectIP(host, 443)
+		if oldIP != ips[2] && ip.String() != oldIP {
+			t.Fatalf("%s moved from %s to %s", host, oldIP, ip)
+		}
+		if ip.String() == ips[2] {
+			t.Fatalf("%s still uses removed IP", host)
+		}
+	}
+
+	// 重新加入后恢复原来的分配
+	selector.SetIPs([]net.IP{net.ParseIP(ips[0]), net.ParseIP(ips[1]), net.ParseIP(ips[2]), net.ParseIP(ips[3])})
+	for host, oldIP := range before {
+		if ip, _ := selector.SelectIP(host, 443); ip.String() != oldIP {
+			t.Fatalf("%s did not return to %s after re-adding, got %s", host, oldIP, ip)
+		}
+	}
+}
+
+func TestDestinationBasedSelector_Weights(t *testing.T) {
+	selector, err := NewDestinationBasedSelectorWithOptions([]string{"192.168.1.1", "192.168.1.2"}, DestinationOptions{
+		Weights: map[string]float64{"192.168.1.1": 3},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create selector: %v", err)
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		ip, _ := selector.SelectIP(fmt.Sprintf("host%d.example.com", i), 443)
+		counts[ip.String()]++
+	}
+	// 权重3:1，期望约3000:1000
+	if counts["192.168.1.1"] < 2700 || counts["192.168.1.1"] > 3300 {
+		t.Errorf("Unexpected weighted distribution: %v", counts)
+	}
+
+	if _, err := NewDestinationBasedSelectorWithOptions([]string{"192.168.1.1"}, DestinationOptions{
+		Weights: map[string]float64{"192.168.1.1": 0},
+	}); err == nil {
+		t.Error("Expected error for zero weight")
+	}
+}
+
+func TestDestinationBasedSelector_HashKey(t *testing.T) {
+	ips := []string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4"}
+
+	// etld1：同一站点的子域名使用同一出口IP
+	selector, err := NewDestinationBasedSelectorWithOptions(ips, DestinationOptions{HashKey: HashKeyETLD1})
+	if err != nil {
+		t.Fatalf("Failed to create selector: %v", err)
+	}
+	expected, _ := selector.SelectIP("example.co.uk", 443)
+	for _, host := range []string{"www.example.co.uk", "static.cdn.example.co.uk", "EXAMPLE.co.uk."} {
+		if ip, _ := selector.SelectIP(host, 80); !ip.Equal(expected) {
+			t.Errorf("%s: expected %s, got %s", host, expected, ip)
+		}
+	}
+
+	// host：忽略目标端口
+	selector, _ = NewDestinationBasedSelectorWithOptions(ips, DestinationOptions{HashKey: HashKeyHost})
+	ip1, _ := selector.SelectIP("example.com", 80)
+	ip2, _ := selector.SelectIP("example.com", 443)
+	if !ip1.Equal(ip2) {
+		t.Errorf("host hash key should ignore port: %s != %s", ip1, ip2)
+	}
+
+	// client_host：同一目标按客户端分散到不同出口IP
+	selector, _ = NewDestinationBasedSelectorWithOptions(ips, DestinationOptions{HashKey: HashKeyClientHost})
+	used := make(map[string]bool)
+	for i := 1; i <= 50; i++ {
+		client := ClientInfo{Addr: net.ParseIP(fmt.Sprintf("10.0.0.%d", i))}
+		ip, _ := selector.SelectIPForClient(client, "example.com", 443, FamilyAny)
+		again, _ := selector.SelectIPForClient(client, "example.com", 443, FamilyAny)
+		if !ip.Equal(again) {
+			t.Errorf("Client %s got different IPs: %s, %s", client.Addr, ip, again)
+		}
+		used[ip.String()] = true
+	}
+	if len(used) < 2 {
+		t.Errorf("Expected clients to be spread across exit IPs, got %v", used)
+	}
+
+	if _, err := NewDestinationBasedSelectorWithOptions(ips, DestinationOptions{HashKey: "url"}); err == nil {
+		t.Error("Expected error for unknown hash key")
+	}
+}
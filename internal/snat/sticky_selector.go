@@ -0,0 +1,350 @@
+package snat
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 粘性会话键的组成部分
+const (
+	StickyKeyClient = "client" // 客户端IP
+	StickyKeyUser   = "user"   // 认证用户名
+	StickyKeyETLD1  = "etld1"  // 目标域名的注册域（eTLD+1）
+)
+
+const (
+	// DefaultStickyIdleTTL 粘性会话默认空闲超时
+	DefaultStickyIdleTTL = 10 * time.Minute
+	// DefaultStickyMaxLifetime 粘性会话默认最长存活时间
+	DefaultStickyMaxLifetime = time.Hour
+)
+
+// StickyOptions 粘性会话选项
+type StickyOptions struct {
+	Key           []string         // 会话键的组成部分（见StickyKey*，空表示client+etld1）
+	IdleTTL       time.Duration    // 会话空闲超过该时间后失效（0表示默认值）
+	MaxLifetime   time.Duration    // 会话创建超过该时间后失效，避免长期固定在一个出口IP（0表示默认值）
+	HealthChecker *IPHealthChecker // 可选：会话的出口IP故障后重新选择
+}
+
+// StickySession 一个粘性会话
+type StickySession struct {
+	Key      string    `json:"key"`
+	IP       string    `json:"ip"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used"`
+	Hits     int64     `json:"hits"`
+}
+
+// stickyEntry 会话表中的会话
+type stickyEntry struct {
+	ip       net.IP
+	created  time.Time
+	lastUsed time.Time
+	hits     int64
+}
+
+// StickySelector 粘性会话选择器包装器
+// 同一会话键（如同一客户端访问同一站点）在会话有效期内使用同一出口IP，出口IP被移除或故障时重新选择
+type StickySelector struct {
+	baseSelector  IPSelector
+	key           []string
+	idleTTL       time.Duration
+	maxLifetime   time.Duration
+	healthChecker *IPHealthChecker
+	ips           map[string]bool         // 当前的出口IP集合
+	sessions      map[string]*stickyEntry // 会话键 -> 会话
+	lastPrune     time.Time
+	mu            sync.Mutex
+	now           func() time.Time
+}
+
+// ValidStickyKey 会话键的组成部分是否有效
+func ValidStickyKey(part string) bool {
+	switch part {
+	case StickyKeyClient, StickyKeyUser, StickyKeyETLD1:
+		return true
+	}
+	return false
+}
+
+// NewStickySelector 创建粘性会话选择器
+func NewStickySelector(baseSelector IPSelector, ips []string, options StickyOptions) (*StickySelector, error) {
+	key := options.Key
+	if len(key) == 0 {
+		key = []string{StickyKeyClient, StickyKeyETLD1}
+	}
+	for _, part := range key {
+		if !ValidStickyKey(part) {
+			return nil, fmt.Errorf("invalid sticky key: %s", part)
+		}
+	}
+
+	ipSet := make(map[string]bool, len(ips))
+	for _, ipStr := range ips {
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			return nil, &InvalidIPError{IP: ipStr}
+		}
+		ipSet[ip.String()] = true
+	}
+
+	idleTTL := options.IdleTTL
+	if idleTTL <= 0 {
+		idleTTL = DefaultStickyIdleTTL
+	}
+	maxLifetime := options.MaxLifetime
+	if maxLifetime <= 0 {
+		maxLifetime = DefaultStickyMaxLifetime
+	}
+
+	return &StickySelector{
+		baseSelector:  baseSelector,
+		key:           key,
+		idleTTL:       idleTTL,
+		maxLifetime:   maxLifetime,
+		healthChecker: options.HealthChecker,
+		ips:           ipSet,
+		sessions:      make(map[string]*stickyEntry),
+		now:           time.Now,
+	}, nil
+}
+
+// SelectIP 选择IP（没有客户端信息时只按目标保持会话）
+func (s *StickySelector) SelectIP(targetAddr string, targetPort int) (net.IP, error) {
+	return s.SelectIPForClient(ClientInfo{}, targetAddr, targetPort, FamilyAny)
+}
+
+// SelectIPForFamily 选择family的IP
+func (s *StickySelector) SelectIPForFamily(targetAddr string, targetPort int, family IPFamily) (net.IP, error) {
+	return s.SelectIPForClient(ClientInfo{}, targetAddr, targetPort, family)
+}
+
+// SelectIPForClient 会话有效且出口IP未达到容量上限时返回会话的出口IP，否则由基础选择器选择并创建会话
+func (s *StickySelector) SelectIPForClient(client ClientInfo, targetAddr string, targetPort int, family IPFamily) (net.IP, error) {
+	key, ok := s.sessionKey(client, targetAddr, family)
+	if !ok {
+		// 会话键的组成部分都为空（如按用户保持但连接没有用户），不保持会话
+		return SelectIPForClient(s.baseSelector, client, targetAddr, targetPort, family)
+	}
+
+	reserver := ReserverOf(s.baseSelector)
+	s.mu.Lock()
+	now := s.now()
+	if entry := s.sessions[key]; entry != nil {
+		if s.valid(entry, now) && reserver.Reserve(entry.ip) {
+			entry.lastUsed = now
+			entry.hits++
+			ip := entry.ip
+			s.mu.Unlock()
+			return ip, nil
+		}
+		// 会话过期、出口IP失效或达到容量上限：重新选择
+		delete(s.sessions, key)
+	}
+	s.mu.Unlock()
+
+	ip, err := SelectIPForClient(s.baseSelector, client, targetAddr, targetPort, family)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// 并发的首次选择以先创建的会话为准（会话的出口IP达到容量上限时使用本次选择）
+	if entry := s.sessions[key]; entry != nil && s.valid(entry, now) {
+		if entry.ip.Equal(ip) || reserver.Reserve(entry.ip) {
+			if !entry.ip.Equal(ip) {
+				reserver.Unreserve(ip)
+			}
+			entry.lastUsed = now
+			entry.hits++
+			return entry.ip, nil
+		}
+	}
+	s.sessions[key] = &stickyEntry{ip: ip, created: now, lastUsed: now, hits: 1}
+	s.pruneLocked(now)
+	return ip, nil
+}
+
+// sessionKey 连接的会话键，组成部分都为空时返回false
+func (s *StickySelector) sessionKey(client ClientInfo, targetAddr string, family IPFamily) (string, bool) {
+	parts := make([]string, 0, len(s.key)+1)
+	nonEmpty := false
+	for _, part := range s.key {
+		var value string
+		switch part {
+		case StickyKeyClient:
+			if client.Addr != nil {
+				value = client.Addr.String()
+			}
+		case StickyKeyUser:
+			value = client.User
+		case StickyKeyETLD1:
+			value = registrableDomain(targetAddr)
+		}
+		if value != "" {
+			nonEmpty = true
+		}
+		parts = append(parts, part+"="+value)
+	}
+	// 不同地址族的出口IP分别保持
+	if family != FamilyAny {
+		parts = append(parts, "family="+family.String())
+	}
+	return strings.Join(parts, ","), nonEmpty
+}
+
+// valid 会话是否仍然有效：未过期、出口IP仍在集合中且未故障（调用方持有s.mu）
+func (s *StickySelector) valid(entry *stickyEntry, now time.Time) bool {
+	if now.Sub(entry.lastUsed) > s.idleTTL || now.Sub(entry.created) > s.maxLifetime {
+		return false
+	}
+	if !s.ips[entry.ip.String()] {
+		return false
+	}
+	return s.healthChecker == nil || !s.healthChecker.IsFailed(entry.ip)
+}
+
+// pruneLocked 定期删除过期的会话（调用方持有s.mu）
+func (s *StickySelector) pruneLocked(now time.Time) {
+	if now.Sub(s.lastPrune) < time.Minute {
+		return
+	}
+	s.lastPrune = now
+	for key, entry := range s.sessions {
+		if now.Sub(entry.lastUsed) > s.idleTTL || now.Sub(entry.created) > s.maxLifetime {
+			delete(s.sessions, key)
+		}
+	}
+}
+
+// Sessions 当前有效的会话（按会话键排序）
+func (s *StickySelector) Sessions() []StickySession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	sessions := make([]StickySession, 0, len(s.sessions))
+	for key, entry := range s.sessions {
+		if !s.valid(entry, now) {
+			continue
+		}
+		sessions = append(sessions, StickySession{
+			Key:      key,
+			IP:       entry.ip.String(),
+			Created:  entry.created,
+			LastUsed: entry.lastUsed,
+			Hits:     entry.hits,
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Key < sessions[j].Key })
+	return sessions
+}
+
+// Evict 删除会话键为key的会话，返回是否存在
+func (s *StickySelector) Evict(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.sessions[key]
+	delete(s.sessions, key)
+	return ok
+}
+
+// EvictIP 删除使用出口IP ip的所有会话，返回删除的数量
+func (s *StickySelector) EvictIP(ip net.IP) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	evicted := 0
+	for key, entry := range s.sessions {
+		if entry.ip.Equal(ip) {
+			delete(s.sessions, key)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// Clear 删除所有会话，返回删除的数量
+func (s *StickySelector) Clear() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	evicted := len(s.sessions)
+	s.sessions = make(map[string]*stickyEntry)
+	return evicted
+}
+
+// ImportSessions 导入from中仍然有效的会话（配置热重载重建选择器链时保持会话）
+func (s *StickySelector) ImportSessions(from *StickySelector) {
+	from.mu.Lock()
+	entries := make(map[string]stickyEntry, len(from.sessions))
+	for key, entry := range from.sessions {
+		entries[key] = *entry
+	}
+	from.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	for key, entry := range entries {
+		entry := entry
+		if s.valid(&entry, now) {
+			s.sessions[key] = &entry
+		}
+	}
+}
+
+// SetIPs 替换出口IP集合：使用已移除IP的会话失效
+func (s *StickySelector) SetIPs(ips []net.IP) {
+	ipSet := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		ipSet[ip.String()] = true
+	}
+
+	s.mu.Lock()
+	s.ips = ipSet
+	for key, entry := range s.sessions {
+		if !ipSet[entry.ip.String()] {
+			delete(s.sessions, key)
+		}
+	}
+	s.mu.Unlock()
+
+	if dynamic, ok := s.baseSelector.(DynamicIPSelector); ok {
+		dynamic.SetIPs(ips)
+	}
+}
+
+// Reserve 转发给基础选择器
+func (s *StickySelector) Reserve(ip net.IP) bool {
+	return ReserverOf(s.baseSelector).Reserve(ip)
+}
+
+// Unreserve 转发给基础选择器
+func (s *StickySelector) Unreserve(ip net.IP) {
+	ReserverOf(s.baseSelector).Unreserve(ip)
+}
+
+// OnConnectionStart 转发给基础选择器
+func (s *StickySelector) OnConnectionStart(ip net.IP) {
+	FeedbackOf(s.baseSelector).OnConnectionStart(ip)
+}
+
+// OnConnectionEnd 转发给基础选择器
+func (s *StickySelector) OnConnectionEnd(ip net.IP) {
+	FeedbackOf(s.baseSelector).OnConnectionEnd(ip)
+}
+
+// OnBytesTransferred 转发给基础选择器
+func (s *StickySelector) OnBytesTransferred(ip net.IP, bytes int64) {
+	FeedbackOf(s.baseSelector).OnBytesTransferred(ip, bytes)
+}
+
+// OnDialResult 转发给基础选择器
+func (s *StickySelector) OnDialResult(ip net.IP, latency time.Duration, err error) {
+	FeedbackOf(s.baseSelector).OnDialResult(ip, latency, err)
+}
@@ -0,0 +1,160 @@
+package snat
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestStickySelector 创建使用可控时钟的粘性会话选择器
+func newTestStickySelector(t *testing.T, ips []string, options StickyOptions) (*StickySelector, *time.Time) {
+	base, err := NewRoundRobinSelector(ips)
+	if err != nil {
+		t.Fatalf("Failed to create base selector: %v", err)
+	}
+	selector, err := NewStickySelector(base, ips, options)
+	if err != nil {
+		t.Fatalf("Failed to create sticky selector: %v", err)
+	}
+	now := time.Unix(1700000000, 0)
+	selector.now = func() time.Time { return now }
+	return selector, &now
+}
+
+func TestStickySelector_KeepsExitIP(t *testing.T) {
+	selector, _ := newTestStickySelector(t, []string{"192.168.1.1", "192.168.1.2"}, StickyOptions{})
+	client := ClientInfo{Addr: net.ParseIP("10.0.0.1")}
+
+	// 同一客户端访问同一站点（包括子域名）使用同一出口IP，轮询的基础选择器不再生效
+	first, _ := selector.SelectIPForClient(client, "www.example.com", 443, FamilyAny)
+	for _, host := range []string{"www.example.com", "api.example.com", "example.com"} {
+		if ip, _ := selector.SelectIPForClient(client, host, 443, FamilyAny); !ip.Equal(first) {
+			t.Errorf("%s: expected sticky IP %s, got %s", host, first, ip)
+		}
+	}
+
+	// 其他客户端单独保持会话
+	other, _ := selector.SelectIPForClient(ClientInfo{Addr: net.ParseIP("10.0.0.2")}, "www.example.com", 443, FamilyAny)
+	if other.Equal(first) {
+		t.Errorf("Expected a different client to get the next round robin IP")
+	}
+
+	sessions := selector.Sessions()
+	if len(sessions) != 2 || sessions[0].Hits != 4 {
+		t.Errorf("Unexpected sessions: %+v", sessions)
+	}
+}
+
+func TestStickySelector_Expiry(t *testing.T) {
+	selector, now := newTestStickySelector(t, []string{"192.168.1.1", "192.168.1.2"}, StickyOptions{
+		Key:         []string{StickyKeyUser},
+		IdleTTL:     time.Minute,
+		MaxLifetime: 5 * time.Minute,
+	})
+	client := ClientInfo{User: "alice"}
+
+	first, _ := selector.SelectIPForClient(client, "example.com", 443, FamilyAny)
+
+	// 空闲超时之前持续使用，直到达到最长存活时间
+	for i := 0; i < 4; i++ {
+		*now = now.Add(50 * time.Second)
+		if ip, _ := selector.SelectIPForClient(client, "example.com", 443, FamilyAny); !ip.Equal(first) {
+			t.Fatalf("Session expired early at step %d", i)
+		}
+	}
+	*now = now.Add(2 * time.Minute)
+	if ip, _ := selector.SelectIPForClient(client, "example.com", 443, FamilyAny); ip.Equal(first) {
+		t.Error("Expected a new session after idle TTL")
+	}
+
+	// 没有用户时不保持会话
+	if _, ok := selector.sessionKey(ClientInfo{}, "example.com", FamilyAny); ok {
+		t.Error("Expected no session key without user")
+	}
+}
+
+func TestStickySelector_RemovedAndFailedIPs(t *testing.T) {
+	ips := []string{"192.168.1.1", "192.168.1.2"}
+	ipList := []net.IP{net.ParseIP(ips[0]), net.ParseIP(ips[1])}
+	healthChecker := NewIPHealthChecker(ipList, 30*time.Second, 5*time.Second)
+	selector, _ := newTestStickySelector(t, ips, StickyOptions{HealthChecker: healthChecker})
+	client := ClientInfo{Addr: net.ParseIP("10.0.0.1")}
+
+	first, _ := selector.SelectIPForClient(client, "example.com", 443, FamilyAny)
+
+	// 出口IP故障后重新选择
+	for i := 0; i < 3; i++ {
+		healthChecker.updateHealth(HealthCheckResult{IP: first, Healthy: false})
+	}
+	second, _ := selector.SelectIPForClient(client, "example.com", 443, FamilyAny)
+	if second.Equal(first) {
+		t.Fatalf("Expected a new exit IP after %s failed", first)
+	}
+
+	// 出口IP移除后重新选择
+	selector.SetIPs([]net.IP{first})
+	if len(selector.Sessions()) != 0 {
+		t.Error("Expected sessions using removed IP to be dropped")
+	}
+	if ip, _ := selector.SelectIPForClient(client, "example.com", 443, FamilyAny); !ip.Equal(first) {
+		t.Errorf("Expected remaining IP %s, got %s", first, ip)
+	}
+}
+
+func TestStickySelector_Evict(t *testing.T) {
+	selector, _ := newTestStickySelector(t, []string{"192.168.1.1", "192.168.1.2"}, StickyOptions{})
+	for _, addr := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		selector.SelectIPForClient(ClientInfo{Addr: net.ParseIP(addr)}, "example.com", 443, FamilyAny)
+	}
+
+	sessions := selector.Sessions()
+	if !selector.Evict(sessions[0].Key) || selector.Evict(sessions[0].Key) {
+		t.Error("Expected Evict to remove the session exactly once")
+	}
+	if evicted := selector.EvictIP(net.ParseIP(sessions[1].IP)); evicted != 1 {
+		t.Errorf("Expected 1 session evicted by IP, got %d", evicted)
+	}
+	if evicted := selector.Clear(); evicted != 1 {
+		t.Errorf("Expected 1 remaining session, got %d", evicted)
+	}
+
+	if _, err := NewStickySelector(selector, nil, StickyOptions{Key: []string{"cookie"}}); err == nil {
+		t.Error("Expected error for unknown sticky key")
+	}
+}
+
+func TestStickySelector_Capacity(t *testing.T) {
+	ips := []string{"192.168.1.1", "192.168.1.2"}
+	load := NewLoadTracker()
+	base, err := NewWeightedRoundRobinSelector(ips, CapacityOptions{
+		Limits: map[string]ExitLimit{"192.168.1.1": {MaxConnections: 1}},
+		Load:   load,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create base selector: %v", err)
+	}
+	selector, err := NewStickySelector(base, ips, StickyOptions{Key: []string{StickyKeyUser}})
+	if err != nil {
+		t.Fatalf("Failed to create sticky selector: %v", err)
+	}
+	client := ClientInfo{User: "alice"}
+
+	first, _ := selector.SelectIPForClient(client, "example.com", 443, FamilyAny)
+	if !first.Equal(net.ParseIP("192.168.1.1")) {
+		t.Fatalf("Expected first selection 192.168.1.1, got %s", first)
+	}
+	load.OnConnectionStart(first)
+
+	// 会话的出口IP达到容量上限时重新选择，会话改用新的出口IP
+	second, err := selector.SelectIPForClient(client, "example.com", 443, FamilyAny)
+	if err != nil || !second.Equal(net.ParseIP("192.168.1.2")) {
+		t.Fatalf("Expected re-selection to 192.168.1.2 at capacity, got %v, %v", second, err)
+	}
+	load.OnConnectionStart(second)
+	if sessions := selector.Sessions(); len(sessions) != 1 || sessions[0].IP != "192.168.1.2" {
+		t.Errorf("Expected the session to move to 192.168.1.2, got %+v", sessions)
+	}
+	if active := load.Load(first).ActiveConnections; active != 1 {
+		t.Errorf("Expected 1 active connection on the capped IP, got %d", active)
+	}
+}
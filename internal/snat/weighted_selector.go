@@ -0,0 +1,313 @@
+package snat
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// 按负载选择的负载指标
+const (
+	LoadMetricConnections = "connections" // 并发连接数
+	LoadMetricBandwidth   = "bandwidth"   // 带宽
+)
+
+// ExitLimit 出口IP的容量上限
+type ExitLimit struct {
+	MaxConnections int64 // 最大并发连接数（0表示不限）
+	MaxBandwidth   int64 // 最大带宽（字节/秒，0表示不限）
+}
+
+// CapacityOptions 加权选择器的选项
+type CapacityOptions struct {
+	Weights map[string]float64   // IP -> 权重（未配置的IP权重为1）
+	Limits  map[string]ExitLimit // IP -> 容量上限，达到上限的IP不再分配新连接
+	Load    *LoadTracker         // 出口IP的当前负载（nil时不检查容量上限，负载视为0）
+	Metric  string               // 按负载选择的负载指标（见LoadMetric*，空表示connections）
+}
+
+// capacity 出口IP的权重、容量上限和负载，供加权选择器共用
+type capacity struct {
+	weights map[string]float64
+	limits  map[string]ExitLimit
+	load    *LoadTracker
+}
+
+// newCapacity 校验并解析权重和容量上限
+func newCapacity(options CapacityOptions) (capacity, error) {
+	weights, err := parseWeights(options.Weights)
+	if err != nil {
+		return capacity{}, err
+	}
+	limits := make(map[string]ExitLimit, len(options.Limits))
+	for ipStr, limit := range options.Limits {
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			return capacity{}, &InvalidIPError{IP: ipStr}
+		}
+		if limit.MaxConnections < 0 || limit.MaxBandwidth < 0 {
+			return capacity{}, fmt.Errorf("invalid limit for %s (must be >= 0)", ipStr)
+		}
+		limits[ip.String()] = limit
+	}
+	return capacity{weights: weights, limits: limits, load: options.Load}, nil
+}
+
+// weight IP的权重
+func (c capacity) weight(ip net.IP) float64 {
+	if weight, ok := c.weights[ip.String()]; ok {
+		return weight
+	}
+	return 1
+}
+
+// exitLoad IP的当前负载
+func (c capacity) exitLoad(ip net.IP) ExitLoad {
+	if c.load == nil {
+		return ExitLoad{}
+	}
+	return c.load.Load(ip)
+}
+
+// atCapacity IP是否已达到容量上限
+func (c capacity) atCapacity(ip net.IP, load ExitLoad) bool {
+	limit, ok := c.limits[ip.String()]
+	if !ok {
+		return false
+	}
+	return (limit.MaxConnections > 0 && load.ActiveConnections >= limit.MaxConnections) ||
+		(limit.MaxBandwidth > 0 && load.Bandwidth >= limit.MaxBandwidth)
+}
+
+// reserve IP未达到容量上限时为一个连接预留容量，返回是否成功
+// 并发连接数的检查和计数在负载跟踪器中原子完成，并发的选择不会超过上限
+func (c capacity) reserve(ip net.IP) bool {
+	if c.load == nil {
+		return true
+	}
+	limit := c.limits[ip.String()]
+	if limit.MaxBandwidth > 0 && c.load.Load(ip).Bandwidth >= limit.MaxBandwidth {
+		return false
+	}
+	return c.load.TryReserve(ip, limit.MaxConnections)
+}
+
+// unreserve 释放IP上一个未使用的预留
+func (c capacity) unreserve(ip net.IP) {
+	if c.load != nil {
+		c.load.Unreserve(ip)
+	}
+}
+
+// parseIPList 解析出口IP列表
+func parseIPList(ips []string) ([]net.IP, error) {
+	ipList := make([]net.IP, 0, len(ips))
+	for _, ipStr := range ips {
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			return nil, &InvalidIPError{IP: ipStr}
+		}
+		ipList = append(ipList, ip)
+	}
+	return ipList, nil
+}
+
+// WeightedRoundRobinSelector 平滑加权轮询选择器
+// 每个IP按权重比例分配连接且分布均匀（不会连续选中同一个高权重IP），跳过达到容量上限的IP
+type WeightedRoundRobinSelector struct {
+	ips      []net.IP
+	capacity capacity
+	current  map[string]float64 // IP -> 当前权重
+	mu       sync.Mutex
+}
+
+// NewWeightedRoundRobinSelector 创建平滑加权轮询选择器
+func NewWeightedRoundRobinSelector(ips []string, options CapacityOptions) (*WeightedRoundRobinSelector, error) {
+	ipList, err := parseIPList(ips)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newCapacity(options)
+	if err != nil {
+		return nil, err
+	}
+	return &WeightedRoundRobinSelector{
+		ips:      ipList,
+		capacity: c,
+		current:  make(map[string]float64),
+	}, nil
+}
+
+// SelectIP 选择IP（平滑加权轮询）
+func (w *WeightedRoundRobinSelector) SelectIP(targetAddr string, targetPort int) (net.IP, error) {
+	return w.SelectIPForFamily(targetAddr, targetPort, FamilyAny)
+}
+
+// SelectIPForFamily 在family未达到容量上限的IP中平滑加权轮询并为连接预留容量：
+// 每次选择时各IP的当前权重加上其权重，选中当前权重最大的IP并减去参与选择的IP的总权重
+func (w *WeightedRoundRobinSelector) SelectIPForFamily(targetAddr string, targetPort int, family IPFamily) (net.IP, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	ips := filterFamily(w.ips, family)
+	if len(ips) == 0 {
+		return nil, &NoIPAvailableError{Family: family}
+	}
+
+	full := make(map[string]bool)
+	for {
+		var bestIP net.IP
+		var bestCurrent float64
+		candidates := make([]net.IP, 0, len(ips))
+		for _, ip := range ips {
+			if full[ip.String()] || w.capacity.atCapacity(ip, w.capacity.exitLoad(ip)) {
+				continue
+			}
+			candidates = append(candidates, ip)
+			if current := w.current[ip.String()] + w.capacity.weight(ip); bestIP == nil || current > bestCurrent {
+				bestIP = ip
+				bestCurrent = current
+			}
+		}
+		if bestIP == nil {
+			return nil, &NoIPAvailableError{Family: family, AtCapacity: true}
+		}
+		// 检查之后其他连接占满了容量（如配置热重载期间新旧选择器并发选择），排除后重新选择
+		if !w.capacity.reserve(bestIP) {
+			full[bestIP.String()] = true
+			continue
+		}
+
+		var total float64
+		for _, ip := range candidates {
+			weight := w.capacity.weight(ip)
+			w.current[ip.String()] += weight
+			total += weight
+		}
+		w.current[bestIP.String()] -= total
+		return bestIP, nil
+	}
+}
+
+// Reserve IP未达到容量上限时为一个连接预留容量
+func (w *WeightedRoundRobinSelector) Reserve(ip net.IP) bool {
+	return w.capacity.reserve(ip)
+}
+
+// Unreserve 释放IP上一个未使用的预留
+func (w *WeightedRoundRobinSelector) Unreserve(ip net.IP) {
+	w.capacity.unreserve(ip)
+}
+
+// SetIPs 替换出口IP集合（保留仍在集合中的IP的当前权重）
+func (w *WeightedRoundRobinSelector) SetIPs(ips []net.IP) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	current := make(map[string]float64, len(ips))
+	for _, ip := range ips {
+		current[ip.String()] = w.current[ip.String()]
+	}
+	w.ips = copyIPs(ips)
+	w.current = current
+}
+
+// LeastLoadSelector 按权重的最小负载选择器
+// 选择负载与权重之比最小的IP（权重大的IP承担更多负载），跳过达到容量上限的IP
+type LeastLoadSelector struct {
+	ips      []net.IP
+	capacity capacity
+	metric   string
+	next     int // 负载相同时从该位置开始比较，避免总是选中第一个IP
+	mu       sync.Mutex
+}
+
+// NewLeastLoadSelector 创建按权重的最小负载选择器
+func NewLeastLoadSelector(ips []string, options CapacityOptions) (*LeastLoadSelector, error) {
+	ipList, err := parseIPList(ips)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newCapacity(options)
+	if err != nil {
+		return nil, err
+	}
+	metric := options.Metric
+	switch metric {
+	case "":
+		metric = LoadMetricConnections
+	case LoadMetricConnections, LoadMetricBandwidth:
+	default:
+		return nil, fmt.Errorf("invalid load metric: %s", metric)
+	}
+	return &LeastLoadSelector{
+		ips:      ipList,
+		capacity: c,
+		metric:   metric,
+	}, nil
+}
+
+// SelectIP 选择IP（负载与权重之比最小）
+func (l *LeastLoadSelector) SelectIP(targetAddr string, targetPort int) (net.IP, error) {
+	return l.SelectIPForFamily(targetAddr, targetPort, FamilyAny)
+}
+
+// SelectIPForFamily 在family未达到容量上限的IP中选择负载与权重之比最小的IP并为连接预留容量
+func (l *LeastLoadSelector) SelectIPForFamily(targetAddr string, targetPort int, family IPFamily) (net.IP, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ips := filterFamily(l.ips, family)
+	if len(ips) == 0 {
+		return nil, &NoIPAvailableError{Family: family}
+	}
+
+	full := make(map[string]bool)
+	start := l.next % len(ips)
+	for {
+		var bestIP net.IP
+		var bestScore float64
+		for i := range ips {
+			ip := ips[(start+i)%len(ips)]
+			load := l.capacity.exitLoad(ip)
+			if full[ip.String()] || l.capacity.atCapacity(ip, load) {
+				continue
+			}
+			value := load.ActiveConnections
+			if l.metric == LoadMetricBandwidth {
+				value = load.Bandwidth
+			}
+			if score := float64(value) / l.capacity.weight(ip); bestIP == nil || score < bestScore {
+				bestIP = ip
+				bestScore = score
+			}
+		}
+		if bestIP == nil {
+			return nil, &NoIPAvailableError{Family: family, AtCapacity: true}
+		}
+		// 检查之后其他连接占满了容量，排除后重新选择
+		if !l.capacity.reserve(bestIP) {
+			full[bestIP.String()] = true
+			continue
+		}
+		l.next = start + 1
+		return bestIP, nil
+	}
+}
+
+// Reserve IP未达到容量上限时为一个连接预留容量
+func (l *LeastLoadSelector) Reserve(ip net.IP) bool {
+	return l.capacity.reserve(ip)
+}
+
+// Unreserve 释放IP上一个未使用的预留
+func (l *LeastLoadSelector) Unreserve(ip net.IP) {
+	l.capacity.unreserve(ip)
+}
+
+// SetIPs 替换出口IP集合
+func (l *LeastLoadSelector) SetIPs(ips []net.IP) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ips = copyIPs(ips)
+}
@@ -0,0 +1,184 @@
+package snat
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWeightedRoundRobinSelector_Smooth(t *testing.T) {
+	selector, err := NewWeightedRoundRobinSelector([]string{"192.168.1.1", "192.168.1.2", "192.168.1.3"}, CapacityOptions{
+		Weights: map[string]float64{"192.168.1.1": 5, "192.168.1.2": 1, "192.168.1.3": 1},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create selector: %v", err)
+	}
+
+	// 平滑加权轮询：每7次选择中按5:1:1分配，且高权重IP不会连续占满
+	var sequence []string
+	for i := 0; i < 7; i++ {
+		ip, err := selector.SelectIP("example.com", 443)
+		if err != nil {
+			t.Fatalf("SelectIP failed: %v", err)
+		}
+		sequence = append(sequence, ip.String())
+	}
+	expected := "192.168.1.1,192.168.1.1,192.168.1.2,192.168.1.1,192.168.1.3,192.168.1.1,192.168.1.1"
+	if got := strings.Join(sequence, ","); got != expected {
+		t.Errorf("Unexpected sequence:\n got %s\nwant %s", got, expected)
+	}
+}
+
+func TestWeightedRoundRobinSelector_Limits(t *testing.T) {
+	load := NewLoadTracker()
+	selector, err := NewWeightedRoundRobinSelector([]string{"192.168.1.1", "192.168.1.2"}, CapacityOptions{
+		Weights: map[string]float64{"192.168.1.1": 10},
+		Limits: map[string]ExitLimit{
+			"192.168.1.1": {MaxConnections: 2},
+			"192.168.1.2": {MaxConnections: 1},
+		},
+		Load: load,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create selector: %v", err)
+	}
+
+	// 模拟代理在选择后建立连接：高权重的IP达到上限后分配给其他IP，全部达到上限时拒绝
+	counts := make(map[string]int)
+	for i := 0; i < 3; i++ {
+		ip, err := selector.SelectIP("example.com", 443)
+		if err != nil {
+			t.Fatalf("SelectIP %d failed: %v", i, err)
+		}
+		load.OnConnectionStart(ip)
+		counts[ip.String()]++
+	}
+	if counts["192.168.1.1"] != 2 || counts["192.168.1.2"] != 1 {
+		t.Errorf("Unexpected distribution: %v", counts)
+	}
+
+	_, err = selector.SelectIP("example.com", 443)
+	if !IsNoIPAvailable(err) || !strings.Contains(err.Error(), "at capacity") {
+		t.Errorf("Expected at capacity error, got %v", err)
+	}
+
+	// 连接结束后恢复分配
+	load.OnConnectionEnd(net.ParseIP("192.168.1.2"))
+	if ip, err := selector.SelectIP("example.com", 443); err != nil || !ip.Equal(net.ParseIP("192.168.1.2")) {
+		t.Errorf("Expected 192.168.1.2 after its connection ended, got %v, %v", ip, err)
+	}
+}
+
+func TestLeastLoadSelector_ConcurrentReservations(t *testing.T) {
+	load := NewLoadTracker()
+	selector, err := NewLeastLoadSelector([]string{"192.168.1.1", "192.168.1.2"}, CapacityOptions{
+		Limits: map[string]ExitLimit{
+			"192.168.1.1": {MaxConnections: 3},
+			"192.168.1.2": {MaxConnections: 2},
+		},
+		Load: load,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create selector: %v", err)
+	}
+
+	// 并发选择（连接尚未开始）不超过容量上限
+	var selected int64
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := selector.SelectIP("example.com", 443); err == nil {
+				atomic.AddInt64(&selected, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if selected != 5 {
+		t.Errorf("Expected 5 selections within capacity, got %d", selected)
+	}
+
+	// 连接开始时使用预留，不重复计数；未使用的预留释放后恢复分配
+	ip := net.ParseIP("192.168.1.2")
+	load.OnConnectionStart(ip)
+	if active := load.Load(ip).ActiveConnections; active != 2 {
+		t.Errorf("Expected 2 active connections after using a reservation, got %d", active)
+	}
+	selector.Unreserve(ip)
+	if got, err := selector.SelectIP("example.com", 443); err != nil || !got.Equal(ip) {
+		t.Errorf("Expected %s after releasing a reservation, got %v, %v", ip, got, err)
+	}
+}
+
+func TestLeastLoadSelector_PerWeight(t *testing.T) {
+	load := NewLoadTracker()
+	selector, err := NewLeastLoadSelector([]string{"192.168.1.1", "192.168.1.2"}, CapacityOptions{
+		Weights: map[string]float64{"192.168.1.1": 3},
+		Load:    load,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create selector: %v", err)
+	}
+
+	// 按连接数与权重之比分配：权重3的IP承担3倍的连接
+	counts := make(map[string]int)
+	for i := 0; i < 40; i++ {
+		ip, err := selector.SelectIP("example.com", 443)
+		if err != nil {
+			t.Fatalf("SelectIP failed: %v", err)
+		}
+		load.OnConnectionStart(ip)
+		counts[ip.String()]++
+	}
+	if counts["192.168.1.1"] != 30 || counts["192.168.1.2"] != 10 {
+		t.Errorf("Expected 30/10 distribution, got %v", counts)
+	}
+
+	if _, err := NewLeastLoadSelector([]string{"192.168.1.1"}, CapacityOptions{Metric: "traffic"}); err == nil {
+		t.Error("Expected error for invalid metric")
+	}
+}
+
+func TestLeastLoadSelector_Bandwidth(t *testing.T) {
+	load := NewLoadTracker()
+	now := time.Unix(1700000000, 0)
+	load.now = func() time.Time { return now }
+
+	selector, err := NewLeastLoadSelector([]string{"192.168.1.1", "192.168.1.2"}, CapacityOptions{
+		Weights: map[string]float64{"192.168.1.1": 10},
+		Limits:  map[string]ExitLimit{"192.168.1.1": {MaxBandwidth: 1000000}},
+		Load:    load,
+		Metric:  LoadMetricBandwidth,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create selector: %v", err)
+	}
+
+	fast, slow := net.ParseIP("192.168.1.1"), net.ParseIP("192.168.1.2")
+	load.OnBytesTransferred(fast, 500000)
+	load.OnBytesTransferred(slow, 100000)
+	// 按权重的带宽：500000/10 < 100000/1
+	if ip, _ := selector.SelectIP("example.com", 443); !ip.Equal(fast) {
+		t.Errorf("Expected %s, got %s", fast, ip)
+	}
+
+	// 当前窗口的流量达到上限后跳过
+	load.OnBytesTransferred(fast, 600000)
+	if ip, _ := selector.SelectIP("example.com", 443); !ip.Equal(slow) {
+		t.Errorf("Expected %s at capacity to be skipped, got %s", fast, ip)
+	}
+
+	// 统计窗口结束后按平均带宽计算，长时间没有流量时带宽归零
+	now = now.Add(2 * time.Second)
+	if bandwidth := load.Load(fast).Bandwidth; bandwidth != 550000 {
+		t.Errorf("Expected bandwidth 550000, got %d", bandwidth)
+	}
+	now = now.Add(time.Minute)
+	if bandwidth := load.Load(fast).Bandwidth; bandwidth != 0 {
+		t.Errorf("Expected bandwidth 0 after idle, got %d", bandwidth)
+	}
+}
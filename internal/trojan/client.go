@@ -32,6 +32,11 @@ func NewClient(config *ClientConfig) *Client {
 
 // Dial 连接到Trojan服务器并建立到目标的连接
 func (c *Client) Dial(targetAddr string) (net.Conn, error) {
+	return c.dialCommand(CmdConnect, targetAddr)
+}
+
+// dialCommand 连接到Trojan服务器并发送指定命令的请求
+func (c *Client) dialCommand(cmd byte, targetAddr string) (net.Conn, error) {
 	// 建立TLS连接到Trojan服务器
 	conn, err := tls.Dial("tcp", c.serverAddr, c.tlsConfig)
 	if err != nil {
@@ -46,7 +51,7 @@ func (c *Client) Dial(targetAddr string) (net.Conn, error) {
 	}
 
 	// 构建并发送连接请求
-	req, err := ParseTargetAddr(targetAddr, CmdConnect)
+	req, err := ParseTargetAddr(targetAddr, cmd)
 	if err != nil {
 		conn.Close()
 		return nil, fmt.Errorf("failed to parse target addr: %w", err)
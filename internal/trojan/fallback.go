@@ -0,0 +1,84 @@
+package trojan
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fallbackDialTimeout 连接回落后端的超时时间
+const fallbackDialTimeout = 10 * time.Second
+
+// hasFallback 是否配置了回落后端
+func (s *Server) hasFallback() bool {
+	return s.fallback != "" || len(s.fallbackALPN) > 0
+}
+
+// readHeader 读取Trojan协议头，返回已读取的字节数
+// 配置了回落后端时与trojan-gfw一致：首个数据块不足协议头长度即视为非Trojan流量，不再等待后续数据
+func (s *Server) readHeader(conn net.Conn, header []byte) (int, error) {
+	if !s.hasFallback() {
+		return io.ReadFull(conn, header)
+	}
+	n, err := conn.Read(header)
+	if err == nil && n < len(header) {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// fallbackAddr 根据TLS协商的ALPN选择回落地址，未匹配时使用默认地址
+func (s *Server) fallbackAddr(conn net.Conn) string {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		proto := tlsConn.ConnectionState().NegotiatedProtocol
+		if addr, ok := s.fallbackALPN[proto]; ok && proto != "" {
+			return addr
+		}
+	}
+	return s.fallback
+}
+
+// handleFallback 将认证失败的连接转发到回落后端：重放已读取的数据后双向透明转发
+// 未配置回落地址时返回HTTP 400响应
+func (s *Server) handleFallback(conn net.Conn, buffered []byte) error {
+	addr := s.fallbackAddr(conn)
+	if addr == "" {
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		return ErrInvalidPassword
+	}
+
+	// 回落连接按普通网站转发，不受协议头读取超时限制
+	conn.SetReadDeadline(time.Time{})
+
+	backend, err := net.DialTimeout("tcp", addr, fallbackDialTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to dial fallback %s: %w", addr, err)
+	}
+	defer backend.Close()
+
+	if _, err := backend.Write(buffered); err != nil {
+		return fmt.Errorf("failed to replay data to fallback: %w", err)
+	}
+	logrus.Debugf("Forwarding non-trojan connection from %s to fallback %s", conn.RemoteAddr(), addr)
+
+	errCh := make(chan error, 2)
+
+	go func() {
+		_, err := io.Copy(backend, conn)
+		errCh <- err
+	}()
+
+	go func() {
+		_, err := io.Copy(conn, backend)
+		errCh <- err
+	}()
+
+	if err := <-errCh; err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package trojan
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startFallbackBackend 启动回显收到的第一段数据的后端
+func startFallbackBackend(t *testing.T, name string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 512)
+				n, _ := conn.Read(buf)
+				conn.Write([]byte(name + ":" + string(buf[:n])))
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// newTestTLSConfig 生成自签名证书的TLS配置
+func newTestTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %v", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+}
+
+func TestServer_Fallback(t *testing.T) {
+	s := newUDPTestServer(t)
+	s.fallback = startFallbackBackend(t, "default")
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go s.handleConn(serverConn)
+
+	// 短于协议头的HTTP请求立即回落，不等待更多数据
+	probe := "GET / HTTP/1.1\r\nHost: a\r\n\r\n"
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := clientConn.Write([]byte(probe)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	reply, err := io.ReadAll(clientConn)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if string(reply) != "default:"+probe {
+		t.Errorf("Unexpected fallback reply %q", reply)
+	}
+}
+
+func TestServer_FallbackALPN(t *testing.T) {
+	s := newUDPTestServer(t)
+	s.fallback = startFallbackBackend(t, "default")
+	s.fallbackALPN = map[string]string{"h2": startFallbackBackend(t, "h2")}
+	serverConfig := newTestTLSConfig(t)
+
+	for _, proto := range []string{"h2", "http/1.1"} {
+		clientConn, serverConn := net.Pipe()
+		go s.handleConn(tls.Server(serverConn, serverConfig))
+
+		conn := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{proto}})
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		probe := strings.Repeat("x", HeaderSize)
+		if _, err := conn.Write([]byte(probe)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		reply, _ := io.ReadAll(conn)
+		want := "default:" + probe
+		if proto == "h2" {
+			want = "h2:" + probe
+		}
+		if string(reply) != want {
+			t.Errorf("ALPN %s: got fallback reply %q, want %q", proto, reply, want)
+		}
+		conn.Close()
+	}
+}
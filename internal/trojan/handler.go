@@ -0,0 +1,106 @@
+package trojan
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"multiexit-proxy/internal/snat"
+)
+
+// Handler 处理已认证的Trojan请求
+// 未配置时使用directHandler；proxy.Server提供的实现复用原生协议的出口选择、拨号、统计和转发流程
+type Handler interface {
+	// HandleConnect 连接目标地址并在conn与目标之间双向转发，直到任一方向结束
+	HandleConnect(conn net.Conn, targetAddr string) error
+	// HandleUDP 处理UDP关联，直到连接关闭或空闲超时
+	HandleUDP(conn *PacketConn) error
+}
+
+// directHandler 默认处理器：通过IP选择器选择出口IP后直接连接目标
+type directHandler struct {
+	ipSelector snat.IPSelector
+	routingMgr *snat.RoutingManager
+	udpTimeout time.Duration // UDP关联空闲超时
+}
+
+// HandleConnect 选择出口IP并连接目标，双向转发数据
+func (h *directHandler) HandleConnect(conn net.Conn, targetAddr string) error {
+	// 选择出口IP
+	host, portStr, _ := net.SplitHostPort(targetAddr)
+	var port int
+	fmt.Sscanf(portStr, "%d", &port)
+
+	exitIP, err := h.ipSelector.SelectIP(host, port)
+	if err != nil {
+		return fmt.Errorf("failed to select IP: %w", err)
+	}
+	feedback := snat.FeedbackOf(h.ipSelector)
+
+	// 建立到目标的连接
+	dialStart := time.Now()
+	targetConn, err := h.dial(exitIP, targetAddr)
+	feedback.OnDialResult(exitIP, time.Since(dialStart), err)
+	if err != nil {
+		return err
+	}
+	defer targetConn.Close()
+	feedback.OnConnectionStart(exitIP)
+	defer feedback.OnConnectionEnd(exitIP)
+
+	// 双向转发数据（Trojan协议没有响应头，直接转发），两个方向的流量都反馈给选择器
+	errCh := make(chan error, 2)
+
+	go func() {
+		_, err := io.Copy(&feedbackWriter{w: targetConn, exitIP: exitIP, feedback: feedback}, conn)
+		errCh <- err
+	}()
+
+	go func() {
+		_, err := io.Copy(&feedbackWriter{w: conn, exitIP: exitIP, feedback: feedback}, targetConn)
+		errCh <- err
+	}()
+
+	// 等待任一方向结束
+	err = <-errCh
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	return nil
+}
+
+// dial 经出口IP连接目标
+func (h *directHandler) dial(exitIP net.IP, targetAddr string) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	if h.routingMgr != nil {
+		// 使用SNAT：在connect之前标记套接字，使握手报文也经出口IP的策略路由
+		markControl, err := h.routingMgr.MarkControl(exitIP)
+		if err != nil {
+			return nil, fmt.Errorf("failed to mark connection: %w", err)
+		}
+		dialer.Control = markControl
+	}
+	// 不使用SNAT时直接连接
+	targetConn, err := dialer.Dial("tcp", targetAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial target: %w", err)
+	}
+	return targetConn, nil
+}
+
+// feedbackWriter 将写入的字节数反馈给选择出口IP的选择器
+type feedbackWriter struct {
+	w        io.Writer
+	exitIP   net.IP
+	feedback snat.SelectorFeedback
+}
+
+func (f *feedbackWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if n > 0 {
+		f.feedback.OnBytesTransferred(f.exitIP, int64(n))
+	}
+	return n, err
+}
@@ -82,19 +82,37 @@ func ParseRequest(reader io.Reader) (*Request, error) {
 		// TCP连接
 		return parseTCPRequest(reader, req)
 	case CmdUDP:
-		// UDP代理（暂不支持）
-		return nil, errors.New("UDP not supported yet")
+		// UDP关联（地址通常为占位，之后的数据为UDP数据包，见ReadUDPPacket）
+		return parseTCPRequest(reader, req)
 	default:
 		return nil, errors.New("unknown command")
 	}
 }
 
-// parseTCPRequest 解析TCP请求
+// parseTCPRequest 解析请求的地址、端口和CRLF（CONNECT和UDP关联格式相同）
 func parseTCPRequest(reader io.Reader, req *Request) (*Request, error) {
+	if err := readAddr(reader, req); err != nil {
+		return nil, err
+	}
+
+	// 读取CRLF（Trojan协议要求）
+	crlf := make([]byte, 2)
+	if _, err := io.ReadFull(reader, crlf); err != nil {
+		return nil, err
+	}
+	if crlf[0] != '\r' || crlf[1] != '\n' {
+		return nil, errors.New("invalid CRLF")
+	}
+
+	return req, nil
+}
+
+// readAddr 读取地址类型、地址和端口
+func readAddr(reader io.Reader, req *Request) error {
 	// 读取地址类型
 	var addrType byte
 	if err := binary.Read(reader, binary.BigEndian, &addrType); err != nil {
-		return nil, err
+		return err
 	}
 
 	req.AddrType = addrType
@@ -103,18 +121,18 @@ func parseTCPRequest(reader io.Reader, req *Request) (*Request, error) {
 	case 1: // IPv4
 		ip := make([]byte, 4)
 		if _, err := io.ReadFull(reader, ip); err != nil {
-			return nil, err
+			return err
 		}
 		req.Address = net.IP(ip)
 
 	case 3: // Domain
 		var domainLen byte
 		if err := binary.Read(reader, binary.BigEndian, &domainLen); err != nil {
-			return nil, err
+			return err
 		}
 		domain := make([]byte, domainLen)
 		if _, err := io.ReadFull(reader, domain); err != nil {
-			return nil, err
+			return err
 		}
 		req.Domain = string(domain)
 		// 解析域名获取IP（或保持域名）
@@ -125,29 +143,16 @@ func parseTCPRequest(reader io.Reader, req *Request) (*Request, error) {
 	case 4: // IPv6
 		ip := make([]byte, 16)
 		if _, err := io.ReadFull(reader, ip); err != nil {
-			return nil, err
+			return err
 		}
 		req.Address = net.IP(ip)
 
 	default:
-		return nil, errors.New("invalid address type")
+		return errors.New("invalid address type")
 	}
 
 	// 读取端口
-	if err := binary.Read(reader, binary.BigEndian, &req.Port); err != nil {
-		return nil, err
-	}
-
-	// 读取CRLF（Trojan协议要求）
-	crlf := make([]byte, 2)
-	if _, err := io.ReadFull(reader, crlf); err != nil {
-		return nil, err
-	}
-	if crlf[0] != '\r' || crlf[1] != '\n' {
-		return nil, errors.New("invalid CRLF")
-	}
-
-	return req, nil
+	return binary.Read(reader, binary.BigEndian, &req.Port)
 }
 
 // BuildRequest 构建Trojan请求
@@ -157,6 +162,17 @@ func BuildRequest(req *Request) []byte {
 	// 命令
 	buf = append(buf, req.Command)
 
+	// 地址和端口
+	buf = appendAddr(buf, req)
+
+	// CRLF
+	buf = append(buf, '\r', '\n')
+
+	return buf
+}
+
+// appendAddr 追加地址类型、地址和端口
+func appendAddr(buf []byte, req *Request) []byte {
 	// 地址类型和地址
 	switch req.AddrType {
 	case 1: // IPv4
@@ -176,12 +192,7 @@ func BuildRequest(req *Request) []byte {
 	// 端口
 	portBuf := make([]byte, 2)
 	binary.BigEndian.PutUint16(portBuf, req.Port)
-	buf = append(buf, portBuf...)
-
-	// CRLF
-	buf = append(buf, '\r', '\n')
-
-	return buf
+	return append(buf, portBuf...)
 }
 
 // GetTargetAddr 获取目标地址字符串
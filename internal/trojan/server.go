@@ -2,52 +2,117 @@ package trojan
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
-	"io"
 	"net"
 	"sync"
+	"time"
 
+	"multiexit-proxy/internal/auth"
+	"multiexit-proxy/internal/monitor"
 	"multiexit-proxy/internal/snat"
 )
 
 // Server Trojan服务器
 type Server struct {
-	password    string
 	tlsConfig   *tls.Config
-	ipSelector  snat.IPSelector
-	routingMgr  *snat.RoutingManager
+	handler     Handler
 	listener    net.Listener
 	connCounter sync.Map // 连接计数器
+	udpEnabled  bool     // 是否允许UDP关联
+	// 读取协议头和请求的超时（0表示不限）
+	handshakeTimeout time.Duration
+	// 认证失败时的回落后端
+	fallback     string
+	fallbackALPN map[string]string
+	// 多用户认证：协议头哈希 -> 用户名（单密码模式的用户名为空）
+	users        map[Header]string
+	traffic      map[string]*userTraffic // 用户名 -> 流量计数（仅有连接的用户）
+	usersMu      sync.RWMutex
+	userManager  *auth.UserManager
+	rateLimiter  UserLimiter
+	statsManager *monitor.StatsManager
 }
 
 // ServerConfig Trojan服务器配置
 type ServerConfig struct {
+	// ListenAddr 监听地址，为空时不创建监听器，由调用方通过HandleConn传入连接
 	ListenAddr string
+	// Password 单密码模式的密码（可选），与多用户可同时使用
 	Password   string
 	TLSConfig  *tls.Config
 	IPSelector snat.IPSelector
 	RoutingMgr *snat.RoutingManager
+	// UDPEnabled 允许客户端建立UDP关联（CmdUDP）
+	UDPEnabled bool
+	// UDPTimeout UDP关联空闲超时（0表示DefaultUDPTimeout）
+	UDPTimeout time.Duration
+	// Fallback 认证失败时转发到的后端地址（如本地nginx），为空时返回HTTP 400
+	Fallback string
+	// FallbackALPN 按TLS协商的ALPN（h2、http/1.1）选择回落后端，未匹配时使用Fallback
+	FallbackALPN map[string]string
+	// UserManager 保存多用户信息（可选，为空时创建新的用户管理器），用户通过Server.AddUser添加
+	UserManager *auth.UserManager
+	// RateLimiter 按用户限制连接数（可选）
+	RateLimiter UserLimiter
+	// StatsManager 按用户统计连接和流量（可选）
+	StatsManager *monitor.StatsManager
+	// Handler 处理已认证的请求（可选，为空时使用IPSelector和RoutingMgr直接连接目标）
+	Handler Handler
+	// HandshakeTimeout 读取协议头和请求的超时（0表示不限）
+	HandshakeTimeout time.Duration
 }
 
 // NewServer 创建Trojan服务器
 func NewServer(config *ServerConfig) (*Server, error) {
 	// 创建TLS监听器
-	listener, err := tls.Listen("tcp", config.ListenAddr, config.TLSConfig)
-	if err != nil {
-		return nil, fmt.Errorf("failed to listen: %w", err)
+	var listener net.Listener
+	if config.ListenAddr != "" {
+		var err error
+		listener, err = tls.Listen("tcp", config.ListenAddr, config.TLSConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen: %w", err)
+		}
+	}
+
+	handler := config.Handler
+	if handler == nil {
+		handler = &directHandler{
+			ipSelector: config.IPSelector,
+			routingMgr: config.RoutingMgr,
+			udpTimeout: config.UDPTimeout,
+		}
+	}
+
+	userManager := config.UserManager
+	if userManager == nil {
+		userManager = auth.NewUserManager()
+	}
+	users := make(map[Header]string)
+	if config.Password != "" {
+		users[NewHeader(config.Password)] = ""
 	}
 
 	return &Server{
-		password:   config.Password,
-		tlsConfig:  config.TLSConfig,
-		ipSelector: config.IPSelector,
-		routingMgr: config.RoutingMgr,
-		listener:   listener,
+		tlsConfig:        config.TLSConfig,
+		handler:          handler,
+		listener:         listener,
+		udpEnabled:       config.UDPEnabled,
+		fallback:         config.Fallback,
+		fallbackALPN:     config.FallbackALPN,
+		users:            users,
+		userManager:      userManager,
+		rateLimiter:      config.RateLimiter,
+		statsManager:     config.StatsManager,
+		handshakeTimeout: config.HandshakeTimeout,
 	}, nil
 }
 
 // Start 启动Trojan服务器
 func (s *Server) Start() error {
+	if s.listener == nil {
+		return errors.New("trojan server has no listener")
+	}
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
@@ -60,26 +125,52 @@ func (s *Server) Start() error {
 
 // Stop 停止服务器
 func (s *Server) Stop() error {
+	if s.listener == nil {
+		return nil
+	}
 	return s.listener.Close()
 }
 
+// HandleConn 处理已接受的连接（由其他服务端的监听循环调用，conn通常为*tls.Conn）
+func (s *Server) HandleConn(conn net.Conn) error {
+	return s.handleConn(conn)
+}
+
 // handleConn 处理Trojan连接
 func (s *Server) handleConn(conn net.Conn) error {
 	defer conn.Close()
 
 	// 读取Trojan协议头（56字节密码哈希）
+	if s.handshakeTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.handshakeTimeout))
+	}
 	header := make([]byte, HeaderSize)
-	if _, err := io.ReadFull(conn, header); err != nil {
+	if n, err := s.readHeader(conn, header); err != nil {
+		if n > 0 && s.hasFallback() {
+			return s.handleFallback(conn, header[:n])
+		}
 		return err
 	}
 
 	// 验证密码
 	var headerHash Header
 	copy(headerHash[:], header)
-	if !VerifyHeader(headerHash, s.password) {
-		// 密码错误，发送HTTP 400响应（伪装）
-		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
-		return ErrInvalidPassword
+	username, ok := s.lookupUser(headerHash)
+	if !ok {
+		// 密码错误，转发到回落后端（伪装）
+		return s.handleFallback(conn, header)
+	}
+
+	// 多用户：检查IP白名单、配额和连接数限制
+	var traffic *userTraffic
+	if username != "" {
+		var release func()
+		var err error
+		traffic, release, err = s.admitUser(username, clientIP(conn))
+		if err != nil {
+			return fmt.Errorf("rejected trojan user %s: %w", username, err)
+		}
+		defer release()
 	}
 
 	// 解析连接请求
@@ -87,64 +178,21 @@ func (s *Server) handleConn(conn net.Conn) error {
 	if err != nil {
 		return fmt.Errorf("failed to parse request: %w", err)
 	}
-
-	// 获取目标地址
-	targetAddr := req.GetTargetAddr()
-
-	// 选择出口IP
-	host, portStr, _ := net.SplitHostPort(targetAddr)
-	var port int
-	fmt.Sscanf(portStr, "%d", &port)
-
-	exitIP, err := s.ipSelector.SelectIP(host, port)
-	if err != nil {
-		return fmt.Errorf("failed to select IP: %w", err)
+	if s.handshakeTimeout > 0 {
+		conn.SetReadDeadline(time.Time{})
 	}
 
-	// 建立到目标的连接
-	var targetConn net.Conn
-	if s.routingMgr != nil {
-		// 使用SNAT
-		dialer := &net.Dialer{}
-		targetConn, err = dialer.Dial("tcp", targetAddr)
-		if err != nil {
-			return fmt.Errorf("failed to dial target: %w", err)
-		}
-
-		// 标记连接
-		if err := s.routingMgr.MarkConnection(targetConn, exitIP); err != nil {
-			targetConn.Close()
-			return fmt.Errorf("failed to mark connection: %w", err)
-		}
-	} else {
-		// 不使用SNAT，直接连接
-		targetConn, err = net.Dial("tcp", targetAddr)
-		if err != nil {
-			return fmt.Errorf("failed to dial target: %w", err)
-		}
+	// 按用户统计请求之后的流量
+	if traffic != nil {
+		conn = &userConn{Conn: conn, server: s, traffic: traffic}
 	}
-	defer targetConn.Close()
-
-	// 双向转发数据（Trojan协议没有响应头，直接转发）
-	errCh := make(chan error, 2)
-
-	go func() {
-		_, err := io.Copy(targetConn, conn)
-		errCh <- err
-	}()
-
-	go func() {
-		_, err := io.Copy(conn, targetConn)
-		errCh <- err
-	}()
 
-	// 等待任一方向结束
-	err = <-errCh
-	if err != nil && err != io.EOF {
-		return err
+	if req.Command == CmdUDP {
+		if !s.udpEnabled {
+			return fmt.Errorf("UDP associate rejected: UDP relay disabled")
+		}
+		return s.handler.HandleUDP(&PacketConn{Conn: conn})
 	}
 
-	return nil
+	return s.handler.HandleConnect(conn, req.GetTargetAddr())
 }
-
-
@@ -0,0 +1,426 @@
+package trojan
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"multiexit-proxy/internal/snat"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultUDPTimeout UDP关联默认空闲超时
+	DefaultUDPTimeout = 60 * time.Second
+
+	// MaxUDPPayloadSize UDP数据包载荷最大长度（长度字段为2字节）
+	MaxUDPPayloadSize = 0xFFFF
+
+	// udpResolveCacheSize 单个UDP关联缓存的目标地址解析结果数量上限
+	udpResolveCacheSize = 256
+
+	// udpResolveTimeout 域名目标的DNS解析超时
+	udpResolveTimeout = 5 * time.Second
+
+	// udpPendingMax 域名目标解析期间暂存的数据包数量上限（超出的丢弃）
+	udpPendingMax = 16
+
+	// udpResolveFailureTTL 域名目标解析失败后，在该时间内直接丢弃发往它的数据包
+	udpResolveFailureTTL = 10 * time.Second
+)
+
+// UDPPacket Trojan UDP数据包：ATYP | DST.ADDR | DST.PORT | Length | CRLF | Payload
+// 客户端发出时地址为目标地址，服务端返回时地址为数据包的来源地址
+type UDPPacket struct {
+	Target  string // host:port
+	Payload []byte
+}
+
+// ReadUDPPacket 读取一个UDP数据包
+func ReadUDPPacket(reader io.Reader) (*UDPPacket, error) {
+	req := &Request{}
+	if err := readAddr(reader, req); err != nil {
+		return nil, err
+	}
+
+	// 长度 + CRLF
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return nil, err
+	}
+	if buf[2] != '\r' || buf[3] != '\n' {
+		return nil, errors.New("invalid CRLF")
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(buf[:2]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+
+	target := req.GetTargetAddr()
+	if target == "" {
+		return nil, ErrInvalidHeader
+	}
+	return &UDPPacket{Target: target, Payload: payload}, nil
+}
+
+// BuildUDPPacket 构建UDP数据包
+func BuildUDPPacket(target string, payload []byte) ([]byte, error) {
+	if len(payload) > MaxUDPPayloadSize {
+		return nil, fmt.Errorf("UDP payload too large: %d", len(payload))
+	}
+	req, err := ParseTargetAddr(target, CmdUDP)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, 1+1+len(req.Domain)+16+2+4+len(payload))
+	buf = appendAddr(buf, req)
+	buf = append(buf, byte(len(payload)>>8), byte(len(payload)), '\r', '\n')
+	return append(buf, payload...), nil
+}
+
+// WriteUDPPacket 构建并一次写入UDP数据包
+func WriteUDPPacket(writer io.Writer, target string, payload []byte) error {
+	packet, err := BuildUDPPacket(target, payload)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(packet)
+	return err
+}
+
+// HandleUDP 处理UDP关联：首个数据包的目标决定本关联的出口IP，之后所有数据包从绑定该出口IP的UDP套接字发出
+// 关联在Trojan连接关闭或空闲超时后结束
+func (h *directHandler) HandleUDP(pc *PacketConn) error {
+	conn := pc.Conn
+	first, err := ReadUDPPacket(conn)
+	if err != nil {
+		return fmt.Errorf("failed to read UDP packet: %w", err)
+	}
+
+	host, portStr, err := net.SplitHostPort(first.Target)
+	if err != nil {
+		return fmt.Errorf("invalid UDP target %s: %w", first.Target, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("invalid UDP target port %s: %w", first.Target, err)
+	}
+	exitIP, err := h.ipSelector.SelectIP(host, port)
+	if err != nil {
+		return fmt.Errorf("failed to select IP: %w", err)
+	}
+
+	feedback := snat.FeedbackOf(h.ipSelector)
+
+	udpConn, err := h.listenUDP(exitIP)
+	if err != nil {
+		return err
+	}
+	defer udpConn.Close()
+	feedback.OnConnectionStart(exitIP)
+	defer feedback.OnConnectionEnd(exitIP)
+
+	timeout := h.udpTimeout
+	if timeout <= 0 {
+		timeout = DefaultUDPTimeout
+	}
+	relay := newUDPAssociation(udpConn, exitIP, feedback)
+	relay.touch()
+
+	// 目标 -> 客户端，空闲超时后关闭Trojan连接结束关联
+	go func() {
+		defer conn.Close()
+		buf := make([]byte, MaxUDPPayloadSize)
+		for {
+			udpConn.SetReadDeadline(time.Now().Add(timeout))
+			n, from, err := udpConn.ReadFromUDP(buf)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() && !relay.idle(timeout) {
+					continue
+				}
+				return
+			}
+			relay.touch()
+			if err := WriteUDPPacket(conn, udpSourceAddr(from), buf[:n]); err != nil {
+				return
+			}
+			feedback.OnBytesTransferred(exitIP, int64(n))
+		}
+	}()
+
+	// 客户端 -> 目标
+	packet := first
+	for {
+		if err := relay.send(packet); err != nil {
+			logrus.Debugf("Dropping trojan UDP packet to %s: %v", packet.Target, err)
+		}
+		packet, err = ReadUDPPacket(conn)
+		if err != nil {
+			if err == io.EOF || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// listenUDP 创建出口UDP套接字：SNAT模式下打标记由策略路由改写源地址，否则直接绑定出口IP
+func (h *directHandler) listenUDP(exitIP net.IP) (*net.UDPConn, error) {
+	if h.routingMgr != nil {
+		udpConn, err := net.ListenUDP(udpNetwork(exitIP), nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen UDP: %w", err)
+		}
+		if err := h.routingMgr.MarkConnection(udpConn, exitIP); err != nil {
+			udpConn.Close()
+			return nil, fmt.Errorf("failed to mark connection: %w", err)
+		}
+		return udpConn, nil
+	}
+
+	udpConn, err := net.ListenUDP(udpNetwork(exitIP), &net.UDPAddr{IP: exitIP})
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind UDP socket to %s: %w", exitIP, err)
+	}
+	return udpConn, nil
+}
+
+// udpAssociation 服务端的一个UDP关联
+type udpAssociation struct {
+	conn       *net.UDPConn
+	network    string
+	exitIP     net.IP
+	feedback   snat.SelectorFeedback
+	lookupIP   func(ctx context.Context, network, host string) ([]net.IP, error)
+	mu         sync.Mutex
+	resolved   map[string]*net.UDPAddr // 目标地址解析缓存
+	pending    map[string]*udpPending  // 正在后台解析的域名目标
+	failed     map[string]udpFailure   // 解析失败的域名目标
+	lastActive int64                   // 原子操作，UnixNano
+}
+
+// udpPending 正在解析的目标及暂存的数据包
+type udpPending struct {
+	queue [][]byte
+}
+
+// udpFailure 目标解析失败的结果
+type udpFailure struct {
+	err     error
+	expires time.Time
+}
+
+// newUDPAssociation 创建从出口IP的套接字conn发出数据包的UDP关联
+func newUDPAssociation(conn *net.UDPConn, exitIP net.IP, feedback snat.SelectorFeedback) *udpAssociation {
+	return &udpAssociation{
+		conn:     conn,
+		network:  udpNetwork(exitIP),
+		exitIP:   exitIP,
+		feedback: feedback,
+		lookupIP: net.DefaultResolver.LookupIP,
+		resolved: make(map[string]*net.UDPAddr),
+		pending:  make(map[string]*udpPending),
+		failed:   make(map[string]udpFailure),
+	}
+}
+
+// send 将数据包发往目标，首次出现的域名目标在后台解析（数据包暂存到解析完成），不阻塞发往其他目标的数据包
+func (a *udpAssociation) send(packet *UDPPacket) error {
+	a.mu.Lock()
+	if addr, ok := a.resolved[packet.Target]; ok {
+		a.mu.Unlock()
+		return a.write(addr, packet.Payload)
+	}
+	if failure, ok := a.failed[packet.Target]; ok {
+		if time.Now().Before(failure.expires) {
+			a.mu.Unlock()
+			return failure.err
+		}
+		delete(a.failed, packet.Target)
+	}
+	if pending, ok := a.pending[packet.Target]; ok {
+		if len(pending.queue) >= udpPendingMax {
+			a.mu.Unlock()
+			return fmt.Errorf("too many packets waiting for %s to resolve", packet.Target)
+		}
+		pending.queue = append(pending.queue, append([]byte(nil), packet.Payload...))
+		a.mu.Unlock()
+		return nil
+	}
+
+	host, portStr, err := net.SplitHostPort(packet.Target)
+	if err != nil {
+		a.mu.Unlock()
+		return fmt.Errorf("invalid target address: %w", err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		a.mu.Unlock()
+		return fmt.Errorf("invalid port: %w", err)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		addr := &net.UDPAddr{IP: ip, Port: port}
+		a.cache(packet.Target, addr)
+		a.mu.Unlock()
+		return a.write(addr, packet.Payload)
+	}
+
+	pending := &udpPending{queue: [][]byte{append([]byte(nil), packet.Payload...)}}
+	a.pending[packet.Target] = pending
+	a.mu.Unlock()
+	go a.resolve(packet.Target, host, port, pending)
+	return nil
+}
+
+// resolve 在后台解析域名目标，然后按顺序发出暂存的数据包；失败时丢弃暂存的数据包并记录失败
+func (a *udpAssociation) resolve(target, host string, port int, pending *udpPending) {
+	ctx, cancel := context.WithTimeout(context.Background(), udpResolveTimeout)
+	ips, err := a.lookupIP(ctx, "ip"+strings.TrimPrefix(a.network, "udp"), host)
+	cancel()
+	if err == nil && len(ips) == 0 {
+		err = fmt.Errorf("no %s address for %s", a.network, host)
+	}
+
+	a.mu.Lock()
+	if err != nil {
+		delete(a.pending, target)
+		if len(a.failed) >= udpResolveCacheSize {
+			a.failed = make(map[string]udpFailure)
+		}
+		a.failed[target] = udpFailure{err: err, expires: time.Now().Add(udpResolveFailureTTL)}
+		a.mu.Unlock()
+		logrus.Debugf("Dropping trojan UDP packets to %s: %v", target, err)
+		return
+	}
+	// 发出暂存的数据包，期间到达的数据包继续暂存，全部发出后解析结果才生效，保持数据包顺序
+	addr := &net.UDPAddr{IP: ips[0], Port: port}
+	for len(pending.queue) > 0 {
+		queue := pending.queue
+		pending.queue = nil
+		a.mu.Unlock()
+		for _, payload := range queue {
+			if err := a.write(addr, payload); err != nil {
+				logrus.Debugf("Dropping trojan UDP packet to %s: %v", target, err)
+			}
+		}
+		a.mu.Lock()
+	}
+	delete(a.pending, target)
+	a.cache(target, addr)
+	a.mu.Unlock()
+}
+
+// cache 缓存目标地址的解析结果（调用方持有a.mu）
+func (a *udpAssociation) cache(target string, addr *net.UDPAddr) {
+	if len(a.resolved) >= udpResolveCacheSize {
+		a.resolved = make(map[string]*net.UDPAddr)
+	}
+	a.resolved[target] = addr
+}
+
+// write 从出口套接字发出数据包
+func (a *udpAssociation) write(addr *net.UDPAddr, payload []byte) error {
+	a.touch()
+	n, err := a.conn.WriteToUDP(payload, addr)
+	if err != nil {
+		return err
+	}
+	a.feedback.OnBytesTransferred(a.exitIP, int64(n))
+	return nil
+}
+
+// touch 记录活动时间
+func (a *udpAssociation) touch() {
+	atomic.StoreInt64(&a.lastActive, time.Now().UnixNano())
+}
+
+// idle 是否已空闲超过timeout
+func (a *udpAssociation) idle(timeout time.Duration) bool {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&a.lastActive))) >= timeout
+}
+
+// udpNetwork 按出口IP的地址族选择网络类型
+func udpNetwork(ip net.IP) string {
+	if ip.To4() != nil {
+		return "udp4"
+	}
+	return "udp6"
+}
+
+// udpSourceAddr 数据包来源地址（IPv4映射的IPv6地址按IPv4返回）
+func udpSourceAddr(addr *net.UDPAddr) string {
+	ip := addr.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return net.JoinHostPort(ip.String(), fmt.Sprintf("%d", addr.Port))
+}
+
+// DialUDP 连接到Trojan服务器并建立UDP关联
+func (c *Client) DialUDP() (*PacketConn, error) {
+	conn, err := c.dialCommand(CmdUDP, "0.0.0.0:0")
+	if err != nil {
+		return nil, err
+	}
+	return &PacketConn{Conn: conn}, nil
+}
+
+// PacketConn Trojan UDP关联（实现net.PacketConn），WriteTo的地址可为域名
+type PacketConn struct {
+	net.Conn
+	writeMu sync.Mutex
+}
+
+// ReadFrom 读取一个数据包，返回来源地址（超出p的部分被丢弃）
+func (pc *PacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	packet, err := ReadUDPPacket(pc.Conn)
+	if err != nil {
+		return 0, nil, err
+	}
+	return copy(p, packet.Payload), packetAddr(packet.Target), nil
+}
+
+// WriteTo 向目标地址发送一个数据包
+func (pc *PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	pc.writeMu.Lock()
+	defer pc.writeMu.Unlock()
+	if err := WriteUDPPacket(pc.Conn, addr.String(), p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Addr 域名形式的UDP地址
+type Addr string
+
+// Network 网络类型
+func (a Addr) Network() string {
+	return "udp"
+}
+
+// String 地址字符串（host:port）
+func (a Addr) String() string {
+	return string(a)
+}
+
+// packetAddr 将地址字符串转换为net.Addr（IP地址返回*net.UDPAddr）
+func packetAddr(target string) net.Addr {
+	host, portStr, err := net.SplitHostPort(target)
+	if ip := net.ParseIP(host); err == nil && ip != nil {
+		var port int
+		fmt.Sscanf(portStr, "%d", &port)
+		return &net.UDPAddr{IP: ip, Port: port}
+	}
+	return Addr(target)
+}
@@ -0,0 +1,273 @@
+package trojan
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"multiexit-proxy/internal/auth"
+	"multiexit-proxy/internal/snat"
+	"multiexit-proxy/pkg/socks5"
+)
+
+func TestUDPPacketRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	targets := []string{"8.8.8.8:53", "[2001:db8::1]:443", "example.com:27015"}
+	for _, target := range targets {
+		if err := WriteUDPPacket(&buf, target, []byte("payload-"+target)); err != nil {
+			t.Fatalf("WriteUDPPacket(%s) failed: %v", target, err)
+		}
+	}
+	for _, target := range targets {
+		packet, err := ReadUDPPacket(&buf)
+		if err != nil {
+			t.Fatalf("ReadUDPPacket failed: %v", err)
+		}
+		if packet.Target != target || string(packet.Payload) != "payload-"+target {
+			t.Errorf("Got %s %q, want %s", packet.Target, packet.Payload, target)
+		}
+	}
+
+	// CRLF错误
+	packet, _ := BuildUDPPacket("1.2.3.4:53", []byte("x"))
+	packet[9] = 'X'
+	if _, err := ReadUDPPacket(bytes.NewReader(packet)); err == nil {
+		t.Error("Expected invalid CRLF to fail")
+	}
+}
+
+func TestParseRequestUDP(t *testing.T) {
+	req, _ := ParseTargetAddr("0.0.0.0:0", CmdUDP)
+	parsed, err := ParseRequest(bytes.NewReader(BuildRequest(req)))
+	if err != nil {
+		t.Fatalf("ParseRequest failed: %v", err)
+	}
+	if parsed.Command != CmdUDP || parsed.GetTargetAddr() != "0.0.0.0:0" {
+		t.Errorf("Unexpected request %+v", parsed)
+	}
+}
+
+// startUDPEchoServer 启动本地UDP回显服务，返回地址和收到数据包的来源地址
+func startUDPEchoServer(t *testing.T) (string, <-chan *net.UDPAddr) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen UDP: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	sources := make(chan *net.UDPAddr, 16)
+	go func() {
+		buf := make([]byte, MaxUDPPayloadSize)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			select {
+			case sources <- from:
+			default:
+			}
+			conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return conn.LocalAddr().String(), sources
+}
+
+// dialTestUDP 在管道上建立到测试服务端的UDP关联
+func dialTestUDP(t *testing.T, s *Server) *PacketConn {
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close() })
+	go s.handleConn(serverConn)
+
+	header := NewHeader("test-password")
+	req, _ := ParseTargetAddr("0.0.0.0:0", CmdUDP)
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := clientConn.Write(append(header[:], BuildRequest(req)...)); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+	return &PacketConn{Conn: clientConn}
+}
+
+func newUDPTestServer(t *testing.T) *Server {
+	selector, err := snat.NewRoundRobinSelector([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatalf("NewRoundRobinSelector failed: %v", err)
+	}
+	return &Server{
+		handler:     &directHandler{ipSelector: selector, udpTimeout: time.Second},
+		udpEnabled:  true,
+		users:       map[Header]string{NewHeader("test-password"): ""},
+		userManager: auth.NewUserManager(),
+	}
+}
+
+func TestServer_HandleUDP(t *testing.T) {
+	s := newUDPTestServer(t)
+	echoAddr, sources := startUDPEchoServer(t)
+
+	pc := dialTestUDP(t, s)
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	for _, payload := range []string{"query-1", "query-2"} {
+		if _, err := pc.WriteTo([]byte(payload), Addr(echoAddr)); err != nil {
+			t.Fatalf("WriteTo failed: %v", err)
+		}
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ReadFrom failed: %v", err)
+		}
+		if from.String() != echoAddr || string(buf[:n]) != payload {
+			t.Errorf("Got %q from %s, want %q from %s", buf[:n], from, payload, echoAddr)
+		}
+	}
+
+	// 同一关联的数据包使用同一出口套接字
+	first, second := <-sources, <-sources
+	if !first.IP.Equal(net.IPv4(127, 0, 0, 1)) || first.Port != second.Port {
+		t.Errorf("Unexpected exit sockets %s, %s", first, second)
+	}
+}
+
+func TestUDPAssociation_ResolvesDomainsInBackground(t *testing.T) {
+	echoAddr, _ := startUDPEchoServer(t)
+	_, echoPort, _ := net.SplitHostPort(echoAddr)
+
+	udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen UDP: %v", err)
+	}
+	defer udpConn.Close()
+	udpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	relay := newUDPAssociation(udpConn, net.IPv4(127, 0, 0, 1), snat.FeedbackOf(nil))
+	release := make(chan struct{})
+	var failedLookups int64
+	relay.lookupIP = func(ctx context.Context, network, host string) ([]net.IP, error) {
+		if host == "slow.test" {
+			<-release
+			return []net.IP{net.IPv4(127, 0, 0, 1)}, nil
+		}
+		atomic.AddInt64(&failedLookups, 1)
+		return nil, errors.New("no such host")
+	}
+
+	readReply := func(want string) {
+		buf := make([]byte, 64)
+		n, _, err := udpConn.ReadFromUDP(buf)
+		if err != nil || string(buf[:n]) != want {
+			t.Fatalf("Got reply %q (%v), want %q", buf[:n], err, want)
+		}
+	}
+
+	// 慢速解析的域名目标不阻塞其他目标
+	if err := relay.send(&UDPPacket{Target: net.JoinHostPort("slow.test", echoPort), Payload: []byte("queued")}); err != nil {
+		t.Fatalf("send to slow target failed: %v", err)
+	}
+	if err := relay.send(&UDPPacket{Target: echoAddr, Payload: []byte("direct")}); err != nil {
+		t.Fatalf("send to IP target failed: %v", err)
+	}
+	readReply("direct")
+
+	// 解析完成后发出暂存的数据包
+	close(release)
+	readReply("queued")
+
+	// 解析失败的结果在一段时间内直接返回，不再重复解析
+	failing := &UDPPacket{Target: "missing.test:53", Payload: []byte("x")}
+	relay.send(failing)
+	deadline := time.Now().Add(5 * time.Second)
+	for relay.send(failing) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Failed resolution was not cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if lookups := atomic.LoadInt64(&failedLookups); lookups != 1 {
+		t.Errorf("Expected 1 lookup for the failing target, got %d", lookups)
+	}
+
+	// 端口无效的目标返回错误
+	if err := relay.send(&UDPPacket{Target: "127.0.0.1:dns", Payload: []byte("x")}); err == nil {
+		t.Error("Expected invalid port to fail")
+	}
+}
+
+func TestServer_HandleUDPDisabled(t *testing.T) {
+	s := newUDPTestServer(t)
+	s.udpEnabled = false
+
+	pc := dialTestUDP(t, s)
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := pc.ReadFrom(make([]byte, 64)); err == nil {
+		t.Error("UDP associate should be rejected when UDP relay is disabled")
+	}
+}
+
+func TestSOCKS5UDPOverTrojan(t *testing.T) {
+	s := newUDPTestServer(t)
+	echoAddr, _ := startUDPEchoServer(t)
+
+	socks5Server := socks5.NewServer(nil)
+	socks5Server.PacketDialFunc = func() (net.PacketConn, error) {
+		return dialTestUDP(t, s), nil
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			socks5Server.HandleConn(conn)
+		}
+	}()
+
+	control, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer control.Close()
+	control.SetDeadline(time.Now().Add(5 * time.Second))
+
+	control.Write([]byte{0x05, 0x01, 0x00})
+	control.Write([]byte{0x05, socks5.CmdUDP, 0x00, socks5.AddrTypeIPv4, 0, 0, 0, 0, 0, 0})
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(control, reply); err != nil {
+		t.Fatalf("Failed to read SOCKS5 reply: %v", err)
+	}
+	if reply[3] != socks5.ReplySuccess {
+		t.Fatalf("Unexpected SOCKS5 reply: %v", reply)
+	}
+	relayAddr := &net.UDPAddr{IP: net.IP(reply[6:10]), Port: int(reply[10])<<8 | int(reply[11])}
+
+	udpConn, err := net.DialUDP("udp4", nil, relayAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial relay: %v", err)
+	}
+	defer udpConn.Close()
+	udpConn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	echo, _ := net.ResolveUDPAddr("udp4", echoAddr)
+	request := append([]byte{0x00, 0x00, 0x00, socks5.AddrTypeIPv4}, echo.IP.To4()...)
+	request = append(request, byte(echo.Port>>8), byte(echo.Port))
+	request = append(request, "dns-query"...)
+	if _, err := udpConn.Write(request); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	buf := make([]byte, 512)
+	n, err := udpConn.Read(buf)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(buf[:n], request) {
+		t.Errorf("Unexpected relayed packet %v, want %v", buf[:n], request)
+	}
+}
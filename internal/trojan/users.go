@@ -0,0 +1,249 @@
+package trojan
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"multiexit-proxy/internal/auth"
+
+	"github.com/sirupsen/logrus"
+)
+
+// userTrafficFlushBytes 未写回UserManager的流量达到该值时写回一次
+const userTrafficFlushBytes = 1 << 20
+
+// userTraffic 用户流量计数：该用户的所有连接共享，认证时解析一次，读写路径只做原子操作
+// 未写回的流量达到userTrafficFlushBytes或连接结束时累计到UserManager
+type userTraffic struct {
+	username string
+	quota    int64 // 原子操作，流量配额（0表示不限），写回时从UserManager同步
+	used     int64 // 原子操作，已用流量（含未写回的部分）
+	pending  int64 // 原子操作，尚未写回UserManager的流量
+	removed  int32 // 原子操作，用户已删除
+	refs     int   // 使用该计数的连接数（usersMu保护）
+}
+
+// exceeded 配额是否已用完
+func (t *userTraffic) exceeded() bool {
+	quota := atomic.LoadInt64(&t.quota)
+	return quota > 0 && atomic.LoadInt64(&t.used) >= quota
+}
+
+// UserLimiter 按用户限制并发连接
+type UserLimiter interface {
+	// AdmitUser 用户未达到连接数上限时登记一个连接，返回连接结束时调用的释放函数
+	AdmitUser(username string) (release func(), ok bool)
+}
+
+// AddUser 运行时添加用户：用户信息保存在UserManager中，协议头哈希预先计算供认证查表
+// quota为流量配额（字节，0表示不限），allowedIPs为客户端IP白名单（为空表示不限制）
+func (s *Server) AddUser(username, password string, quota int64, allowedIPs []string) error {
+	if username == "" || password == "" {
+		return errors.New("username and password are required")
+	}
+	header := NewHeader(password)
+
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+
+	if _, exists := s.users[header]; exists {
+		return fmt.Errorf("password of user %s is already in use", username)
+	}
+	if err := s.userManager.AddUser(username, password, 0, allowedIPs); err != nil {
+		return err
+	}
+	if quota > 0 {
+		s.userManager.SetUserQuota(username, quota)
+	}
+	s.users[header] = username
+	return nil
+}
+
+// RemoveUser 运行时删除用户，该用户已建立的连接在下一次读写时断开
+func (s *Server) RemoveUser(username string) error {
+	if err := s.userManager.DeleteUser(username); err != nil {
+		return err
+	}
+
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+	for header, name := range s.users {
+		if name == username {
+			delete(s.users, header)
+		}
+	}
+	if traffic, ok := s.traffic[username]; ok {
+		atomic.StoreInt32(&traffic.removed, 1)
+		delete(s.traffic, username)
+	}
+	return nil
+}
+
+// Users 列出所有用户
+func (s *Server) Users() []string {
+	return s.userManager.ListUsers()
+}
+
+// UserManager 获取用户管理器（用于查询配额和已用流量）
+func (s *Server) UserManager() *auth.UserManager {
+	return s.userManager
+}
+
+// lookupUser 根据协议头查找用户，单密码模式的用户名为空
+func (s *Server) lookupUser(header Header) (string, bool) {
+	s.usersMu.RLock()
+	username, ok := s.users[header]
+	s.usersMu.RUnlock()
+	return username, ok
+}
+
+// admitUser 检查用户的IP白名单、流量配额和连接数限制，返回用户的流量计数和连接结束时调用的释放函数
+func (s *Server) admitUser(username string, clientIP net.IP) (*userTraffic, func(), error) {
+	user, err := s.userManager.GetUser(username)
+	if err != nil {
+		return nil, nil, err
+	}
+	if clientIP != nil && !user.AllowsIP(clientIP) {
+		return nil, nil, auth.ErrIPNotAllowed
+	}
+	traffic := s.acquireTraffic(user)
+	if traffic.exceeded() {
+		s.releaseTraffic(traffic)
+		return nil, nil, auth.ErrQuotaExceeded
+	}
+	releaseLimit := func() {}
+	if s.rateLimiter != nil {
+		release, ok := s.rateLimiter.AdmitUser(username)
+		if !ok {
+			s.releaseTraffic(traffic)
+			return nil, nil, fmt.Errorf("user %s exceeded connection limit", username)
+		}
+		releaseLimit = release
+	}
+	if s.statsManager != nil {
+		s.statsManager.OnUserConnectionStart(username)
+	}
+
+	return traffic, func() {
+		s.releaseTraffic(traffic)
+		releaseLimit()
+		if s.statsManager != nil {
+			s.statsManager.OnUserConnectionEnd(username)
+		}
+	}, nil
+}
+
+// acquireTraffic 获取用户的流量计数，用户没有其他连接时按UserManager中的配额和已用流量创建
+func (s *Server) acquireTraffic(user *auth.User) *userTraffic {
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+
+	traffic, ok := s.traffic[user.Username]
+	if !ok {
+		if s.traffic == nil {
+			s.traffic = make(map[string]*userTraffic)
+		}
+		traffic = &userTraffic{username: user.Username, quota: user.Quota, used: user.BytesUsed}
+		s.traffic[user.Username] = traffic
+	}
+	traffic.refs++
+	return traffic
+}
+
+// releaseTraffic 连接结束：写回未记录的流量，用户的最后一个连接结束时丢弃计数
+func (s *Server) releaseTraffic(traffic *userTraffic) {
+	s.flushTraffic(traffic)
+
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+	traffic.refs--
+	if traffic.refs == 0 && s.traffic[traffic.username] == traffic {
+		delete(s.traffic, traffic.username)
+	}
+}
+
+// flushTraffic 将未写回的流量累计到UserManager，并同步配额
+func (s *Server) flushTraffic(traffic *userTraffic) {
+	n := atomic.SwapInt64(&traffic.pending, 0)
+	if n == 0 {
+		return
+	}
+	// 配额由used计数检查，这里忽略ErrQuotaExceeded
+	if err := s.userManager.AddUserTraffic(traffic.username, n); errors.Is(err, auth.ErrUserNotFound) {
+		atomic.StoreInt32(&traffic.removed, 1)
+		return
+	}
+	if user, err := s.userManager.GetUser(traffic.username); err == nil {
+		atomic.StoreInt64(&traffic.quota, user.Quota)
+	}
+}
+
+// recordTraffic 记录用户流量，配额用完或用户已删除时返回错误
+func (s *Server) recordTraffic(traffic *userTraffic, up, down int64) error {
+	if s.statsManager != nil {
+		s.statsManager.OnUserBytesTransferred(traffic.username, up, down)
+	}
+	if atomic.LoadInt32(&traffic.removed) != 0 {
+		return auth.ErrUserNotFound
+	}
+
+	used := atomic.AddInt64(&traffic.used, up+down)
+	if atomic.AddInt64(&traffic.pending, up+down) >= userTrafficFlushBytes {
+		s.flushTraffic(traffic)
+	}
+	if quota := atomic.LoadInt64(&traffic.quota); quota > 0 && used > quota {
+		logrus.Infof("Trojan user %s exceeded traffic quota", traffic.username)
+		return auth.ErrQuotaExceeded
+	}
+	return nil
+}
+
+// userConn 统计用户流量的连接，配额用完后读写返回错误以中断转发
+type userConn struct {
+	net.Conn
+	server  *Server
+	traffic *userTraffic
+}
+
+// Read 读取客户端上行数据
+func (c *userConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		if qerr := c.server.recordTraffic(c.traffic, int64(n), 0); qerr != nil {
+			return n, qerr
+		}
+	}
+	return n, err
+}
+
+// Write 写入客户端下行数据
+func (c *userConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		if qerr := c.server.recordTraffic(c.traffic, 0, int64(n)); qerr != nil {
+			return n, qerr
+		}
+	}
+	return n, err
+}
+
+// ConnUser 连接所属的Trojan用户（单密码模式或非Trojan连接返回空字符串）
+func ConnUser(conn net.Conn) string {
+	if pc, ok := conn.(*PacketConn); ok {
+		conn = pc.Conn
+	}
+	if uc, ok := conn.(*userConn); ok {
+		return uc.traffic.username
+	}
+	return ""
+}
+
+// clientIP 获取连接的客户端IP
+func clientIP(conn net.Conn) net.IP {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
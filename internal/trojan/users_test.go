@@ -0,0 +1,99 @@
+package trojan
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"multiexit-proxy/internal/monitor"
+)
+
+// startTCPEchoServer 启动本地TCP回显服务
+func startTCPEchoServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// dialTestConnect 在管道上以指定密码建立CONNECT连接（服务端拒绝时写入失败，由之后的读取体现）
+func dialTestConnect(t *testing.T, s *Server, password, target string) net.Conn {
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close() })
+	go s.handleConn(serverConn)
+
+	header := NewHeader(password)
+	req, _ := ParseTargetAddr(target, CmdConnect)
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	clientConn.Write(append(header[:], BuildRequest(req)...))
+	return clientConn
+}
+
+func TestServer_MultiUser(t *testing.T) {
+	s := newUDPTestServer(t)
+	s.statsManager = monitor.NewStatsManager()
+	echoAddr := startTCPEchoServer(t)
+
+	if err := s.AddUser("alice", "alice-password", 10, nil); err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+	if err := s.AddUser("bob", "alice-password", 0, nil); err == nil {
+		t.Error("Expected AddUser with a duplicate password to fail")
+	}
+
+	// 配额内的流量正常转发：上行5字节 + 下行5字节
+	conn := dialTestConnect(t, s, "alice-password", echoAddr)
+	buf := make([]byte, 16)
+	conn.Write([]byte("hello"))
+	if _, err := io.ReadFull(conn, buf[:5]); err != nil || string(buf[:5]) != "hello" {
+		t.Fatalf("Unexpected echo %q (%v)", buf[:5], err)
+	}
+
+	// 超出配额后连接被中断
+	conn.Write([]byte("more"))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("Expected connection to be closed, got %v", err)
+	}
+	userStats := s.statsManager.GetUserStats("alice")
+	if userStats == nil || userStats.Connections != 1 || userStats.BytesUp < 5 || userStats.BytesDown < 5 {
+		t.Errorf("Unexpected user stats %+v", userStats)
+	}
+
+	// 连接结束时流量写回UserManager
+	if user, err := s.userManager.GetUser("alice"); err != nil || user.BytesUsed < 10 {
+		t.Errorf("Expected traffic to be flushed on close, got %+v (%v)", user, err)
+	}
+
+	// 配额用完后拒绝新连接
+	conn = dialTestConnect(t, s, "alice-password", echoAddr)
+	if n, _ := conn.Read(buf); n != 0 {
+		t.Errorf("Expected user over quota to be rejected, got %q", buf[:n])
+	}
+
+	// 删除后的用户按认证失败处理
+	if err := s.RemoveUser("alice"); err != nil {
+		t.Fatalf("RemoveUser failed: %v", err)
+	}
+	if _, ok := s.lookupUser(NewHeader("alice-password")); ok {
+		t.Error("Removed user should not authenticate")
+	}
+	if len(s.Users()) != 0 {
+		t.Errorf("Expected no users, got %v", s.Users())
+	}
+}
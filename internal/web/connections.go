@@ -0,0 +1,33 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"multiexit-proxy/internal/proxy"
+
+	"github.com/sirupsen/logrus"
+)
+
+// connectionTable 支持列出当前连接的代理服务器
+type connectionTable interface {
+	ActiveConnections() []proxy.ConnectionInfo
+}
+
+// getConnections 获取当前连接及其协商的加密算法
+func (s *Server) getConnections(w http.ResponseWriter, r *http.Request) {
+	table, ok := s.proxyServer.(connectionTable)
+	if !ok {
+		http.Error(w, "connections not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	conns := table.ActiveConnections()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"connections": conns,
+		"count":       len(conns),
+	}); err != nil {
+		logrus.Errorf("Failed to encode connections response: %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"multiexit-proxy/internal/proxy"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// exitIPPool 支持运行时管理出口IP的代理服务器
+type exitIPPool interface {
+	ExitIPs() []proxy.ExitIPStatus
+	AddExitIP(ip string) error
+	DrainExitIP(ip string) (<-chan struct{}, error)
+	RemoveExitIP(ip string) error
+}
+
+// addIP 添加出口IP，立即参与出口IP选择
+func (s *Server) addIP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		IP string `json:"ip"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ip := net.ParseIP(req.IP)
+	if ip == nil {
+		http.Error(w, fmt.Sprintf("invalid IP address: %s", req.IP), http.StatusBadRequest)
+		return
+	}
+
+	pool, ok := s.proxyServer.(exitIPPool)
+	if !ok {
+		http.Error(w, "exit IP management not available", http.StatusServiceUnavailable)
+		return
+	}
+	if err := pool.AddExitIP(ip.String()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.persistExitIPs(pool, "Add exit IP "+ip.String())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "success",
+		"ip":     ip.String(),
+	}); err != nil {
+		logrus.Errorf("Failed to encode add IP response: %v", err)
+	}
+}
+
+// removeIP 移除出口IP：默认排空（等待活跃连接结束后移除，返回202），force=true时立即移除
+func (s *Server) removeIP(w http.ResponseWriter, r *http.Request) {
+	ip := net.ParseIP(mux.Vars(r)["ip"])
+	if ip == nil {
+		http.Error(w, fmt.Sprintf("invalid IP address: %s", mux.Vars(r)["ip"]), http.StatusBadRequest)
+		return
+	}
+
+	pool, ok := s.proxyServer.(exitIPPool)
+	if !ok {
+		http.Error(w, "exit IP management not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	status := http.StatusOK
+	state := "removed"
+	if r.URL.Query().Get("force") == "true" {
+		if err := pool.RemoveExitIP(ip.String()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		if _, err := pool.DrainExitIP(ip.String()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status = http.StatusAccepted
+		state = proxy.ExitIPDraining
+	}
+	s.persistExitIPs(pool, "Remove exit IP "+ip.String())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "success",
+		"ip":     ip.String(),
+		"state":  state,
+	}); err != nil {
+		logrus.Errorf("Failed to encode remove IP response: %v", err)
+	}
+}
+
+// persistExitIPs 将代理服务器当前的出口IP写入配置文件，重启后保持一致
+// 写入失败只记录日志：运行时的变更已经生效
+func (s *Server) persistExitIPs(pool exitIPPool, description string) {
+	exitIPs := make([]string, 0)
+	for _, status := range pool.ExitIPs() {
+		if status.State == proxy.ExitIPActive {
+			exitIPs = append(exitIPs, status.IP)
+		}
+	}
+
+	cfg := *s.config
+	cfg.ExitIPs = exitIPs
+	if _, err := s.saveConfig(&cfg, description); err != nil {
+		logrus.Errorf("Failed to save exit IPs to config file: %v", err)
+		return
+	}
+	s.config = &cfg
+}
@@ -2,6 +2,7 @@ package web
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 
 	"multiexit-proxy/internal/config"
@@ -41,12 +42,23 @@ func (s *Server) rollbackConfig(w http.ResponseWriter, r *http.Request) {
 
 	s.config = cfg
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+	// 热重载到运行中的代理服务器
+	response := map[string]interface{}{
 		"status":  "success",
 		"version": req.Version,
 		"message": "Config rolled back successfully",
-	}); err != nil {
+	}
+	reloadResult, err := s.applyToProxy(cfg)
+	if err != nil {
+		logrus.Errorf("Failed to apply rolled back config: %v", err)
+		response["message"] = fmt.Sprintf("Config rolled back, but failed to apply to running proxy: %v", err)
+	} else if reloadResult != nil {
+		response["reload"] = reloadResult
+		response["restart_required"] = reloadResult.NeedsRestart()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
 		logrus.Errorf("Failed to encode rollback response: %v", err)
 		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
 		return
@@ -1,17 +1,22 @@
 package web
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"multiexit-proxy/internal/config"
 	"multiexit-proxy/internal/database"
 	"multiexit-proxy/internal/monitor"
+	"multiexit-proxy/internal/proxy"
+	"multiexit-proxy/internal/security"
 	"multiexit-proxy/internal/subscribe"
 
 	"github.com/gorilla/mux"
@@ -50,6 +55,9 @@ type Server struct {
 	loginProtection *LoginProtection                    // 登录保护
 	statsRepo       *database.StatsRepository           // 统计数据仓库
 	trafficRepo     *database.TrafficRepository         // 流量分析数据仓库
+	httpServer      *http.Server                        // Start创建，Shutdown关闭
+	httpMu          sync.Mutex
+	shutdown        bool
 }
 
 // NewServer 创建Web服务器
@@ -142,6 +150,30 @@ func (s *Server) handlePrometheusMetrics(w http.ResponseWriter, r *http.Request)
 		fmt.Fprintf(w, "multiexit_proxy_total_connections %v\n", statsMap["total_connections"])
 		fmt.Fprintf(w, "multiexit_proxy_active_connections %v\n", statsMap["active_connections"])
 	}
+
+	// 握手重放过滤指标
+	if replay, ok := s.proxyServer.(interface {
+		GetReplayStats() *security.ReplayStats
+	}); ok {
+		if replayStats := replay.GetReplayStats(); replayStats != nil {
+			writeReplayMetrics(w, replayStats)
+		}
+	}
+}
+
+// writeReplayMetrics 输出握手重放过滤的Prometheus指标
+func writeReplayMetrics(w io.Writer, stats *security.ReplayStats) {
+	fmt.Fprintf(w, "# HELP multiexit_proxy_replay_checked_total Handshakes checked by the replay filter\n")
+	fmt.Fprintf(w, "# TYPE multiexit_proxy_replay_checked_total counter\n")
+	fmt.Fprintf(w, "multiexit_proxy_replay_checked_total %d\n", stats.Checked)
+	fmt.Fprintf(w, "# HELP multiexit_proxy_replay_rejected_total Handshakes rejected by the replay filter\n")
+	fmt.Fprintf(w, "# TYPE multiexit_proxy_replay_rejected_total counter\n")
+	fmt.Fprintf(w, "multiexit_proxy_replay_rejected_total{reason=\"replay\"} %d\n", stats.Rejected)
+	fmt.Fprintf(w, "multiexit_proxy_replay_rejected_total{reason=\"expired\"} %d\n", stats.Expired)
+	fmt.Fprintf(w, "multiexit_proxy_replay_rejected_total{reason=\"overflow\"} %d\n", stats.Overflow)
+	fmt.Fprintf(w, "# HELP multiexit_proxy_replay_entries Handshake nonces currently tracked\n")
+	fmt.Fprintf(w, "# TYPE multiexit_proxy_replay_entries gauge\n")
+	fmt.Fprintf(w, "multiexit_proxy_replay_entries %d\n", stats.Entries)
 }
 
 // corsMiddleware CORS中间件
@@ -179,6 +211,11 @@ func (s *Server) setupRoutes() {
 	api.HandleFunc("/config/rollback", s.rollbackConfig).Methods("POST")
 	api.HandleFunc("/config/versions", s.listConfigVersions).Methods("GET")
 	api.HandleFunc("/ips", s.getIPs).Methods("GET")
+	api.HandleFunc("/ips", s.addIP).Methods("POST")
+	api.HandleFunc("/ips/{ip}", s.removeIP).Methods("DELETE")
+	api.HandleFunc("/sessions", s.getSessions).Methods("GET")
+	api.HandleFunc("/sessions", s.evictSessions).Methods("DELETE")
+	api.HandleFunc("/connections", s.getConnections).Methods("GET")
 	api.HandleFunc("/status", s.getStatus).Methods("GET")
 	api.HandleFunc("/stats", s.getStats).Methods("GET")
 	api.HandleFunc("/rules", s.getRules).Methods("GET")
@@ -215,6 +252,7 @@ func (s *Server) setupRoutes() {
 				"stats":    "/api/stats",
 				"config":   "/api/config",
 				"ips":      "/api/ips",
+				"sessions": "/api/sessions",
 				"rules":    "/api/rules",
 				"traffic":  "/api/traffic",
 				"metrics":  "/metrics",
@@ -324,23 +362,15 @@ func (s *Server) updateConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 保存配置版本
-	version, err := s.versionMgr.SaveVersion("Manual update via web interface")
-	if err != nil {
-		logrus.Warnf("Failed to save config version: %v", err)
-		// 继续执行，但不保证能回滚
-	} else {
-		logrus.Infof("Config version saved: %s", version)
-	}
-
-	// 保存配置到文件（YAML格式）
-	data, err := yaml.Marshal(newConfig)
+	// 先热重载到运行中的代理服务器，失败时不写入配置文件
+	reloadResult, err := s.applyToProxy(&newConfig)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to apply config: %v", err), http.StatusBadRequest)
 		return
 	}
 
-	if err := os.WriteFile(s.configPath, data, 0644); err != nil {
+	version, err := s.saveConfig(&newConfig, "Manual update via web interface")
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -352,22 +382,85 @@ func (s *Server) updateConfig(w http.ResponseWriter, r *http.Request) {
 		"version": version,
 		"message": "Config updated successfully",
 	}
+	if reloadResult != nil {
+		response["reload"] = reloadResult
+		response["restart_required"] = reloadResult.NeedsRestart()
+	}
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		logrus.Errorf("Failed to encode config update response: %v", err)
 		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
 		return
 	}
 
-	// 注意：配置更新后，代理服务器可能需要重新加载配置
-	// 这里只更新了Web服务器的配置，实际代理服务器配置需要重启或热重载
-	logrus.Info("Config updated successfully, proxy server may need restart to apply changes")
+	logrus.Info("Config updated successfully via web interface")
+}
+
+// saveConfig 保存当前配置版本后将cfg写入配置文件（YAML格式），返回保存的版本
+func (s *Server) saveConfig(cfg *config.ServerConfig, description string) (string, error) {
+	// 保存配置版本
+	version, err := s.versionMgr.SaveVersion(description)
+	if err != nil {
+		logrus.Warnf("Failed to save config version: %v", err)
+		// 继续执行，但不保证能回滚
+	} else {
+		logrus.Infof("Config version saved: %s", version)
+	}
+
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(s.configPath, data, 0644); err != nil {
+		return "", err
+	}
+	return version, nil
+}
+
+// applyToProxy 将配置热重载到代理服务器（代理服务器不支持热重载时返回nil结果）
+func (s *Server) applyToProxy(cfg *config.ServerConfig) (*proxy.ReloadResult, error) {
+	reloader, ok := s.proxyServer.(interface {
+		ApplyConfig(*proxy.ServerConfig) (*proxy.ReloadResult, error)
+	})
+	if !ok {
+		return nil, nil
+	}
+
+	serverConfig, err := proxy.BuildServerConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return reloader.ApplyConfig(serverConfig)
 }
 
 // getIPs 获取IP列表
 func (s *Server) getIPs(w http.ResponseWriter, r *http.Request) {
 	type IPInfo struct {
-		IP     string `json:"ip"`
-		Active bool   `json:"active"`
+		IP                string `json:"ip"`
+		Active            bool   `json:"active"`
+		State             string `json:"state,omitempty"`
+		Healthy           bool   `json:"healthy,omitempty"`
+		ActiveConnections int    `json:"active_connections,omitempty"`
+	}
+
+	// 代理服务器支持运行时管理出口IP时，返回出口IP池的状态（包括正在排空的IP）
+	if pool, ok := s.proxyServer.(exitIPPool); ok {
+		statuses := pool.ExitIPs()
+		ips := make([]IPInfo, 0, len(statuses))
+		for _, status := range statuses {
+			ips = append(ips, IPInfo{
+				IP:                status.IP,
+				Active:            status.State == proxy.ExitIPActive && status.Healthy,
+				State:             status.State,
+				Healthy:           status.Healthy,
+				ActiveConnections: status.ActiveConnections,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(ips); err != nil {
+			logrus.Errorf("Failed to encode IPs response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		}
+		return
 	}
 
 	ips := make([]IPInfo, 0, len(s.config.ExitIPs))
@@ -501,6 +594,7 @@ func (s *Server) getStats(w http.ResponseWriter, r *http.Request) {
 		BytesUp           int64                  `json:"bytes_up"`
 		BytesDown         int64                  `json:"bytes_down"`
 		IPStats           map[string]interface{} `json:"ip_stats"`
+		CipherStats       map[string]int64       `json:"cipher_stats"`
 	}
 
 	// 使用反射或类型断言转换
@@ -532,6 +626,7 @@ func (s *Server) getStats(w http.ResponseWriter, r *http.Request) {
 			BytesUp:           stats.BytesUp,
 			BytesDown:         stats.BytesDown,
 			IPStats:           ipStatsMap,
+			CipherStats:       stats.CipherStats,
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -659,5 +754,33 @@ func (s *Server) generateToken() string {
 func (s *Server) Start(listenAddr string) error {
 	logrus.Infof("Web API服务器启动在 %s", listenAddr)
 	logrus.Infof("前端管理界面请访问独立的前端服务（默认: http://localhost:8081）")
-	return http.ListenAndServe(listenAddr, s.router)
+
+	s.httpMu.Lock()
+	if s.shutdown {
+		s.httpMu.Unlock()
+		return http.ErrServerClosed
+	}
+	s.httpServer = &http.Server{Addr: listenAddr, Handler: s.router}
+	httpServer := s.httpServer
+	s.httpMu.Unlock()
+	return httpServer.ListenAndServe()
+}
+
+// Shutdown 停止接受新请求，等待处理中的请求完成（最多timeout，0表示不等待），之后Start返回http.ErrServerClosed
+func (s *Server) Shutdown(timeout time.Duration) error {
+	s.httpMu.Lock()
+	s.shutdown = true
+	httpServer := s.httpServer
+	s.httpMu.Unlock()
+	if httpServer == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		httpServer.Close()
+		return err
+	}
+	return nil
 }
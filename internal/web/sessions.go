@@ -0,0 +1,70 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"multiexit-proxy/internal/proxy"
+	"multiexit-proxy/internal/snat"
+
+	"github.com/sirupsen/logrus"
+)
+
+// stickySessionTable 支持查看和删除粘性会话的代理服务器
+type stickySessionTable interface {
+	StickySessions() ([]snat.StickySession, error)
+	EvictStickySessions(key, ip string) (int, error)
+}
+
+// getSessions 获取粘性会话表
+func (s *Server) getSessions(w http.ResponseWriter, r *http.Request) {
+	table, ok := s.proxyServer.(stickySessionTable)
+	if !ok {
+		http.Error(w, "sticky sessions not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	enabled := true
+	sessions, err := table.StickySessions()
+	if errors.Is(err, proxy.ErrStickyDisabled) {
+		enabled = false
+		sessions = []snat.StickySession{}
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":  enabled,
+		"sessions": sessions,
+		"count":    len(sessions),
+	}); err != nil {
+		logrus.Errorf("Failed to encode sessions response: %v", err)
+	}
+}
+
+// evictSessions 删除粘性会话：?key=删除指定会话，?ip=删除使用该出口IP的会话，都不指定时删除全部
+func (s *Server) evictSessions(w http.ResponseWriter, r *http.Request) {
+	table, ok := s.proxyServer.(stickySessionTable)
+	if !ok {
+		http.Error(w, "sticky sessions not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	evicted, err := table.EvictStickySessions(query.Get("key"), query.Get("ip"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "success",
+		"evicted": evicted,
+	}); err != nil {
+		logrus.Errorf("Failed to encode evict sessions response: %v", err)
+	}
+}
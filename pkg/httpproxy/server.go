@@ -0,0 +1,309 @@
+package httpproxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"multiexit-proxy/internal/auth"
+)
+
+// hopHeaders 逐跳头部，转发时删除
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Upgrade",
+}
+
+// ErrAuthFailed 认证失败
+var ErrAuthFailed = errors.New("HTTP proxy authentication failed")
+
+// Server HTTP代理服务器，支持CONNECT隧道和绝对URI请求转发（保持连接）
+type Server struct {
+	DialFunc func(network, addr string) (net.Conn, error)
+	// Authenticate 校验Basic认证的用户名和密码（可选），为nil时不认证
+	Authenticate func(username, password string, clientIP net.IP) error
+}
+
+// NewServer 创建HTTP代理服务器
+func NewServer(dialFunc func(network, addr string) (net.Conn, error)) *Server {
+	return &Server{
+		DialFunc: dialFunc,
+	}
+}
+
+// NewUserManagerAuth 创建使用auth.UserManager校验用户名、密码和IP白名单的认证函数
+func NewUserManagerAuth(users *auth.UserManager) func(username, password string, clientIP net.IP) error {
+	return func(username, password string, clientIP net.IP) error {
+		_, err := users.Authenticate(username, password, clientIP)
+		return err
+	}
+}
+
+// HandleConn 处理连接
+func (s *Server) HandleConn(conn net.Conn) error {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	upstream := &upstreamConn{}
+	defer upstream.Close()
+
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		if err := s.authenticate(conn, req); err != nil {
+			writeStatus(conn, http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"multiexit-proxy\"\r\n")
+			return err
+		}
+
+		if req.Method == http.MethodConnect {
+			return s.handleConnect(conn, reader, req)
+		}
+
+		keepAlive, err := s.handleForward(conn, reader, upstream, req)
+		if err != nil || !keepAlive {
+			return err
+		}
+	}
+}
+
+// authenticate 校验Proxy-Authorization头部
+func (s *Server) authenticate(conn net.Conn, req *http.Request) error {
+	if s.Authenticate == nil {
+		return nil
+	}
+
+	username, password, ok := parseBasicAuth(req.Header.Get("Proxy-Authorization"))
+	if !ok {
+		return fmt.Errorf("%w: missing credentials", ErrAuthFailed)
+	}
+	if err := s.Authenticate(username, password, remoteIP(conn)); err != nil {
+		return fmt.Errorf("%w: user %s: %v", ErrAuthFailed, username, err)
+	}
+	return nil
+}
+
+// handleConnect 处理CONNECT隧道
+func (s *Server) handleConnect(conn net.Conn, reader *bufio.Reader, req *http.Request) error {
+	addr := targetAddr(req.Host, "443")
+	targetConn, err := s.DialFunc("tcp", addr)
+	if err != nil {
+		writeStatus(conn, http.StatusBadGateway, "")
+		return err
+	}
+	defer targetConn.Close()
+
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return err
+	}
+
+	// 客户端可能在收到响应前就发送了数据（如TLS ClientHello）
+	if n := reader.Buffered(); n > 0 {
+		buffered, _ := reader.Peek(n)
+		if _, err := targetConn.Write(buffered); err != nil {
+			return err
+		}
+		reader.Discard(n)
+	}
+
+	return relay(conn, targetConn)
+}
+
+// handleForward 转发绝对URI请求，返回客户端连接是否可以继续使用
+func (s *Server) handleForward(conn net.Conn, reader *bufio.Reader, upstream *upstreamConn, req *http.Request) (bool, error) {
+	if req.URL.Host == "" {
+		writeStatus(conn, http.StatusBadRequest, "")
+		return false, fmt.Errorf("request URI is not absolute: %s", req.RequestURI)
+	}
+
+	defaultPort := "80"
+	if req.URL.Scheme == "https" {
+		defaultPort = "443"
+	}
+	addr := targetAddr(req.URL.Host, defaultPort)
+
+	// 同一目标的连续请求复用上游连接
+	if err := upstream.connect(s.DialFunc, addr); err != nil {
+		writeStatus(conn, http.StatusBadGateway, "")
+		return false, err
+	}
+
+	upgrade := req.Header.Get("Upgrade")
+	removeHopHeaders(req.Header)
+	if upgrade != "" {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", upgrade)
+	}
+	// 客户端未发送User-Agent时不添加默认值
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header.Set("User-Agent", "")
+	}
+	if err := req.Write(upstream.conn); err != nil {
+		upstream.Close()
+		writeStatus(conn, http.StatusBadGateway, "")
+		return false, err
+	}
+
+	resp, err := http.ReadResponse(upstream.reader, req)
+	if err != nil {
+		upstream.Close()
+		writeStatus(conn, http.StatusBadGateway, "")
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	// 协议升级（如WebSocket）后双向透明转发
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		if err := resp.Write(conn); err != nil {
+			return false, err
+		}
+		return false, upstream.relay(conn, reader)
+	}
+
+	removeHopHeaders(resp.Header)
+	if err := resp.Write(conn); err != nil {
+		upstream.Close()
+		return false, err
+	}
+
+	if resp.Close {
+		upstream.Close()
+	}
+	return !req.Close && !resp.Close, nil
+}
+
+// upstreamConn 绝对URI转发使用的上游连接
+type upstreamConn struct {
+	addr   string
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// connect 连接目标地址，已连接到同一地址时复用
+func (u *upstreamConn) connect(dial func(network, addr string) (net.Conn, error), addr string) error {
+	if u.conn != nil && u.addr == addr {
+		return nil
+	}
+	u.Close()
+
+	conn, err := dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	u.addr = addr
+	u.conn = conn
+	u.reader = bufio.NewReader(conn)
+	return nil
+}
+
+// relay 在客户端连接和上游连接之间双向转发（包括两端已缓冲的数据）
+func (u *upstreamConn) relay(conn net.Conn, reader *bufio.Reader) error {
+	errCh := make(chan error, 2)
+
+	go func() {
+		_, err := io.Copy(u.conn, reader)
+		errCh <- err
+	}()
+
+	go func() {
+		_, err := io.Copy(conn, u.reader)
+		errCh <- err
+	}()
+
+	return <-errCh
+}
+
+// Close 关闭上游连接
+func (u *upstreamConn) Close() error {
+	if u.conn == nil {
+		return nil
+	}
+	err := u.conn.Close()
+	u.conn = nil
+	u.reader = nil
+	u.addr = ""
+	return err
+}
+
+// relay 双向转发数据，任一方向结束即返回
+func relay(conn, targetConn net.Conn) error {
+	errCh := make(chan error, 2)
+
+	go func() {
+		_, err := io.Copy(targetConn, conn)
+		errCh <- err
+	}()
+
+	go func() {
+		_, err := io.Copy(conn, targetConn)
+		errCh <- err
+	}()
+
+	return <-errCh
+}
+
+// removeHopHeaders 删除逐跳头部（包括Connection中列出的头部）
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// parseBasicAuth 解析Basic认证头部
+func parseBasicAuth(value string) (username, password string, ok bool) {
+	const prefix = "Basic "
+	if len(value) < len(prefix) || !strings.EqualFold(value[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(value[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	username, password, ok = strings.Cut(string(decoded), ":")
+	return username, password, ok
+}
+
+// targetAddr 补全目标地址的端口
+func targetAddr(host, defaultPort string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), defaultPort)
+}
+
+// writeStatus 发送不带正文的响应，随后由调用方关闭连接
+func writeStatus(conn net.Conn, code int, extraHeaders string) error {
+	_, err := fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n%sConnection: close\r\nContent-Length: 0\r\n\r\n", code, http.StatusText(code), extraHeaders)
+	return err
+}
+
+// remoteIP 获取连接的客户端IP
+func remoteIP(conn net.Conn) net.IP {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
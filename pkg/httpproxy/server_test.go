@@ -0,0 +1,120 @@
+package httpproxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startProxy 在管道上运行HTTP代理，返回客户端连接
+func startProxy(t *testing.T, s *Server) net.Conn {
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close() })
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	go s.HandleConn(serverConn)
+	return clientConn
+}
+
+func TestServer_Connect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	conn := startProxy(t, NewServer(net.Dial))
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\nhello", listener.Addr(), listener.Addr())
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected CONNECT response %v (%v)", resp, err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(reader, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("Unexpected echo %q (%v)", buf, err)
+	}
+}
+
+func TestServer_ForwardKeepAlive(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Connection") != "" {
+			t.Errorf("Hop-by-hop header forwarded")
+		}
+		fmt.Fprintf(w, "path=%s", r.URL.Path)
+	}))
+	defer backend.Close()
+
+	var dials int32
+	conn := startProxy(t, NewServer(func(network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return net.Dial(network, addr)
+	}))
+	reader := bufio.NewReader(conn)
+
+	for _, path := range []string{"/a", "/b"} {
+		fmt.Fprintf(conn, "GET %s%s HTTP/1.1\r\nHost: %s\r\nProxy-Connection: keep-alive\r\n\r\n", backend.URL, path, backend.Listener.Addr())
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "path="+path {
+			t.Errorf("Got body %q, want path=%s", body, path)
+		}
+	}
+
+	// 同一目标的请求复用上游连接
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Errorf("Expected 1 upstream dial, got %d", n)
+	}
+}
+
+func TestServer_BasicAuth(t *testing.T) {
+	s := NewServer(func(network, addr string) (net.Conn, error) {
+		return nil, errors.New("dial disabled in test")
+	})
+	s.Authenticate = func(username, password string, clientIP net.IP) error {
+		if username != "alice" || password != "secret" {
+			return errors.New("invalid credentials")
+		}
+		return nil
+	}
+
+	// 缺少凭据
+	conn := startProxy(t, s)
+	fmt.Fprintf(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("Expected 407, got %v (%v)", resp, err)
+	}
+	if resp.Header.Get("Proxy-Authenticate") == "" {
+		t.Error("Missing Proxy-Authenticate header")
+	}
+
+	// 凭据正确时继续处理（拨号失败返回502）
+	conn = startProxy(t, s)
+	credentials := base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	fmt.Fprintf(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nProxy-Authorization: Basic %s\r\n\r\n", credentials)
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("Expected 502, got %v (%v)", resp, err)
+	}
+}
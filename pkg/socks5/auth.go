@@ -0,0 +1,145 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"multiexit-proxy/internal/auth"
+)
+
+// 用户名/密码认证子协商（RFC 1929）
+const (
+	userPassVersion = 0x01
+	userPassSuccess = 0x00
+	userPassFailure = 0x01
+)
+
+// ErrAuthFailed 认证失败
+var ErrAuthFailed = errors.New("SOCKS5 authentication failed")
+
+// Identity 认证后的客户端身份
+type Identity struct {
+	Method   byte   // 协商的认证方法
+	Username string // 用户名（无认证时为空）
+}
+
+// Authenticator SOCKS5认证方法
+type Authenticator interface {
+	// Method 认证方法编号
+	Method() byte
+	// Authenticate 完成该方法的子协商，返回客户端身份
+	Authenticate(conn net.Conn) (*Identity, error)
+}
+
+// NoAuthAuthenticator 无认证
+type NoAuthAuthenticator struct{}
+
+// Method 认证方法编号
+func (a NoAuthAuthenticator) Method() byte {
+	return MethodNoAuth
+}
+
+// Authenticate 无需子协商
+func (a NoAuthAuthenticator) Authenticate(conn net.Conn) (*Identity, error) {
+	return &Identity{Method: MethodNoAuth}, nil
+}
+
+// UserPassAuthenticator 用户名/密码认证（RFC 1929），由Validate回调校验凭据
+type UserPassAuthenticator struct {
+	Validate func(username, password string, clientIP net.IP) error
+}
+
+// NewUserManagerAuthenticator 创建使用auth.UserManager校验用户名、密码和IP白名单的认证方法
+func NewUserManagerAuthenticator(users *auth.UserManager) *UserPassAuthenticator {
+	return &UserPassAuthenticator{
+		Validate: func(username, password string, clientIP net.IP) error {
+			_, err := users.Authenticate(username, password, clientIP)
+			return err
+		},
+	}
+}
+
+// Method 认证方法编号
+func (a *UserPassAuthenticator) Method() byte {
+	return MethodUsernamePass
+}
+
+// Authenticate 读取用户名和密码并校验
+func (a *UserPassAuthenticator) Authenticate(conn net.Conn) (*Identity, error) {
+	// VER | ULEN | UNAME | PLEN | PASSWD
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	if buf[0] != userPassVersion {
+		return nil, fmt.Errorf("invalid username/password auth version: %d", buf[0])
+	}
+	username := make([]byte, int(buf[1]))
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return nil, err
+	}
+	password := make([]byte, int(buf[0]))
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return nil, err
+	}
+
+	if err := a.Validate(string(username), string(password), remoteIP(conn)); err != nil {
+		conn.Write([]byte{userPassVersion, userPassFailure})
+		return nil, fmt.Errorf("%w: user %s: %v", ErrAuthFailed, username, err)
+	}
+	if _, err := conn.Write([]byte{userPassVersion, userPassSuccess}); err != nil {
+		return nil, err
+	}
+	return &Identity{Method: MethodUsernamePass, Username: string(username)}, nil
+}
+
+// NegotiateAuth 读取客户端支持的方法，按authenticators的顺序选择第一个客户端支持的方法并完成认证
+// authenticators为空时使用无认证
+func NegotiateAuth(conn net.Conn, authenticators []Authenticator) (*Identity, error) {
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+
+	if buf[0] != Version {
+		return nil, errors.New("invalid SOCKS version")
+	}
+
+	nMethods := int(buf[1])
+	methods := make([]byte, nMethods)
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+
+	if len(authenticators) == 0 {
+		authenticators = []Authenticator{NoAuthAuthenticator{}}
+	}
+	for _, authenticator := range authenticators {
+		for _, method := range methods {
+			if method != authenticator.Method() {
+				continue
+			}
+			if _, err := conn.Write([]byte{Version, method}); err != nil {
+				return nil, err
+			}
+			return authenticator.Authenticate(conn)
+		}
+	}
+
+	// 没有可接受的方法
+	conn.Write([]byte{Version, MethodNoAcceptable})
+	return nil, fmt.Errorf("%w: no acceptable authentication method", ErrAuthFailed)
+}
+
+// remoteIP 获取连接的客户端IP
+func remoteIP(conn net.Conn) net.IP {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
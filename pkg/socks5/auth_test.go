@@ -0,0 +1,107 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"multiexit-proxy/internal/auth"
+)
+
+// startTestServer 在管道上运行SOCKS5服务器，返回客户端连接和记录拨号身份的通道
+func startTestServer(t *testing.T, authenticators []Authenticator) (net.Conn, chan *Identity) {
+	identities := make(chan *Identity, 1)
+	server := &Server{
+		Authenticators: authenticators,
+		IdentityDialFunc: func(identity *Identity, network, addr string) (net.Conn, error) {
+			identities <- identity
+			return nil, errors.New("dial disabled in test")
+		},
+	}
+
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close() })
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	go server.HandleConn(serverConn)
+	return clientConn, identities
+}
+
+// writeUserPass 发送用户名/密码子协商请求并返回状态
+func writeUserPass(t *testing.T, conn net.Conn, username, password string) byte {
+	req := []byte{userPassVersion, byte(len(username))}
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatalf("Failed to write credentials: %v", err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Failed to read auth reply: %v", err)
+	}
+	return reply[1]
+}
+
+func TestServer_UserPassAuth(t *testing.T) {
+	users := auth.NewUserManager()
+	if err := users.AddUser("alice", "secret", 0, nil); err != nil {
+		t.Fatalf("AddUser failed: %v", err)
+	}
+	authenticators := []Authenticator{NewUserManagerAuthenticator(users)}
+
+	// 认证成功后身份传给拨号函数
+	conn, identities := startTestServer(t, authenticators)
+	conn.Write([]byte{Version, 2, MethodNoAuth, MethodUsernamePass})
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil || method[1] != MethodUsernamePass {
+		t.Fatalf("Expected username/password method, got %v (%v)", method, err)
+	}
+	if status := writeUserPass(t, conn, "alice", "secret"); status != userPassSuccess {
+		t.Fatalf("Expected auth success, got status %d", status)
+	}
+	conn.Write([]byte{Version, CmdConnect, 0x00, AddrTypeIPv4, 127, 0, 0, 1, 0, 80})
+	identity := <-identities
+	if identity.Username != "alice" || identity.Method != MethodUsernamePass {
+		t.Errorf("Unexpected identity %+v", identity)
+	}
+
+	// 密码错误
+	conn, _ = startTestServer(t, authenticators)
+	conn.Write([]byte{Version, 1, MethodUsernamePass})
+	io.ReadFull(conn, method)
+	if status := writeUserPass(t, conn, "alice", "wrong"); status != userPassFailure {
+		t.Errorf("Expected auth failure, got status %d", status)
+	}
+}
+
+func TestServer_NoAcceptableMethod(t *testing.T) {
+	authenticators := []Authenticator{&UserPassAuthenticator{
+		Validate: func(username, password string, clientIP net.IP) error { return nil },
+	}}
+
+	conn, _ := startTestServer(t, authenticators)
+	conn.Write([]byte{Version, 1, MethodNoAuth})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Failed to read method reply: %v", err)
+	}
+	if !bytes.Equal(reply, []byte{Version, MethodNoAcceptable}) {
+		t.Errorf("Expected no acceptable method, got %v", reply)
+	}
+}
+
+func TestServer_NoAuthDefault(t *testing.T) {
+	conn, identities := startTestServer(t, nil)
+	conn.Write([]byte{Version, 1, MethodNoAuth})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != MethodNoAuth {
+		t.Fatalf("Expected no-auth method, got %v (%v)", reply, err)
+	}
+	conn.Write([]byte{Version, CmdConnect, 0x00, AddrTypeIPv4, 127, 0, 0, 1, 0, 80})
+	if identity := <-identities; identity.Username != "" || identity.Method != MethodNoAuth {
+		t.Errorf("Unexpected identity %+v", identity)
+	}
+}
@@ -0,0 +1,103 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// bindAcceptTimeout BIND请求等待对端连入的超时时间
+const bindAcceptTimeout = 2 * time.Minute
+
+// bindReplyFunc 发送BIND响应（SOCKS5和SOCKS4格式不同）
+type bindReplyFunc func(success bool, addr *net.TCPAddr) error
+
+// handleBind 处理BIND请求：打开监听并发送第一个响应（监听地址），
+// 对端连入后发送第二个响应（对端地址）并双向转发
+func (s *Server) handleBind(conn net.Conn, identity *Identity, addr string, reply bindReplyFunc) error {
+	listener, err := s.listenBind(conn, identity, addr)
+	if err != nil {
+		reply(false, nil)
+		return fmt.Errorf("failed to listen for BIND: %w", err)
+	}
+	defer listener.Close()
+
+	bindAddr, ok := listener.Addr().(*net.TCPAddr)
+	if !ok {
+		reply(false, nil)
+		return fmt.Errorf("failed to get BIND address")
+	}
+	// 监听在通配地址时返回控制连接的本地地址
+	if bindAddr.IP.IsUnspecified() {
+		if local, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+			bindAddr = &net.TCPAddr{IP: local.IP, Port: bindAddr.Port}
+		}
+	}
+	if err := reply(true, bindAddr); err != nil {
+		return err
+	}
+
+	// 等待对端连入
+	type acceptResult struct {
+		conn net.Conn
+		err  error
+	}
+	acceptCh := make(chan acceptResult, 1)
+	go func() {
+		peerConn, err := listener.Accept()
+		acceptCh <- acceptResult{peerConn, err}
+	}()
+
+	var peerConn net.Conn
+	select {
+	case result := <-acceptCh:
+		if result.err != nil {
+			reply(false, nil)
+			return result.err
+		}
+		peerConn = result.conn
+	case <-time.After(bindAcceptTimeout):
+		reply(false, nil)
+		return fmt.Errorf("BIND timed out waiting for connection")
+	}
+	defer peerConn.Close()
+
+	peerAddr, _ := peerConn.RemoteAddr().(*net.TCPAddr)
+	if !bindPeerAllowed(addr, peerAddr) {
+		reply(false, nil)
+		return fmt.Errorf("BIND connection from unexpected peer %s (expected %s)", peerConn.RemoteAddr(), addr)
+	}
+	if err := reply(true, peerAddr); err != nil {
+		return err
+	}
+
+	relay(conn, peerConn)
+	return nil
+}
+
+// listenBind 为BIND请求创建监听：设置了BindFunc时由其决定（如在选定的出口IP上监听），
+// 否则与UDP关联一致，在控制连接的本地地址上监听随机端口
+func (s *Server) listenBind(conn net.Conn, identity *Identity, addr string) (net.Listener, error) {
+	if s.BindFunc != nil {
+		return s.BindFunc(identity, addr)
+	}
+
+	bindHost := ""
+	if tcpAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		bindHost = tcpAddr.IP.String()
+	}
+	return net.Listen("tcp", net.JoinHostPort(bindHost, "0"))
+}
+
+// bindPeerAllowed 检查连入的对端是否为BIND请求中指定的地址（请求中为域名或未指定地址时不检查）
+func bindPeerAllowed(addr string, peer *net.TCPAddr) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	expected := net.ParseIP(host)
+	if expected == nil || expected.IsUnspecified() {
+		return true
+	}
+	return peer != nil && peer.IP.Equal(expected)
+}
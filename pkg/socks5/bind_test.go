@@ -0,0 +1,61 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer_Bind(t *testing.T) {
+	server := &Server{}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			server.HandleConn(conn)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte{Version, 1, MethodNoAuth})
+	io.ReadFull(conn, make([]byte, 2))
+
+	// 预期对端为127.0.0.1
+	conn.Write([]byte{Version, CmdBind, 0x00, AddrTypeIPv4, 127, 0, 0, 1, 0, 0})
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != ReplySuccess {
+		t.Fatalf("Unexpected first BIND reply %v (%v)", reply, err)
+	}
+	bindAddr := &net.TCPAddr{IP: net.IP(reply[4:8]), Port: int(binary.BigEndian.Uint16(reply[8:10]))}
+
+	peer, err := net.Dial("tcp", bindAddr.String())
+	if err != nil {
+		t.Fatalf("Failed to connect to BIND address %s: %v", bindAddr, err)
+	}
+	defer peer.Close()
+
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != ReplySuccess {
+		t.Fatalf("Unexpected second BIND reply %v (%v)", reply, err)
+	}
+	if peerPort := int(binary.BigEndian.Uint16(reply[8:10])); peerPort != peer.LocalAddr().(*net.TCPAddr).Port {
+		t.Errorf("Second reply port %d, want %s", peerPort, peer.LocalAddr())
+	}
+
+	peer.Write([]byte("data"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "data" {
+		t.Errorf("Unexpected relayed data %q (%v)", buf, err)
+	}
+}
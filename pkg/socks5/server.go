@@ -1,6 +1,7 @@
 package socks5
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -33,6 +34,16 @@ const (
 // Server SOCKS5服务器
 type Server struct {
 	DialFunc func(network, addr string) (net.Conn, error)
+	// PacketDialFunc 为每个UDP关联建立上游数据报通道（可选，如Trojan UDP关联）
+	// 为nil时UDP数据包直接发往目标
+	PacketDialFunc func() (net.PacketConn, error)
+	// Authenticators 支持的认证方法，按优先级排列；为空时使用无认证
+	Authenticators []Authenticator
+	// IdentityDialFunc 携带认证身份的拨号函数（可选），设置时优先于DialFunc
+	IdentityDialFunc func(identity *Identity, network, addr string) (net.Conn, error)
+	// BindFunc 为BIND请求创建监听（可选，如在为addr选定的出口IP上监听），addr为请求中预期连入的对端地址
+	// 为nil时在控制连接的本地地址上监听
+	BindFunc func(identity *Identity, addr string) (net.Listener, error)
 }
 
 // NewServer 创建SOCKS5服务器
@@ -42,47 +53,31 @@ func NewServer(dialFunc func(network, addr string) (net.Conn, error)) *Server {
 	}
 }
 
-// HandleConn 处理连接
+// HandleConn 处理连接，根据第一个字节区分SOCKS5和SOCKS4/4a
 func (s *Server) HandleConn(conn net.Conn) error {
 	defer conn.Close()
 
-	// 协商认证方法
-	if err := s.negotiateAuth(conn); err != nil {
-		return err
-	}
-
-	// 处理请求
-	return s.handleRequest(conn)
-}
-
-// negotiateAuth 协商认证方法
-func (s *Server) negotiateAuth(conn net.Conn) error {
-	buf := make([]byte, 2)
-	if _, err := io.ReadFull(conn, buf); err != nil {
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil {
 		return err
 	}
-
-	if buf[0] != Version {
-		return errors.New("invalid SOCKS version")
-	}
-
-	nMethods := int(buf[1])
-	methods := make([]byte, nMethods)
-	if _, err := io.ReadFull(conn, methods); err != nil {
-		return err
+	if version[0] == Version4 {
+		return s.handleSOCKS4(conn)
 	}
+	conn = &prefixConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(version), conn)}
 
-	// 选择无认证方法
-	response := []byte{Version, MethodNoAuth}
-	if _, err := conn.Write(response); err != nil {
+	// 协商认证方法
+	identity, err := NegotiateAuth(conn, s.Authenticators)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	// 处理请求
+	return s.handleRequest(conn, identity)
 }
 
 // handleRequest 处理请求
-func (s *Server) handleRequest(conn net.Conn) error {
+func (s *Server) handleRequest(conn net.Conn, identity *Identity) error {
 	buf := make([]byte, 4)
 	if _, err := io.ReadFull(conn, buf); err != nil {
 		return err
@@ -93,12 +88,26 @@ func (s *Server) handleRequest(conn net.Conn) error {
 	}
 
 	cmd := buf[1]
+	addr, err := readAddr(conn, buf[3])
+	if err != nil {
+		s.sendReply(conn, ReplyGeneralFailure, nil, 0)
+		return err
+	}
+
 	switch cmd {
 	case CmdConnect:
 		// 处理TCP连接
-		return s.handleConnect(conn)
+		return s.handleConnect(conn, identity, addr)
+	case CmdBind:
+		// 处理BIND请求（如FTP主动模式的数据连接）
+		return s.handleBind(conn, identity, addr, func(success bool, bindAddr *net.TCPAddr) error {
+			if !success {
+				return s.sendReply(conn, ReplyGeneralFailure, nil, 0)
+			}
+			return s.sendReply(conn, ReplySuccess, bindAddr.IP, uint16(bindAddr.Port))
+		})
 	case CmdUDP:
-		// 处理UDP关联请求
+		// 处理UDP关联请求（请求中的地址为客户端预期的发送地址，忽略）
 		return s.HandleUDPRequest(conn)
 	default:
 		s.sendReply(conn, ReplyGeneralFailure, nil, 0)
@@ -106,63 +115,51 @@ func (s *Server) handleRequest(conn net.Conn) error {
 	}
 }
 
-// handleConnect 处理TCP连接请求
-func (s *Server) handleConnect(conn net.Conn) error {
-	buf := make([]byte, 4)
-	if _, err := io.ReadFull(conn, buf); err != nil {
-		return err
-	}
-
-	// 读取地址
-	addrType := buf[3]
-	var addr string
-	var port uint16
+// readAddr 读取请求中的地址和端口
+func readAddr(conn net.Conn, addrType byte) (string, error) {
+	buf := make([]byte, 2)
+	var host string
 
 	switch addrType {
 	case AddrTypeIPv4:
 		ip := make([]byte, 4)
 		if _, err := io.ReadFull(conn, ip); err != nil {
-			return err
-		}
-		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
-			return err
+			return "", err
 		}
-		port = binary.BigEndian.Uint16(buf[:2])
-		addr = fmt.Sprintf("%s:%d", net.IP(ip).String(), port)
+		host = net.IP(ip).String()
 
 	case AddrTypeIPv6:
 		ip := make([]byte, 16)
 		if _, err := io.ReadFull(conn, ip); err != nil {
-			return err
-		}
-		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
-			return err
+			return "", err
 		}
-		port = binary.BigEndian.Uint16(buf[:2])
-		addr = fmt.Sprintf("[%s]:%d", net.IP(ip).String(), port)
+		host = net.IP(ip).String()
 
 	case AddrTypeDomain:
 		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
-			return err
+			return "", err
 		}
-		domainLen := int(buf[0])
-		domain := make([]byte, domainLen)
+		domain := make([]byte, int(buf[0]))
 		if _, err := io.ReadFull(conn, domain); err != nil {
-			return err
+			return "", err
 		}
-		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
-			return err
-		}
-		port = binary.BigEndian.Uint16(buf[:2])
-		addr = fmt.Sprintf("%s:%d", string(domain), port)
+		host = string(domain)
 
 	default:
-		s.sendReply(conn, ReplyGeneralFailure, nil, 0)
-		return fmt.Errorf("unsupported address type: %d", addrType)
+		return "", fmt.Errorf("unsupported address type: %d", addrType)
 	}
 
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", err
+	}
+	port := binary.BigEndian.Uint16(buf)
+	return net.JoinHostPort(host, fmt.Sprintf("%d", port)), nil
+}
+
+// handleConnect 处理TCP连接请求
+func (s *Server) handleConnect(conn net.Conn, identity *Identity, addr string) error {
 	// 连接目标
-	targetConn, err := s.DialFunc("tcp", addr)
+	targetConn, err := s.dial(identity, "tcp", addr)
 	if err != nil {
 		s.sendReply(conn, ReplyConnectionRefused, nil, 0)
 		return err
@@ -175,10 +172,23 @@ func (s *Server) handleConnect(conn net.Conn) error {
 	}
 
 	// 转发数据
+	relay(conn, targetConn)
+
+	return nil
+}
+
+// relay 双向转发数据，目标关闭连接后返回
+func relay(conn, targetConn net.Conn) {
 	go io.Copy(targetConn, conn)
 	io.Copy(conn, targetConn)
+}
 
-	return nil
+// dial 连接目标，设置了IdentityDialFunc时传入认证身份
+func (s *Server) dial(identity *Identity, network, addr string) (net.Conn, error) {
+	if s.IdentityDialFunc != nil {
+		return s.IdentityDialFunc(identity, network, addr)
+	}
+	return s.DialFunc(network, addr)
 }
 
 // sendReply 发送响应
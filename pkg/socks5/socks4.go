@@ -0,0 +1,143 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS4/4a协议常量
+const (
+	Version4 = 0x04
+
+	socks4ReplyVersion  = 0x00
+	socks4ReplyGranted  = 0x5A
+	socks4ReplyRejected = 0x5B
+
+	// socks4MaxFieldLen USERID和域名字段的最大长度
+	socks4MaxFieldLen = 255
+)
+
+// prefixConn 先返回已读取的数据，再从底层连接读取
+type prefixConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+// Read 读取数据
+func (c *prefixConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// allowsSOCKS4 SOCKS4没有认证机制，只有允许无认证时才接受
+func (s *Server) allowsSOCKS4() bool {
+	if len(s.Authenticators) == 0 {
+		return true
+	}
+	for _, authenticator := range s.Authenticators {
+		if authenticator.Method() == MethodNoAuth {
+			return true
+		}
+	}
+	return false
+}
+
+// handleSOCKS4 处理SOCKS4/4a请求（版本号已读取）
+func (s *Server) handleSOCKS4(conn net.Conn) error {
+	// CD | DSTPORT | DSTIP | USERID | NULL [| DOMAIN | NULL]
+	buf := make([]byte, 7)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	cmd := buf[0]
+	port := binary.BigEndian.Uint16(buf[1:3])
+	ip := net.IP(buf[3:7])
+
+	if _, err := readNullTerminated(conn); err != nil {
+		sendSOCKS4Reply(conn, false, nil)
+		return err
+	}
+
+	host := ip.String()
+	// SOCKS4a：DSTIP为0.0.0.x（x非0）时，目标域名跟在USERID之后
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		domain, err := readNullTerminated(conn)
+		if err != nil {
+			sendSOCKS4Reply(conn, false, nil)
+			return err
+		}
+		host = domain
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+
+	if !s.allowsSOCKS4() {
+		sendSOCKS4Reply(conn, false, nil)
+		return fmt.Errorf("%w: SOCKS4 has no authentication", ErrAuthFailed)
+	}
+	identity := &Identity{Method: MethodNoAuth}
+
+	reply := func(success bool, bindAddr *net.TCPAddr) error {
+		return sendSOCKS4Reply(conn, success, bindAddr)
+	}
+
+	switch cmd {
+	case CmdConnect:
+		targetConn, err := s.dial(identity, "tcp", addr)
+		if err != nil {
+			reply(false, nil)
+			return err
+		}
+		defer targetConn.Close()
+
+		if err := reply(true, nil); err != nil {
+			return err
+		}
+		relay(conn, targetConn)
+		return nil
+	case CmdBind:
+		return s.handleBind(conn, identity, addr, reply)
+	default:
+		reply(false, nil)
+		return fmt.Errorf("unsupported SOCKS4 command: %d", cmd)
+	}
+}
+
+// readNullTerminated 逐字节读取以null结尾的字段（不能多读请求之后的数据）
+func readNullTerminated(conn net.Conn) (string, error) {
+	var field []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0x00 {
+			return string(field), nil
+		}
+		if len(field) >= socks4MaxFieldLen {
+			return "", errors.New("SOCKS4 field too long")
+		}
+		field = append(field, b[0])
+	}
+}
+
+// sendSOCKS4Reply 发送SOCKS4响应
+func sendSOCKS4Reply(conn net.Conn, success bool, addr *net.TCPAddr) error {
+	buf := make([]byte, 8)
+	buf[0] = socks4ReplyVersion
+	buf[1] = socks4ReplyRejected
+	if success {
+		buf[1] = socks4ReplyGranted
+	}
+	if addr != nil {
+		binary.BigEndian.PutUint16(buf[2:4], uint16(addr.Port))
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			copy(buf[4:8], ip4)
+		}
+	}
+
+	_, err := conn.Write(buf)
+	return err
+}
@@ -0,0 +1,42 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestServer_SOCKS4a(t *testing.T) {
+	conn, identities := startTestServer(t, nil)
+
+	// SOCKS4a：DSTIP为0.0.0.1，域名跟在USERID之后
+	req := []byte{Version4, CmdConnect, 0x00, 0x50, 0, 0, 0, 1}
+	req = append(req, "user\x00example.com\x00"...)
+	conn.Write(req)
+
+	identity := <-identities
+	if identity.Method != MethodNoAuth {
+		t.Errorf("Unexpected identity %+v", identity)
+	}
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	// 测试中拨号总是失败
+	if reply[0] != socks4ReplyVersion || reply[1] != socks4ReplyRejected {
+		t.Errorf("Unexpected reply %v", reply)
+	}
+}
+
+func TestServer_SOCKS4RequiresNoAuth(t *testing.T) {
+	conn, _ := startTestServer(t, []Authenticator{&UserPassAuthenticator{}})
+	conn.Write([]byte{Version4, CmdConnect, 0x00, 0x50, 127, 0, 0, 1, 0x00})
+
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	if !bytes.Equal(reply[:2], []byte{socks4ReplyVersion, socks4ReplyRejected}) {
+		t.Errorf("SOCKS4 should be rejected when authentication is required, got %v", reply)
+	}
+}
@@ -3,8 +3,10 @@ package socks5
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -13,6 +15,9 @@ type UDPRelay struct {
 	conn       net.PacketConn
 	timeout    time.Duration
 	associations map[string]*UDPAssociation
+	upstream   net.PacketConn // 上游数据报通道（可选），为nil时直接发往目标
+	clientMu   sync.Mutex
+	client     net.Addr // 最近发送数据包的客户端地址（上游返回的数据包发往此地址）
 }
 
 // UDPAssociation UDP关联
@@ -44,8 +49,12 @@ func (s *Server) HandleUDPRequest(conn net.Conn) error {
 	// 获取客户端地址用于UDP关联
 	clientAddr := conn.RemoteAddr()
 	
-	// 创建UDP监听器（绑定到随机端口）
-	udpConn, err := net.ListenPacket("udp", ":0")
+	// 创建UDP监听器（与控制连接使用同一本地地址，绑定到随机端口）
+	bindHost := ""
+	if tcpAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		bindHost = tcpAddr.IP.String()
+	}
+	udpConn, err := net.ListenPacket("udp", net.JoinHostPort(bindHost, "0"))
 	if err != nil {
 		s.sendReply(conn, ReplyGeneralFailure, nil, 0)
 		return err
@@ -76,6 +85,23 @@ func (s *Server) HandleUDPRequest(conn net.Conn) error {
 		created:    time.Now(),
 	}
 
+	// 经上游转发（如Trojan UDP关联）
+	if s.PacketDialFunc != nil {
+		upstream, err := s.PacketDialFunc()
+		if err != nil {
+			return fmt.Errorf("failed to open UDP upstream: %w", err)
+		}
+		defer upstream.Close()
+		relay.upstream = upstream
+		go relay.serveUpstream()
+	}
+
+	// 控制连接关闭时结束关联
+	go func() {
+		io.Copy(io.Discard, conn)
+		udpConn.Close()
+	}()
+
 	// 启动UDP中继处理
 	return relay.Serve(s.DialFunc)
 }
@@ -145,11 +171,59 @@ func (r *UDPRelay) Serve(dialFunc func(network, addr string) (net.Conn, error))
 		// 获取数据部分
 		data := buf[dataOffset:n]
 
-		// 转发数据到目标
-		go r.forwardUDP(dialFunc, clientAddr, targetAddr, data)
+		// 经上游转发，响应由serveUpstream发回客户端
+		if r.upstream != nil {
+			r.clientMu.Lock()
+			r.client = clientAddr
+			r.clientMu.Unlock()
+			if _, err := r.upstream.WriteTo(data, udpAddr(targetAddr)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// 转发数据到目标（数据在goroutine中使用，需要复制）
+		go r.forwardUDP(dialFunc, clientAddr, targetAddr, append([]byte(nil), data...))
 	}
 }
 
+// serveUpstream 将上游返回的数据包发回客户端
+func (r *UDPRelay) serveUpstream() {
+	buf := make([]byte, 65507)
+	for {
+		n, from, err := r.upstream.ReadFrom(buf)
+		if err != nil {
+			r.conn.Close()
+			return
+		}
+
+		r.clientMu.Lock()
+		client := r.client
+		r.clientMu.Unlock()
+		if client == nil {
+			continue
+		}
+
+		udpResp := r.buildUDPResponse(client, from.String(), buf[:n])
+		if udpResp != nil {
+			r.conn.WriteTo(udpResp, client)
+		}
+	}
+}
+
+// udpAddr 目标地址（可为域名，由上游解析）
+type udpAddr string
+
+// Network 网络类型
+func (a udpAddr) Network() string {
+	return "udp"
+}
+
+// String 地址字符串（host:port）
+func (a udpAddr) String() string {
+	return string(a)
+}
+
 // forwardUDP 转发UDP数据包
 func (r *UDPRelay) forwardUDP(dialFunc func(network, addr string) (net.Conn, error), clientAddr net.Addr, targetAddr string, data []byte) {
 	// 连接到目标（UDP实际上不需要连接，但需要获取UDPConn）
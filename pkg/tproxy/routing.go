@@ -0,0 +1,82 @@
+package tproxy
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Routing TPROXY策略路由：带fwmark的数据包查询table，table将所有地址视为本机地址交给监听套接字
+// iptables的TPROXY规则（mangle表PREROUTING链，--tproxy-mark与Mark一致）由部署环境配置
+type Routing struct {
+	Mark  int
+	Table int
+}
+
+// NewRouting 创建TPROXY策略路由
+func NewRouting(mark, table int) (*Routing, error) {
+	if mark <= 0 {
+		return nil, fmt.Errorf("invalid fwmark: %d", mark)
+	}
+	if table <= 0 {
+		return nil, fmt.Errorf("invalid routing table: %d", table)
+	}
+	return &Routing{Mark: mark, Table: table}, nil
+}
+
+// Setup 添加路由规则（IPv4和IPv6）
+func (r *Routing) Setup() error {
+	for _, family := range []string{"-4", "-6"} {
+		// 创建路由规则
+		cmd := exec.Command("ip", family, "rule", "add", "fwmark", strconv.Itoa(r.Mark),
+			"table", strconv.Itoa(r.Table))
+		if err := cmd.Run(); err != nil {
+			// 如果规则已存在，记录警告但不返回错误
+			logrus.Warnf("Failed to add %s rule for mark %d (table %d): %v (may already exist)", family, r.Mark, r.Table, err)
+		} else {
+			logrus.Debugf("Added %s rule for mark %d in table %d", family, r.Mark, r.Table)
+		}
+
+		// 所有地址按本机地址投递
+		dst := "0.0.0.0/0"
+		if family == "-6" {
+			dst = "::/0"
+		}
+		cmd = exec.Command("ip", family, "route", "add", "local", dst, "dev", "lo",
+			"table", strconv.Itoa(r.Table))
+		if err := cmd.Run(); err != nil {
+			// 如果路由已存在（或未启用IPv6），记录警告但不返回错误
+			logrus.Warnf("Failed to add %s local route in table %d: %v (may already exist)", family, r.Table, err)
+		} else {
+			logrus.Debugf("Added %s local route in table %d", family, r.Table)
+		}
+	}
+
+	return nil
+}
+
+// Cleanup 删除路由规则
+func (r *Routing) Cleanup() error {
+	for _, family := range []string{"-4", "-6"} {
+		cmd := exec.Command("ip", family, "rule", "del", "fwmark", strconv.Itoa(r.Mark),
+			"table", strconv.Itoa(r.Table))
+		if err := cmd.Run(); err != nil {
+			logrus.Warnf("Failed to delete %s rule for mark %d (table %d): %v", family, r.Mark, r.Table, err)
+		}
+
+		dst := "0.0.0.0/0"
+		if family == "-6" {
+			dst = "::/0"
+		}
+		cmd = exec.Command("ip", family, "route", "del", "local", dst, "dev", "lo",
+			"table", strconv.Itoa(r.Table))
+		if err := cmd.Run(); err != nil {
+			logrus.Warnf("Failed to delete %s local route in table %d: %v", family, r.Table, err)
+		}
+	}
+
+	// 清理失败不应该阻止程序退出
+	return nil
+}
@@ -0,0 +1,309 @@
+package tproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 透明代理模式
+const (
+	ModeRedirect = "redirect" // iptables REDIRECT（仅TCP），目标地址从SO_ORIGINAL_DST读取
+	ModeTProxy   = "tproxy"   // iptables TPROXY（TCP和UDP），监听套接字设置IP_TRANSPARENT，目标地址即连接的本地地址
+)
+
+const (
+	// defaultUDPTimeout UDP会话默认空闲超时
+	defaultUDPTimeout = 60 * time.Second
+
+	// udpBufferSize UDP读缓冲区大小（可容纳最大的UDP数据报）
+	udpBufferSize = 64 * 1024
+
+	// udpPendingMax 上游通道建立期间每个客户端暂存的数据报数量上限（超出的丢弃）
+	udpPendingMax = 16
+)
+
+// ErrUnsupported 当前平台不支持透明代理
+var ErrUnsupported = errors.New("transparent proxy is only supported on Linux")
+
+// Server 透明代理服务器：接受被iptables重定向的连接，将原始目标地址经DialFunc转发
+type Server struct {
+	Mode     string
+	DialFunc func(network, addr string) (net.Conn, error)
+	// PacketDialFunc 为每个UDP客户端建立上游数据报通道（TPROXY模式转发UDP时必需）
+	// WriteTo的地址为目标地址，ReadFrom返回的地址为数据报来源地址
+	PacketDialFunc func() (net.PacketConn, error)
+	// UDPTimeout UDP会话空闲超时（0表示默认60秒）
+	UDPTimeout time.Duration
+}
+
+// NewServer 创建透明代理服务器
+func NewServer(mode string, dialFunc func(network, addr string) (net.Conn, error)) (*Server, error) {
+	if mode != ModeRedirect && mode != ModeTProxy {
+		return nil, fmt.Errorf("invalid transparent proxy mode: %s (must be %s or %s)", mode, ModeRedirect, ModeTProxy)
+	}
+	return &Server{
+		Mode:     mode,
+		DialFunc: dialFunc,
+	}, nil
+}
+
+// Listen 创建TCP监听（TPROXY模式设置IP_TRANSPARENT）
+func (s *Server) Listen(addr string) (net.Listener, error) {
+	if s.Mode == ModeTProxy {
+		return listenTransparentTCP(addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// ListenUDP 创建接收原始目标地址的UDP监听（仅TPROXY模式）
+func (s *Server) ListenUDP(addr string) (*net.UDPConn, error) {
+	if s.Mode != ModeTProxy {
+		return nil, fmt.Errorf("UDP requires %s mode", ModeTProxy)
+	}
+	return listenTransparentUDP(addr)
+}
+
+// HandleConn 处理被重定向的TCP连接
+func (s *Server) HandleConn(conn net.Conn) error {
+	defer conn.Close()
+
+	target, err := s.originalDst(conn)
+	if err != nil {
+		return err
+	}
+
+	targetConn, err := s.DialFunc("tcp", target.String())
+	if err != nil {
+		return fmt.Errorf("failed to dial %s: %w", target, err)
+	}
+	defer targetConn.Close()
+
+	errCh := make(chan error, 2)
+
+	go func() {
+		_, err := io.Copy(targetConn, conn)
+		errCh <- err
+	}()
+
+	go func() {
+		_, err := io.Copy(conn, targetConn)
+		errCh <- err
+	}()
+
+	return <-errCh
+}
+
+// originalDst 获取连接的原始目标地址
+func (s *Server) originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("transparent proxy requires a TCP connection")
+	}
+
+	// TPROXY不修改目标地址，本地地址即原始目标
+	if s.Mode == ModeTProxy {
+		return tcpConn.LocalAddr().(*net.TCPAddr), nil
+	}
+
+	target, err := redirectOriginalDst(tcpConn)
+	if err != nil {
+		return nil, err
+	}
+	// 直接连接到监听端口（没有经过REDIRECT）时拒绝，避免转发回自身
+	if local := tcpConn.LocalAddr().(*net.TCPAddr); target.IP.Equal(local.IP) && target.Port == local.Port {
+		return nil, fmt.Errorf("connection from %s was not redirected", conn.RemoteAddr())
+	}
+	return target, nil
+}
+
+// udpSession 一个客户端地址的UDP会话
+type udpSession struct {
+	upstream   net.PacketConn // 上游通道建立之前为nil
+	pending    []udpPacket    // 上游通道建立期间暂存的数据报
+	lastActive time.Time
+}
+
+// udpPacket 暂存的数据报
+type udpPacket struct {
+	payload []byte
+	target  *net.UDPAddr
+}
+
+// ServeUDP 处理TPROXY UDP：每个客户端地址一个上游通道，返回的数据报从原始目标地址发回客户端
+// 上游通道在后台建立，不阻塞其他客户端的数据报；上游通道失效时移除会话，客户端的下一个数据报重新建立
+func (s *Server) ServeUDP(conn *net.UDPConn) error {
+	if s.PacketDialFunc == nil {
+		return fmt.Errorf("UDP forwarding requires PacketDialFunc")
+	}
+	timeout := s.UDPTimeout
+	if timeout == 0 {
+		timeout = defaultUDPTimeout
+	}
+
+	var mu sync.Mutex
+	sessions := make(map[string]*udpSession)
+	defer func() {
+		mu.Lock()
+		for key, session := range sessions {
+			if session.upstream != nil {
+				session.upstream.Close()
+			}
+			delete(sessions, key)
+		}
+		mu.Unlock()
+	}()
+
+	// remove 移除仍在表中的会话并关闭其上游通道
+	remove := func(key string, session *udpSession) {
+		mu.Lock()
+		if sessions[key] == session {
+			delete(sessions, key)
+		}
+		upstream := session.upstream
+		mu.Unlock()
+		if upstream != nil {
+			upstream.Close()
+		}
+	}
+
+	// dial 建立上游通道，按顺序发出暂存的数据报后会话才直接转发
+	dial := func(key string, session *udpSession, client *net.UDPAddr) {
+		upstream, err := s.PacketDialFunc()
+		if err != nil {
+			logrus.Warnf("Failed to open UDP upstream for %s: %v", client, err)
+			mu.Lock()
+			if sessions[key] == session {
+				delete(sessions, key)
+			}
+			mu.Unlock()
+			return
+		}
+
+		mu.Lock()
+		for len(session.pending) > 0 && sessions[key] == session {
+			pending := session.pending
+			session.pending = nil
+			mu.Unlock()
+			for _, packet := range pending {
+				if _, err := upstream.WriteTo(packet.payload, packet.target); err != nil {
+					logrus.Debugf("Failed to forward UDP packet from %s to %s: %v", client, packet.target, err)
+				}
+			}
+			mu.Lock()
+		}
+		// 建立期间会话已空闲超时或服务结束
+		if sessions[key] != session {
+			mu.Unlock()
+			upstream.Close()
+			return
+		}
+		session.upstream = upstream
+		mu.Unlock()
+
+		s.replyLoop(upstream, client)
+		remove(key, session)
+	}
+
+	// 清理空闲会话
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(timeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				mu.Lock()
+				for key, session := range sessions {
+					if time.Since(session.lastActive) > timeout {
+						if session.upstream != nil {
+							session.upstream.Close()
+						}
+						delete(sessions, key)
+					}
+				}
+				mu.Unlock()
+			}
+		}
+	}()
+
+	buf := make([]byte, udpBufferSize)
+	oob := make([]byte, 1024)
+	for {
+		n, oobn, _, client, err := conn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			return err
+		}
+		target, err := parseOriginalDst(oob[:oobn])
+		if err != nil {
+			logrus.Debugf("Dropping UDP packet from %s: %v", client, err)
+			continue
+		}
+
+		key := client.String()
+		mu.Lock()
+		session, ok := sessions[key]
+		if !ok {
+			session = &udpSession{}
+			sessions[key] = session
+			go dial(key, session, client)
+		}
+		session.lastActive = time.Now()
+		upstream := session.upstream
+		if upstream == nil {
+			if len(session.pending) < udpPendingMax {
+				session.pending = append(session.pending, udpPacket{payload: append([]byte(nil), buf[:n]...), target: target})
+			}
+			mu.Unlock()
+			continue
+		}
+		mu.Unlock()
+
+		if _, err := upstream.WriteTo(buf[:n], target); err != nil {
+			logrus.Debugf("Failed to forward UDP packet from %s to %s: %v", client, target, err)
+			remove(key, session)
+		}
+	}
+}
+
+// replyLoop 将上游返回的数据报以来源地址为源地址发回客户端，上游通道关闭或失败时返回
+func (s *Server) replyLoop(upstream net.PacketConn, client *net.UDPAddr) {
+	defer upstream.Close()
+
+	// 每个来源地址一个透明套接字
+	replyConns := make(map[string]*net.UDPConn)
+	defer func() {
+		for _, replyConn := range replyConns {
+			replyConn.Close()
+		}
+	}()
+
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, from, err := upstream.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		replyConn, ok := replyConns[from.String()]
+		if !ok {
+			source, err := net.ResolveUDPAddr("udp", from.String())
+			if err != nil {
+				continue
+			}
+			if replyConn, err = dialTransparentUDP(source); err != nil {
+				logrus.Debugf("Failed to create UDP reply socket for %s: %v", source, err)
+				continue
+			}
+			replyConns[from.String()] = replyConn
+		}
+		replyConn.WriteToUDP(buf[:n], client)
+	}
+}
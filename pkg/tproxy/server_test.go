@@ -0,0 +1,75 @@
+package tproxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// acceptOne 在本地监听并返回一对已连接的TCP连接（服务端、客户端）
+func acceptOne(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	return server, client
+}
+
+func TestServer_TProxyOriginalDst(t *testing.T) {
+	targets := make(chan string, 1)
+	s, err := NewServer(ModeTProxy, func(network, addr string) (net.Conn, error) {
+		targets <- addr
+		return nil, errors.New("dial disabled in test")
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	// TPROXY不修改目标地址，连接的本地地址即原始目标
+	server, _ := acceptOne(t)
+	want := server.LocalAddr().String()
+	go s.HandleConn(server)
+
+	select {
+	case target := <-targets:
+		if target != want {
+			t.Errorf("Dialed %s, want %s", target, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for dial")
+	}
+}
+
+func TestServer_RedirectRejectsDirectConnection(t *testing.T) {
+	s, err := NewServer(ModeRedirect, func(network, addr string) (net.Conn, error) {
+		t.Errorf("Unexpected dial to %s", addr)
+		return nil, errors.New("dial disabled in test")
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	// 没有经过REDIRECT的连接无法获取原始目标地址
+	server, _ := acceptOne(t)
+	if err := s.HandleConn(server); err == nil {
+		t.Error("Expected error for connection that was not redirected")
+	}
+}
+
+func TestNewServer_InvalidMode(t *testing.T) {
+	if _, err := NewServer("socks", nil); err == nil {
+		t.Error("Expected error for invalid mode")
+	}
+}
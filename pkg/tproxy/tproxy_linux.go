@@ -0,0 +1,145 @@
+//go:build linux
+
+package tproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// soOriginalDst SO_ORIGINAL_DST / IP6T_SO_ORIGINAL_DST（netfilter）
+const soOriginalDst = 80
+
+// listenTransparentTCP 创建设置了IP_TRANSPARENT的TCP监听（需要CAP_NET_ADMIN）
+func listenTransparentTCP(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: transparentControl(false)}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// listenTransparentUDP 创建设置了IP_TRANSPARENT并接收原始目标地址的UDP监听
+func listenTransparentUDP(addr string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: transparentControl(true)}
+	conn, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// dialTransparentUDP 创建绑定到非本机地址source的UDP套接字，用于以原始目标地址回复TPROXY客户端
+func dialTransparentUDP(source *net.UDPAddr) (*net.UDPConn, error) {
+	network := "udp4"
+	if source.IP.To4() == nil {
+		network = "udp6"
+	}
+	lc := net.ListenConfig{Control: transparentControl(false)}
+	conn, err := lc.ListenPacket(context.Background(), network, source.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// transparentControl 设置IP_TRANSPARENT（IPv4和IPv6）、SO_REUSEADDR，recvOrigDst时同时设置IP_RECVORIGDSTADDR
+func transparentControl(recvOrigDst bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); sockErr != nil {
+				return
+			}
+			// 双栈套接字同时设置两个协议族的选项，IPv6选项失败时忽略（纯IPv4套接字）
+			if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1); sockErr != nil {
+				sockErr = fmt.Errorf("failed to set IP_TRANSPARENT: %w", sockErr)
+				return
+			}
+			unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+			if recvOrigDst {
+				if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1); sockErr != nil {
+					sockErr = fmt.Errorf("failed to set IP_RECVORIGDSTADDR: %w", sockErr)
+					return
+				}
+				unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
+
+// redirectOriginalDst 读取REDIRECT前的原始目标地址（SO_ORIGINAL_DST）
+func redirectOriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	ipv6 := conn.LocalAddr().(*net.TCPAddr).IP.To4() == nil
+	var target *net.TCPAddr
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if ipv6 {
+			// sockaddr_in6放不进IPv6Mreq，借用IPv6MTUInfo（开头即sockaddr_in6）读取
+			info, err := unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			// 端口字段为网络字节序
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			target = &net.TCPAddr{IP: net.IP(info.Addr.Addr[:]), Port: int(binary.BigEndian.Uint16(port[:]))}
+			return
+		}
+		// sockaddr_in：family(2) | port(2) | addr(4)
+		mreq, err := unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		raw := mreq.Multiaddr
+		target = &net.TCPAddr{
+			IP:   net.IPv4(raw[4], raw[5], raw[6], raw[7]),
+			Port: int(binary.BigEndian.Uint16(raw[2:4])),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, fmt.Errorf("failed to get SO_ORIGINAL_DST: %w", sockErr)
+	}
+	return target, nil
+}
+
+// parseOriginalDst 从控制消息中解析UDP数据报的原始目标地址（IP_ORIGDSTADDR / IPV6_ORIGDSTADDR）
+func parseOriginalDst(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == unix.SOL_IP && msg.Header.Type == unix.IP_ORIGDSTADDR && len(msg.Data) >= 8:
+			// sockaddr_in：family(2) | port(2) | addr(4)
+			return &net.UDPAddr{
+				IP:   net.IPv4(msg.Data[4], msg.Data[5], msg.Data[6], msg.Data[7]),
+				Port: int(binary.BigEndian.Uint16(msg.Data[2:4])),
+			}, nil
+		case msg.Header.Level == unix.SOL_IPV6 && msg.Header.Type == unix.IPV6_ORIGDSTADDR && len(msg.Data) >= 24:
+			// sockaddr_in6：family(2) | port(2) | flowinfo(4) | addr(16)
+			return &net.UDPAddr{
+				IP:   net.IP(append([]byte(nil), msg.Data[8:24]...)),
+				Port: int(binary.BigEndian.Uint16(msg.Data[2:4])),
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("original destination not found in control message")
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+
+package tproxy
+
+import "net"
+
+// listenTransparentTCP 当前平台不支持
+func listenTransparentTCP(addr string) (net.Listener, error) {
+	return nil, ErrUnsupported
+}
+
+// listenTransparentUDP 当前平台不支持
+func listenTransparentUDP(addr string) (*net.UDPConn, error) {
+	return nil, ErrUnsupported
+}
+
+// dialTransparentUDP 当前平台不支持
+func dialTransparentUDP(source *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, ErrUnsupported
+}
+
+// redirectOriginalDst 当前平台不支持
+func redirectOriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, ErrUnsupported
+}
+
+// parseOriginalDst 当前平台不支持
+func parseOriginalDst(oob []byte) (*net.UDPAddr, error) {
+	return nil, ErrUnsupported
+}